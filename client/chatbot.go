@@ -30,6 +30,19 @@ func (h *BotHandlers) SetUserVariables(msg messages.Message) {
 		"name":      username,
 		"isAdmin":   "false",
 		"messageID": fmt.Sprint(msg.MessageID),
+
+		// The message that they replied to, if any.
+		"replyTo":         "0",
+		"replyToUsername": "undefined",
+		"replyToExcerpt":  "undefined",
+	}
+
+	if msg.Quote != nil {
+		vars["replyTo"] = fmt.Sprint(msg.Quote.MessageID)
+		vars["replyToUsername"] = msg.Quote.Username
+		if msg.Quote.Excerpt != "" {
+			vars["replyToExcerpt"] = msg.Quote.Excerpt
+		}
 	}
 
 	// Set global variables.
@@ -17,7 +17,6 @@ import (
 	"git.kirsle.net/apps/barertc/pkg/log"
 	"git.kirsle.net/apps/barertc/pkg/messages"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 // HandlerFunc for WebSocket chat protocol events.
@@ -44,11 +43,12 @@ type Client struct {
 	OnSDP        HandlerFunc
 
 	// Private state variables.
-	url    string
-	jwt    string // JWT token
-	claims jwt.Claims
-	ctx    context.Context
-	conn   *websocket.Conn
+	url      string
+	jwt      string // JWT token
+	claims   jwt.Claims
+	ctx      context.Context
+	conn     *websocket.Conn
+	encoding messages.Encoding // as agreed with the server
 }
 
 // NewClient initializes the WebSocket connection (JWT claims required).
@@ -83,13 +83,17 @@ func (c *Client) Run() error {
 	ctx := context.Background()
 	c.ctx = ctx
 
-	conn, _, err := websocket.Dial(ctx, wss, nil)
+	conn, _, err := websocket.Dial(ctx, wss, dialOptions())
 	if err != nil {
 		return fmt.Errorf("dialing websocket URL (%s): %s", c.url, err)
 	}
 	c.conn = conn
 	defer conn.Close(websocket.StatusInternalError, "the sky is falling")
 
+	// The server picks the encoding; older servers only speak JSON.
+	c.encoding = messages.EncodingForSubprotocol(conn.Subprotocol())
+	log.Info("Connected to BareRTC with the %s encoding", c.encoding)
+
 	conn.SetReadLimit(config.Current.WebSocketReadLimit)
 
 	// Authenticate via JWT token.
@@ -103,13 +107,18 @@ func (c *Client) Run() error {
 
 	// Enter the Read Loop
 	for {
-		var msg messages.Message
-		err := wsjson.Read(c.ctx, c.conn, &msg)
+		_, data, err := c.conn.Read(c.ctx)
 		if err != nil {
-			log.Error("wsjson.Read: %s", err)
+			log.Error("Read: %s", err)
 			break
 		}
 
+		var msg messages.Message
+		if err := c.encoding.Unmarshal(data, &msg); err != nil {
+			log.Error("Read: decoding %s message: %s", c.encoding, err)
+			continue
+		}
+
 		// Handle the various protocol messages.
 		switch msg.Action {
 		case messages.ActionWhoList:
@@ -154,7 +163,35 @@ func (c *Client) Run() error {
 
 // Send a WebSocket message.
 func (c *Client) Send(msg messages.Message) error {
-	return wsjson.Write(c.ctx, c.conn, msg)
+	data, err := c.encoding.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	var typ = websocket.MessageText
+	if c.encoding.Binary() {
+		typ = websocket.MessageBinary
+	}
+	return c.conn.Write(c.ctx, typ, data)
+}
+
+// dialOptions returns the WebSocket options from the chatbot settings: the compression and
+// message encoding to ask the server for.
+func dialOptions() *websocket.DialOptions {
+	var opts = &websocket.DialOptions{
+		CompressionMode: websocket.CompressionDisabled,
+	}
+	if config.Current.WebSocketCompression {
+		opts.CompressionMode = websocket.CompressionNoContextTakeover
+	}
+
+	enc, err := messages.ParseEncoding(config.Current.WebSocketEncoding)
+	if err != nil {
+		log.Error("WebSocketEncoding: %s (using json)", err)
+	}
+	opts.Subprotocols = []string{enc.Subprotocol()}
+
+	return opts
 }
 
 // Username returns the bot's username.
@@ -23,7 +23,9 @@ type Config struct {
 	// Profile settings for their chat username
 	Profile Profile
 
-	WebSocketReadLimit int64
+	WebSocketReadLimit   int64
+	WebSocketCompression bool   // ask the server to compress the messages
+	WebSocketEncoding    string // "json" (default) or "cbor"
 }
 
 type BareRTC struct {
@@ -57,7 +59,9 @@ func DefaultConfig() Config {
 			Nickname: "BareBOT",
 			Emoji:    "🤖",
 		},
-		WebSocketReadLimit: 1024 * 1024 * 40, // 40 MB.
+		WebSocketReadLimit:   1024 * 1024 * 40, // 40 MB.
+		WebSocketCompression: true,
+		WebSocketEncoding:    "json",
 	}
 	return c
 }
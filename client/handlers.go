@@ -314,6 +314,7 @@ func (h *BotHandlers) OnReact(msg messages.Message) {
 			time.Sleep(2500 * time.Millisecond)
 			h.client.Send(messages.Message{
 				Action:    messages.ActionReact,
+				Channel:   msg.Channel,
 				MessageID: msg.MessageID,
 				Message:   msg.Message,
 			})
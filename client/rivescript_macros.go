@@ -40,11 +40,18 @@ func (h *BotHandlers) setObjectMacros() {
 	h.rs.SetSubroutine("react", func(rs *rivescript.RiveScript, args []string) string {
 		if len(args) >= 2 {
 			if msgID, err := strconv.Atoi(args[0]); err == nil {
+				// In the channel we saw the message in, if we did.
+				var channel string
+				if msg, ok := h.getMessageByID(int64(msgID)); ok {
+					channel = msg.Channel
+				}
+
 				// With a small delay.
 				go func() {
 					time.Sleep(2500 * time.Millisecond)
 					h.client.Send(messages.Message{
 						Action:    messages.ActionReact,
+						Channel:   channel,
 						MessageID: int64(msgID),
 						Message:   args[1],
 					})
@@ -116,6 +123,31 @@ func (h *BotHandlers) setObjectMacros() {
 		return "[report: invalid number of parameters]"
 	})
 
+	// Reply to a message seen on chat, in its channel.
+	h.rs.SetSubroutine("reply", func(rs *rivescript.RiveScript, args []string) string {
+		if len(args) >= 2 {
+			if msgID, err := strconv.Atoi(args[0]); err == nil {
+				var message = strings.Join(args[1:], " ")
+
+				// Look up this message.
+				if msg, ok := h.getMessageByID(int64(msgID)); ok {
+					h.client.Send(messages.Message{
+						Action:  messages.ActionMessage,
+						Channel: msg.Channel,
+						Message: message,
+						ReplyTo: msg.MessageID,
+					})
+					return ""
+				}
+
+				return "[msgID not found]"
+			} else {
+				return fmt.Sprintf("[reply: %s]", err)
+			}
+		}
+		return "[reply: invalid number of parameters]"
+	})
+
 	// Send a user a Direct Message.
 	h.rs.SetSubroutine("dm", func(rs *rivescript.RiveScript, args []string) string {
 		if len(args) >= 2 {
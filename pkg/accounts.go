@@ -0,0 +1,574 @@
+package barertc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+	"git.kirsle.net/apps/barertc/pkg/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* Local chat accounts, for users who sign in with a password on the chat server itself. */
+
+// Limits on local account usernames and passwords.
+const (
+	MaxUsernameLength = 32
+	MinPasswordLength = 6
+)
+
+// ErrLoginFailed is the one error message given for a wrong username or password, so the
+// response does not reveal which usernames have accounts.
+const ErrLoginFailed = "Usuario o contraseña incorrectos"
+
+// dummyPasswordHash is checked against when a username has no account, so that a login for
+// an unknown user takes as long as one with a wrong password.
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+// authenticateUser checks a local account's username and password.
+func authenticateUser(username, password string) (models.User, bool) {
+	user, err := models.GetUser(username)
+	if err != nil {
+		if err != models.ErrUserNotFound {
+			log.Error("authenticateUser(%s): %s", username, err)
+		}
+
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte(randomPassword()), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return user, false
+	}
+
+	return user, user.CheckPassword(password)
+}
+
+// validateUsername checks that a new account's username is acceptable.
+func validateUsername(username string) error {
+	if username == "" {
+		return errors.New("Falta el nombre de usuario")
+	} else if utf8.RuneCountInString(username) > MaxUsernameLength {
+		return fmt.Errorf("El nombre de usuario no puede tener más de %d caracteres", MaxUsernameLength)
+	} else if strings.ContainsAny(username, " \t\r\n@#/:%_<>") {
+		return errors.New("El nombre de usuario no puede contener espacios ni los caracteres @ # / : % _ < >")
+	}
+	return nil
+}
+
+// validatePassword checks that a new password is long enough.
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return fmt.Errorf("La contraseña debe tener al menos %d caracteres", MinPasswordLength)
+	}
+	return nil
+}
+
+// Registro de usuarios (/api/register)
+//
+// It is a POST request with form fields: username, password and (optionally) email.
+func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST methods allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		username = strings.TrimSpace(r.FormValue("username"))
+		password = r.FormValue("password")
+		email    = strings.TrimSpace(r.FormValue("email"))
+	)
+
+	if !checkLoginThrottle(w, r, "") {
+		return
+	}
+
+	if username == "" || password == "" {
+		http.Error(w, "Faltan campos", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateUsername(username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := validatePassword(password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The Operators and VIPs of the settings.toml get their role by username, so nobody
+	// may claim one of those names that has not been registered yet.
+	if config.Current.Roles.IsOperator(username) || config.Current.Roles.IsVIP(username) {
+		log.Warn("HandleRegister: %s tried to register the reserved username %s", util.IPAddress(r), username)
+		http.Error(w, "Este nombre de usuario está reservado", http.StatusConflict)
+		return
+	}
+
+	// One IP address may only register so many accounts, each of which costs a password hash.
+	var ip = util.IPAddress(r)
+	if remaining, ok := ReserveRegistration(ip); !ok {
+		log.Warn("HandleRegister: %s has registered too many accounts, refusing %s", ip, username)
+		tooManyAttempts(w, remaining)
+		return
+	}
+
+	var user = models.User{
+		Username: username,
+		Email:    email,
+	}
+	if err := user.SetPassword(password); err != nil {
+		CancelRegistration(ip)
+		http.Error(w, "Error interno", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := models.CreateUser(user); err != nil {
+		CancelRegistration(ip)
+		if err == models.ErrUserExists {
+			// Count it as a failure: probing for taken usernames is account enumeration.
+			RecordLoginFailure("/api/register", ip, "")
+			http.Error(w, "El usuario ya existe", http.StatusConflict)
+			return
+		}
+		log.Error("HandleRegister(%s): %s", username, err)
+		http.Error(w, "No se puede guardar", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("HandleRegister: new account created for %s", username)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Inicio de sesión (/api/login)
+//
+// It is a POST request with form fields: username and password. On success, the user
+// is redirected into the chat room with a signed JWT token for their account.
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST methods allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+
+	if username == "" || password == "" {
+		http.Error(w, "Faltan campos", http.StatusBadRequest)
+		return
+	}
+
+	if !checkLoginThrottle(w, r, username) {
+		return
+	}
+
+	user, ok := authenticateUser(username, password)
+	if !ok {
+		RecordLoginFailure("/api/login", util.IPAddress(r), username)
+		http.Error(w, ErrLoginFailed, http.StatusUnauthorized)
+		return
+	}
+	ResetLoginFailures(username)
+
+	if user.Disabled {
+		http.Error(w, "Esta cuenta ha sido deshabilitada", http.StatusForbidden)
+		return
+	}
+
+	if err := user.TouchLastLogin(); err != nil {
+		log.Error("HandleLogin(%s): updating last login time: %s", user.Username, err)
+	}
+
+	// Firmar un token JWT con los roles de la cuenta (operador, VIP, reglas).
+	tokenString, err := IssueLoginToken(user.Username)
+	if err != nil {
+		log.Error("HandleLogin(%s): signing JWT token: %s", user.Username, err)
+		http.Error(w, "Error al generar token", http.StatusInternalServerError)
+		return
+	}
+
+	redirectURL := fmt.Sprintf("/?jwt=%s", tokenString)
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// ChangePassword (/api/account/password) lets a user change their own account password.
+//
+// It is a POST request with form fields: username, password (the current one) and new_password.
+func (s *Server) ChangePassword() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST methods allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		var (
+			username    = strings.TrimSpace(r.FormValue("username"))
+			password    = r.FormValue("password")
+			newPassword = r.FormValue("new_password")
+		)
+
+		if username == "" || password == "" || newPassword == "" {
+			http.Error(w, "Faltan campos", http.StatusBadRequest)
+			return
+		}
+
+		if !checkLoginThrottle(w, r, username) {
+			return
+		}
+
+		user, ok := authenticateUser(username, password)
+		if !ok {
+			RecordLoginFailure("/api/account/password", util.IPAddress(r), username)
+			http.Error(w, ErrLoginFailed, http.StatusUnauthorized)
+			return
+		}
+		ResetLoginFailures(username)
+
+		if err := validatePassword(newPassword); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := user.SetPassword(newPassword); err != nil {
+			http.Error(w, "Error interno", http.StatusInternalServerError)
+			return
+		}
+
+		if err := user.Save(); err != nil {
+			log.Error("ChangePassword(%s): %s", user.Username, err)
+			http.Error(w, "No se puede guardar", http.StatusInternalServerError)
+			return
+		}
+
+		log.Info("ChangePassword: %s has changed their password", user.Username)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// ResetPassword (/api/account/reset-password) lets your website or an administrator
+// set a new password on a local chat account. It requires the AdminAPIKey.
+//
+// It is a POST request with a json body containing the following schema:
+//
+//	{
+//		"APIKey": "from settings.toml",
+//		"Username": "alice",
+//		"Password": "the new password, or blank to generate a random one"
+//	}
+//
+// The return schema looks like:
+//
+//	{
+//		"OK": true,
+//		"Password": "the new password",
+//		"Error": "only on errors"
+//	}
+func (s *Server) ResetPassword() http.HandlerFunc {
+	type request struct {
+		APIKey   string
+		Username string
+		Password string
+	}
+
+	type result struct {
+		OK       bool
+		Password string `json:",omitempty"`
+		Error    string `json:",omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// JSON writer for the response.
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		// Parse the request.
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only POST methods allowed",
+			})
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only application/json content-types allowed",
+			})
+			return
+		}
+
+		defer r.Body.Close()
+
+		// Parse the request payload.
+		var (
+			params request
+			dec    = json.NewDecoder(r.Body)
+		)
+		if err := dec.Decode(&params); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Validate the API key.
+		if params.APIKey != config.Current.AdminAPIKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			enc.Encode(result{
+				Error: "Authentication denied.",
+			})
+			return
+		}
+
+		user, err := models.GetUser(params.Username)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Generate a random password?
+		if params.Password == "" {
+			params.Password = randomPassword()
+		} else if err := validatePassword(params.Password); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		if err := user.SetPassword(params.Password); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		if err := user.Save(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		log.Info("ResetPassword API: the password for %s has been reset", user.Username)
+		Audit(models.AuditSourceAPI, AdminAPIKeyOperator, "reset_password", user.Username, "")
+		enc.Encode(result{
+			OK:       true,
+			Password: params.Password,
+		})
+	})
+}
+
+// UpdateAccount (/api/account/update) lets your website or an administrator manage a
+// local chat account. It requires the AdminAPIKey.
+//
+// It is a POST request with a json body containing the following schema:
+//
+//	{
+//		"APIKey": "from settings.toml",
+//		"Username": "alice",
+//		"Email": "alice@example.com",
+//		"Operator": false,
+//		"VIP": true,
+//		"Disabled": false
+//	}
+//
+// Fields other than APIKey and Username are optional, and only the ones included
+// are changed. If the account is disabled while the user is online, they are
+// removed from the chat room.
+//
+// The return schema looks like:
+//
+//	{
+//		"OK": true,
+//		"Error": "only on errors"
+//	}
+func (s *Server) UpdateAccount() http.HandlerFunc {
+	type request struct {
+		APIKey   string
+		Username string
+		Email    *string
+		Operator *bool
+		VIP      *bool
+		Disabled *bool
+	}
+
+	type result struct {
+		OK    bool
+		Error string `json:",omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// JSON writer for the response.
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		// Parse the request.
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only POST methods allowed",
+			})
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only application/json content-types allowed",
+			})
+			return
+		}
+
+		defer r.Body.Close()
+
+		// Parse the request payload.
+		var (
+			params request
+			dec    = json.NewDecoder(r.Body)
+		)
+		if err := dec.Decode(&params); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Validate the API key.
+		if params.APIKey != config.Current.AdminAPIKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			enc.Encode(result{
+				Error: "Authentication denied.",
+			})
+			return
+		}
+
+		user, err := models.GetUser(params.Username)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		if params.Email != nil {
+			user.Email = strings.TrimSpace(*params.Email)
+		}
+		if params.Operator != nil {
+			user.Operator = *params.Operator
+		}
+		if params.VIP != nil {
+			user.VIP = *params.VIP
+		}
+		if params.Disabled != nil {
+			user.Disabled = *params.Disabled
+		}
+
+		if err := user.Save(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		log.Info("UpdateAccount API: updated account %s (operator=%t vip=%t disabled=%t)", user.Username, user.Operator, user.VIP, user.Disabled)
+		Audit(models.AuditSourceAPI, AdminAPIKeyOperator, "update_account", user.Username,
+			fmt.Sprintf("operator=%t vip=%t disabled=%t", user.Operator, user.VIP, user.Disabled))
+
+		// Remove a disabled user from the chat room.
+		if user.Disabled {
+			if sub, err := s.GetSubscriber(user.Username); err == nil {
+				sub.ChatServer("Your chat account has been disabled.")
+				s.Disconnect(sub, messages.PresenceKicked)
+			}
+		}
+
+		enc.Encode(result{
+			OK: true,
+		})
+	})
+}
+
+// randomPassword generates a random password for ResetPassword.
+func randomPassword() string {
+	var buf = make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+/*
+ImportLegacyUsers imports the accounts from the .users.txt file into the database.
+
+Older versions of the chat server stored accounts as "username:bcrypt hash" lines in
+a .users.txt file in the working directory. The password hashes are imported as-is,
+so users can keep logging in with their current passwords.
+*/
+func ImportLegacyUsers() {
+	for _, filename := range legacyFiles(".users.txt") {
+		var count int
+		err := importLegacyFile(filename, func(line string) error {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return errors.New("unrecognized line format")
+			}
+
+			// Skip accounts that already exist.
+			if exists, err := models.UserExists(parts[0]); err != nil {
+				return err
+			} else if exists {
+				return nil
+			}
+
+			if _, err := models.CreateUser(models.User{
+				Username:     parts[0],
+				PasswordHash: parts[1],
+			}); err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			log.Error("ImportLegacyUsers(%s): %s", filename, err)
+			continue
+		}
+		log.Warn("ImportLegacyUsers: imported %d accounts from %s", count, filename)
+	}
+}
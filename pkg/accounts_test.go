@@ -0,0 +1,86 @@
+package barertc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+)
+
+func TestRegister(t *testing.T) {
+	setupTestDatabase(t)
+	resetAuthThrottle()
+	config.Current.Roles.Operators = []string{"alice"}
+	config.Current.Roles.VIPs = []string{"@carol"}
+
+	var (
+		s        = NewServer()
+		register = func(username string) int {
+			var form = url.Values{
+				"username": {username},
+				"password": {"hunter2hunter2"},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			s.HandleRegister(w, req)
+			return w.Code
+		}
+	)
+
+	for username, expect := range map[string]int{
+		"bob":       http.StatusOK,
+		"Alice":     http.StatusConflict, // a configured operator
+		"carol":     http.StatusConflict, // a configured VIP
+		"%":         http.StatusBadRequest,
+		"bob_":      http.StatusBadRequest,
+		"<b>dave":   http.StatusBadRequest,
+		"some body": http.StatusBadRequest,
+	} {
+		if code := register(username); code != expect {
+			t.Errorf("register %q: expected status %d, got %d", username, expect, code)
+		}
+	}
+}
+
+func TestRegisterThrottle(t *testing.T) {
+	setupTestDatabase(t)
+	resetAuthThrottle()
+	config.Current.LoginThrottle.Enabled = true
+	config.Current.LoginThrottle.MaxRegistrationsPerIP = 2
+
+	var (
+		s        = NewServer()
+		register = func(username, remoteAddr string) int {
+			var form = url.Values{
+				"username": {username},
+				"password": {"hunter2hunter2"},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = remoteAddr
+			w := httptest.NewRecorder()
+			s.HandleRegister(w, req)
+			return w.Code
+		}
+	)
+
+	for i, test := range []struct {
+		Username string
+		Addr     string
+		Expect   int
+	}{
+		{"bob", "192.0.2.1:1234", http.StatusOK},
+		{"bob", "192.0.2.1:1234", http.StatusConflict}, // a failure does not count as a registration
+		{"dave", "192.0.2.1:1234", http.StatusOK},
+		{"erin", "192.0.2.1:1234", http.StatusTooManyRequests},
+		{"erin", "192.0.2.2:1234", http.StatusOK},
+	} {
+		if code := register(test.Username, test.Addr); code != test.Expect {
+			t.Errorf("#%d register %q from %s: expected status %d, got %d", i, test.Username, test.Addr, test.Expect, code)
+		}
+	}
+}
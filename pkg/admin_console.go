@@ -0,0 +1,226 @@
+package barertc
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/util"
+)
+
+/* Admin web console (/admin) for live moderation of the chat room. */
+
+// AdminSubscriber is a row of the admin console's live subscriber list.
+type AdminSubscriber struct {
+	ID            int
+	Username      string
+	IP            string
+	LoginAt       time.Time
+	Authenticated bool
+	Transport     string // "WebSocket" or "Polling"
+	ChatStatus    string
+	DND           bool
+	VideoStatus   int
+	VideoFlags    []string
+	Claims        *jwt.Claims
+}
+
+// AdminPage (/admin) shows the admin console.
+func (s *Server) AdminPage() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tmpl := template.New("index")
+
+		// Gather the live subscriber list.
+		var subscribers = []AdminSubscriber{}
+		for _, sub := range s.IterSubscribers() {
+			var row = AdminSubscriber{
+				ID:            sub.ID,
+				Username:      sub.Username,
+				IP:            sub.IP,
+				LoginAt:       sub.loginAt,
+				Authenticated: sub.authenticated,
+				Transport:     "WebSocket",
+				ChatStatus:    sub.ChatStatus,
+				DND:           sub.DND,
+				VideoStatus:   sub.VideoStatus,
+				VideoFlags:    videoFlagNames(sub.VideoStatus),
+				Claims:        sub.JWTClaims,
+			}
+			if sub.isStreaming() {
+				row.Transport = "Server-Sent Events"
+			} else if sub.isLongPolling() {
+				row.Transport = "Long-poll"
+			} else if sub.usePolling {
+				row.Transport = "Polling"
+			} else if sub.encoding.Binary() {
+				row.Transport = "WebSocket (CBOR)"
+			}
+			subscribers = append(subscribers, row)
+		}
+		sort.Slice(subscribers, func(i, j int) bool {
+			return strings.ToLower(subscribers[i].Username) < strings.ToLower(subscribers[j].Username)
+		})
+
+		// Recent context of each public channel.
+		var channels = []map[string]interface{}{}
+		for _, ch := range config.Current.PublicChannels {
+			channels = append(channels, map[string]interface{}{
+				"Channel":  ch,
+				"Messages": RecentChannelMessages(ch.ID),
+			})
+		}
+
+		var values = map[string]interface{}{
+			"CacheHash":   util.RandomString(8),
+			"Config":      config.Current,
+			"Operator":    OperatorName(r),
+			"CSRFToken":   OperatorCSRFToken(r),
+			"Message":     r.URL.Query().Get("message"),
+			"IsError":     r.URL.Query().Get("error") != "",
+			"Subscribers": subscribers,
+			"Channels":    channels,
+			"Bans":        ActiveBans(),
+			"UpSince":     s.upSince,
+		}
+
+		tmpl.Funcs(template.FuncMap{
+			"FormatTime": func(t time.Time) string {
+				if t.IsZero() {
+					return "-"
+				}
+				return t.Format("2006-01-02 15:04:05")
+			},
+			"Since": func(t time.Time) string {
+				if t.IsZero() {
+					return "-"
+				}
+				return time.Since(t).Round(time.Second).String()
+			},
+		})
+		tmpl, err := tmpl.ParseFiles("web/templates/admin.html")
+		if err != nil {
+			http.Error(w, "Error loading admin.html: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tmpl.ExecuteTemplate(w, "index", values); err != nil {
+			log.Error("AdminPage: %s", err)
+		}
+	})
+}
+
+// AdminAction (/admin/action) performs a moderation action from the admin console.
+//
+// It is a POST request with form fields: action (kick, ban, cut, nsfw, op or deop),
+// username, and for bans the duration and reason. The operator is redirected back
+// to the console with the result.
+func (s *Server) AdminAction() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST methods allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			operator = OperatorName(r)
+			action   = r.PostFormValue("action")
+			username = strings.TrimPrefix(strings.TrimSpace(r.PostFormValue("username")), "@")
+			message  string
+			err      error
+		)
+
+		if username == "" {
+			adminRedirect(w, r, "A username is required.", true)
+			return
+		}
+
+		switch action {
+		case "kick":
+			if err = s.KickUser(operator, username); err == nil {
+				message = fmt.Sprintf("%s has been kicked from the room", username)
+			}
+		case "ban":
+			var duration = 24 * time.Hour
+			if value := strings.TrimSpace(r.PostFormValue("duration")); value != "" {
+				duration, err = ParseBanDuration(value)
+			}
+			if err == nil {
+				if _, err = s.BanAndDisconnect(operator, username, duration, strings.TrimSpace(r.PostFormValue("reason"))); err == nil {
+					message = fmt.Sprintf("%s has been banned from the room %s.", username, FormatBanDuration(duration))
+				}
+			}
+		case "cut":
+			if err = s.CutCamera(operator, username); err == nil {
+				message = fmt.Sprintf("%s has been told to turn off their camera.", username)
+			}
+		case "nsfw":
+			if err = s.MarkCameraNSFW(operator, username); err == nil {
+				message = fmt.Sprintf("%s now has their camera marked as Explicit", username)
+			}
+		case "op", "deop":
+			var grant = action == "op"
+			if _, err = s.SetOperatorRights(operator, username, grant); err == nil {
+				if grant {
+					message = fmt.Sprintf("Operator rights have been granted to %s", username)
+				} else {
+					message = fmt.Sprintf("Operator rights have been taken from %s", username)
+				}
+			}
+		default:
+			adminRedirect(w, r, "Unknown action: "+action, true)
+			return
+		}
+
+		if err != nil {
+			adminRedirect(w, r, fmt.Sprintf("%s: %s", action, err), true)
+			return
+		}
+
+		var arguments string
+		if action == "ban" {
+			arguments = strings.TrimSpace(r.PostFormValue("duration") + " " + r.PostFormValue("reason"))
+		}
+		Audit(operatorSource(r), operator, action, username, arguments)
+		adminRedirect(w, r, message, false)
+	})
+}
+
+// adminRedirect sends the operator back to the admin console with a message.
+func adminRedirect(w http.ResponseWriter, r *http.Request, message string, isError bool) {
+	var query = url.Values{}
+	query.Set("message", message)
+	if isError {
+		query.Set("error", "1")
+	}
+	http.Redirect(w, r, "/admin?"+query.Encode(), http.StatusSeeOther)
+}
+
+// videoFlagNames describes the video flags of a user, for the admin console.
+func videoFlagNames(flags int) []string {
+	var names = []string{}
+	for _, flag := range []struct {
+		Flag int
+		Name string
+	}{
+		{messages.VideoFlagActive, "active"},
+		{messages.VideoFlagNSFW, "nsfw"},
+		{messages.VideoFlagMuted, "muted"},
+		{messages.VideoFlagNonExplicit, "non-explicit"},
+		{messages.VideoFlagMutualRequired, "mutual-required"},
+		{messages.VideoFlagMutualOpen, "mutual-open"},
+		{messages.VideoFlagOnlyVIP, "vip-only"},
+	} {
+		if flags&flag.Flag == flag.Flag {
+			names = append(names, flag.Name)
+		}
+	}
+	return names
+}
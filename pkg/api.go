@@ -14,6 +14,7 @@ import (
 	"git.kirsle.net/apps/barertc/pkg/log"
 	"git.kirsle.net/apps/barertc/pkg/messages"
 	"git.kirsle.net/apps/barertc/pkg/models"
+	"git.kirsle.net/apps/barertc/pkg/util"
 )
 
 // Statistics (/api/statistics) returns info about the users currently logged onto the chat,
@@ -136,6 +137,17 @@ func (s *Server) Authenticate() http.HandlerFunc {
 			return
 		}
 
+		// Brute-force protection for the API key.
+		var ip = util.IPAddress(r)
+		if remaining, locked := LoginLockedOut(ip, ""); locked {
+			setRetryAfter(w, remaining)
+			w.WriteHeader(http.StatusTooManyRequests)
+			enc.Encode(result{
+				Error: "Too many failed attempts, please try again later.",
+			})
+			return
+		}
+
 		defer r.Body.Close()
 
 		// Parse the request payload.
@@ -153,6 +165,7 @@ func (s *Server) Authenticate() http.HandlerFunc {
 
 		// Validate the API key.
 		if params.APIKey != config.Current.AdminAPIKey {
+			RecordLoginFailure("/api/authenticate", ip, "")
 			w.WriteHeader(http.StatusUnauthorized)
 			enc.Encode(result{
 				Error: "Authentication denied.",
@@ -162,6 +175,7 @@ func (s *Server) Authenticate() http.HandlerFunc {
 
 		// Encode the JWT token.
 		var claims = params.Claims
+		claims.Issuer = ChatbotTokenIssuer
 		token, err := claims.ReSign()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -251,6 +265,8 @@ func (s *Server) ShutdownAPI() http.HandlerFunc {
 			return
 		}
 
+		Audit(models.AuditSourceAPI, AdminAPIKeyOperator, "shutdown", "", "")
+
 		// Send the response.
 		enc.Encode(result{
 			OK: true,
@@ -430,6 +446,8 @@ func (s *Server) BlockNow() http.HandlerFunc {
 			return
 		}
 
+		Audit(models.AuditSourceAPI, AdminAPIKeyOperator, "block", strings.Join(params.Usernames, ", "), "")
+
 		// Check if any of these users are online, and update their blocklist accordingly.
 		var changed bool
 		for _, username := range params.Usernames {
@@ -460,7 +478,7 @@ func (s *Server) BlockNow() http.HandlerFunc {
 
 		// If any changes to blocklists were made: send the Who List.
 		if changed {
-			s.SendWhoList()
+			s.SendWhoListChanges(params.Usernames...)
 		}
 
 		enc.Encode(result{
@@ -555,7 +573,10 @@ func (s *Server) DisconnectNow() http.HandlerFunc {
 		}
 
 		// Check if any of these users are online, and disconnect them from the chat.
-		var removed int
+		var (
+			removed          int
+			removedUsernames = []string{}
+		)
 		for _, username := range params.Usernames {
 			if sub, err := s.GetSubscriber(username); err == nil {
 				// Broadcast to everybody that the user left the chat.
@@ -582,12 +603,16 @@ func (s *Server) DisconnectNow() http.HandlerFunc {
 				sub.Username = ""
 
 				removed++
+				removedUsernames = append(removedUsernames, username)
 			}
 		}
 
+		Audit(models.AuditSourceAPI, AdminAPIKeyOperator, "disconnect", strings.Join(params.Usernames, ", "),
+			fmt.Sprintf("kick=%t removed=%d message=%q", params.Kick, removed, params.Message))
+
 		// If any changes to blocklists were made: send the Who List.
 		if removed > 0 {
-			s.SendWhoList()
+			s.SendWhoListChanges(removedUsernames...)
 		}
 
 		enc.Encode(result{
@@ -881,6 +906,171 @@ func (s *Server) MessageHistory() http.HandlerFunc {
 	})
 }
 
+// ChannelHistory (/api/channel/history) fetches past messages of a public channel.
+//
+// This endpoint pages back through the stored history of a public channel, when the
+// ChannelHistory setting is enabled. The caller must be logged into the chat room and
+// in the channel.
+//
+// It is a POST request with a json body containing the following schema:
+//
+//	{
+//		"JWTToken": "the caller's jwt token",
+//		"Channel": "lobby",
+//		"BeforeID": 1234,
+//	}
+//
+// The "BeforeID" parameter is for pagination, the same as for /api/message/history.
+//
+// The response JSON will look like the following:
+//
+//	{
+//		"OK": true,
+//		"Error": "only on error responses",
+//		"Messages": [
+//			{
+//				// Standard BareRTC Message objects, newest first...
+//				"msgID": 1234,
+//				"username": "soandso",
+//				"message": "hello!",
+//			}
+//		],
+//		"Remaining": 42,
+//		"BeforeID": 1200,
+//	}
+//
+// Messages by users whom the caller has blocked or muted are left out of the page, so
+// the BeforeID to fetch the next (older) page is given in the response.
+func (s *Server) ChannelHistory() http.HandlerFunc {
+	type request struct {
+		JWTToken string
+		Channel  string
+		BeforeID int64
+	}
+
+	type result struct {
+		OK        bool
+		Error     string `json:",omitempty"`
+		Messages  []messages.Message
+		Remaining int
+		BeforeID  int64
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// JSON writer for the response.
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		// Parse the request.
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only POST methods allowed",
+			})
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only application/json content-types allowed",
+			})
+			return
+		}
+
+		defer r.Body.Close()
+
+		// Parse the request payload.
+		var (
+			params request
+			dec    = json.NewDecoder(r.Body)
+		)
+		if err := dec.Decode(&params); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Is the channel history enabled on the server?
+		if !models.ChannelHistoryEnabled() {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Channel history is not enabled on this server.",
+			})
+			return
+		}
+
+		// Are JWT tokens enabled on the server?
+		if !config.Current.JWT.Enabled || params.JWTToken == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "JWT authentication is not available.",
+			})
+			return
+		}
+
+		// Validate the user's JWT token.
+		claims, _, err := jwt.ParseAndValidate(params.JWTToken)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Get the user from the chat roster.
+		sub, err := s.GetSubscriber(claims.Subject)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "You are not logged into the chat room.",
+			})
+			return
+		}
+
+		// They must be in the (public) channel.
+		if _, ok := config.Current.GetChannel(params.Channel); !ok || !sub.InChannel(params.Channel) {
+			w.WriteHeader(http.StatusForbidden)
+			enc.Encode(result{
+				Error: "You are not in that channel.",
+			})
+			return
+		}
+
+		// Fetch a page of message history.
+		page, remaining, err := models.PaginateChannelMessages(params.Channel, params.BeforeID, models.ChannelMessagePerPage)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Leave out the users they have blocked or muted.
+		var (
+			blocks   = sub.blockedOrMuted()
+			msgs     = []messages.Message{}
+			beforeID int64
+		)
+		for _, msg := range page {
+			beforeID = msg.MessageID
+			if _, ok := blocks[msg.Username]; !ok {
+				msgs = append(msgs, msg)
+			}
+		}
+
+		enc.Encode(result{
+			OK:        true,
+			Messages:  msgs,
+			Remaining: remaining,
+			BeforeID:  beforeID,
+		})
+	})
+}
+
 // MessageUsernameHistory (/api/message/usernames) fetches past conversation threads for a user.
 //
 // This endpoint will paginate the distinct usernames that the current user has
@@ -911,9 +1101,15 @@ func (s *Server) MessageHistory() http.HandlerFunc {
 //			"alice",
 //			"bob"
 //		],
+//		"Unread": {
+//			"alice": 3
+//		},
 //		"Pages": 42,
 //	}
 //
+// The Unread map counts the messages from each username that the user has not read yet
+// (usernames without unread messages are not in the map).
+//
 // The Remaining value is how many older messages still exist to be loaded.
 func (s *Server) MessageUsernameHistory() http.HandlerFunc {
 	type request struct {
@@ -926,6 +1122,7 @@ func (s *Server) MessageUsernameHistory() http.HandlerFunc {
 		OK        bool
 		Error     string `json:",omitempty"`
 		Usernames []string
+		Unread    map[string]int
 		Count     int
 		Pages     int
 	}
@@ -996,7 +1193,7 @@ func (s *Server) MessageUsernameHistory() http.HandlerFunc {
 		}
 
 		// Fetch a page of message history.
-		usernames, count, pages, err := models.PaginateUsernames(sub.Username, params.Sort, params.Page, 9)
+		usernames, unread, count, pages, err := models.PaginateUsernames(sub.Username, params.Sort, params.Page, 9)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			enc.Encode(result{
@@ -1008,6 +1205,7 @@ func (s *Server) MessageUsernameHistory() http.HandlerFunc {
 		enc.Encode(result{
 			OK:        true,
 			Usernames: usernames,
+			Unread:    unread,
 			Count:     count,
 			Pages:     pages,
 		})
@@ -1086,6 +1284,7 @@ func (s *Server) ClearMessages() http.HandlerFunc {
 		}
 
 		// Authenticate this request.
+		var actor = AdminAPIKeyOperator
 		if params.APIKey != "" {
 			// By admin API key.
 			if params.APIKey != config.Current.AdminAPIKey {
@@ -1117,6 +1316,7 @@ func (s *Server) ClearMessages() http.HandlerFunc {
 
 			// Set the username to clear.
 			params.Username = claims.Subject
+			actor = claims.Subject
 		}
 
 		// Erase their message history.
@@ -1129,6 +1329,8 @@ func (s *Server) ClearMessages() http.HandlerFunc {
 			return
 		}
 
+		Audit(models.AuditSourceAPI, actor, "clear_messages", params.Username, fmt.Sprintf("erased=%d", count))
+
 		enc.Encode(result{
 			OK:             true,
 			MessagesErased: count,
@@ -0,0 +1,243 @@
+package barertc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+/* Audit log of operator actions. */
+
+// Page sizes of the audit log.
+const (
+	AuditCommandPageSize = 10  // for the /audit command
+	AuditAPIPageSize     = 50  // default for the /api/audit endpoint
+	AuditAPIMaxPageSize  = 500 // largest per_page for the /api/audit endpoint
+)
+
+// Audit records an operator action to the audit log.
+//
+// A failure to write the audit log is logged, but does not stop the action.
+func Audit(source, actor, action, target, arguments string) {
+	if _, err := models.CreateAuditLog(models.AuditLog{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Arguments: arguments,
+		Source:    source,
+	}); err != nil && err != models.ErrNotInitialized {
+		log.Error("Audit(%s %s %s): %s", actor, action, target, err)
+	}
+}
+
+// auditCommand records an operator chat command to the audit log. The action is the
+// command name and the arguments are the rest of the words after the target.
+func auditCommand(sub *Subscriber, words []string, target string) {
+	var (
+		action    = strings.TrimPrefix(words[0], "/")
+		arguments []string
+	)
+	if len(words) > 2 {
+		arguments = words[2:]
+	}
+	Audit(commandSource(sub), sub.Username, action, target, strings.Join(arguments, " "))
+}
+
+// commandSource tells whether a chat command came from an operator or a chatbot, by
+// whether their JWT token was signed by the /api/authenticate endpoint.
+func commandSource(sub *Subscriber) string {
+	if sub.JWTClaims != nil && sub.JWTClaims.Issuer == ChatbotTokenIssuer {
+		return models.AuditSourceBot
+	}
+	return models.AuditSourceCommand
+}
+
+// operatorSource tells whether a request to the moderation panel came from a browser
+// session or from a script with the X-API-Key header.
+func operatorSource(r *http.Request) string {
+	if OperatorCSRFToken(r) == "" {
+		return models.AuditSourceAPI
+	}
+	return models.AuditSourceConsole
+}
+
+// AuditCommand handles the `/audit` operator command.
+func (s *Server) AuditCommand(words []string, sub *Subscriber) {
+	var (
+		filter models.AuditLogFilter
+		page   = 1
+	)
+
+	// Parse the optional username and page number, in either order.
+	for _, word := range words[1:] {
+		if n, err := strconv.Atoi(word); err == nil && n > 0 {
+			page = n
+		} else {
+			filter.Username = strings.TrimPrefix(word, "@")
+		}
+	}
+
+	entries, total, err := models.SearchAuditLogs(filter, page, AuditCommandPageSize)
+	if err != nil {
+		sub.ChatServer("/audit: %s", err)
+		return
+	} else if total == 0 {
+		sub.ChatServer("The audit log has no entries to show.")
+		return
+	}
+
+	var (
+		pages = (total + AuditCommandPageSize - 1) / AuditCommandPageSize
+		lines = []string{
+			fmt.Sprintf("Audit log (page %d of %d, %d entries):\n", page, pages, total),
+		}
+	)
+	for _, entry := range entries {
+		var line = fmt.Sprintf("* `%s` **%s** %s", entry.CreatedAt.Format(time.DateTime), entry.Actor, entry.Action)
+		if entry.Target != "" {
+			line += " " + entry.Target
+		}
+		if entry.Arguments != "" {
+			line += fmt.Sprintf(": %s", entry.Arguments)
+		}
+		lines = append(lines, line+fmt.Sprintf(" (%s)", entry.Source))
+	}
+	if page < pages {
+		var next = strconv.Itoa(page + 1)
+		if filter.Username != "" {
+			next = strconv.Quote(filter.Username) + " " + next
+		}
+		lines = append(lines, fmt.Sprintf("\nUse `/audit %s` to see older entries.", next))
+	}
+
+	sub.ChatServer(RenderMarkdown(strings.Join(lines, "\n")))
+}
+
+// AuditAPI (/api/audit) searches the audit log of operator actions.
+//
+// It is a GET request for operators (see OperatorAuth), with these optional
+// query parameters to filter the results:
+//
+//   - actor: username of the operator
+//   - target: username or IP address the action was taken on
+//   - user: matches either the actor or the target
+//   - action: e.g. "kick" or "ban"
+//   - source: "command", "api", "bot" or "console"
+//   - since, until: RFC 3339 timestamps, e.g. "2024-01-31T00:00:00Z"
+//   - page: page number, starting from 1
+//   - per_page: number of entries per page (default 50, max 500)
+//
+// The return schema looks like:
+//
+//	{
+//		"OK": true,
+//		"Error": "error string, omitted if none",
+//		"Total": 123,
+//		"Page": 1,
+//		"Pages": 3,
+//		"Entries": [
+//			{
+//				"ID": 1,
+//				"Actor": "admin",
+//				"Action": "ban",
+//				"Target": "alice",
+//				"Arguments": "7d spamming the lobby",
+//				"Source": "command",
+//				"CreatedAt": "2024-01-31T12:00:00Z"
+//			}
+//		]
+//	}
+func (s *Server) AuditAPI() http.HandlerFunc {
+	type result struct {
+		OK      bool
+		Error   string `json:",omitempty"`
+		Total   int
+		Page    int
+		Pages   int
+		Entries []models.AuditLog
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// JSON writer for the response.
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only GET methods allowed",
+			})
+			return
+		}
+
+		// Parse the query parameters.
+		var (
+			query  = r.URL.Query()
+			filter = models.AuditLogFilter{
+				Actor:    query.Get("actor"),
+				Target:   query.Get("target"),
+				Username: query.Get("user"),
+				Action:   query.Get("action"),
+				Source:   query.Get("source"),
+			}
+			page    = 1
+			perPage = AuditAPIPageSize
+			err     error
+		)
+		for param, dest := range map[string]*time.Time{
+			"since": &filter.Since,
+			"until": &filter.Until,
+		} {
+			if value := query.Get(param); value != "" {
+				if *dest, err = time.Parse(time.RFC3339, value); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					enc.Encode(result{
+						Error: fmt.Sprintf("Invalid %s timestamp: %s", param, err),
+					})
+					return
+				}
+			}
+		}
+		for param, dest := range map[string]*int{
+			"page":     &page,
+			"per_page": &perPage,
+		} {
+			if value := query.Get(param); value != "" {
+				if *dest, err = strconv.Atoi(value); err != nil || *dest < 1 {
+					w.WriteHeader(http.StatusBadRequest)
+					enc.Encode(result{
+						Error: fmt.Sprintf("Invalid %s: must be a positive number", param),
+					})
+					return
+				}
+			}
+		}
+		if perPage > AuditAPIMaxPageSize {
+			perPage = AuditAPIMaxPageSize
+		}
+
+		entries, total, err := models.SearchAuditLogs(filter, page, perPage)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		enc.Encode(result{
+			OK:      true,
+			Total:   total,
+			Page:    page,
+			Pages:   (total + perPage - 1) / perPage,
+			Entries: entries,
+		})
+	})
+}
@@ -0,0 +1,58 @@
+package barertc
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestAuditAPI(t *testing.T) {
+	setupTestDatabase(t)
+
+	Audit(models.AuditSourceCommand, "admin", "kick", "alice", "")
+	Audit(models.AuditSourceBot, "bot", "ban", "Bob", "7d spam")
+	Audit(models.AuditSourceAPI, AdminAPIKeyOperator, "disconnect", "alice", "")
+	Audit(models.AuditSourceConsole, "Alice", "cut", "carol", "")
+
+	var tests = []struct {
+		Query  string
+		Status int
+		Total  int
+		Count  int
+	}{
+		{"", 200, 4, 4},
+		{"?user=alice", 200, 3, 3},
+		{"?target=bob", 200, 1, 1},
+		{"?actor=admin&action=kick", 200, 1, 1},
+		{"?source=bot", 200, 1, 1},
+		{"?per_page=3&page=2", 200, 4, 1},
+		{"?since=2000-01-01T00:00:00Z&until=2001-01-01T00:00:00Z", 200, 0, 0},
+		{"?page=0", 400, 0, 0},
+		{"?since=yesterday", 400, 0, 0},
+	}
+
+	var s = NewServer()
+	for _, test := range tests {
+		var (
+			rec = httptest.NewRecorder()
+			req = httptest.NewRequest("GET", "/api/audit"+test.Query, nil)
+		)
+		s.AuditAPI().ServeHTTP(rec, req)
+		if rec.Code != test.Status {
+			t.Errorf("%q: expected status %d, got %d: %s", test.Query, test.Status, rec.Code, rec.Body.String())
+			continue
+		}
+
+		var result struct {
+			Total   int
+			Entries []models.AuditLog
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Errorf("%q: %s", test.Query, err)
+		} else if result.Total != test.Total || len(result.Entries) != test.Count {
+			t.Errorf("%q: expected %d of %d entries, got %d of %d", test.Query, test.Count, test.Total, len(result.Entries), result.Total)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package barertc
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/models"
+	"git.kirsle.net/apps/barertc/pkg/util"
+)
+
+/* Persistent ban list backed by the SQLite database. */
+
+// cachedBan is a ban from the database with its CIDR range (if any) pre-parsed.
+type cachedBan struct {
+	models.Ban
+	network *net.IPNet
+}
+
+// newCachedBan pre-parses the CIDR range of a ban.
+func newCachedBan(ban models.Ban) (cachedBan, error) {
+	entry := cachedBan{Ban: ban}
+	if ban.Kind == models.BanKindCIDR {
+		_, network, err := net.ParseCIDR(ban.Value)
+		if err != nil {
+			return entry, err
+		}
+		entry.network = network
+	}
+	return entry, nil
+}
+
+// matchesIP checks whether an IP or CIDR ban covers the IP address.
+func (b cachedBan) matchesIP(ip net.IP) bool {
+	switch b.Kind {
+	case models.BanKindIP:
+		if other := net.ParseIP(b.Value); other != nil && other.Equal(ip) {
+			return true
+		}
+	case models.BanKindCIDR:
+		if b.network != nil && b.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// In-memory copy of the active bans, so that connection checks do not need to
+// query the database on every WebSocket accept or page load.
+var (
+	banCache   = []cachedBan{}
+	banCacheMu sync.RWMutex
+)
+
+// ReloadBans refreshes the in-memory ban cache from the database.
+func ReloadBans() error {
+	bans, err := models.GetActiveBans()
+	if err != nil {
+		return err
+	}
+
+	var cache = []cachedBan{}
+	for _, ban := range bans {
+		entry, err := newCachedBan(ban)
+		if err != nil {
+			log.Error("ReloadBans: ban #%d has an invalid CIDR range %s: %s", ban.ID, ban.Value, err)
+			continue
+		}
+		cache = append(cache, entry)
+	}
+
+	banCacheMu.Lock()
+	banCache = cache
+	banCacheMu.Unlock()
+
+	log.Info("ReloadBans: %d active bans loaded", len(cache))
+	return nil
+}
+
+// AddBan stores a new ban in the database and refreshes the cache.
+//
+// IP and CIDR values are validated and normalized before they are saved.
+func AddBan(ban models.Ban) (models.Ban, error) {
+	ban, err := normalizeBan(ban)
+	if err != nil {
+		return ban, err
+	}
+
+	ban, err = models.CreateBan(ban)
+	if err != nil {
+		return ban, err
+	}
+
+	return ban, ReloadBans()
+}
+
+// normalizeBan validates the ban value for its kind and puts it into canonical form.
+func normalizeBan(ban models.Ban) (models.Ban, error) {
+	ban.Value = strings.TrimSpace(ban.Value)
+
+	switch ban.Kind {
+	case models.BanKindIP:
+		ip := net.ParseIP(ban.Value)
+		if ip == nil {
+			return ban, errors.New("not a valid IP address")
+		}
+		ban.Value = ip.String()
+
+		// IPv6 addresses are banned by their network prefix.
+		if network := util.IPv6Network(ip, config.Current.IPv6BanPrefixLength); network != nil && config.Current.IPv6BanPrefixLength < 128 {
+			ban.Kind = models.BanKindCIDR
+			ban.Value = network.String()
+		}
+	case models.BanKindCIDR:
+		_, network, err := net.ParseCIDR(ban.Value)
+		if err != nil {
+			return ban, errors.New("not a valid CIDR range")
+		}
+		ban.Value = network.String()
+	case models.BanKindUsername, models.BanKindSubject:
+		ban.Value = strings.TrimPrefix(ban.Value, "@")
+	default:
+		return ban, errors.New("unknown ban kind")
+	}
+
+	return ban, nil
+}
+
+// LiftBans removes every ban of a kind on the given value, returning the count removed.
+//
+// IP values are also normalized the same way as AddBan, so that lifting the ban on
+// an IPv6 address lifts the ban on its network prefix.
+func LiftBans(kind, value string) (int, error) {
+	var candidates = []models.Ban{
+		{Kind: kind, Value: strings.TrimSpace(value)},
+	}
+	if kind == models.BanKindIP {
+		if ip := net.ParseIP(candidates[0].Value); ip != nil {
+			candidates[0].Value = ip.String()
+		}
+	}
+	if ban, err := normalizeBan(models.Ban{Kind: kind, Value: value}); err == nil && ban != candidates[0] {
+		candidates = append(candidates, ban)
+	}
+
+	var count int
+	for _, ban := range candidates {
+		n, err := models.DeleteBansByValue(ban.Kind, ban.Value)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+
+	return count, ReloadBans()
+}
+
+// ActiveBans returns a copy of the currently cached bans.
+func ActiveBans() []models.Ban {
+	banCacheMu.RLock()
+	defer banCacheMu.RUnlock()
+
+	var result = []models.Ban{}
+	for _, ban := range banCache {
+		if ban.IsExpired() {
+			continue
+		}
+		result = append(result, ban.Ban)
+	}
+	return result
+}
+
+// FindIPBan returns an active ban that matches the IP address, either exactly or by CIDR range.
+func FindIPBan(addr string) (models.Ban, bool) {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return models.Ban{}, false
+	}
+
+	banCacheMu.RLock()
+	defer banCacheMu.RUnlock()
+
+	for _, ban := range banCache {
+		if !ban.IsExpired() && ban.matchesIP(ip) {
+			return ban.Ban, true
+		}
+	}
+
+	return models.Ban{}, false
+}
+
+// BanCoversIP checks whether an IP or CIDR ban covers the IP address, regardless of
+// any other ban that may also match it.
+func BanCoversIP(ban models.Ban, addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+
+	entry, err := newCachedBan(ban)
+	if err != nil {
+		return false
+	}
+	return entry.matchesIP(ip)
+}
+
+// FindUserBan returns an active ban on the chat username or the JWT subject of the user.
+func FindUserBan(username, subject string) (models.Ban, bool) {
+	banCacheMu.RLock()
+	defer banCacheMu.RUnlock()
+
+	for _, ban := range banCache {
+		if ban.IsExpired() {
+			continue
+		}
+
+		switch ban.Kind {
+		case models.BanKindUsername:
+			if username != "" && ban.Value == username {
+				return ban.Ban, true
+			}
+		case models.BanKindSubject:
+			if subject != "" && ban.Value == subject {
+				return ban.Ban, true
+			}
+		}
+	}
+
+	return models.Ban{}, false
+}
+
+/*
+Legacy ban list importer.
+
+Older versions of the chat server kept a free-form log of nicknames and IP
+addresses in datos.txt and a list of banned IPs in datos2.txt, either in the
+working directory or next to the executable. On startup these files are
+imported into the database one time, then renamed with an ".imported" suffix.
+*/
+
+var legacyNickLineRegexp = regexp.MustCompile(`^Nick:\s*(.+?)\s*\|\s*IP:\s*(\S+)\s*$`)
+
+// ImportLegacyBans imports the datos.txt and datos2.txt files into the database, and
+// then (re)loads the ban list.
+func ImportLegacyBans() {
+	for _, filename := range legacyFiles("datos2.txt") {
+		var count int
+		err := importLegacyFile(filename, func(line string) error {
+			ban, err := normalizeBan(models.Ban{
+				Kind:     models.BanKindIP,
+				Value:    line,
+				Reason:   "Imported from " + filepath.Base(filename),
+				Operator: "ChatServer",
+			})
+			if err != nil {
+				return err
+			}
+
+			// Skip duplicate lines.
+			if exists, err := models.BanExists(ban.Kind, ban.Value); err != nil {
+				return err
+			} else if exists {
+				return nil
+			}
+
+			if _, err := models.CreateBan(ban); err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			log.Error("ImportLegacyBans(%s): %s", filename, err)
+			continue
+		}
+		log.Warn("ImportLegacyBans: imported %d IP bans from %s", count, filename)
+	}
+
+	for _, filename := range legacyFiles("datos.txt") {
+		var count int
+		err := importLegacyFile(filename, func(line string) error {
+			m := legacyNickLineRegexp.FindStringSubmatch(line)
+			if m == nil {
+				return errors.New("unrecognized line format")
+			}
+			if err := models.LogUserIP(m[1], m[2]); err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			log.Error("ImportLegacyBans(%s): %s", filename, err)
+			continue
+		}
+		log.Warn("ImportLegacyBans: imported %d nickname/IP records from %s", count, filename)
+	}
+
+	if err := ReloadBans(); err != nil {
+		log.Error("ImportLegacyBans: reloading the ban list: %s", err)
+	}
+}
+
+// legacyFiles returns the distinct existing paths of a legacy file, checking both the
+// working directory and the directory of the executable.
+func legacyFiles(name string) []string {
+	var (
+		candidates = []string{name}
+		seen       = map[string]struct{}{}
+		result     = []string{}
+	)
+	if exePath, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(exePath), name))
+	}
+
+	for _, candidate := range candidates {
+		abs, err := filepath.Abs(candidate)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[abs]; ok {
+			continue
+		}
+		seen[abs] = struct{}{}
+
+		if stat, err := os.Stat(abs); err == nil && !stat.IsDir() {
+			result = append(result, abs)
+		}
+	}
+
+	return result
+}
+
+// importLegacyFile calls the handler for each non-empty line of the file, then renames the
+// file so it will not be imported again. Lines the handler rejects are logged and skipped.
+func importLegacyFile(filename string, handler func(line string) error) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := handler(line); err != nil {
+			log.Error("importLegacyFile(%s): skip line %q: %s", filename, line, err)
+		}
+	}
+	fh.Close()
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return os.Rename(filename, filename+".imported")
+}
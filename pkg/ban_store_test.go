@@ -0,0 +1,38 @@
+package barertc
+
+import (
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestBanIPKicksEveryoneInRange(t *testing.T) {
+	setupTestDatabase(t)
+	t.Cleanup(func() {
+		banCacheMu.Lock()
+		banCache = []cachedBan{}
+		banCacheMu.Unlock()
+	})
+
+	// An older ban already covers one of the addresses.
+	if _, err := AddBan(models.Ban{Kind: models.BanKindIP, Value: "203.0.113.7"}); err != nil {
+		t.Fatalf("AddBan: %s", err)
+	}
+
+	var (
+		s    = NewServer()
+		subs = loginUsers(s, false, "operator", "alice", "bob", "carol")
+	)
+	subs[0].IP = "203.0.113.1"
+	subs[1].IP = "203.0.113.7"
+	subs[2].IP = "203.0.113.8"
+	subs[3].IP = "198.51.100.1"
+
+	s.BanIPCommand([]string{"/banip", "203.0.113.0/24"}, subs[0])
+
+	for i, expect := range []bool{true, false, false, true} {
+		if subs[i].authenticated != expect {
+			t.Errorf("subscriber #%d: expected authenticated=%v", i, expect)
+		}
+	}
+}
@@ -1,73 +1,178 @@
 package barertc
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/models"
 )
 
 /* Functions to handle banned users */
 
-// Ban is an entry on the ban list.
-type Ban struct {
-	Username  string
-	ExpiresAt time.Time
-}
-
-// Global storage for banned users in memory.
-var (
-	banList   = map[string]Ban{}
-	banListMu sync.RWMutex
-)
+// BanSweepInterval is how often expired bans are purged from the database.
+const BanSweepInterval = time.Minute
 
-// BanUser adds a user to the ban list.
-func BanUser(username string, duration time.Duration) {
-	banListMu.Lock()
-	defer banListMu.Unlock()
-	banList[username] = Ban{
-		Username:  username,
-		ExpiresAt: time.Now().Add(duration),
+// BanUser adds a user to the ban list. A zero duration is a permanent ban.
+//
+// The ban is stored in the database so that it survives a reboot of the chat server.
+func BanUser(username string, duration time.Duration, reason, operator string) (models.Ban, error) {
+	var ban = models.Ban{
+		Kind:     models.BanKindUsername,
+		Value:    username,
+		Reason:   reason,
+		Operator: operator,
+	}
+	if duration > 0 {
+		ban.ExpiresAt = time.Now().Add(duration)
 	}
+	return AddBan(ban)
 }
 
 // UnbanUser lifts the ban of a user early.
 func UnbanUser(username string) bool {
-	banListMu.RLock()
-	defer banListMu.RUnlock()
-	_, ok := banList[username]
-	if ok {
-		delete(banList, username)
+	count, err := LiftBans(models.BanKindUsername, username)
+	if err != nil {
+		log.Error("UnbanUser(%s): %s", username, err)
 	}
-	return ok
+	return count > 0
 }
 
-// StringifyBannedUsers returns a stringified list of all the current banned users.
+// StringifyBannedUsers returns a stringified list of all the current banned users and IP addresses.
 func StringifyBannedUsers() string {
 	var lines = []string{}
-	banListMu.RLock()
-	defer banListMu.RUnlock()
-	for username, ban := range banList {
-		lines = append(lines, fmt.Sprintf(
-			"* `%s` banned until %s",
-			username,
-			ban.ExpiresAt.Format(time.RFC3339),
-		))
+	for _, ban := range ActiveBans() {
+		var line = fmt.Sprintf("* `%s`", ban.Value)
+		switch ban.Kind {
+		case models.BanKindSubject:
+			line += " (account)"
+		case models.BanKindIP, models.BanKindCIDR:
+			line += " (IP)"
+		}
+
+		if ban.IsPermanent() {
+			line += " banned permanently"
+		} else {
+			line += " banned until " + ban.ExpiresAt.Format(time.RFC3339)
+		}
+
+		if ban.Operator != "" {
+			line += " by " + ban.Operator
+		}
+		if ban.Reason != "" {
+			line += ": " + ban.Reason
+		}
+
+		lines = append(lines, line)
 	}
 	return strings.Join(lines, "\n")
 }
 
 // IsBanned returns whether the username is currently banned.
 func IsBanned(username string) bool {
-	banListMu.Lock()
-	defer banListMu.Unlock()
-	ban, ok := banList[username]
-	if ok {
-		// Has the ban expired?
-		if time.Now().After(ban.ExpiresAt) {
-			delete(banList, username)
-			return false
+	_, ok := FindUserBan(username, "")
+	return ok
+}
+
+// SweepExpiredBans is a goroutine that periodically removes expired bans from the database.
+func (s *Server) SweepExpiredBans() {
+	log.Debug("SweepExpiredBans goroutine engaged")
+	for {
+		time.Sleep(BanSweepInterval)
+
+		count, err := models.DeleteExpiredBans()
+		if err != nil {
+			if err != models.ErrNotInitialized {
+				log.Error("SweepExpiredBans: %s", err)
+			}
+			continue
+		}
+
+		if count > 0 {
+			log.Info("SweepExpiredBans: %d bans have expired", count)
+			if err := ReloadBans(); err != nil {
+				log.Error("SweepExpiredBans: reloading the ban list: %s", err)
+			}
 		}
 	}
-	return ok
+}
+
+/*
+ParseBanDuration parses a human friendly ban duration.
+
+Accepted formats include Go style durations ("30m", "12h", "1h30m"), days
+and weeks ("7d", "2w"), a bare number of hours ("24") for compatibility with
+earlier versions of the /ban command, and "perm" or "permanent" for a ban that
+never expires (returned as a zero duration).
+*/
+func ParseBanDuration(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch value {
+	case "":
+		return 0, errors.New("empty duration")
+	case "perm", "permanent", "forever":
+		return 0, nil
+	}
+
+	// Bare number of hours.
+	if hours, err := strconv.Atoi(value); err == nil {
+		if hours <= 0 {
+			return 0, errors.New("duration must be positive")
+		}
+		return time.Duration(hours) * time.Hour, nil
+	}
+
+	// Days and weeks, which time.ParseDuration does not support.
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	} {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count <= 0 {
+				return 0, fmt.Errorf("invalid duration: %s", value)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	} else if duration <= 0 {
+		return 0, errors.New("duration must be positive")
+	}
+	return duration, nil
+}
+
+// FormatBanDuration returns a human friendly description of a ban duration,
+// such as "for 7 days" or "permanently".
+func FormatBanDuration(duration time.Duration) string {
+	if duration <= 0 {
+		return "permanently"
+	}
+
+	switch {
+	case duration%(7*24*time.Hour) == 0:
+		return "for " + pluralize(int(duration/(7*24*time.Hour)), "week")
+	case duration%(24*time.Hour) == 0:
+		return "for " + pluralize(int(duration/(24*time.Hour)), "day")
+	case duration%time.Hour == 0:
+		return "for " + pluralize(int(duration/time.Hour), "hour")
+	case duration%time.Minute == 0:
+		return "for " + pluralize(int(duration/time.Minute), "minute")
+	}
+	return "for " + duration.String()
+}
+
+// pluralize formats a count with its unit, e.g. "1 day" or "3 days".
+func pluralize(count int, unit string) string {
+	if count == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
 }
@@ -0,0 +1,65 @@
+package barertc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBanDuration(t *testing.T) {
+	var tests = []struct {
+		Input  string
+		Expect time.Duration
+		Error  bool
+	}{
+		{"24", 24 * time.Hour, false},
+		{"2", 2 * time.Hour, false},
+		{"30m", 30 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"perm", 0, false},
+		{"Permanent", 0, false},
+		{"", 0, true},
+		{"0", 0, true},
+		{"-5m", 0, true},
+		{"xd", 0, true},
+		{"spamming", 0, true},
+	}
+
+	for _, test := range tests {
+		actual, err := ParseBanDuration(test.Input)
+		if test.Error {
+			if err == nil {
+				t.Errorf("ParseBanDuration(%q): expected an error but got %s", test.Input, actual)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseBanDuration(%q): unexpected error: %s", test.Input, err)
+		} else if actual != test.Expect {
+			t.Errorf("ParseBanDuration(%q): expected %s but got %s", test.Input, test.Expect, actual)
+		}
+	}
+}
+
+func TestFormatBanDuration(t *testing.T) {
+	var tests = []struct {
+		Input  time.Duration
+		Expect string
+	}{
+		{0, "permanently"},
+		{time.Hour, "for 1 hour"},
+		{24 * time.Hour, "for 1 day"},
+		{3 * 24 * time.Hour, "for 3 days"},
+		{14 * 24 * time.Hour, "for 2 weeks"},
+		{45 * time.Minute, "for 45 minutes"},
+		{90 * time.Second, "for 1m30s"},
+	}
+
+	for _, test := range tests {
+		if actual := FormatBanDuration(test.Input); actual != test.Expect {
+			t.Errorf("FormatBanDuration(%s): expected %q but got %q", test.Input, test.Expect, actual)
+		}
+	}
+}
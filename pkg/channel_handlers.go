@@ -0,0 +1,575 @@
+package barertc
+
+import (
+	"fmt"
+	"strings"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+/*
+Created channels: the protocol actions and chat commands to create, join, part and
+manage chat rooms at runtime.
+
+Private channels must not leak to non-members: their messages only go to members
+(see Broadcast), they are left out of everybody else's channel list, and errors
+about them read the same as for a channel that does not exist.
+*/
+
+// MaxTopicLength is the longest topic of a channel.
+const MaxTopicLength = 300
+
+// OnChannelAction handles the `create`, `join`, `part`, `invite` and `topic` actions.
+func (s *Server) OnChannelAction(sub *Subscriber, msg messages.Message) {
+	if sub.Username == "" || !sub.authenticated {
+		sub.ChatServer("You must log in first.")
+		return
+	}
+
+	switch msg.Action {
+	case messages.ActionCreate:
+		s.OnCreateChannel(sub, msg)
+	case messages.ActionJoin:
+		s.OnJoinChannel(sub, msg)
+	case messages.ActionPart:
+		s.OnPartChannel(sub, msg)
+	case messages.ActionInvite:
+		s.OnInviteChannel(sub, msg)
+	case messages.ActionTopic:
+		s.OnTopic(sub, msg)
+	}
+}
+
+// OnCreateChannel handles a user creating a chat channel.
+//
+// The Channel is the new channel ID and the Message its display name (optional).
+func (s *Server) OnCreateChannel(sub *Subscriber, msg messages.Message) {
+	var settings = config.Current.UserChannels
+	if !settings.Enabled {
+		sub.ChatServer("Creating chat channels is not enabled on this server.")
+		return
+	} else if settings.OperatorsOnly && !sub.IsAdmin() {
+		sub.ChatServer("Only operators may create chat channels.")
+		return
+	}
+
+	var id = normalizeChannelID(msg.Channel)
+	if !userChannelIDRegexp.MatchString(id) {
+		sub.ChatServer("Channel names must be 2 to 32 lowercase letters, numbers, dashes or underscores.")
+		return
+	} else if _, ok := config.Current.GetChannel(id); ok {
+		sub.ChatServer("Could not create #%s: %s", id, models.ErrChannelExists)
+		return
+	}
+
+	// Limit on the channels one user may own.
+	if settings.MaxPerUser > 0 && !sub.IsAdmin() {
+		var count int
+		for _, ch := range ListUserChannels() {
+			if ch.Owner == sub.Username {
+				count++
+			}
+		}
+		if count >= settings.MaxPerUser {
+			sub.ChatServer("You may own at most %d chat channels: close one with /close before you create another.", settings.MaxPerUser)
+			return
+		}
+	}
+
+	var ch = models.Channel{
+		ID:         id,
+		Name:       strings.TrimSpace(msg.Message),
+		Owner:      sub.Username,
+		Private:    msg.Private,
+		InviteOnly: msg.InviteOnly,
+	}
+	if ch.Name == "" {
+		ch.Name = id
+	}
+	if err := ch.SetPassword(msg.Password); err != nil {
+		sub.ChatServer("Could not create #%s: %s", id, err)
+		return
+	}
+
+	uc, err := CreateUserChannel(ch)
+	if err == models.ErrChannelExists {
+		// Don't reveal that a private channel exists to somebody who can't see it.
+		if existing, ok := LookupUserChannel(id); ok && existing.VisibleTo(sub.Username) {
+			sub.ChatServer("Could not create #%s: %s", id, err)
+		} else {
+			sub.ChatServer("Could not create #%s: that channel name is not available.", id)
+		}
+		return
+	} else if err != nil {
+		sub.ChatServer("Could not create #%s: %s", id, err)
+		return
+	}
+	log.Info("OnCreateChannel: %s creates #%s", sub.Username, id)
+
+	// Describe the channel's settings.
+	var options = []string{}
+	if uc.Private {
+		options = append(options, "private")
+	}
+	if uc.InviteOnly {
+		options = append(options, "invite-only")
+	}
+	if uc.HasPassword() {
+		options = append(options, "password-protected")
+	}
+	var description = "an open channel"
+	if len(options) > 0 {
+		description = "a " + strings.Join(options, ", ") + " channel"
+	}
+	sub.ChatServer(RenderMarkdown(fmt.Sprintf(
+		"You have created #%s, %s. Use `/invite <username> %s` to invite people, "+
+			"`/topic #%s <topic>` to set its topic and `/close %s` when you are done with it.",
+		id, description, id, id, id,
+	)))
+
+	s.JoinChannel(sub, id)
+
+	// A private channel only shows up in its owner's list.
+	if uc.Private {
+		sub.SendChannels()
+	} else {
+		s.SendChannels()
+	}
+}
+
+// OnJoinChannel handles a user joining a channel, with the Password if it is a created
+// channel that has one.
+func (s *Server) OnJoinChannel(sub *Subscriber, msg messages.Message) {
+	var id = normalizeChannelID(msg.Channel)
+	if sub.InChannel(id) {
+		sub.ChatServer("You are already in #%s.", id)
+		return
+	}
+
+	// Public channels from the settings.
+	if pc, ok := config.Current.GetChannel(id); ok {
+		if !sub.CanJoinPublicChannel(pc) {
+			sub.ChatServer("#%s is only for %s members.", id, config.Current.VIP.Name)
+			return
+		}
+		s.JoinChannel(sub, id)
+		sub.SendChannelEchoes(id)
+		return
+	}
+
+	ch, ok := LookupUserChannel(id)
+	if !ok {
+		sub.ChatServer("Channel not found: %s", id)
+		return
+	} else if ch.IsMember(sub.Username) {
+		s.JoinChannel(sub, id)
+		return
+	}
+
+	// May they join? Operators, the owner and invitees always may.
+	var allowed bool
+	switch {
+	case sub.IsAdmin(), sub.Username == ch.Owner, ch.Role(sub.Username) == models.ChannelRoleInvited:
+		allowed = true
+	case ch.HasPassword():
+		allowed = !ch.InviteOnly && msg.Password != "" && ch.CheckPassword(msg.Password)
+	default:
+		allowed = !ch.InviteOnly && !ch.Private
+	}
+
+	if !allowed {
+		switch {
+		case !ch.VisibleTo(sub.Username):
+			sub.ChatServer("Channel not found: %s", id)
+		case ch.InviteOnly:
+			sub.ChatServer("#%s is invite-only: ask one of its operators for an invite.", id)
+		case msg.Password == "":
+			sub.ChatServer(RenderMarkdown(fmt.Sprintf("#%s is password-protected: use `/join %s <password>` to join.", id, id)))
+		default:
+			sub.ChatServer("Wrong password for #%s.", id)
+		}
+		return
+	}
+
+	var role = models.ChannelRoleMember
+	if ch.IsOperator(sub.Username) {
+		role = models.ChannelRoleOperator
+	}
+	if err := SetUserChannelRole(id, sub.Username, role); err != nil {
+		sub.ChatServer("Could not join #%s: %s", id, err)
+		return
+	}
+	log.Info("OnJoinChannel: %s joins #%s", sub.Username, id)
+
+	sub.SendChannels()
+	s.JoinChannel(sub, id)
+}
+
+// OnPartChannel handles a user leaving a channel.
+//
+// Leaving a created channel gives up its membership; the owner of a channel keeps
+// their ownership and may join it again at any time.
+func (s *Server) OnPartChannel(sub *Subscriber, msg messages.Message) {
+	var id = normalizeChannelID(msg.Channel)
+	if !sub.InChannel(id) {
+		sub.ChatServer("You are not in #%s.", id)
+		return
+	}
+
+	if ch, ok := LookupUserChannel(id); ok && ch.Role(sub.Username) != "" {
+		if err := SetUserChannelRole(id, sub.Username, ""); err != nil {
+			sub.ChatServer("Could not leave #%s: %s", id, err)
+			return
+		}
+		log.Info("OnPartChannel: %s leaves #%s", sub.Username, id)
+		defer sub.SendChannels()
+	}
+
+	s.PartChannel(sub, id)
+}
+
+// OnInviteChannel handles a user inviting the Username to a created channel.
+//
+// Invites to private, invite-only or password-protected channels are only given by
+// the channel's operators, and let the invitee join without the password.
+func (s *Server) OnInviteChannel(sub *Subscriber, msg messages.Message) {
+	var (
+		id       = normalizeChannelID(msg.Channel)
+		username = strings.TrimPrefix(msg.Username, "@")
+	)
+	ch, ok := LookupUserChannel(id)
+	if !ok || (!ch.IsMember(sub.Username) && !sub.IsAdmin()) {
+		sub.ChatServer("You are not in #%s.", id)
+		return
+	} else if !ch.IsOpen() && !ch.IsOperator(sub.Username) && !sub.IsAdmin() {
+		sub.ChatServer("Only the operators of #%s may invite people to it.", id)
+		return
+	} else if username == "" {
+		sub.ChatServer("Who do you want to invite to #%s?", id)
+		return
+	}
+
+	switch ch.Role(username) {
+	case models.ChannelRoleMember, models.ChannelRoleOperator:
+		sub.ChatServer("%s is already in #%s.", username, id)
+		return
+	case models.ChannelRoleInvited:
+		sub.ChatServer("%s has already been invited to #%s.", username, id)
+		return
+	}
+
+	if err := SetUserChannelRole(id, username, models.ChannelRoleInvited); err != nil {
+		sub.ChatServer("Could not invite %s: %s", username, err)
+		return
+	}
+	log.Info("OnInviteChannel: %s invites %s to #%s", sub.Username, username, id)
+	sub.ChatServer("You have invited %s to #%s.", username, id)
+
+	// Let them know if they are online (and not muting or blocking the inviter).
+	if rcpt, err := s.GetSubscriber(username); err == nil && !rcpt.Mutes(sub.Username) && !sub.Blocks(rcpt) {
+		rcpt.ChatServer(RenderMarkdown(fmt.Sprintf(
+			"%s has invited you to #%s (%s): type `/join %s` to join it.",
+			sub.Username, id, ch.Name, id,
+		)))
+		rcpt.SendChannels()
+	}
+}
+
+// OnTopic handles an operator setting the topic of a channel: the channel operators of
+// a created channel, or the chat operators for a public channel. A blank topic removes it.
+func (s *Server) OnTopic(sub *Subscriber, msg messages.Message) {
+	var id = normalizeChannelID(msg.Channel)
+	if !s.canManageChannel(sub, id, "set its topic") {
+		return
+	}
+
+	var topic = strings.TrimSpace(msg.Message)
+	if len(topic) > MaxTopicLength {
+		sub.ChatServer("The topic is too long: please keep it under %d characters.", MaxTopicLength)
+		return
+	}
+
+	if ch, ok := LookupUserChannel(id); ok {
+		ch.Topic = topic
+		if err := SaveUserChannel(ch.Channel); err != nil {
+			sub.ChatServer("Could not set the topic of #%s: %s", id, err)
+			return
+		}
+		defer s.SendChannels()
+	} else {
+		if err := setStoredTopic(models.ChannelTopic{
+			ChannelID: id,
+			Topic:     topic,
+			Username:  sub.Username,
+		}); err != nil {
+			sub.ChatServer("Could not set the topic of #%s: %s", id, err)
+			return
+		}
+		Audit(commandSource(sub), sub.Username, "topic", id, topic)
+	}
+	log.Info("OnTopic: %s sets the topic of #%s: %s", sub.Username, id, topic)
+
+	s.Broadcast(messages.Message{
+		Action:   messages.ActionTopic,
+		Channel:  id,
+		Username: sub.Username,
+		Message:  RenderMarkdown(topic),
+	})
+}
+
+// SetChannelOperator grants or removes a member's channel operator rights.
+func (s *Server) SetChannelOperator(sub *Subscriber, channel, username string, grant bool) {
+	var id = normalizeChannelID(channel)
+	ch, ok := LookupUserChannel(id)
+	if !ok || (!ch.IsMember(sub.Username) && !sub.IsAdmin()) {
+		sub.ChatServer("You are not in #%s.", id)
+		return
+	} else if !ch.IsOperator(sub.Username) && !sub.IsAdmin() {
+		sub.ChatServer("Only the operators of #%s may do that.", id)
+		return
+	} else if !ch.IsMember(username) {
+		sub.ChatServer("%s is not in #%s.", username, id)
+		return
+	} else if username == ch.Owner && !grant {
+		sub.ChatServer("%s owns #%s and is always one of its operators.", username, id)
+		return
+	}
+
+	var role = models.ChannelRoleMember
+	if grant {
+		role = models.ChannelRoleOperator
+	}
+	if err := SetUserChannelRole(id, username, role); err != nil {
+		sub.ChatServer("Could not change the role of %s: %s", username, err)
+		return
+	}
+
+	if grant {
+		s.channelNotice(id, "%s has made %s an operator of #%s.", sub.Username, username, id)
+	} else {
+		s.channelNotice(id, "%s is no longer an operator of #%s.", username, id)
+	}
+	if rcpt, err := s.GetSubscriber(username); err == nil {
+		rcpt.SendChannels()
+	}
+}
+
+// CloseChannel deletes a created channel, by its owner or an operator.
+func (s *Server) CloseChannel(sub *Subscriber, channel string) {
+	var id = normalizeChannelID(channel)
+	ch, ok := LookupUserChannel(id)
+	if !ok || (!ch.VisibleTo(sub.Username) && !sub.IsAdmin()) {
+		sub.ChatServer("Channel not found: %s", id)
+		return
+	} else if sub.Username != ch.Owner && !sub.IsAdmin() {
+		sub.ChatServer("Only the owner of #%s may close it.", id)
+		return
+	}
+
+	s.channelNotice(id, "#%s has been closed by %s.", id, sub.Username)
+	if err := DeleteUserChannel(id); err != nil {
+		sub.ChatServer("Could not close #%s: %s", id, err)
+		return
+	}
+	if err := deleteChannelPins(id); err != nil {
+		log.Error("CloseChannel(%s): deleting its pinned messages: %s", id, err)
+	}
+	ClearEchoMessages(id)
+	log.Info("CloseChannel: %s closes #%s", sub.Username, id)
+
+	// Everybody is out of the channel.
+	for _, member := range s.IterSubscribers() {
+		if member.setInChannel(id, false) {
+			member.SendJSON(messages.Message{
+				Action:  messages.ActionPart,
+				Channel: id,
+			})
+		}
+	}
+
+	// Operators closing somebody else's channel is a moderation action.
+	if sub.Username != ch.Owner {
+		Audit(commandSource(sub), sub.Username, "close", id, "owner="+ch.Owner)
+	}
+
+	sub.ChatServer("#%s has been closed.", id)
+	s.SendChannels()
+}
+
+// channelNotice sends a ChatServer message to the members of a channel.
+func (s *Server) channelNotice(channel, message string, v ...interface{}) {
+	s.Broadcast(messages.Message{
+		Action:   messages.ActionError,
+		Channel:  channel,
+		Username: "ChatServer",
+		Message:  fmt.Sprintf(message, v...),
+	})
+}
+
+// SendChannels sends the subscriber the list of created channels they may see.
+func (sub *Subscriber) SendChannels() {
+	var list = []messages.ChannelInfo{}
+	for _, ch := range ListUserChannels() {
+		if ch.VisibleTo(sub.Username) {
+			list = append(list, ch.Info(sub.Username))
+		}
+	}
+
+	sub.SendJSON(messages.Message{
+		Action:   messages.ActionChannels,
+		Channels: list,
+	})
+}
+
+// SendChannels sends every logged-in subscriber their list of created channels.
+func (s *Server) SendChannels() {
+	for _, sub := range s.IterSubscribers() {
+		if sub.authenticated {
+			sub.SendChannels()
+		}
+	}
+}
+
+// ChannelCommand handles the chat commands for created channels, which everybody may use.
+//
+// Commands that act on a channel default to the one they were typed in.
+func (s *Server) ChannelCommand(words []string, sub *Subscriber, msg messages.Message) {
+	// The channel given as an optional argument, or the current one.
+	var channelArg = func(i int) string {
+		if len(words) > i {
+			return words[i]
+		}
+		return msg.Channel
+	}
+
+	switch words[0] {
+	case "/create":
+		if len(words) < 2 {
+			sub.ChatServer(RenderMarkdown("Usage: `/create <channel> [\"Display Name\"] [private] [invite] [password <secret>]`"))
+			return
+		}
+
+		var create = messages.Message{
+			Action:  messages.ActionCreate,
+			Channel: words[1],
+		}
+		for i := 2; i < len(words); i++ {
+			switch words[i] {
+			case "private":
+				create.Private = true
+			case "invite":
+				create.InviteOnly = true
+			case "password":
+				if i+1 < len(words) {
+					create.Password = words[i+1]
+					i++
+				}
+			default:
+				create.Message = words[i]
+			}
+		}
+		s.OnCreateChannel(sub, create)
+	case "/join":
+		if len(words) < 2 {
+			sub.ChatServer(RenderMarkdown("Usage: `/join <channel> [password]`"))
+			return
+		}
+		var join = messages.Message{
+			Action:  messages.ActionJoin,
+			Channel: words[1],
+		}
+		if len(words) > 2 {
+			join.Password = words[2]
+		}
+		s.OnJoinChannel(sub, join)
+	case "/part":
+		s.OnPartChannel(sub, messages.Message{
+			Action:  messages.ActionPart,
+			Channel: channelArg(1),
+		})
+	case "/invite":
+		if len(words) < 2 {
+			sub.ChatServer(RenderMarkdown("Usage: `/invite <username> [channel]`"))
+			return
+		}
+		s.OnInviteChannel(sub, messages.Message{
+			Action:   messages.ActionInvite,
+			Channel:  channelArg(2),
+			Username: words[1],
+		})
+	case "/topic":
+		// The channel is optional and starts with a #, e.g. "/topic #movies Tonight: Alien".
+		var (
+			channel = msg.Channel
+			topic   = strings.TrimSpace(strings.TrimPrefix(msg.Message, words[0]))
+		)
+		if strings.HasPrefix(topic, "#") {
+			parts := strings.SplitN(topic, " ", 2)
+			channel = parts[0]
+			topic = ""
+			if len(parts) > 1 {
+				topic = strings.TrimSpace(parts[1])
+			}
+		}
+
+		// With no topic, show the current one.
+		if topic == "" {
+			var id = normalizeChannelID(channel)
+			if current := ChannelTopic(id); current != "" && sub.InChannel(id) {
+				sub.ChatServer("The topic of #%s is: %s", id, RenderMarkdown(current))
+			} else {
+				sub.ChatServer(RenderMarkdown("Usage: `/topic [#channel] <topic>` to set the topic of a channel, and `/topic [#channel] clear` to remove it."))
+			}
+			return
+		} else if topic == "clear" {
+			topic = ""
+		}
+
+		s.OnTopic(sub, messages.Message{
+			Action:  messages.ActionTopic,
+			Channel: channel,
+			Message: topic,
+		})
+	case "/chanop", "/chandeop":
+		if len(words) < 2 {
+			sub.ChatServer(RenderMarkdown(fmt.Sprintf("Usage: `%s <username> [channel]`", words[0])))
+			return
+		}
+		s.SetChannelOperator(sub, channelArg(2), strings.TrimPrefix(words[1], "@"), words[0] == "/chanop")
+	case "/close":
+		s.CloseChannel(sub, channelArg(1))
+	case "/channels":
+		var lines = []string{}
+		for _, ch := range ListUserChannels() {
+			if !ch.VisibleTo(sub.Username) {
+				continue
+			}
+
+			var line = fmt.Sprintf("* **#%s** (%s)", ch.ID, ch.Name)
+			if ch.IsMember(sub.Username) {
+				line += " - joined"
+			} else if ch.InviteOnly && ch.Role(sub.Username) != models.ChannelRoleInvited {
+				line += " - invite-only"
+			} else if ch.HasPassword() {
+				line += " - password"
+			}
+			if ch.Topic != "" {
+				line += ": " + ch.Topic
+			}
+			lines = append(lines, line)
+		}
+
+		var message = "Chat channels created by users:\n\n" + strings.Join(lines, "\n")
+		if len(lines) == 0 {
+			message = "Nobody has created a chat channel yet."
+		}
+		message += "\n\nUse `/join <channel>` to join a channel, `/part` to leave it, " +
+			"`/create <channel> [private] [invite] [password <secret>]` to make your own, " +
+			"`/invite <username>`, `/topic <topic>`, `/chanop <username>` or `/chandeop <username>` to manage it " +
+			"and `/close` to close it."
+		sub.ChatServer(RenderMarkdown(message))
+	}
+}
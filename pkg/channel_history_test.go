@@ -0,0 +1,86 @@
+package barertc
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+func TestChannelHistory(t *testing.T) {
+	setupTestDatabase(t)
+	defer ClearEchoMessages("lobby")
+	config.Current.ChannelHistory.Enabled = true
+	config.Current.JWT.Enabled = true
+	config.Current.JWT.SecretKey = "test"
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+	)
+
+	for _, message := range []string{"one", "two", "three"} {
+		s.OnMessage(alice, messages.Message{Channel: "lobby", Message: message})
+	}
+
+	// Bob takes back his message: it is gone from the history too.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "oops"})
+	for _, msg := range RecentChannelMessages("lobby") {
+		if msg.Username == "bob" {
+			s.OnTakeback(bob, messages.Message{Action: messages.ActionTakeback, MessageID: msg.MessageID})
+		}
+	}
+
+	// Fetch the history from the API.
+	token, err := IssueLoginToken("bob")
+	if err != nil {
+		t.Fatalf("IssueLoginToken: %s", err)
+	}
+	var history = func() (int, []string) {
+		var (
+			rec = httptest.NewRecorder()
+			req = httptest.NewRequest("POST", "/api/channel/history", strings.NewReader(
+				`{"JWTToken": "`+token+`", "Channel": "lobby"}`,
+			))
+			result struct {
+				Messages []messages.Message
+			}
+			texts []string
+		)
+		req.Header.Set("Content-Type", "application/json")
+		s.ChannelHistory().ServeHTTP(rec, req)
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		for _, msg := range result.Messages {
+			texts = append(texts, msg.Message)
+		}
+		return rec.Code, texts
+	}
+
+	if code, texts := history(); code != 200 || strings.Join(texts, ",") != "<p>three</p>,<p>two</p>,<p>one</p>" {
+		t.Errorf("unexpected history (status %d): %v", code, texts)
+	}
+
+	// The echo buffer is filled again after a reboot.
+	ClearEchoMessages("lobby")
+	if err := RehydrateEchoMessages(); err != nil {
+		t.Fatalf("RehydrateEchoMessages: %s", err)
+	}
+	var echoes []string
+	for _, msg := range RecentChannelMessages("lobby") {
+		echoes = append(echoes, msg.Message)
+	}
+	if strings.Join(echoes, ",") != "<p>one</p>,<p>two</p>,<p>three</p>" {
+		t.Errorf("unexpected echo buffer after a reboot: %v", echoes)
+	}
+
+	// Only the members of the channel may read it.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "/part"})
+	if code, _ := history(); code != 403 {
+		t.Errorf("expected a 403 error after leaving the channel, got %d", code)
+	}
+}
@@ -0,0 +1,216 @@
+package barertc
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+/*
+Channel membership: which chat channels each subscriber is in.
+
+On login a user joins every public channel they may access (VIP channels are for VIP
+users and operators) and the created channels they are a member of. They may then
+/part and /join channels during their session. Channel messages are only broadcast
+to the channel's members, and each channel has its own Who List: a `who` message
+with the Channel and the usernames in it.
+*/
+
+// InChannel tells whether the subscriber is in a channel.
+func (sub *Subscriber) InChannel(channel string) bool {
+	sub.channelsMu.RLock()
+	defer sub.channelsMu.RUnlock()
+	_, ok := sub.channels[channel]
+	return ok
+}
+
+// JoinedChannels returns the channels the subscriber is in, sorted by ID.
+func (sub *Subscriber) JoinedChannels() []string {
+	sub.channelsMu.RLock()
+	var result = make([]string, 0, len(sub.channels))
+	for channel := range sub.channels {
+		result = append(result, channel)
+	}
+	sub.channelsMu.RUnlock()
+
+	sort.Strings(result)
+	return result
+}
+
+// setInChannel adds or removes the subscriber from a channel, and returns whether it changed.
+func (sub *Subscriber) setInChannel(channel string, in bool) bool {
+	sub.channelsMu.Lock()
+	defer sub.channelsMu.Unlock()
+
+	if _, ok := sub.channels[channel]; ok == in {
+		return false
+	}
+
+	if in {
+		sub.channels[channel] = struct{}{}
+	} else {
+		delete(sub.channels, channel)
+	}
+	return true
+}
+
+// CanJoinPublicChannel tells whether the subscriber may be in a public channel.
+func (sub *Subscriber) CanJoinPublicChannel(ch config.Channel) bool {
+	return !ch.VIP || sub.IsVIP() || sub.IsAdmin()
+}
+
+// JoinChannelsOnLogin puts a newly logged-in subscriber in their channels: the public
+// channels they may access, and the created channels they are a member of.
+func (s *Server) JoinChannelsOnLogin(sub *Subscriber) {
+	var joined = []string{}
+	for _, ch := range config.Current.PublicChannels {
+		if sub.CanJoinPublicChannel(ch) && sub.setInChannel(ch.ID, true) {
+			joined = append(joined, ch.ID)
+		}
+	}
+	for _, ch := range ListUserChannels() {
+		if ch.IsMember(sub.Username) && sub.setInChannel(ch.ID, true) {
+			joined = append(joined, ch.ID)
+		}
+	}
+
+	for _, channel := range joined {
+		sub.SendChannelNotices(channel)
+		s.SendChannelWhoList(channel)
+	}
+}
+
+// JoinChannel puts the subscriber in a channel: they are sent a `join` message and the
+// channel's topic and pins, and its members get a presence message and the updated Who List.
+//
+// The caller checks whether the subscriber may join the channel.
+func (s *Server) JoinChannel(sub *Subscriber, channel string) {
+	if !sub.setInChannel(channel, true) {
+		return
+	}
+	log.Debug("JoinChannel: %s joins #%s", sub.Username, channel)
+
+	sub.SendJSON(messages.Message{
+		Action:  messages.ActionJoin,
+		Channel: channel,
+	})
+	sub.SendChannelNotices(channel)
+	s.Broadcast(messages.Message{
+		Action:   messages.ActionPresence,
+		Channel:  channel,
+		Username: sub.Username,
+		Message:  messages.PresenceJoinedChannel,
+	})
+	s.SendChannelWhoList(channel)
+}
+
+// PartChannel takes the subscriber out of a channel: they are sent a `part` message,
+// and the channel's remaining members get a presence message and the updated Who List.
+func (s *Server) PartChannel(sub *Subscriber, channel string) {
+	if !sub.setInChannel(channel, false) {
+		return
+	}
+	log.Debug("PartChannel: %s leaves #%s", sub.Username, channel)
+
+	sub.SendJSON(messages.Message{
+		Action:  messages.ActionPart,
+		Channel: channel,
+	})
+	s.Broadcast(messages.Message{
+		Action:   messages.ActionPresence,
+		Channel:  channel,
+		Username: sub.Username,
+		Message:  messages.PresenceLeftChannel,
+	})
+	s.SendChannelWhoList(channel)
+}
+
+// LeaveAllChannels takes a subscriber out of all their channels when they leave the
+// chat room, and updates the Who List of those channels.
+func (s *Server) LeaveAllChannels(sub *Subscriber) {
+	sub.channelsMu.Lock()
+	var channels = sub.channels
+	sub.channels = map[string]struct{}{}
+	sub.channelsMu.Unlock()
+
+	for channel := range channels {
+		s.SendChannelWhoList(channel)
+	}
+}
+
+// SendChannelWhoList sends the members of a channel its Who List: a `who` message
+// with the Channel and the usernames in it.
+//
+// Hidden users and blocking are respected, the same as the main Who List.
+func (s *Server) SendChannelWhoList(channel string) {
+	// The main Who List is not sent in the first seconds of the server launch, see SendWhoList.
+	if time.Since(s.upSince) < 15*time.Second {
+		return
+	}
+
+	var members = []*Subscriber{}
+	for _, sub := range s.IterSubscribers() {
+		if sub.authenticated && sub.InChannel(channel) {
+			members = append(members, sub)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+
+	for _, sub := range members {
+		var usernames = []string{}
+		for _, member := range members {
+			if member != sub && (member.ChatStatus == "hidden" || member.Blocks(sub)) {
+				continue
+			}
+			usernames = append(usernames, member.Username)
+		}
+
+		sub.SendJSON(messages.Message{
+			Action:    messages.ActionWhoList,
+			Channel:   channel,
+			Usernames: usernames,
+		})
+	}
+}
+
+// SendAllChannelWhoLists sends the Who List of every channel somebody is in.
+func (s *Server) SendAllChannelWhoLists() {
+	var channels = map[string]struct{}{}
+	for _, sub := range s.IterSubscribers() {
+		for _, channel := range sub.JoinedChannels() {
+			channels[channel] = struct{}{}
+		}
+	}
+
+	for channel := range channels {
+		s.SendChannelWhoList(channel)
+	}
+}
+
+// checkChannelAccess tells whether the subscriber may post to a channel: they must be
+// in it. They are told why not, without leaking the names of private channels.
+func (s *Server) checkChannelAccess(sub *Subscriber, channel string) bool {
+	if channel == "" || strings.HasPrefix(channel, "@") || sub.InChannel(channel) {
+		return true
+	}
+
+	var known bool
+	if ch, ok := LookupUserChannel(channel); ok {
+		known = ch.VisibleTo(sub.Username)
+	} else if ch, ok := config.Current.GetChannel(channel); ok {
+		known = sub.CanJoinPublicChannel(ch)
+	}
+
+	if known {
+		sub.ChatServer(RenderMarkdown("You are not in #" + channel + ": type `/join " + channel + "` to join it."))
+	} else {
+		sub.ChatServer("Channel not found: %s", channel)
+	}
+	return false
+}
@@ -0,0 +1,515 @@
+package barertc
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+/*
+Channel topics, pinned messages and the message of the day.
+
+The topic of a created channel is kept on the channel itself (see user_channels.go);
+the topics of the public channels, the pinned messages and the message of the day are
+kept here, backed by the SQLite database. They are sent to a user on login and when
+they join a channel.
+*/
+
+// Limits on pinned messages and the message of the day.
+const (
+	MaxPinnedMessages = 10 // in one channel
+	MaxMOTDLength     = 1000
+)
+
+// In-memory copy of the topics and pinned messages.
+var (
+	channelTopics  = map[string]models.ChannelTopic{}    // channel ID -> topic, and the MOTD
+	pinnedMessages = map[string][]models.PinnedMessage{} // channel ID -> pins, oldest first
+	topicsMu       sync.RWMutex
+)
+
+// ReloadChannelTopics refreshes the in-memory topics and pinned messages from the database.
+func ReloadChannelTopics() error {
+	topics, err := models.GetChannelTopics()
+	if err != nil {
+		return err
+	}
+
+	pins, err := models.GetPinnedMessages()
+	if err != nil {
+		return err
+	}
+
+	var (
+		topicCache = map[string]models.ChannelTopic{}
+		pinCache   = map[string][]models.PinnedMessage{}
+	)
+	for _, topic := range topics {
+		topicCache[topic.ChannelID] = topic
+	}
+	for _, pin := range pins {
+		pinCache[pin.ChannelID] = append(pinCache[pin.ChannelID], pin)
+	}
+
+	topicsMu.Lock()
+	channelTopics = topicCache
+	pinnedMessages = pinCache
+	topicsMu.Unlock()
+
+	log.Info("ReloadChannelTopics: %d topics and %d pinned messages loaded", len(topics), len(pins))
+	return nil
+}
+
+// ChannelTopic returns the topic of a public or created channel.
+func ChannelTopic(channel string) string {
+	if ch, ok := LookupUserChannel(channel); ok {
+		return ch.Topic
+	}
+
+	topicsMu.RLock()
+	defer topicsMu.RUnlock()
+	if channel == models.MOTDChannel {
+		return ""
+	}
+	return channelTopics[channel].Topic
+}
+
+// MOTD returns the message of the day: its Topic is blank if there is none.
+func MOTD() models.ChannelTopic {
+	topicsMu.RLock()
+	defer topicsMu.RUnlock()
+	return channelTopics[models.MOTDChannel]
+}
+
+// setStoredTopic saves the topic of a public channel, or the message of the day.
+func setStoredTopic(topic models.ChannelTopic) error {
+	topic.UpdatedAt = time.Now()
+
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	if err := models.SetChannelTopic(topic); err != nil && err != models.ErrNotInitialized {
+		return err
+	}
+
+	if topic.Topic == "" {
+		delete(channelTopics, topic.ChannelID)
+	} else {
+		channelTopics[topic.ChannelID] = topic
+	}
+	return nil
+}
+
+// PinnedMessages returns a copy of the pinned messages of a channel, oldest first.
+func PinnedMessages(channel string) []models.PinnedMessage {
+	topicsMu.RLock()
+	defer topicsMu.RUnlock()
+
+	var result = make([]models.PinnedMessage, len(pinnedMessages[channel]))
+	copy(result, pinnedMessages[channel])
+	return result
+}
+
+// pinMessage adds a pinned message to its channel.
+func pinMessage(pin models.PinnedMessage) error {
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	if len(pinnedMessages[pin.ChannelID]) >= MaxPinnedMessages {
+		return fmt.Errorf("#%s already has %d pinned messages: unpin one first", pin.ChannelID, MaxPinnedMessages)
+	}
+
+	if err := models.PinMessage(pin); err != nil && err != models.ErrNotInitialized {
+		return err
+	}
+
+	// Copy on write, as PinnedMessages may be reading the old slice.
+	var pins = make([]models.PinnedMessage, 0, len(pinnedMessages[pin.ChannelID])+1)
+	pins = append(pins, pinnedMessages[pin.ChannelID]...)
+	pinnedMessages[pin.ChannelID] = append(pins, pin)
+	return nil
+}
+
+// unpinMessage removes a pinned message from a channel, and returns whether it was pinned.
+func unpinMessage(channel string, msgID int64) (bool, error) {
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	var (
+		pins  = []models.PinnedMessage{}
+		found bool
+	)
+	for _, pin := range pinnedMessages[channel] {
+		if pin.MessageID == msgID {
+			found = true
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	if !found {
+		return false, nil
+	}
+
+	if err := models.UnpinMessage(channel, msgID); err != nil && err != models.ErrNotInitialized {
+		return false, err
+	}
+
+	if len(pins) == 0 {
+		delete(pinnedMessages, channel)
+	} else {
+		pinnedMessages[channel] = pins
+	}
+	return true, nil
+}
+
+// editPinnedMessage updates the copy of a pinned message that was edited, and returns
+// whether it was pinned.
+func editPinnedMessage(channel string, msgID int64, message string) (bool, error) {
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	var (
+		pins  = make([]models.PinnedMessage, 0, len(pinnedMessages[channel]))
+		found bool
+	)
+	for _, pin := range pinnedMessages[channel] {
+		if pin.MessageID == msgID {
+			found = true
+			pin.Message = message
+			if err := models.PinMessage(pin); err != nil && err != models.ErrNotInitialized {
+				return false, err
+			}
+		}
+		pins = append(pins, pin)
+	}
+	if !found {
+		return false, nil
+	}
+
+	pinnedMessages[channel] = pins
+	return true, nil
+}
+
+// deleteChannelPins removes all of the pinned messages of a channel, e.g. when it is closed.
+func deleteChannelPins(channel string) error {
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	if err := models.DeleteChannelPins(channel); err != nil && err != models.ErrNotInitialized {
+		return err
+	}
+
+	delete(pinnedMessages, channel)
+	return nil
+}
+
+// canManageChannel tells whether the subscriber may set the topic of (and pin messages
+// in) a channel: the operators of a created channel, and the chat operators for the
+// public channels. They are told why not, e.g. "Only the operators of #lobby may set its topic."
+func (s *Server) canManageChannel(sub *Subscriber, channel, what string) bool {
+	if ch, ok := LookupUserChannel(channel); ok {
+		if !ch.IsMember(sub.Username) && !sub.IsAdmin() {
+			sub.ChatServer("You are not in #%s.", channel)
+			return false
+		} else if !ch.IsOperator(sub.Username) && !sub.IsAdmin() {
+			sub.ChatServer("Only the operators of #%s may %s.", channel, what)
+			return false
+		}
+		return true
+	}
+
+	if pc, ok := config.Current.GetChannel(channel); !ok || !sub.CanJoinPublicChannel(pc) {
+		sub.ChatServer("Channel not found: %s", channel)
+		return false
+	} else if !sub.IsAdmin() {
+		sub.ChatServer("Only the operators of #%s may %s.", channel, what)
+		return false
+	}
+	return true
+}
+
+// SendChannelNotices sends the subscriber the topic and pinned messages of a channel,
+// when they log in or join it.
+func (sub *Subscriber) SendChannelNotices(channel string) {
+	if topic := ChannelTopic(channel); topic != "" {
+		sub.SendJSON(messages.Message{
+			Action:  messages.ActionTopic,
+			Channel: channel,
+			Message: RenderMarkdown(topic),
+		})
+	}
+
+	if pins := PinnedMessages(channel); len(pins) > 0 {
+		sub.SendJSON(messages.Message{
+			Action:  messages.ActionPins,
+			Channel: channel,
+			Pins:    pinsToMessages(pins),
+		})
+	}
+}
+
+// SendMOTD sends the subscriber the message of the day, if there is one.
+func (sub *Subscriber) SendMOTD() {
+	if motd := MOTD(); motd.Topic != "" {
+		sub.SendJSON(messages.Message{
+			Action:   messages.ActionMOTD,
+			Username: motd.Username,
+			Message:  RenderMarkdown(motd.Topic),
+		})
+	}
+}
+
+// SendPins sends the pinned messages of a channel to its members, after they have changed.
+func (s *Server) SendPins(channel string) {
+	var msg = messages.Message{
+		Action:  messages.ActionPins,
+		Channel: channel,
+		Pins:    pinsToMessages(PinnedMessages(channel)),
+	}
+	for _, sub := range s.IterSubscribers() {
+		if sub.authenticated && sub.InChannel(channel) {
+			sub.SendJSON(msg)
+		}
+	}
+}
+
+// pinsToMessages converts pinned messages for the `pins` protocol action.
+func pinsToMessages(pins []models.PinnedMessage) []messages.PinnedMessage {
+	var result = []messages.PinnedMessage{}
+	for _, pin := range pins {
+		result = append(result, messages.PinnedMessage{
+			MessageID: pin.MessageID,
+			Username:  pin.Username,
+			Message:   pin.Message,
+			PinnedBy:  pin.PinnedBy,
+			Timestamp: pin.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return result
+}
+
+// OnPin handles the `pin` and `unpin` actions: an operator pins the MessageID to the
+// top of its Channel, or unpins it.
+//
+// Only the recent messages of a channel may be pinned (see RecentChannelMessages).
+func (s *Server) OnPin(sub *Subscriber, msg messages.Message) {
+	if sub.Username == "" || !sub.authenticated {
+		sub.ChatServer("You must log in first.")
+		return
+	}
+
+	var id = normalizeChannelID(msg.Channel)
+	if !s.canManageChannel(sub, id, "pin messages") {
+		return
+	}
+
+	// Unpinning.
+	if msg.Action == messages.ActionUnpin {
+		if ok, err := unpinMessage(id, msg.MessageID); err != nil {
+			sub.ChatServer("Could not unpin the message: %s", err)
+			return
+		} else if !ok {
+			sub.ChatServer("That message is not pinned in #%s.", id)
+			return
+		}
+
+		log.Info("OnPin: %s unpins message %d in #%s", sub.Username, msg.MessageID, id)
+		if sub.IsAdmin() {
+			Audit(commandSource(sub), sub.Username, "unpin", id, strconv.FormatInt(msg.MessageID, 10))
+		}
+		s.SendPins(id)
+		return
+	}
+
+	// Find the message to pin.
+	var (
+		pin   models.PinnedMessage
+		found bool
+	)
+	for _, recent := range RecentChannelMessages(id) {
+		if recent.MessageID == msg.MessageID {
+			pin = models.PinnedMessage{
+				ChannelID: id,
+				MessageID: recent.MessageID,
+				Username:  recent.Username,
+				Message:   recent.Message,
+				PinnedBy:  sub.Username,
+				CreatedAt: time.Now(),
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		sub.ChatServer("Message not found: only the recent messages of #%s may be pinned.", id)
+		return
+	}
+
+	for _, existing := range PinnedMessages(id) {
+		if existing.MessageID == pin.MessageID {
+			sub.ChatServer("That message is already pinned in #%s.", id)
+			return
+		}
+	}
+
+	if err := pinMessage(pin); err != nil {
+		sub.ChatServer("Could not pin the message: %s", err)
+		return
+	}
+
+	log.Info("OnPin: %s pins message %d in #%s", sub.Username, pin.MessageID, id)
+	if sub.IsAdmin() {
+		Audit(commandSource(sub), sub.Username, "pin", id, strconv.FormatInt(pin.MessageID, 10))
+	}
+	s.SendPins(id)
+}
+
+// UnpinTakenBackMessage removes a message that was taken back from the channels it
+// was pinned in.
+func (s *Server) UnpinTakenBackMessage(msgID int64) {
+	topicsMu.RLock()
+	var channels = []string{}
+	for channel, pins := range pinnedMessages {
+		for _, pin := range pins {
+			if pin.MessageID == msgID {
+				channels = append(channels, channel)
+			}
+		}
+	}
+	topicsMu.RUnlock()
+
+	for _, channel := range channels {
+		if _, err := unpinMessage(channel, msgID); err != nil {
+			log.Error("UnpinTakenBackMessage(%d): %s", msgID, err)
+			continue
+		}
+		s.SendPins(channel)
+	}
+}
+
+// OnMOTD handles an operator setting the message of the day, which everybody sees
+// when they log in. A blank message removes it.
+func (s *Server) OnMOTD(sub *Subscriber, msg messages.Message) {
+	if !sub.IsAdmin() {
+		sub.ChatServer("Only operators may set the message of the day.")
+		return
+	}
+
+	var motd = strings.TrimSpace(msg.Message)
+	if len(motd) > MaxMOTDLength {
+		sub.ChatServer("The message of the day is too long: please keep it under %d characters.", MaxMOTDLength)
+		return
+	}
+
+	if err := setStoredTopic(models.ChannelTopic{
+		ChannelID: models.MOTDChannel,
+		Topic:     motd,
+		Username:  sub.Username,
+	}); err != nil {
+		sub.ChatServer("Could not set the message of the day: %s", err)
+		return
+	}
+	log.Info("OnMOTD: %s sets the message of the day: %s", sub.Username, motd)
+	Audit(commandSource(sub), sub.Username, "motd", "", motd)
+
+	// Everybody gets the new message of the day; a blank one clears it.
+	var update = messages.Message{
+		Action:   messages.ActionMOTD,
+		Username: sub.Username,
+		Message:  RenderMarkdown(motd),
+	}
+	for _, other := range s.IterSubscribers() {
+		if other.authenticated {
+			other.SendJSON(update)
+		}
+	}
+
+	if motd == "" {
+		sub.ChatServer("The message of the day has been removed.")
+	}
+}
+
+// TopicCommand handles the `/pin`, `/unpin`, `/pins` and `/motd` chat commands.
+func (s *Server) TopicCommand(words []string, sub *Subscriber, msg messages.Message) {
+	switch words[0] {
+	case "/pin", "/unpin":
+		if len(words) < 2 {
+			sub.ChatServer(RenderMarkdown(fmt.Sprintf("Usage: `%s <message ID> [channel]`", words[0])))
+			return
+		}
+		msgID, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil {
+			sub.ChatServer("%s: the message ID must be a number.", words[0])
+			return
+		}
+
+		var pin = messages.Message{
+			Action:    messages.ActionPin,
+			Channel:   msg.Channel,
+			MessageID: msgID,
+		}
+		if words[0] == "/unpin" {
+			pin.Action = messages.ActionUnpin
+		}
+		if len(words) > 2 {
+			pin.Channel = words[2]
+		}
+		s.OnPin(sub, pin)
+	case "/pins":
+		var id = msg.Channel
+		if len(words) > 1 {
+			id = words[1]
+		}
+		id = normalizeChannelID(id)
+
+		if !sub.InChannel(id) {
+			sub.ChatServer("You are not in #%s.", id)
+			return
+		}
+
+		var pins = PinnedMessages(id)
+		if len(pins) == 0 {
+			sub.ChatServer("There are no pinned messages in #%s.", id)
+			return
+		}
+
+		// The pinned messages are HTML already.
+		var lines = []string{}
+		for _, pin := range pins {
+			lines = append(lines, fmt.Sprintf(
+				"<li>[%d] <strong>%s</strong>: %s <em>(pinned by %s)</em></li>",
+				pin.MessageID, html.EscapeString(pin.Username), pin.Message, html.EscapeString(pin.PinnedBy),
+			))
+		}
+		sub.ChatServer("Pinned messages in #%s:<ul>%s</ul>", id, strings.Join(lines, ""))
+	case "/motd":
+		var motd = strings.TrimSpace(strings.TrimPrefix(msg.Message, words[0]))
+
+		// With no message, show the current one.
+		if motd == "" {
+			if current := MOTD(); current.Topic != "" {
+				sub.ChatServer("The message of the day (set by %s): %s", html.EscapeString(current.Username), RenderMarkdown(current.Topic))
+			} else if sub.IsAdmin() {
+				sub.ChatServer(RenderMarkdown("There is no message of the day: use `/motd <message>` to set one, and `/motd clear` to remove it."))
+			} else {
+				sub.ChatServer("There is no message of the day.")
+			}
+			return
+		} else if motd == "clear" {
+			motd = ""
+		}
+
+		s.OnMOTD(sub, messages.Message{
+			Action:  messages.ActionMOTD,
+			Message: motd,
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package barertc
+
+import (
+	"fmt"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestTopicsAndPins(t *testing.T) {
+	defer func() {
+		setStoredTopic(models.ChannelTopic{ChannelID: "lobby"})
+		setStoredTopic(models.ChannelTopic{ChannelID: models.MOTDChannel})
+		deleteChannelPins("lobby")
+	}()
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+	)
+	alice.JWTClaims = &jwt.Claims{IsAdmin: true}
+
+	// Find the last message of an action that bob received.
+	var last = func(action string) (messages.Message, bool) {
+		var (
+			result messages.Message
+			found  bool
+		)
+		for _, msg := range drainMessages(t, bob) {
+			if msg.Action == action {
+				result, found = msg, true
+			}
+		}
+		return result, found
+	}
+
+	// Only operators set the topics of public channels.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "/topic mine now"})
+	if msg, _ := last(messages.ActionError); msg.Message != "Only the operators of #lobby may set its topic." {
+		t.Errorf("bob set the topic: %q", msg.Message)
+	}
+
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "/topic Be **nice**"})
+	if msg, ok := last(messages.ActionTopic); !ok || msg.Channel != "lobby" || msg.Message != "<p>Be <strong>nice</strong></p>" {
+		t.Errorf("bob did not get the new topic: %+v", msg)
+	}
+
+	// Alice pins bob's message.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "read the rules"})
+	var mid int64
+	for _, msg := range RecentChannelMessages("lobby") {
+		if msg.Username == "bob" {
+			mid = msg.MessageID
+		}
+	}
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: fmt.Sprintf("/pin %d", mid)})
+	if msg, ok := last(messages.ActionPins); !ok || len(msg.Pins) != 1 || msg.Pins[0].MessageID != mid || msg.Pins[0].PinnedBy != "alice" {
+		t.Errorf("bob did not get the pinned message: %+v", msg)
+	}
+
+	// The topic and pins are sent again when bob rejoins the lobby.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "/part"})
+	drainMessages(t, bob)
+	s.OnMessage(bob, messages.Message{Channel: "offtopic", Message: "/join lobby"})
+	var gotTopic, gotPins bool
+	for _, msg := range drainMessages(t, bob) {
+		gotTopic = gotTopic || (msg.Action == messages.ActionTopic && msg.Channel == "lobby")
+		gotPins = gotPins || (msg.Action == messages.ActionPins && len(msg.Pins) == 1)
+	}
+	if !gotTopic || !gotPins {
+		t.Errorf("bob did not get the lobby topic (%v) and pins (%v) on join", gotTopic, gotPins)
+	}
+
+	// Taking the message back unpins it.
+	s.OnTakeback(bob, messages.Message{Action: messages.ActionTakeback, MessageID: mid})
+	if msg, ok := last(messages.ActionPins); !ok || len(msg.Pins) != 0 {
+		t.Errorf("the message is still pinned after its takeback: %+v", msg)
+	}
+
+	// The message of the day.
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "/motd Hello, world!"})
+	if msg, ok := last(messages.ActionMOTD); !ok || msg.Username != "alice" || msg.Message != "<p>Hello, world!</p>" {
+		t.Errorf("bob did not get the message of the day: %+v", msg)
+	}
+	bob.SendMOTD()
+	if _, ok := last(messages.ActionMOTD); !ok {
+		t.Errorf("the message of the day is not sent on login")
+	}
+}
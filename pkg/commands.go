@@ -3,15 +3,13 @@ package barertc
 import (
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"git.kirsle.net/apps/barertc/pkg/config"
-	ourjwt "git.kirsle.net/apps/barertc/pkg/jwt"
 	"git.kirsle.net/apps/barertc/pkg/log"
 	"git.kirsle.net/apps/barertc/pkg/messages"
-	"github.com/golang-jwt/jwt/v4"
+	"git.kirsle.net/apps/barertc/pkg/models"
 	"github.com/mattn/go-shellwords"
 )
 
@@ -42,9 +40,24 @@ func (s *Server) ProcessCommand(sub *Subscriber, msg messages.Message) bool {
 		case "/unban":
 			s.UnbanCommand(words, sub)
 			return true
+		case "/banip":
+			s.BanIPCommand(words, sub)
+			return true
+		case "/unbanip":
+			s.UnbanIPCommand(words, sub)
+			return true
 		case "/bans":
 			s.BansCommand(words, sub)
 			return true
+		case "/audit":
+			s.AuditCommand(words, sub)
+			return true
+		case "/slowmode":
+			s.SlowModeCommand(words, sub)
+			return true
+		case "/edits":
+			s.EditsCommand(words, sub)
+			return true
 		case "/nsfw":
 			s.NSFWCommand(words, sub)
 			return true
@@ -57,9 +70,17 @@ func (s *Server) ProcessCommand(sub *Subscriber, msg messages.Message) bool {
 		case "/help":
 			sub.ChatServer(RenderMarkdown("The most common moderator commands on chat are:\n\n" +
 				"* `/kick <username>` to kick from chat\n" +
-				"* `/ban <username> <duration>` to ban from chat (default duration is 24 (hours))\n" +
+				"* `/ban <username> [duration] [reason]` to ban from chat (default duration is 24h; also `30m`, `7d`, `perm`)\n" +
 				"* `/unban <username>` to list the ban on a user\n" +
-				"* `/bans` to list current banned users and their expiration date\n" +
+				"* `/banip <ip or cidr> [duration] [reason]` to ban an IP address or range, e.g. `10.0.0.0/8` (default is permanent)\n" +
+				"* `/unbanip <ip or cidr>` to lift the ban on an IP address or range\n" +
+				"* `/bans` to list current banned users, their expiration date, who banned them and why\n" +
+				"* `/audit [username] [page]` to review the log of operator actions, optionally by or on a user\n" +
+				"* `/slowmode <channel> <seconds>` to make users wait between messages in a channel (`off` to turn it off)\n" +
+				"* `/topic [#channel] <topic>` to set the topic of a channel (`clear` to remove it)\n" +
+				"* `/pin <message ID>` and `/unpin <message ID>` to pin messages to the top of the channel, and `/pins` to list them\n" +
+				"* `/edits <message ID>` to see the prior versions of an edited message\n" +
+				"* `/motd <message>` to set the message of the day that everybody sees when they log in (`clear` to remove it)\n" +
 				"* `/nsfw <username>` to mark their camera NSFW\n" +
 				"* `/cut <username>` to make them turn off their camera\n" +
 				"* `/help` to show this message\n" +
@@ -78,6 +99,7 @@ func (s *Server) ProcessCommand(sub *Subscriber, msg messages.Message) bool {
 			))
 			return true
 		case "/shutdown":
+			auditCommand(sub, words, "")
 			s.Broadcast(messages.Message{
 				Action:   messages.ActionError,
 				Username: "ChatServer",
@@ -86,6 +108,7 @@ func (s *Server) ProcessCommand(sub *Subscriber, msg messages.Message) bool {
 			os.Exit(1)
 			return true
 		case "/kickall":
+			auditCommand(sub, words, "")
 			s.KickAllCommand()
 			return true
 		case "/reconfigure":
@@ -101,6 +124,16 @@ func (s *Server) ProcessCommand(sub *Subscriber, msg messages.Message) bool {
 
 	}
 
+	// Commands for the chat channels created by users, which everybody may use.
+	switch words[0] {
+	case "/create", "/join", "/part", "/invite", "/topic", "/chanop", "/chandeop", "/close", "/channels":
+		s.ChannelCommand(words, sub, msg)
+		return true
+	case "/pin", "/unpin", "/pins", "/motd":
+		s.TopicCommand(words, sub, msg)
+		return true
+	}
+
 	// Not handled.
 	return false
 }
@@ -108,71 +141,29 @@ func (s *Server) ProcessCommand(sub *Subscriber, msg messages.Message) bool {
 // NSFWCommand handles the `/nsfw` operator command.
 func (s *Server) NSFWCommand(words []string, sub *Subscriber) {
 	if len(words) == 1 {
-		sub.ChatServer("Usage: `/nsfw username` to add the NSFW flag to their camera.")
+		sub.ChatServer(RenderMarkdown("Usage: `/nsfw username` to add the NSFW flag to their camera."))
+		return
 	}
 	username := strings.TrimPrefix(words[1], "@")
-	other, err := s.GetSubscriber(username)
-	if err != nil {
-		sub.ChatServer("/nsfw: username not found: %s", username)
+	if err := s.MarkCameraNSFW(sub.Username, username); err != nil {
+		sub.ChatServer("/nsfw: %s", err)
 	} else {
-		// Sanity check that the target user is presently on a blue camera.
-		if !(other.VideoStatus&messages.VideoFlagActive == messages.VideoFlagActive) {
-			sub.ChatServer("/nsfw: %s's camera was not currently enabled.", username)
-			return
-		} else if other.VideoStatus&messages.VideoFlagNSFW == messages.VideoFlagNSFW {
-			sub.ChatServer("/nsfw: %s's camera was already marked as explicit.", username)
-			return
-		}
-
-		// The message to deliver to the target.
-		var message = "Just a friendly reminder to mark your camera as 'Explicit' by using the button at the top " +
-			"of the page if you are going to be sexual on webcam.<br><br>"
-
-		// If the admin who marked it was previously booted
-		if other.Boots(sub.Username) {
-			message += "Your camera was detected to depict 'Explicit' activity and has been marked for you."
-		} else {
-			message += fmt.Sprintf("Your camera has been marked as Explicit for you by @%s", sub.Username)
-		}
-
-		other.ChatServer(message)
-		other.VideoStatus |= messages.VideoFlagNSFW
-		other.SendMe()
-		s.SendWhoList()
+		auditCommand(sub, words, username)
 		sub.ChatServer("%s now has their camera marked as Explicit", username)
-
-		// Send an admin report to your main website.
-		if err := PostWebhookReport(WebhookRequestReport{
-			FromUsername:  sub.Username,
-			AboutUsername: username,
-			Channel:       "n/a",
-			Timestamp:     time.Now().Format(time.RFC3339),
-			Reason:        "NSFW Command Issued",
-			Message:       fmt.Sprintf("The admin @%s marks the webcam red for user @%s", sub.Username, username),
-			Comment:       "An admin marked their webcam as explicit.",
-		}); err != nil {
-			log.Error("Error delivering a report to your website about the /nsfw command by %s: %s", sub.Username, err)
-		}
 	}
 }
 
 // CutCommand handles the `/cut` operator command (force a user's camera to turn off).
 func (s *Server) CutCommand(words []string, sub *Subscriber) {
 	if len(words) == 1 {
-		sub.ChatServer("Usage: `/cut username` to turn their camera off.")
+		sub.ChatServer(RenderMarkdown("Usage: `/cut username` to turn their camera off."))
+		return
 	}
 	username := strings.TrimPrefix(words[1], "@")
-	other, err := s.GetSubscriber(username)
-	if err != nil {
-		sub.ChatServer("/cut: username not found: %s", username)
+	if err := s.CutCamera(sub.Username, username); err != nil {
+		sub.ChatServer("/cut: %s", err)
 	} else {
-		// Sanity check that the target user is presently on a blue camera.
-		if !(other.VideoStatus&messages.VideoFlagActive == messages.VideoFlagActive) {
-			sub.ChatServer("/cut: %s's camera was not currently enabled.", username)
-			return
-		}
-
-		other.SendCut()
+		auditCommand(sub, words, username)
 		sub.ChatServer("%s has been told to turn off their camera.", username)
 	}
 }
@@ -190,7 +181,7 @@ func (s *Server) UnmuteAllCommand(words []string, sub *Subscriber) {
 	sub.muted = map[string]struct{}{}
 	sub.unblockable = true
 	sub.ChatServer("Your mute on %d users has been lifted.", count)
-	s.SendWhoList()
+	s.SendWhoListChanges(sub.Username)
 }
 
 // KickCommand handles the `/kick` operator command.
@@ -202,26 +193,11 @@ func (s *Server) KickCommand(words []string, sub *Subscriber) {
 		return
 	}
 	username := strings.TrimPrefix(words[1], "@")
-	other, err := s.GetSubscriber(username)
-	if err != nil {
-		sub.ChatServer("/kick: username not found: %s", username)
-	} else if other.Username == sub.Username {
-		sub.ChatServer("/kick: did you really mean to kick yourself?")
+	if err := s.KickUser(sub.Username, username); err != nil {
+		sub.ChatServer("/kick: %s", err)
 	} else {
-		other.ChatServer("You have been kicked from the chat room by %s", sub.Username)
-		other.SendJSON(messages.Message{
-			Action: messages.ActionKick,
-		})
-		other.authenticated = false
-		other.Username = ""
+		auditCommand(sub, words, username)
 		sub.ChatServer("%s has been kicked from the room", username)
-
-		// Broadcast it to everyone.
-		s.Broadcast(messages.Message{
-			Action:   messages.ActionPresence,
-			Username: username,
-			Message:  messages.PresenceKicked,
-		})
 	}
 }
 
@@ -270,8 +246,10 @@ func (s *Server) KickAllCommand() {
 func (s *Server) BanCommand(words []string, sub *Subscriber) {
 	if len(words) == 1 {
 		sub.ChatServer(RenderMarkdown(
-			"Usage: `/ban username` to remove the user from the chat room for 24 hours (default).\n\n" +
-				"Set another duration (in hours) like: `/ban username 2` for a 2-hour ban.",
+			"Usage: `/ban username [duration] [reason]` to remove the user from the chat room for 24 hours (default).\n\n" +
+				"Set another duration like: `/ban username 30m`, `/ban username 7d` or `/ban username perm` for a permanent ban. " +
+				"A bare number is a count of hours, e.g. `/ban username 2` for a 2-hour ban.\n\n" +
+				"Any words after the duration are recorded as the reason, e.g. `/ban username 7d spamming the lobby`",
 		))
 		return
 	}
@@ -280,35 +258,25 @@ func (s *Server) BanCommand(words []string, sub *Subscriber) {
 	var (
 		username = strings.TrimPrefix(words[1], "@")
 		duration = 24 * time.Hour
+		reason   []string
 	)
 	if len(words) >= 3 {
-		if dur, err := strconv.Atoi(words[2]); err == nil {
-			duration = time.Duration(dur) * time.Hour
+		if dur, err := ParseBanDuration(words[2]); err == nil {
+			duration = dur
+			reason = words[3:]
+		} else {
+			// Not a duration: the default applies and the rest is the reason.
+			reason = words[2:]
 		}
 	}
 
-	log.Info("Operator %s bans %s for %d hours", sub.Username, username, duration/time.Hour)
-
-	// Add them to the ban list.
-	BanUser(username, duration)
-
-	// If the target user is currently online, disconnect them and broadcast the ban to everybody.
-	if other, err := s.GetSubscriber(username); err == nil {
-		s.Broadcast(messages.Message{
-			Action:   messages.ActionPresence,
-			Username: username,
-			Message:  messages.PresenceBanned,
-		})
-
-		other.ChatServer("You have been banned from the chat room by %s. You may come back after %d hours.", sub.Username, duration/time.Hour)
-		other.SendJSON(messages.Message{
-			Action: messages.ActionKick,
-		})
-		other.authenticated = false
-		other.Username = ""
+	if _, err := s.BanAndDisconnect(sub.Username, username, duration, strings.Join(reason, " ")); err != nil {
+		sub.ChatServer("/ban: %s", err)
+		return
 	}
+	auditCommand(sub, words, username)
 
-	sub.ChatServer("%s has been banned from the room for %d hours.", username, duration/time.Hour)
+	sub.ChatServer("%s has been banned from the room %s.", username, FormatBanDuration(duration))
 }
 
 // UnbanCommand handles the `/unban` operator command.
@@ -324,15 +292,104 @@ func (s *Server) UnbanCommand(words []string, sub *Subscriber) {
 	var username = strings.TrimPrefix(words[1], "@")
 
 	if UnbanUser(username) {
+		auditCommand(sub, words, username)
 		sub.ChatServer("The ban on %s has been lifted.", username)
 	} else {
 		sub.ChatServer("/unban: user %s was not found to be banned. Try `/bans` to see current banned users.", username)
 	}
 }
 
+// BanIPCommand handles the `/banip` operator command.
+func (s *Server) BanIPCommand(words []string, sub *Subscriber) {
+	if len(words) == 1 {
+		sub.ChatServer(RenderMarkdown(
+			"Usage: `/banip <ip or cidr> [duration] [reason]` to ban an IP address or a range of addresses in CIDR notation.\n\n" +
+				"IPv6 addresses are banned by their network prefix (e.g. the whole /64). The ban is permanent by default: " +
+				"set a duration like `/banip 203.0.113.7 7d spam bot`.",
+		))
+		return
+	}
+
+	// Parse the command.
+	var (
+		addr     = words[1]
+		duration time.Duration
+		reason   []string
+	)
+	if len(words) >= 3 {
+		if dur, err := ParseBanDuration(words[2]); err == nil {
+			duration = dur
+			reason = words[3:]
+		} else {
+			reason = words[2:]
+		}
+	}
+
+	var ban = models.Ban{
+		Kind:     banKindForAddress(addr),
+		Value:    addr,
+		Reason:   strings.Join(reason, " "),
+		Operator: sub.Username,
+	}
+	if duration > 0 {
+		ban.ExpiresAt = time.Now().Add(duration)
+	}
+
+	ban, err := AddBan(ban)
+	if err != nil {
+		sub.ChatServer("/banip: could not ban %s: %s", addr, err)
+		return
+	}
+
+	log.Info("Operator %s bans IP %s %s", sub.Username, ban.Value, FormatBanDuration(duration))
+	auditCommand(sub, words, ban.Value)
+
+	// Disconnect anybody currently online from the banned addresses.
+	var kicked = []string{}
+	for _, other := range s.IterSubscribers() {
+		if other == sub || !BanCoversIP(ban, other.IP) {
+			continue
+		}
+		if other.authenticated && other.Username != "" {
+			kicked = append(kicked, other.Username)
+			other.ChatServer("You have been banned from the chat room by %s %s.", sub.Username, FormatBanDuration(duration))
+		}
+		s.Disconnect(other, messages.PresenceBanned)
+	}
+
+	sub.ChatServer("%s has been banned %s.", ban.Value, FormatBanDuration(duration))
+	if len(kicked) > 0 {
+		sub.ChatServer("These users were online from that address and have been removed: %s", strings.Join(kicked, ", "))
+	}
+}
+
+// UnbanIPCommand handles the `/unbanip` operator command.
+func (s *Server) UnbanIPCommand(words []string, sub *Subscriber) {
+	if len(words) == 1 {
+		sub.ChatServer(RenderMarkdown(
+			"Usage: `/unbanip <ip or cidr>` to lift the ban on an IP address or range.",
+		))
+		return
+	}
+
+	count, err := LiftBans(banKindForAddress(words[1]), words[1])
+	if err != nil {
+		sub.ChatServer("/unbanip: %s", err)
+	} else if count == 0 {
+		sub.ChatServer("/unbanip: %s was not found to be banned. Try `/bans` to see current bans.", words[1])
+	} else {
+		auditCommand(sub, words, words[1])
+		sub.ChatServer("The ban on %s has been lifted.", words[1])
+	}
+}
+
 // BansCommand handles the `/bans` operator command.
 func (s *Server) BansCommand(words []string, sub *Subscriber) {
 	result := StringifyBannedUsers()
+	if result == "" {
+		sub.ChatServer("There are no banned users at this time.")
+		return
+	}
 	sub.ChatServer(
 		RenderMarkdown("The listing of banned users currently includes:\n\n" + result),
 	)
@@ -346,35 +403,34 @@ func (s *Server) ReconfigureCommand(sub *Subscriber) {
 		return
 	}
 
+	auditCommand(sub, []string{"/reconfigure"}, "")
 	sub.ChatServer("The server config file has been reloaded successfully!")
 }
 
 // OpCommand handles the `/op` operator command.
+//
+// The operator role is saved to the database so it will be given again the next time
+// the user logs in.
 func (s *Server) OpCommand(words []string, sub *Subscriber) {
 	if len(words) == 1 {
 		sub.ChatServer(RenderMarkdown(
-			"Usage: `/op username` to grant temporary operator rights to a user.",
+			"Usage: `/op username` to grant operator rights to a user.",
 		))
 		return
 	}
 
 	// Parse the command.
 	var username = strings.TrimPrefix(words[1], "@")
-	if other, err := s.GetSubscriber(username); err != nil {
-		sub.ChatServer("/op: user %s was not found.", username)
-	} else {
-		if other.JWTClaims == nil {
-			other.JWTClaims = &ourjwt.Claims{
-				RegisteredClaims: jwt.RegisteredClaims{
-					Subject: username,
-				},
-			}
-		}
-		other.JWTClaims.IsAdmin = true
-
-		// Send everyone the Who List.
-		s.SendWhoList()
+	online, err := s.SetOperatorRights(sub.Username, username, true)
+	if err != nil {
+		sub.ChatServer("/op: %s", err)
+		return
+	}
 
+	auditCommand(sub, words, username)
+	if !online {
+		sub.ChatServer("Operator rights have been granted to %s, and will take effect the next time they log in.", username)
+	} else {
 		sub.ChatServer("Operator rights have been granted to %s", username)
 	}
 }
@@ -390,21 +446,16 @@ func (s *Server) DeopCommand(words []string, sub *Subscriber) {
 
 	// Parse the command.
 	var username = strings.TrimPrefix(words[1], "@")
-	if other, err := s.GetSubscriber(username); err != nil {
-		sub.ChatServer("/deop: user %s was not found.", username)
-	} else {
-		if other.JWTClaims == nil {
-			other.JWTClaims = &ourjwt.Claims{
-				RegisteredClaims: jwt.RegisteredClaims{
-					Subject: username,
-				},
-			}
-		}
-		other.JWTClaims.IsAdmin = false
-
-		// Send everyone the Who List.
-		s.SendWhoList()
+	online, err := s.SetOperatorRights(sub.Username, username, false)
+	if err != nil {
+		sub.ChatServer("/deop: %s", err)
+		return
+	}
 
+	auditCommand(sub, words, username)
+	if !online {
+		sub.ChatServer("Operator rights have been taken from %s, and will take effect the next time they log in.", username)
+	} else {
 		sub.ChatServer("Operator rights have been taken from %s", username)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"html/template"
 	"os"
+	"strings"
 
 	"git.kirsle.net/apps/barertc/pkg/log"
 	"github.com/google/uuid"
@@ -12,7 +13,7 @@ import (
 
 // Version of the config format - when new fields are added, it will attempt
 // to write the settings.toml to disk so new defaults populate.
-var currentVersion = 16
+var currentVersion = 27
 
 // Config for your BareRTC app.
 type Config struct {
@@ -35,25 +36,41 @@ type Config struct {
 	BlockableAdmins bool
 
 	UseXForwardedFor bool
+	TrustedProxies   []string `toml:"" comment:"With UseXForwardedFor: the IP addresses or CIDR ranges of your reverse proxies.\nProxy headers are only trusted from these addresses (all addresses, if the list is empty)."`
+
+	IPv6BanPrefixLength int `toml:"" comment:"IPv6 addresses are banned by their network prefix (e.g. 64 for the whole /64),\nas one device may rotate through many addresses in its range. Set 128 to ban exact addresses."`
+
+	LoginThrottle LoginThrottle `toml:"" comment:"Brute-force protection for the login, register and authenticate API endpoints."`
+
+	FloodControl FloodControl `toml:"" comment:"Rate limits on how fast users may post messages, share pictures, react and update their status.\nEach is a token bucket: a user may do Burst actions at once, refilled at PerMinute.\nRepeat offenders are warned, then muted for MuteSeconds, then kicked."`
 
 	WebSocketReadLimit   int64
 	WebSocketSendTimeout int
+	WebSocketCompression bool `toml:"" comment:"Compress the WebSocket messages (permessage-deflate) for the clients that support it."`
 	MaxImageWidth        int
 	PreviewImageWidth    int
 
+	ResumeGracePeriod int `toml:"" comment:"How many seconds a user whose WebSocket dropped (e.g. a phone switching networks) keeps their place in\nthe chat, so they can reconnect and get the messages they missed. Set to 0 to disable."`
+
 	TURN TurnConfig `toml:"" comment:"Configure your TURN or STUN servers here.\n\nSTUN servers help WebRTC clients connect peer-to-peer for video, which is\npreferable as it saves on your bandwidth. You should list at least one, and\nthere are many public servers available such as Google's.\n\nTURN servers help WebRTC clients connect when a direct connection isn't\npossible. An open source server called 'coturn' can do both STUN and TURN."`
 
 	PublicChannels []Channel `toml:"" comment:"Your pre-defined common public chat rooms.\n"`
 
+	UserChannels UserChannels `toml:"" comment:"Chat rooms that users create at runtime with the /create command, e.g. for an event.\nThey may be private, invite-only or password-protected, and are kept in the SQLite database."`
+
 	WebhookURLs []WebhookURL
 
 	VIP VIP
 
+	Roles Roles `toml:"" comment:"Operator and VIP roles for accounts which log in to the chat server. Roles granted\nby the /op command are kept in the database, but the Operators listed here can not be /deop'd."`
+
 	MessageFilters []*MessageFilter
 	ModerationRule []*ModerationRule
 
 	DirectMessageHistory DirectMessageHistory
 
+	ChannelHistory ChannelHistory `toml:"" comment:"Keep the history of the public channels in the SQLite database (the one of the DirectMessageHistory),\nso users can scroll back and recent messages are echoed to new joiners after a reboot."`
+
 	Strings Strings
 
 	Logging Logging
@@ -72,11 +89,91 @@ type VIP struct {
 	MutuallySecret bool
 }
 
+// LoginThrottle configures the rate limits on the authentication endpoints.
+type LoginThrottle struct {
+	Enabled                bool
+	WindowSeconds          int     // sliding window in which failed attempts are counted
+	MaxFailuresPerIP       int     // failed attempts from one IP address before it is locked out
+	MaxFailuresPerUsername int     // failed attempts on one username before it is locked out
+	MaxRegistrationsPerIP  int     // accounts one IP address may register in the window (0 = no limit)
+	LockoutSeconds         int     // length of the first lockout
+	LockoutBackoff         float64 // each repeated lockout (within a day) is this many times longer
+	MaxLockoutSeconds      int     // upper limit on the lockout length
+	BanAfterLockouts       int     // ban an IP address after this many lockouts within a day (0 = never)
+	BanDuration            string  // e.g. "24h", "7d" or "perm"
+}
+
+// FloodControl configures the rate limits on chat actions.
+type FloodControl struct {
+	Enabled         bool
+	Message         RateLimit // chat messages
+	File            RateLimit // pictures shared in chat
+	React           RateLimit // emoji reactions
+	Me              RateLimit // status and webcam updates
+	WindowSeconds   int       // window in which rate limit violations are counted
+	MuteAfter       int       // violations before the user is muted (0 = never)
+	MuteSeconds     int       // length of the mute
+	KickAfter       int       // violations before the user is kicked (0 = never)
+	ExemptOperators bool
+	ExemptVIPs      bool
+}
+
+// UserChannels configures the chat rooms that users create with the /create command.
+type UserChannels struct {
+	Enabled       bool
+	OperatorsOnly bool // only operators may create channels
+	MaxPerUser    int  // channels one user may own (0 = no limit); operators have no limit
+	PermitPhotos  bool // photos may be shared in created channels
+}
+
+// RateLimit is a token bucket: Burst actions at once, refilled at PerMinute.
+// A zero PerMinute is no limit.
+type RateLimit struct {
+	PerMinute float64
+	Burst     int
+}
+
+// Roles lists the usernames that have operator or VIP status in chat.
+type Roles struct {
+	Operators []string
+	VIPs      []string
+}
+
+// IsOperator checks whether the username is one of the configured Operators.
+func (r Roles) IsOperator(username string) bool {
+	return containsUsername(r.Operators, username)
+}
+
+// IsVIP checks whether the username is one of the configured VIPs.
+func (r Roles) IsVIP(username string) bool {
+	return containsUsername(r.VIPs, username)
+}
+
+func containsUsername(list []string, username string) bool {
+	for _, name := range list {
+		if strings.EqualFold(strings.TrimPrefix(name, "@"), username) {
+			return true
+		}
+	}
+	return false
+}
+
 type DirectMessageHistory struct {
 	Enabled           bool
 	SQLiteDatabase    string
 	RetentionDays     int
 	DisclaimerMessage string
+
+	// Store-and-forward of DMs to offline users (needs the DM history).
+	OfflineDelivery  bool
+	MailboxQuota     int // pending DMs per recipient, 0 = no limit
+	MailboxPerSender int // pending DMs per recipient from one sender, 0 = no limit
+}
+
+// ChannelHistory configures the stored history of the public channels.
+type ChannelHistory struct {
+	Enabled       bool
+	RetentionDays int // 0 = keep forever
 }
 
 // GetChannels returns a JavaScript safe array of the default PublicChannels.
@@ -107,6 +204,12 @@ type Channel struct {
 	WelcomeMessages []string
 
 	EchoMessagesOnJoin int
+
+	// Flood control: seconds a user must wait between messages (slow mode), and
+	// overrides of the FloodControl rate limits in this channel.
+	SlowModeSeconds int        `toml:",omitempty"`
+	MessageRate     *RateLimit `toml:",omitempty"`
+	FileRate        *RateLimit `toml:",omitempty"`
 }
 
 // WebhookURL allows tighter integration with your website.
@@ -158,8 +261,36 @@ func DefaultConfig() Config {
 		},
 		WebSocketReadLimit:   1024 * 1024 * 40, // 40 MB.
 		WebSocketSendTimeout: 10,               // seconds
+		WebSocketCompression: true,
 		MaxImageWidth:        1280,
 		PreviewImageWidth:    360,
+		ResumeGracePeriod:    60,
+		IPv6BanPrefixLength:  64,
+		LoginThrottle: LoginThrottle{
+			Enabled:                true,
+			WindowSeconds:          300,
+			MaxFailuresPerIP:       20,
+			MaxFailuresPerUsername: 5,
+			MaxRegistrationsPerIP:  3,
+			LockoutSeconds:         60,
+			LockoutBackoff:         2,
+			MaxLockoutSeconds:      3600,
+			BanAfterLockouts:       5,
+			BanDuration:            "24h",
+		},
+		FloodControl: FloodControl{
+			Enabled:         true,
+			Message:         RateLimit{PerMinute: 30, Burst: 10},
+			File:            RateLimit{PerMinute: 6, Burst: 3},
+			React:           RateLimit{PerMinute: 60, Burst: 20},
+			Me:              RateLimit{PerMinute: 30, Burst: 10},
+			WindowSeconds:   120,
+			MuteAfter:       5,
+			MuteSeconds:     60,
+			KickAfter:       10,
+			ExemptOperators: true,
+			ExemptVIPs:      true,
+		},
 		PublicChannels: []Channel{
 			{
 				ID:   "lobby",
@@ -188,6 +319,10 @@ func DefaultConfig() Config {
 				},
 			},
 		},
+		UserChannels: UserChannels{
+			Enabled:    true,
+			MaxPerUser: 3,
+		},
 		TURN: TurnConfig{
 			URLs: []string{
 				"stun:stun.cloudflare.com:3478",
@@ -208,7 +343,12 @@ func DefaultConfig() Config {
 			Branding: "<em>VIP Members</em>",
 			Icon:     "fa fa-circle",
 		},
+		Roles: Roles{
+			Operators: []string{},
+			VIPs:      []string{},
+		},
 		MessageFilters: []*MessageFilter{
+			forbiddenPhrasesFilter(),
 			{
 				PublicChannels:  true,
 				PrivateChannels: true,
@@ -237,6 +377,12 @@ func DefaultConfig() Config {
 			SQLiteDatabase:    "database.sqlite",
 			RetentionDays:     90,
 			DisclaimerMessage: `<i class="fa fa-info-circle mr-1"></i> <strong>Reminder:</strong> please conduct yourself honorably in Direct Messages.`,
+			OfflineDelivery:   false,
+			MailboxQuota:      100,
+			MailboxPerSender:  20,
+		},
+		ChannelHistory: ChannelHistory{
+			RetentionDays: 30,
 		},
 		Logging: Logging{
 			Directory: "./logs",
@@ -267,6 +413,12 @@ func LoadSettings() error {
 
 	// Have we added new config fields? Save the settings.toml.
 	if Current.Version != currentVersion {
+		// Version 20 moved the forbidden phrases that were hardcoded in the chat server
+		// into the MessageFilters.
+		if Current.Version < 20 {
+			Current.MessageFilters = append([]*MessageFilter{forbiddenPhrasesFilter()}, Current.MessageFilters...)
+		}
+
 		log.Warn("New options are available for your settings.toml file. Your settings will be re-saved now.")
 		Current.Version = currentVersion
 		if err := WriteSettings(); err != nil {
@@ -288,6 +440,24 @@ func WriteSettings() error {
 	return os.WriteFile("./settings.toml", buf, 0644)
 }
 
+// forbiddenPhrasesFilter is the message filter which kicks users for advertising other
+// chat sites.
+func forbiddenPhrasesFilter() *MessageFilter {
+	return &MessageFilter{
+		Enabled:         true,
+		PublicChannels:  true,
+		PrivateChannels: true,
+		KeywordPhrases: []string{
+			`elchatea`,
+			`el chatea`,
+			`corito`,
+			`alborada`,
+		},
+		ChatServerResponse: "Mensaje no permitido.",
+		KickUser:           true,
+	}
+}
+
 // GetModerationRule returns a matching ModerationRule for the given user, or nil if no rule is found.
 func (c Config) GetModerationRule(username string) *ModerationRule {
 	for _, rule := range c.ModerationRule {
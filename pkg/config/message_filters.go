@@ -18,12 +18,24 @@ type MessageFilter struct {
 	ReportMessage      bool
 	ChatServerResponse string
 
+	// Remove the user from the chat room: kick them, ban their username and/or ban
+	// their IP address. Bans last for the BanDuration (e.g. "24h", "7d" or "perm").
+	KickUser    bool
+	BanUser     bool
+	BanIP       bool
+	BanDuration string
+
 	// Private use variables.
 	isRegexpCompiled bool
 	regexps          []*regexp.Regexp
 	regexpMu         sync.Mutex
 }
 
+// RemovesUser returns whether the filter kicks or bans the sender of a matching message.
+func (mf *MessageFilter) RemovesUser() bool {
+	return mf.KickUser || mf.BanUser || mf.BanIP
+}
+
 // IterPhrases returns the keyword phrases as regular expressions.
 func (mf *MessageFilter) IterPhrases() []*regexp.Regexp {
 	if mf.isRegexpCompiled {
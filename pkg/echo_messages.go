@@ -7,6 +7,7 @@ import (
 	"git.kirsle.net/apps/barertc/pkg/config"
 	"git.kirsle.net/apps/barertc/pkg/log"
 	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
 )
 
 // Functionality for storing recent public channel messages and echo them to new joiners.
@@ -16,7 +17,16 @@ Echo Messages On Join
 
 This feature stores recent public messages to channels (in memory) to echo them
 back to new users when they join the room.
+
+A few more messages than are echoed are kept for each channel, so that operators
+can read the recent context of a channel from the admin console and pin recent
+messages. The created channels keep this context too, but do not echo it.
+
+With the ChannelHistory setting, the public channel messages are also stored in the
+database, and the echo buffers are filled from it again when the server starts.
 */
+const ChannelContextSize = 50
+
 var (
 	echoMessages = map[string][]messages.Message{} // map channel ID -> messages
 	echoLock     sync.RWMutex
@@ -24,24 +34,41 @@ var (
 
 // SendEchoedMessages will repeat recent public messages in public channels to the newly
 // connecting subscriber as echoed messages.
+//
+// Only the channels the subscriber is in are echoed.
 func (sub *Subscriber) SendEchoedMessages() {
+	sub.sendEchoes(sub.InChannel)
+}
+
+// SendChannelEchoes repeats the recent public messages of one channel to the
+// subscriber, e.g. when they /join it.
+func (sub *Subscriber) SendChannelEchoes(channel string) {
+	sub.sendEchoes(func(ch string) bool {
+		return ch == channel
+	})
+}
+
+// sendEchoes sends the recent messages of the channels that match the filter.
+func (sub *Subscriber) sendEchoes(filter func(channel string) bool) {
 	var echoes []messages.Message
 
 	// Gather the subscriber's block list, so we don't echo users who are on it.
-	var blocks = map[string]interface{}{}
-	sub.muteMu.RLock()
-	for username := range sub.blocked {
-		blocks[username] = nil
-	}
-	for username := range sub.muted {
-		blocks[username] = nil
-	}
-	sub.muteMu.RUnlock()
+	var blocks = sub.blockedOrMuted()
 
 	// Read lock to collect the messages.
 	echoLock.RLock()
 
-	for _, msgs := range echoMessages {
+	for channel, msgs := range echoMessages {
+		if !filter(channel) {
+			continue
+		}
+
+		// Only echo the most recent messages, as configured for the channel.
+		ch, _ := config.Current.GetChannel(channel)
+		if ln := len(msgs); ln > ch.EchoMessagesOnJoin {
+			msgs = msgs[ln-ch.EchoMessagesOnJoin:]
+		}
+
 		for _, msg := range msgs {
 			if _, ok := blocks[msg.Username]; ok {
 				continue
@@ -53,6 +80,9 @@ func (sub *Subscriber) SendEchoedMessages() {
 	// Release the lock.
 	echoLock.RUnlock()
 
+	// With their emoji reactions so far.
+	attachEchoReactions(echoes)
+
 	// Send all of these in one Echo message.
 	sub.SendJSON(messages.Message{
 		Action:   messages.ActionEcho,
@@ -60,6 +90,21 @@ func (sub *Subscriber) SendEchoedMessages() {
 	})
 }
 
+// blockedOrMuted returns the usernames the subscriber has blocked or muted, whose
+// past messages should not be shown to them.
+func (sub *Subscriber) blockedOrMuted() map[string]struct{} {
+	var result = map[string]struct{}{}
+	sub.muteMu.RLock()
+	for username := range sub.blocked {
+		result[username] = struct{}{}
+	}
+	for username := range sub.muted {
+		result[username] = struct{}{}
+	}
+	sub.muteMu.RUnlock()
+	return result
+}
+
 // EchoPushPublicMessage pushes a message into the recent message history of the channel ID.
 //
 // The buffer of recent messages (the size configured in settings.toml) is echoed to
@@ -69,7 +114,9 @@ func (s *Server) EchoPushPublicMessage(sub *Subscriber, channel string, msg mess
 	// Get the channel from settings to see its capacity.
 	ch, ok := config.Current.GetChannel(channel)
 	if !ok {
-		return
+		if _, ok := LookupUserChannel(channel); !ok {
+			return
+		}
 	}
 
 	echoLock.Lock()
@@ -84,12 +131,26 @@ func (s *Server) EchoPushPublicMessage(sub *Subscriber, channel string, msg mess
 	msg.Timestamp = time.Now().Format(time.RFC3339)
 	echoMessages[channel] = append(echoMessages[channel], msg)
 
-	// Trim the history to the configured window size.
-	if ln := len(echoMessages[channel]); ln > ch.EchoMessagesOnJoin {
-		echoMessages[channel] = echoMessages[channel][ln-ch.EchoMessagesOnJoin:]
+	// Trim the history to the configured window size (or the admin console's, if larger).
+	var size = ch.EchoMessagesOnJoin
+	if size < ChannelContextSize {
+		size = ChannelContextSize
+	}
+	if ln := len(echoMessages[channel]); ln > size {
+		echoMessages[channel] = echoMessages[channel][ln-size:]
 	}
 }
 
+// RecentChannelMessages returns a copy of the recent public messages of a channel, oldest first.
+func RecentChannelMessages(channel string) []messages.Message {
+	echoLock.RLock()
+	defer echoLock.RUnlock()
+
+	var result = make([]messages.Message, len(echoMessages[channel]))
+	copy(result, echoMessages[channel])
+	return result
+}
+
 // EchoTakebackMessage will remove any taken-back message that was cached
 // in the echo buffer for new joiners.
 func (s *Server) EchoTakebackMessage(msgID int64) {
@@ -100,14 +161,74 @@ func (s *Server) EchoTakebackMessage(msgID int64) {
 	defer echoLock.Unlock()
 
 	// Find matching messages in each channel.
-	for _, ch := range config.Current.PublicChannels {
-		for i, msg := range echoMessages[ch.ID] {
+	for channel, msgs := range echoMessages {
+		for i, msg := range msgs {
 			if msg.MessageID == msgID {
-				log.Error("EchoTakebackMessage: message ID %d removed from channel %s", msgID, ch.ID)
+				log.Error("EchoTakebackMessage: message ID %d removed from channel %s", msgID, channel)
 
 				// Remove this message.
-				echoMessages[ch.ID] = append(echoMessages[ch.ID][:i], echoMessages[ch.ID][i+1:]...)
+				echoMessages[channel] = append(msgs[:i], msgs[i+1:]...)
+				break
 			}
 		}
 	}
 }
+
+// EchoEditMessage updates an edited message in the echo buffer of its channel, and
+// returns its prior text if it was found.
+func (s *Server) EchoEditMessage(channel string, msgID int64, message string) (string, bool) {
+	echoLock.Lock()
+	defer echoLock.Unlock()
+
+	for i, msg := range echoMessages[channel] {
+		if msg.MessageID == msgID {
+			echoMessages[channel][i].Message = message
+			echoMessages[channel][i].Edited = true
+			return msg.Message, true
+		}
+	}
+	return "", false
+}
+
+// RehydrateEchoMessages fills the echo buffers of the public channels from the stored
+// channel history, so that new joiners still see the recent messages after a reboot.
+func RehydrateEchoMessages() error {
+	if !models.ChannelHistoryEnabled() {
+		return nil
+	}
+
+	var loaded = map[string][]messages.Message{}
+	for _, ch := range config.Current.PublicChannels {
+		var size = ch.EchoMessagesOnJoin
+		if size < ChannelContextSize {
+			size = ChannelContextSize
+		}
+
+		// The page is newest first: reverse it.
+		page, _, err := models.PaginateChannelMessages(ch.ID, 0, size)
+		if err != nil {
+			return err
+		}
+		var msgs = make([]messages.Message, 0, len(page))
+		for i := len(page) - 1; i >= 0; i-- {
+			msgs = append(msgs, page[i])
+		}
+		loaded[ch.ID] = msgs
+	}
+
+	echoLock.Lock()
+	defer echoLock.Unlock()
+	for channel, msgs := range loaded {
+		if len(msgs) > 0 {
+			echoMessages[channel] = msgs
+		}
+	}
+	return nil
+}
+
+// ClearEchoMessages forgets the recent messages of a channel, e.g. when it is closed.
+func ClearEchoMessages(channel string) {
+	echoLock.Lock()
+	defer echoLock.Unlock()
+	delete(echoMessages, channel)
+}
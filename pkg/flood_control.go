@@ -0,0 +1,298 @@
+package barertc
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+/*
+Flood control: rate limits on how fast a user can post messages, share pictures,
+react to messages and update their status, and the slow mode of public channels.
+
+The limits are checked in OnClientMessage so they apply the same to WebSocket and
+polling users. Each user has a token bucket per action type (and per channel, for
+messages and pictures in the channels they are in); when a bucket runs dry the action
+is dropped and counts as a violation. Repeat offenders are warned, then muted for a while, then kicked.
+*/
+
+// floodState is the flood control state of one subscriber.
+type floodState struct {
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket // by action type and channel
+	lastPost   map[string]time.Time    // last message in each channel, for slow mode
+	violations []time.Time
+	mutedUntil time.Time
+}
+
+// tokenBucket is a rate limiter which holds up to Burst tokens, refilled at PerMinute.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take tries to take a token from the bucket.
+func (b *tokenBucket) take(limit config.RateLimit, now time.Time) bool {
+	var burst = math.Max(float64(limit.Burst), 1)
+
+	// Refill the tokens since the last update.
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Minutes()*limit.PerMinute)
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Runtime slow mode settings from the /slowmode command, which override the channel
+// config until the server restarts.
+var (
+	slowModes   = map[string]int{}
+	slowModesMu sync.RWMutex
+)
+
+// SlowModeSeconds returns the slow mode of a public channel (0 = off).
+func SlowModeSeconds(channel string) int {
+	slowModesMu.RLock()
+	seconds, ok := slowModes[channel]
+	slowModesMu.RUnlock()
+	if ok {
+		return seconds
+	}
+
+	if ch, ok := config.Current.GetChannel(channel); ok {
+		return ch.SlowModeSeconds
+	}
+	return 0
+}
+
+// SetSlowMode sets the slow mode of a public channel (0 = off).
+func SetSlowMode(channel string, seconds int) {
+	slowModesMu.Lock()
+	defer slowModesMu.Unlock()
+	slowModes[channel] = seconds
+}
+
+// floodExempt checks whether a subscriber is exempt from flood control.
+func floodExempt(sub *Subscriber) bool {
+	var settings = config.Current.FloodControl
+	return (settings.ExemptOperators && sub.IsAdmin()) || (settings.ExemptVIPs && sub.IsVIP())
+}
+
+// floodRateLimit returns the rate limit and bucket name for a chat action, or false
+// if the action is not rate limited.
+//
+// The channel comes from the client and is not yet validated, so only the public channels
+// and those the subscriber is in get a bucket of their own: any other channel name shares
+// one bucket, so that a client can't grow the map of buckets without bound.
+func floodRateLimit(sub *Subscriber, msg messages.Message) (config.RateLimit, string, bool) {
+	var settings = config.Current.FloodControl
+
+	switch msg.Action {
+	case messages.ActionMessage, messages.ActionFile:
+		var limit = settings.Message
+		if msg.Action == messages.ActionFile {
+			limit = settings.File
+		}
+
+		// Direct messages share one bucket; public channels may override the limits.
+		var channel = msg.Channel
+		if strings.HasPrefix(channel, "@") {
+			channel = "@"
+		} else if ch, ok := config.Current.GetChannel(channel); ok {
+			if msg.Action == messages.ActionMessage && ch.MessageRate != nil {
+				limit = *ch.MessageRate
+			} else if msg.Action == messages.ActionFile && ch.FileRate != nil {
+				limit = *ch.FileRate
+			}
+		} else if !sub.InChannel(channel) {
+			channel = "*"
+		}
+		return limit, msg.Action + ":" + channel, true
+	case messages.ActionEdit:
+		return settings.Message, msg.Action, true
+	case messages.ActionReact, messages.ActionUnreact:
+		return settings.React, messages.ActionReact, true
+	case messages.ActionMe:
+		return settings.Me, msg.Action, true
+	}
+
+	return config.RateLimit{}, "", false
+}
+
+// checkFloodControl checks a chat action against the flood control limits, and
+// returns whether the action may go ahead.
+//
+// When the action is rejected, the subscriber has already been told why (or kicked).
+func (s *Server) checkFloodControl(sub *Subscriber, msg messages.Message) bool {
+	if !config.Current.FloodControl.Enabled || !sub.authenticated || floodExempt(sub) {
+		return true
+	}
+
+	limit, bucket, ok := floodRateLimit(sub, msg)
+	if !ok {
+		return true
+	}
+
+	var (
+		state = &sub.flood
+		now   = time.Now()
+	)
+	state.mu.Lock()
+	if state.buckets == nil {
+		state.buckets = map[string]*tokenBucket{}
+		state.lastPost = map[string]time.Time{}
+	}
+
+	// Muted for flooding?
+	if now.Before(state.mutedUntil) {
+		var remaining = state.mutedUntil.Sub(now)
+		state.mu.Unlock()
+		s.floodViolation(sub, msg, fmt.Sprintf(
+			"You are muted for flooding the chat: please wait %s.", remaining.Round(time.Second),
+		))
+		return false
+	}
+
+	// Slow mode in public channels.
+	var slowMode bool
+	if msg.Action == messages.ActionMessage || msg.Action == messages.ActionFile {
+		if seconds := SlowModeSeconds(msg.Channel); seconds > 0 && !strings.HasPrefix(msg.Channel, "@") {
+			var wait = state.lastPost[msg.Channel].Add(time.Duration(seconds) * time.Second).Sub(now)
+			if wait > 0 {
+				state.mu.Unlock()
+				sub.ChatServer("Slow mode is on in #%s: you may post again in %s.", msg.Channel, wait.Round(time.Second))
+				return false
+			}
+			slowMode = true
+		}
+	}
+
+	// The token bucket.
+	if limit.PerMinute > 0 {
+		if _, ok := state.buckets[bucket]; !ok {
+			state.buckets[bucket] = &tokenBucket{}
+		}
+		if !state.buckets[bucket].take(limit, now) {
+			state.mu.Unlock()
+			s.floodViolation(sub, msg, "You are doing that too fast, please slow down.")
+			return false
+		}
+	}
+
+	if slowMode {
+		state.lastPost[msg.Channel] = now
+	}
+	state.mu.Unlock()
+	return true
+}
+
+// floodViolation counts a rate limit violation against a subscriber, and warns, mutes
+// or kicks them.
+func (s *Server) floodViolation(sub *Subscriber, msg messages.Message, warning string) {
+	var (
+		settings = config.Current.FloodControl
+		state    = &sub.flood
+		now      = time.Now()
+		window   = time.Duration(settings.WindowSeconds) * time.Second
+	)
+
+	state.mu.Lock()
+	state.violations = pruneTimes(append(state.violations, now), now.Add(-window))
+	var count = len(state.violations)
+
+	var kick = settings.KickAfter > 0 && count >= settings.KickAfter
+	if !kick && settings.MuteAfter > 0 && count == settings.MuteAfter {
+		state.mutedUntil = now.Add(time.Duration(settings.MuteSeconds) * time.Second)
+		warning = fmt.Sprintf("You have been muted for %d seconds for flooding the chat.", settings.MuteSeconds)
+	}
+	state.mu.Unlock()
+
+	if kick {
+		var username = sub.Username
+		log.Info("FloodControl: %s is kicked after %d violations", username, count)
+		Audit(models.AuditSourceFlood, "ChatServer", "kick", username, fmt.Sprintf("%d violations on %s", count, msg.Action))
+		sub.ChatServer("You have been kicked from the chat room for flooding.")
+		s.Disconnect(sub, messages.PresenceKicked)
+		return
+	}
+
+	sub.ChatServer(warning)
+
+	// A dropped status update: sync the front-end back to what the server has.
+	if msg.Action == messages.ActionMe {
+		sub.SendMe()
+	}
+}
+
+// SlowModeCommand handles the `/slowmode` operator command.
+func (s *Server) SlowModeCommand(words []string, sub *Subscriber) {
+	// With no arguments, list the channels in slow mode.
+	if len(words) == 1 {
+		var lines = []string{}
+		for _, ch := range config.Current.PublicChannels {
+			if seconds := SlowModeSeconds(ch.ID); seconds > 0 {
+				lines = append(lines, fmt.Sprintf("* #%s: %d seconds", ch.ID, seconds))
+			}
+		}
+		sort.Strings(lines)
+
+		var message = "Usage: `/slowmode <channel> <seconds>` to make users wait between messages in a channel, " +
+			"or `/slowmode <channel> off` to turn it off.\n\n"
+		if len(lines) == 0 {
+			message += "No channels are in slow mode."
+		} else {
+			message += "Channels in slow mode:\n\n" + strings.Join(lines, "\n")
+		}
+		sub.ChatServer(RenderMarkdown(message))
+		return
+	} else if len(words) != 3 {
+		sub.ChatServer(RenderMarkdown("Usage: `/slowmode <channel> <seconds>` or `/slowmode <channel> off`"))
+		return
+	}
+
+	var channel = strings.TrimPrefix(words[1], "#")
+	if _, ok := config.Current.GetChannel(channel); !ok {
+		sub.ChatServer("/slowmode: channel not found: %s", channel)
+		return
+	}
+
+	var seconds int
+	if words[2] != "off" {
+		n, err := strconv.Atoi(words[2])
+		if err != nil || n < 0 {
+			sub.ChatServer("/slowmode: the seconds must be a number, or 'off'")
+			return
+		}
+		seconds = n
+	}
+
+	SetSlowMode(channel, seconds)
+	auditCommand(sub, []string{words[0], channel, strconv.Itoa(seconds)}, channel)
+
+	var notice = fmt.Sprintf("Slow mode is now off in #%s.", channel)
+	if seconds > 0 {
+		notice = fmt.Sprintf("Slow mode is now on in #%s: users may post once every %d seconds.", channel, seconds)
+	}
+	s.Broadcast(messages.Message{
+		Action:   messages.ActionError,
+		Channel:  channel,
+		Username: "ChatServer",
+		Message:  notice,
+	})
+}
@@ -0,0 +1,125 @@
+package barertc
+
+import (
+	"fmt"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+func TestFloodControl(t *testing.T) {
+	var saved = config.Current.FloodControl
+	defer func() {
+		config.Current.FloodControl = saved
+	}()
+	config.Current.FloodControl = config.FloodControl{
+		Enabled:         true,
+		Message:         config.RateLimit{PerMinute: 1, Burst: 3},
+		WindowSeconds:   60,
+		MuteAfter:       2,
+		MuteSeconds:     60,
+		KickAfter:       4,
+		ExemptOperators: true,
+	}
+
+	var (
+		s   = NewServer()
+		sub = s.NewPollingSubscriber(nil, func() {})
+		msg = messages.Message{
+			Action:  messages.ActionMessage,
+			Channel: "lobby",
+			Message: "hello",
+		}
+	)
+	logIn(s, sub, "alice", false)
+
+	// The burst goes through, the next message does not.
+	for i := 0; i < 3; i++ {
+		if !s.checkFloodControl(sub, msg) {
+			t.Fatalf("message %d should be allowed", i+1)
+		}
+	}
+	if s.checkFloodControl(sub, msg) {
+		t.Errorf("message 4 should be rate limited")
+	}
+
+	// DMs and other channels have their own buckets.
+	for _, channel := range []string{"@bob", "offtopic"} {
+		msg.Channel = channel
+		if !s.checkFloodControl(sub, msg) {
+			t.Errorf("message in %s should be allowed", channel)
+		}
+	}
+
+	// The second violation mutes them everywhere, and they're kicked on the fourth.
+	msg.Channel = "lobby"
+	s.checkFloodControl(sub, msg)
+	msg.Channel = "@bob"
+	if s.checkFloodControl(sub, msg) {
+		t.Errorf("alice should be muted")
+	}
+	if !sub.authenticated {
+		t.Errorf("alice was kicked too early")
+	}
+	s.checkFloodControl(sub, msg)
+	if sub.authenticated || sub.Username != "" {
+		t.Errorf("alice should have been kicked")
+	}
+
+	// Slow mode.
+	var bob = s.NewPollingSubscriber(nil, func() {})
+	bob.Username = "bob"
+	bob.authenticated = true
+	SetSlowMode("lobby", 30)
+	defer SetSlowMode("lobby", 0)
+	msg.Channel = "lobby"
+	if !s.checkFloodControl(bob, msg) {
+		t.Errorf("bob's first message in slow mode should be allowed")
+	}
+	if s.checkFloodControl(bob, msg) {
+		t.Errorf("bob's second message in slow mode should be rejected")
+	}
+
+	// Operators are exempt.
+	bob.JWTClaims = &jwt.Claims{IsAdmin: true}
+	if !s.checkFloodControl(bob, msg) {
+		t.Errorf("operators should be exempt from slow mode")
+	}
+}
+
+func TestFloodControlUnknownChannels(t *testing.T) {
+	var saved = config.Current.FloodControl
+	defer func() {
+		config.Current.FloodControl = saved
+	}()
+	config.Current.FloodControl = config.FloodControl{
+		Enabled: true,
+		Message: config.RateLimit{PerMinute: 1, Burst: 3},
+	}
+
+	var (
+		s   = NewServer()
+		sub = s.NewPollingSubscriber(nil, func() {})
+	)
+	logIn(s, sub, "alice", false)
+
+	// Made up channel names share one bucket, and don't each get their own.
+	var allowed int
+	for i := 0; i < 20; i++ {
+		if s.checkFloodControl(sub, messages.Message{
+			Action:  messages.ActionMessage,
+			Channel: fmt.Sprintf("nonexistent-%d", i),
+			Message: "hello",
+		}) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("expected 3 messages to unknown channels to be allowed, got %d", allowed)
+	}
+	if len(sub.flood.buckets) != 1 {
+		t.Errorf("expected one bucket for the unknown channels, got %d", len(sub.flood.buckets))
+	}
+}
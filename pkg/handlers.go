@@ -6,7 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
-"nhooyr.io/websocket"
+
 	"git.kirsle.net/apps/barertc/pkg/config"
 	"git.kirsle.net/apps/barertc/pkg/jwt"
 	"git.kirsle.net/apps/barertc/pkg/log"
@@ -15,7 +15,6 @@ import (
 	"git.kirsle.net/apps/barertc/pkg/util"
 )
 
-// OnLogin handles "login" actions from the client.
 // OnLogin handles "login" actions from the client.
 func (s *Server) OnLogin(sub *Subscriber, msg messages.Message) {
 	var claims = &jwt.Claims{}
@@ -36,6 +35,17 @@ func (s *Server) OnLogin(sub *Subscriber, msg messages.Message) {
 		}
 		claims = parsed
 		msg.Username = claims.Subject
+
+		// Tokens from our own login page: the local account may since have been disabled.
+		if claims.Issuer == LoginTokenIssuer {
+			if user, err := models.GetUser(claims.Subject); err == nil && user.Disabled {
+				sub.ChatServer("Your chat account has been disabled.")
+				sub.SendJSON(messages.Message{Action: messages.ActionKick})
+				return
+			}
+		}
+
+		ApplyRoles(claims)
 		sub.JWTClaims = claims
 	}
 
@@ -55,8 +65,18 @@ func (s *Server) OnLogin(sub *Subscriber, msg messages.Message) {
 
 	msg.Username, _ = s.UniqueUsername(msg.Username)
 
-	if IsBanned(msg.Username) {
-		sub.ChatServer("You are currently banned from entering the chat room. Chat room bans are temporarily and usually last for 24 hours. Please try coming back later.")
+	if ban, banned := FindUserBan(msg.Username, claims.Subject); banned {
+		if ban.IsPermanent() {
+			sub.ChatServer("You have been permanently banned from entering the chat room.")
+		} else {
+			sub.ChatServer(
+				"You are currently banned from entering the chat room. Your ban expires on %s, please try coming back later.",
+				ban.ExpiresAt.Format(time.RFC1123),
+			)
+		}
+		if ban.Reason != "" {
+			sub.ChatServer("Reason: %s", ban.Reason)
+		}
 		sub.SendJSON(messages.Message{Action: messages.ActionKick})
 		return
 	}
@@ -64,12 +84,21 @@ func (s *Server) OnLogin(sub *Subscriber, msg messages.Message) {
 	sub.Username = msg.Username
 	sub.authenticated = true
 	sub.DND = msg.DND
+	sub.NoReceipts = msg.NoReceipts
 	sub.loginAt = time.Now()
+	sub.setProtocol(msg.Protocol)
 	log.Debug("OnLogin: %s joins the room", sub.Username)
 
+	// A token to resume their WebSocket connection if it drops.
+	sub.newResumeToken()
+
 	sub.SendMe()
-	s.SendWhoList()
+	sub.SendMOTD()
+	sub.SendChannels()
+	s.JoinChannelsOnLogin(sub)
+	s.SendWhoListChanges(sub.Username)
 	sub.SendEchoedMessages()
+	s.DeliverPendingMessages(sub)
 
 	s.Broadcast(messages.Message{
 		Action:   messages.ActionPresence,
@@ -78,6 +107,9 @@ func (s *Server) OnLogin(sub *Subscriber, msg messages.Message) {
 	})
 
 	for _, channel := range config.Current.PublicChannels {
+		if !sub.InChannel(channel.ID) {
+			continue
+		}
 		for _, msg := range channel.WelcomeMessages {
 			sub.SendJSON(messages.Message{
 				Channel:  channel.ID,
@@ -94,14 +126,6 @@ func (s *Server) OnMessage(sub *Subscriber, msg messages.Message) {
 	if !strings.HasPrefix(msg.Channel, "@") {
 		log.Info("[%s to #%s] %s", sub.Username, msg.Channel, msg.Message)
 	}
-	if strings.Contains(msg.Message, "elchatea") ||
-   strings.Contains(msg.Message, "el chatea") ||
-   strings.Contains(msg.Message, "corito") ||
-   strings.Contains(msg.Message, "alborada") {
-		sub.conn.Close(websocket.StatusPolicyViolation, "Mensaje no permitido")
-		return
-	}
-
 	if sub.Username == "" || !sub.authenticated {
 		sub.ChatServer("You must log in first.")
 		return
@@ -112,6 +136,21 @@ func (s *Server) OnMessage(sub *Subscriber, msg messages.Message) {
 		return
 	}
 
+	// Created channels are only for their members.
+	if !s.checkChannelAccess(sub, msg.Channel) {
+		return
+	}
+
+	// Is it a reply to another message?
+	var quote *messages.Quote
+	if msg.ReplyTo != 0 {
+		var err error
+		if quote, err = s.quoteReply(sub, msg.Channel, msg.ReplyTo); err != nil {
+			sub.ChatServer("Your reply was not sent: %s.", err)
+			return
+		}
+	}
+
 	// Translate their message as Markdown syntax.
 	markdown := RenderMarkdown(msg.Message)
 	if markdown == "" {
@@ -124,7 +163,7 @@ func (s *Server) OnMessage(sub *Subscriber, msg messages.Message) {
 	// Assign a message ID and own it to the sender.
 	sub.midMu.Lock()
 	var mid = messages.NextMessageID()
-	sub.messageIDs[mid] = struct{}{}
+	sub.messageIDs[mid] = msg.Channel
 	sub.midMu.Unlock()
 
 	// Message to be echoed to the channel.
@@ -135,37 +174,14 @@ func (s *Server) OnMessage(sub *Subscriber, msg messages.Message) {
 		Message:   markdown,
 		MessageID: mid,
 	}
+	if quote != nil {
+		message.ReplyTo = quote.MessageID
+		message.Quote = quote
+	}
 
 	// Run message filters.
-	if filter, ok := s.filterMessage(sub, msg, &message); ok {
-		// What do we do with the matched filter?
-
-		// If we will not send this message out, do echo it back to
-		// the sender (possibly with censors applied).
-		if !filter.ForwardMessage {
-			s.SendTo(sub.Username, message)
-		}
-
-		// Is ChatServer to say something?
-		if filter.ChatServerResponse != "" {
-			sub.ChatServer(filter.ChatServerResponse)
-		}
-
-		// Are we to report the message to the site admin?
-		if filter.ReportMessage {
-			// If the user is OP, just tell them we would.
-			if sub.IsAdmin() {
-				sub.ChatServer("Your recent chat context would have been reported to your main website.")
-			} else if err := s.reportFilteredMessage(sub, msg); err != nil {
-				// Send the report to the main website.
-				log.Error("Reporting filtered message: %s", err)
-			}
-		}
-
-		// If we are not forwarding this message, stop here.
-		if !filter.ForwardMessage {
-			return
-		}
+	if !s.runMessageFilters(sub, msg, &message) {
+		return
 	}
 
 	// Is this a DM?
@@ -178,7 +194,11 @@ func (s *Server) OnMessage(sub *Subscriber, msg messages.Message) {
 		// can still deliver a DM to the one who muted them.
 		rcpt, err := s.GetSubscriber(strings.TrimPrefix(msg.Channel, "@"))
 		if err != nil {
-			// Recipient was no longer online: the message won't be sent.
+			// Recipient was no longer online: keep it for them if we can, or the message won't be sent.
+			if OfflineDeliveryEnabled() {
+				s.sendOfflineMessage(sub, strings.TrimPrefix(msg.Channel, "@"), msg, message)
+				return
+			}
 			sub.ChatServer("Could not deliver your message: %s appears not to be online.", msg.Channel)
 			return
 		} else if rcpt.Mutes(sub.Username) && !sub.IsAdmin() {
@@ -226,8 +246,13 @@ func (s *Server) OnMessage(sub *Subscriber, msg messages.Message) {
 		LogChannel(s, msg.Channel, sub.Username, msg)
 	}
 
-	// Append it to the public channel's echo buffer.
+	// Append it to the public channel's echo buffer, and its stored history.
 	s.EchoPushPublicMessage(sub, message.Channel, message)
+	if _, ok := config.Current.GetChannel(message.Channel); ok {
+		if err := (models.ChannelMessage{}).LogMessage(message.Channel, message); err != nil && err != models.ErrNotInitialized {
+			log.Error("Logging channel history to SQLite: %s", err)
+		}
+	}
 
 	// Broadcast a chat message to the room.
 	s.Broadcast(message)
@@ -242,6 +267,13 @@ func (s *Server) OnTakeback(sub *Subscriber, msg messages.Message) {
 		log.Error("Error taking back DM history message (%s, %d): %s", sub.Username, msg.MessageID, err)
 	}
 
+	// Or from the public channel history.
+	wasRemovedFromChannel, err := (models.ChannelMessage{}).TakebackMessage(sub.Username, msg.MessageID, sub.IsAdmin())
+	if err != nil && err != models.ErrNotInitialized {
+		log.Error("Error taking back channel history message (%s, %d): %s", sub.Username, msg.MessageID, err)
+	}
+	wasRemovedFromHistory = wasRemovedFromHistory || wasRemovedFromChannel
+
 	// Permission check.
 	if sub.JWTClaims == nil || !sub.JWTClaims.IsAdmin {
 		sub.midMu.Lock()
@@ -258,8 +290,14 @@ func (s *Server) OnTakeback(sub *Subscriber, msg messages.Message) {
 		}
 	}
 
-	// Remove it from cached echo buffers for public channels.
+	// Remove it from cached echo buffers for public channels, and unpin it.
 	s.EchoTakebackMessage(msg.MessageID)
+	s.UnpinTakenBackMessage(msg.MessageID)
+
+	// Forget its emoji reactions.
+	if err := models.DeleteMessageReactions(msg.MessageID); err != nil && err != models.ErrNotInitialized {
+		log.Error("Error deleting the reactions to message %d: %s", msg.MessageID, err)
+	}
 
 	// Broadcast to everybody to remove this message.
 	s.Broadcast(messages.Message{
@@ -268,17 +306,6 @@ func (s *Server) OnTakeback(sub *Subscriber, msg messages.Message) {
 	})
 }
 
-// OnReact handles emoji reactions for chat messages.
-func (s *Server) OnReact(sub *Subscriber, msg messages.Message) {
-	// Forward the reaction to everybody.
-	s.Broadcast(messages.Message{
-		Action:    messages.ActionReact,
-		Username:  sub.Username,
-		Message:   msg.Message,
-		MessageID: msg.MessageID,
-	})
-}
-
 // OnFile handles a picture shared in chat with a channel.
 func (s *Server) OnFile(sub *Subscriber, msg messages.Message) {
 	if sub.Username == "" {
@@ -286,6 +313,11 @@ func (s *Server) OnFile(sub *Subscriber, msg messages.Message) {
 		return
 	}
 
+	// Created channels are only for their members.
+	if !s.checkChannelAccess(sub, msg.Channel) {
+		return
+	}
+
 	// Moderation rules?
 	if rule := sub.GetModerationRule(); rule != nil {
 
@@ -322,7 +354,7 @@ func (s *Server) OnFile(sub *Subscriber, msg messages.Message) {
 	// Assign a message ID and own it to the sender.
 	sub.midMu.Lock()
 	var mid = messages.NextMessageID()
-	sub.messageIDs[mid] = struct{}{}
+	sub.messageIDs[mid] = ""
 	sub.midMu.Unlock()
 
 	// Message to be echoed to the channel.
@@ -424,12 +456,19 @@ func (s *Server) OnMe(sub *Subscriber, msg messages.Message) {
 		msg.ChatStatus = "away"
 	}
 
+	var wasHidden = sub.ChatStatus == "hidden"
 	sub.VideoStatus = msg.VideoStatus
 	sub.ChatStatus = msg.ChatStatus
 	sub.DND = msg.DND
+	sub.NoReceipts = msg.NoReceipts
 
 	// Sync the WhoList to everybody.
-	s.SendWhoList()
+	s.SendWhoListChanges(sub.Username)
+	if wasHidden != (sub.ChatStatus == "hidden") {
+		for _, channel := range sub.JoinedChannels() {
+			s.SendChannelWhoList(channel)
+		}
+	}
 
 	// Reflect a 'me' message back?
 	if reflect {
@@ -445,7 +484,7 @@ func (s *Server) OnVideoInvite(sub *Subscriber, msg messages.Message) {
 	}
 	sub.muteMu.Unlock()
 
-	s.SendWhoList()
+	s.SendWhoListChanges(sub.Username)
 }
 
 // OnOpen is a client wanting to start WebRTC with another, e.g. to see their camera.
@@ -572,7 +611,7 @@ func (s *Server) OnBoot(sub *Subscriber, msg messages.Message, boot bool) {
 
 	sub.muteMu.Unlock()
 
-	s.SendWhoList()
+	s.SendWhoListChanges(sub.Username)
 }
 
 // OnMute is a user kicking setting the mute flag for another user.
@@ -598,7 +637,7 @@ func (s *Server) OnMute(sub *Subscriber, msg messages.Message, mute bool) {
 	}
 
 	// Send the Who List in case our cam will show as disabled to the muted party.
-	s.SendWhoList()
+	s.SendWhoListChanges(sub.Username)
 }
 
 // OnBlock is a user placing a hard block (hide from) another user.
@@ -618,7 +657,7 @@ func (s *Server) OnBlock(sub *Subscriber, msg messages.Message) {
 	sub.muteMu.Unlock()
 
 	// Send the Who List so the blocker/blockee can disappear from each other's list.
-	s.SendWhoList()
+	s.SendWhoListChanges(sub.Username, msg.Username)
 }
 
 // OnBlocklist is a bulk user mute from the CachedBlocklist sent by the website.
@@ -634,7 +673,7 @@ func (s *Server) OnBlocklist(sub *Subscriber, msg messages.Message) {
 	sub.muteMu.Unlock()
 
 	// Send the Who List in case our cam will show as disabled to the muted party.
-	s.SendWhoList()
+	s.SendWhoListChanges(append([]string{sub.Username}, msg.Usernames...)...)
 }
 
 // OnReport handles a user's report of a message.
@@ -0,0 +1,77 @@
+package barertc
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+// setupTestDatabase opens a new database for the test. The settings, which the test may
+// change, are restored after it.
+func setupTestDatabase(t *testing.T) {
+	t.Helper()
+	if err := models.Initialize(filepath.Join(t.TempDir(), "test.sqlite")); err != nil {
+		t.Fatalf("models.Initialize: %s", err)
+	}
+	var saved = config.Current
+	t.Cleanup(func() {
+		models.DB.Close()
+		models.DB = nil
+		config.Current = saved
+	})
+}
+
+// logIn marks the subscriber as logged in with the username and adds them to the server,
+// and puts them in their channels if joinChannels.
+func logIn(s *Server, sub *Subscriber, username string, joinChannels bool) {
+	sub.Username = username
+	sub.authenticated = true
+	s.AddSubscriber(sub)
+	if joinChannels {
+		s.JoinChannelsOnLogin(sub)
+	}
+}
+
+// loginUsers logs in a new polling subscriber for each username.
+func loginUsers(s *Server, joinChannels bool, usernames ...string) []*Subscriber {
+	var result = []*Subscriber{}
+	for _, username := range usernames {
+		sub := s.NewPollingSubscriber(nil, func() {})
+		logIn(s, sub, username, joinChannels)
+		result = append(result, sub)
+	}
+	return result
+}
+
+// drainMessages reads the messages queued up for a subscriber.
+func drainMessages(t *testing.T, sub *Subscriber) []messages.Message {
+	var result = []messages.Message{}
+	for {
+		select {
+		case data := <-sub.messages:
+			var msg messages.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("drainMessages: %s", err)
+			}
+			result = append(result, msg)
+		default:
+			return result
+		}
+	}
+}
+
+// resetAuthThrottle starts the login throttle from a clean slate, in case a test is run
+// more than once.
+func resetAuthThrottle() {
+	authThrottle = &loginThrottle{
+		failures:      map[string][]time.Time{},
+		lockouts:      map[string]time.Time{},
+		counts:        map[string][]time.Time{},
+		registrations: map[string][]time.Time{},
+	}
+}
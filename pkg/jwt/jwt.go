@@ -63,8 +63,13 @@ func ParseAndValidate(tokenStr string) (*Claims, bool, error) {
 // to the front-end so the server can reboot gracefully, clients reconnect and not be told their auth had
 // expired. New token expires after 5 minutes.
 func (c Claims) ReSign() (string, error) {
+	return c.Sign(5 * time.Minute)
+}
+
+// Sign generates a signed JWT token for the claims which expires after the given duration.
+func (c Claims) Sign(expires time.Duration) (string, error) {
 	// Refresh timestamps.
-	c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(5 * time.Minute))
+	c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(expires))
 	c.IssuedAt = jwt.NewNumericDate(time.Now())
 	c.NotBefore = jwt.NewNumericDate(time.Now())
 
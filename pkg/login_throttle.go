@@ -0,0 +1,349 @@
+package barertc
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/models"
+	"git.kirsle.net/apps/barertc/pkg/util"
+)
+
+/* Brute-force protection for the authentication endpoints. */
+
+// LockoutDecay is how long a lockout counts towards the backoff of the next one, and
+// towards escalating an IP address to a ban.
+const LockoutDecay = 24 * time.Hour
+
+// loginThrottle keeps sliding windows of recent failed attempts, and the current
+// lockouts, keyed by kind and value (e.g. "ip:127.0.0.1" or "username:alice").
+type loginThrottle struct {
+	mu            sync.Mutex
+	failures      map[string][]time.Time
+	lockouts      map[string]time.Time // locked until
+	counts        map[string][]time.Time
+	registrations map[string][]time.Time // accounts registered, by IP address
+	lastSweep     time.Time
+}
+
+var authThrottle = &loginThrottle{
+	failures:      map[string][]time.Time{},
+	lockouts:      map[string]time.Time{},
+	counts:        map[string][]time.Time{},
+	registrations: map[string][]time.Time{},
+}
+
+func throttleKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// LoginLockedOut checks whether the IP address or the username is currently locked out,
+// and returns the time remaining.
+func LoginLockedOut(ip, username string) (time.Duration, bool) {
+	if !config.Current.LoginThrottle.Enabled {
+		return 0, false
+	}
+
+	authThrottle.mu.Lock()
+	defer authThrottle.mu.Unlock()
+
+	var (
+		now       = time.Now()
+		remaining time.Duration
+	)
+	for _, key := range []string{
+		throttleKey(models.LockoutKindIP, ip),
+		throttleKey(models.LockoutKindUsername, strings.ToLower(username)),
+	} {
+		if until, ok := authThrottle.lockouts[key]; ok {
+			if now.After(until) {
+				delete(authThrottle.lockouts, key)
+			} else if until.Sub(now) > remaining {
+				remaining = until.Sub(now)
+			}
+		}
+	}
+
+	return remaining, remaining > 0
+}
+
+// RecordLoginFailure counts a failed attempt at an authentication endpoint, and locks out
+// the IP address and/or username when they have had too many. The username may be blank.
+func RecordLoginFailure(endpoint, ip, username string) {
+	var settings = config.Current.LoginThrottle
+	if !settings.Enabled {
+		return
+	}
+
+	var (
+		now      = time.Now()
+		window   = time.Duration(settings.WindowSeconds) * time.Second
+		lockouts []pendingLockout
+	)
+
+	authThrottle.mu.Lock()
+	authThrottle.sweep(now, window)
+
+	for _, target := range []struct {
+		kind  string
+		value string
+		max   int
+	}{
+		{models.LockoutKindIP, ip, settings.MaxFailuresPerIP},
+		{models.LockoutKindUsername, strings.ToLower(username), settings.MaxFailuresPerUsername},
+	} {
+		if target.value == "" || target.max <= 0 {
+			continue
+		}
+
+		var key = throttleKey(target.kind, target.value)
+		authThrottle.failures[key] = append(pruneTimes(authThrottle.failures[key], now.Add(-window)), now)
+
+		if failures := len(authThrottle.failures[key]); failures >= target.max {
+			delete(authThrottle.failures, key)
+
+			// How many times were they locked out recently?
+			authThrottle.counts[key] = pruneTimes(authThrottle.counts[key], now.Add(-LockoutDecay))
+			var previous = len(authThrottle.counts[key])
+			authThrottle.counts[key] = append(authThrottle.counts[key], now)
+
+			lockouts = append(lockouts, pendingLockout{
+				endpoint: endpoint,
+				kind:     target.kind,
+				value:    target.value,
+				failures: failures,
+				previous: previous,
+				until:    authThrottle.lockOut(key, previous, now),
+				now:      now,
+			})
+		}
+	}
+	authThrottle.mu.Unlock()
+
+	// The database work is done without holding up the other login attempts.
+	for _, lockout := range lockouts {
+		authThrottle.recordLockout(lockout)
+	}
+}
+
+// ResetLoginFailures clears the failed attempts on a username after a successful login.
+func ResetLoginFailures(username string) {
+	authThrottle.mu.Lock()
+	defer authThrottle.mu.Unlock()
+	delete(authThrottle.failures, throttleKey(models.LockoutKindUsername, strings.ToLower(username)))
+}
+
+// ReserveRegistration counts a new account registration by an IP address in the sliding
+// window. If the IP address has registered too many already, it returns false and the
+// time until it may register again.
+//
+// The registration is counted before the account is created, so that a burst of requests
+// can not all slip in together; call CancelRegistration if it then fails.
+func ReserveRegistration(ip string) (time.Duration, bool) {
+	var settings = config.Current.LoginThrottle
+	if !settings.Enabled || settings.MaxRegistrationsPerIP <= 0 {
+		return 0, true
+	}
+
+	var (
+		now    = time.Now()
+		window = time.Duration(settings.WindowSeconds) * time.Second
+		key    = throttleKey(models.LockoutKindIP, ip)
+	)
+
+	authThrottle.mu.Lock()
+	defer authThrottle.mu.Unlock()
+	authThrottle.sweep(now, window)
+
+	var times = pruneTimes(authThrottle.registrations[key], now.Add(-window))
+	if len(times) >= settings.MaxRegistrationsPerIP {
+		authThrottle.registrations[key] = times
+		return times[0].Add(window).Sub(now), false
+	}
+	authThrottle.registrations[key] = append(times, now)
+	return 0, true
+}
+
+// CancelRegistration uncounts a registration from ReserveRegistration which did not go
+// through (e.g. the username was taken).
+func CancelRegistration(ip string) {
+	authThrottle.mu.Lock()
+	defer authThrottle.mu.Unlock()
+
+	var key = throttleKey(models.LockoutKindIP, ip)
+	if times := authThrottle.registrations[key]; len(times) > 0 {
+		authThrottle.registrations[key] = times[:len(times)-1]
+	}
+}
+
+// pendingLockout is a lockout decided under the mutex, to be logged (and maybe escalated
+// to a ban) after it is released.
+type pendingLockout struct {
+	endpoint string
+	kind     string
+	value    string
+	failures int
+	previous int // lockouts in the last LockoutDecay
+	until    time.Time
+	now      time.Time
+}
+
+// lockOut locks out a key with exponential backoff on its previous lockouts, and returns
+// when the lockout ends. The caller holds the mutex.
+func (t *loginThrottle) lockOut(key string, previous int, now time.Time) time.Time {
+	var settings = config.Current.LoginThrottle
+
+	var seconds = float64(settings.LockoutSeconds) * math.Pow(math.Max(settings.LockoutBackoff, 1), float64(previous))
+	if settings.MaxLockoutSeconds > 0 {
+		seconds = math.Min(seconds, float64(settings.MaxLockoutSeconds))
+	}
+
+	var until = now.Add(time.Duration(seconds) * time.Second)
+	if until.After(t.lockouts[key]) {
+		t.lockouts[key] = until
+	}
+	return t.lockouts[key]
+}
+
+// recordLockout logs a lockout to the database, and escalates repeat offending IP
+// addresses to a ban. Call it without holding the mutex.
+func (t *loginThrottle) recordLockout(lockout pendingLockout) {
+	var (
+		settings = config.Current.LoginThrottle
+		key      = throttleKey(lockout.kind, lockout.value)
+	)
+
+	// Prefer the durable count of previous lockouts from the database, which survives a
+	// reboot of the chat server, and lengthen the lockout if it has more.
+	if count, err := models.CountLoginLockouts(lockout.kind, lockout.value, lockout.now.Add(-LockoutDecay)); err == nil && count > lockout.previous {
+		lockout.previous = count
+		t.mu.Lock()
+		lockout.until = t.lockOut(key, count, lockout.now)
+		t.mu.Unlock()
+	}
+
+	log.Warn("Login throttle: %s %s is locked out until %s after %d failed attempts at %s",
+		lockout.kind, lockout.value, lockout.until.Format(time.RFC3339), lockout.failures, lockout.endpoint,
+	)
+	if _, err := models.CreateLoginLockout(models.LoginLockout{
+		Kind:        lockout.kind,
+		Value:       lockout.value,
+		Endpoint:    lockout.endpoint,
+		Failures:    lockout.failures,
+		LockedUntil: lockout.until,
+		CreatedAt:   lockout.now,
+	}); err != nil {
+		log.Error("Login throttle: logging the lockout of %s %s: %s", lockout.kind, lockout.value, err)
+	}
+
+	// Escalate a repeat offending IP address to a ban. Usernames are only locked out: the
+	// owner of an account is not necessarily the one guessing at its password.
+	if lockout.kind != models.LockoutKindIP || settings.BanAfterLockouts <= 0 || lockout.previous+1 < settings.BanAfterLockouts {
+		return
+	}
+	if _, banned := FindIPBan(lockout.value); banned {
+		return
+	}
+
+	duration, err := ParseBanDuration(settings.BanDuration)
+	if err != nil {
+		log.Error("Login throttle: invalid BanDuration %q in settings, using 24 hours: %s", settings.BanDuration, err)
+		duration = 24 * time.Hour
+	}
+
+	var ban = models.Ban{
+		Kind:     models.BanKindIP,
+		Value:    lockout.value,
+		Reason:   "Too many failed login attempts",
+		Operator: "ChatServer",
+	}
+	if duration > 0 {
+		ban.ExpiresAt = lockout.now.Add(duration)
+	}
+	if _, err := AddBan(ban); err != nil {
+		log.Error("Login throttle: banning IP %s: %s", lockout.value, err)
+	} else {
+		log.Warn("Login throttle: IP %s has been banned %s after %d lockouts", lockout.value, FormatBanDuration(duration), lockout.previous+1)
+	}
+}
+
+// sweep removes stale entries from the maps, at most once per window. The caller holds the mutex.
+func (t *loginThrottle) sweep(now time.Time, window time.Duration) {
+	if now.Sub(t.lastSweep) < window {
+		return
+	}
+	t.lastSweep = now
+
+	for key, times := range t.failures {
+		if times = pruneTimes(times, now.Add(-window)); len(times) == 0 {
+			delete(t.failures, key)
+		} else {
+			t.failures[key] = times
+		}
+	}
+	for key, until := range t.lockouts {
+		if now.After(until) {
+			delete(t.lockouts, key)
+		}
+	}
+	for key, times := range t.registrations {
+		if times = pruneTimes(times, now.Add(-window)); len(times) == 0 {
+			delete(t.registrations, key)
+		} else {
+			t.registrations[key] = times
+		}
+	}
+	for key, times := range t.counts {
+		if times = pruneTimes(times, now.Add(-LockoutDecay)); len(times) == 0 {
+			delete(t.counts, key)
+		} else {
+			t.counts[key] = times
+		}
+	}
+}
+
+// pruneTimes drops the times before the cutoff from a sorted list.
+func pruneTimes(times []time.Time, cutoff time.Time) []time.Time {
+	for i, t := range times {
+		if !t.Before(cutoff) {
+			return times[i:]
+		}
+	}
+	return nil
+}
+
+/*
+checkLoginThrottle guards the form based authentication endpoints: it rejects banned
+IP addresses, and IP addresses or usernames which are locked out, writing the error
+response. Returns true if the request may proceed.
+*/
+func checkLoginThrottle(w http.ResponseWriter, r *http.Request, username string) bool {
+	var ip = util.IPAddress(r)
+	if _, banned := FindIPBan(ip); banned {
+		http.Error(w, "Acceso denegado", http.StatusForbidden)
+		return false
+	}
+
+	if remaining, locked := LoginLockedOut(ip, username); locked {
+		tooManyAttempts(w, remaining)
+		return false
+	}
+
+	return true
+}
+
+// tooManyAttempts writes the uniform response of a throttled authentication endpoint.
+func tooManyAttempts(w http.ResponseWriter, remaining time.Duration) {
+	setRetryAfter(w, remaining)
+	http.Error(w, "Demasiados intentos fallidos. Inténtalo de nuevo más tarde.", http.StatusTooManyRequests)
+}
+
+// setRetryAfter sets the Retry-After header on a throttled response.
+func setRetryAfter(w http.ResponseWriter, remaining time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+}
@@ -0,0 +1,69 @@
+package barertc
+
+import (
+	"testing"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	var saved = config.Current.LoginThrottle
+	defer func() {
+		config.Current.LoginThrottle = saved
+	}()
+
+	resetAuthThrottle()
+	config.Current.LoginThrottle = config.LoginThrottle{
+		Enabled:                true,
+		WindowSeconds:          60,
+		MaxFailuresPerIP:       5,
+		MaxFailuresPerUsername: 3,
+		LockoutSeconds:         60,
+		LockoutBackoff:         2,
+		MaxLockoutSeconds:      150,
+	}
+
+	// Two failures on a username are not yet a lockout.
+	for i := 0; i < 2; i++ {
+		RecordLoginFailure("/api/login", "10.0.0.1", "Alice")
+	}
+	if _, locked := LoginLockedOut("10.0.0.2", "alice"); locked {
+		t.Errorf("alice should not be locked out after 2 failures")
+	}
+
+	// The third failure locks out the username (case insensitive), but not the IP.
+	RecordLoginFailure("/api/login", "10.0.0.1", "alice")
+	remaining, locked := LoginLockedOut("10.0.0.2", "ALICE")
+	if !locked || remaining > 60*time.Second || remaining < 59*time.Second {
+		t.Errorf("expected alice locked out for 60s, got %s (%t)", remaining, locked)
+	}
+	if _, locked := LoginLockedOut("10.0.0.1", "bob"); locked {
+		t.Errorf("10.0.0.1 should not be locked out after 3 failures")
+	}
+
+	// The IP address gets locked out on its fifth failure, on any username.
+	for i := 0; i < 2; i++ {
+		RecordLoginFailure("/api/login", "10.0.0.1", "bob")
+	}
+	if _, locked := LoginLockedOut("10.0.0.1", "carol"); !locked {
+		t.Errorf("10.0.0.1 should be locked out after 5 failures")
+	}
+
+	// Repeated lockouts back off, up to the maximum.
+	for _, expect := range []time.Duration{120 * time.Second, 150 * time.Second} {
+		for i := 0; i < 3; i++ {
+			RecordLoginFailure("/api/login", "10.0.0.3", "alice")
+		}
+		remaining, _ := LoginLockedOut("", "alice")
+		if remaining > expect || remaining < expect-time.Second {
+			t.Errorf("expected alice locked out for %s, got %s", expect, remaining)
+		}
+	}
+
+	// Disabled throttle never locks anyone out.
+	config.Current.LoginThrottle.Enabled = false
+	if _, locked := LoginLockedOut("10.0.0.1", "alice"); locked {
+		t.Errorf("throttle is disabled but alice is locked out")
+	}
+}
@@ -1,6 +1,7 @@
 package barertc
 
 import (
+	"html"
 	"strings"
 
 	"github.com/microcosm-cc/bluemonday"
@@ -17,3 +18,9 @@ func RenderMarkdown(input string) string {
 	safened := p.SanitizeBytes(html)
 	return strings.TrimSpace(string(safened))
 }
+
+// PlainText strips the HTML of a chat message down to its text, on one line.
+func PlainText(input string) string {
+	var text = html.UnescapeString(bluemonday.StrictPolicy().Sanitize(input))
+	return strings.Join(strings.Fields(text), " ")
+}
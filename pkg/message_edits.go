@@ -0,0 +1,194 @@
+package barertc
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+// OnEdit handles a user correcting their chat message for everybody.
+//
+// The new text goes through the Markdown, media embeds and message filters like a new
+// message, and then replaces the message in the echo buffer, the DM or channel history
+// and the pinned messages. The prior version is recorded for operators to review.
+func (s *Server) OnEdit(sub *Subscriber, msg messages.Message) {
+	if sub.Username == "" || !sub.authenticated {
+		sub.ChatServer("You must log in first.")
+		return
+	}
+
+	// Is it their own (text) message?
+	channel, ok := s.findOwnMessage(sub, msg.MessageID)
+	if !ok {
+		sub.ChatServer("That is not your message to edit.")
+		return
+	}
+
+	// Created channels are only for their members.
+	if !s.checkChannelAccess(sub, channel) {
+		return
+	}
+
+	// Translate their message as Markdown syntax.
+	markdown := RenderMarkdown(msg.Message)
+	if markdown == "" {
+		sub.ChatServer("A message can not be edited to be blank: take it back instead.")
+		return
+	}
+
+	// Detect and expand media such as YouTube videos.
+	markdown = s.ExpandMedia(markdown)
+
+	var message = messages.Message{
+		Action:    messages.ActionEdit,
+		Channel:   channel,
+		Username:  sub.Username,
+		Message:   markdown,
+		MessageID: msg.MessageID,
+		Edited:    true,
+	}
+
+	// Run message filters.
+	if !s.runMessageFilters(sub, messages.Message{Channel: channel, Message: msg.Message}, &message) {
+		return
+	}
+
+	// Update the stored copies of the message, and keep the prior version.
+	var (
+		isDM = strings.HasPrefix(channel, "@")
+		edit = models.MessageEdit{
+			MessageID: msg.MessageID,
+			ChannelID: channel,
+			Username:  sub.Username,
+			Message:   message.Message,
+		}
+	)
+	if isDM {
+		edit.ChannelID = models.CreateChannelID(sub.Username, strings.TrimPrefix(channel, "@"))
+		if past, err := models.GetDirectMessage(msg.MessageID); err == nil {
+			edit.Previous = past.Message
+			if err := (models.DirectMessage{}).EditMessage(msg.MessageID, message.Message); err != nil {
+				log.Error("Error editing DM history message %d: %s", msg.MessageID, err)
+			}
+		}
+	} else {
+		edit.Previous, _ = s.EchoEditMessage(channel, msg.MessageID, message.Message)
+		if past, err := models.GetChannelMessage(msg.MessageID); err == nil {
+			if edit.Previous == "" {
+				edit.Previous = past.Message
+			}
+			if err := (models.ChannelMessage{}).EditMessage(msg.MessageID, message.Message); err != nil {
+				log.Error("Error editing channel history message %d: %s", msg.MessageID, err)
+			}
+		}
+
+		if pinned, err := editPinnedMessage(channel, msg.MessageID, message.Message); err != nil {
+			log.Error("Error editing pinned message %d: %s", msg.MessageID, err)
+		} else if pinned {
+			s.SendPins(channel)
+		}
+	}
+
+	// DM edits are only kept along with the DM history.
+	if !isDM || models.DirectMessageHistoryEnabled() {
+		if err := models.CreateMessageEdit(edit); err != nil && err != models.ErrNotInitialized {
+			log.Error("Error recording the edit of message %d: %s", msg.MessageID, err)
+		}
+	}
+
+	// Is this a DM?
+	if isDM {
+		// Send the edit only to both parties.
+		s.SendTo(sub.Username, message)
+		message.Channel = "@" + sub.Username
+
+		// Not if the message would not have been delivered to them.
+		rcpt, err := s.GetSubscriber(strings.TrimPrefix(channel, "@"))
+		if err != nil || (rcpt.Mutes(sub.Username) && !sub.IsAdmin()) || sub.Blocks(rcpt) {
+			return
+		}
+		s.SendTo(rcpt.Username, message)
+		return
+	}
+
+	// Broadcast the edit to the room.
+	s.Broadcast(message)
+}
+
+// findOwnMessage looks up the channel of a text message sent by the user: from their
+// current chat session, or from the DM or channel history.
+//
+// For DMs, the channel is the other party's username (with the @ prefix), as seen by
+// the sender.
+func (s *Server) findOwnMessage(sub *Subscriber, msgID int64) (string, bool) {
+	if channel, ok := sub.sentMessage(msgID); ok {
+		// Pictures have a blank channel.
+		return channel, channel != ""
+	}
+
+	// A message from a previous chat session?
+	if dm, err := models.GetDirectMessage(msgID); err == nil && dm.Username == sub.Username {
+		// The channel ID is like "@alice:@bob".
+		for _, party := range strings.Split(dm.ChannelID, ":") {
+			if party != "@"+sub.Username {
+				return party, true
+			}
+		}
+	}
+	if cm, err := models.GetChannelMessage(msgID); err == nil && cm.Username == sub.Username {
+		return cm.ChannelID, true
+	}
+
+	return "", false
+}
+
+// EditsCommand handles the `/edits` operator command to review the prior versions of
+// an edited message.
+func (s *Server) EditsCommand(words []string, sub *Subscriber) {
+	if len(words) < 2 {
+		sub.ChatServer(RenderMarkdown("Usage: `/edits <message ID>` to see the prior versions of an edited message."))
+		return
+	}
+
+	msgID, err := strconv.ParseInt(words[1], 10, 64)
+	if err != nil {
+		sub.ChatServer("/edits: invalid message ID: %s", words[1])
+		return
+	}
+
+	edits, err := models.GetMessageEdits(msgID)
+	if err != nil {
+		sub.ChatServer("/edits: %s", err)
+		return
+	} else if len(edits) == 0 {
+		sub.ChatServer("There are no edits recorded for message %d.", msgID)
+		return
+	}
+
+	// Reading somebody's DMs is on the record.
+	var first = edits[0]
+	if strings.HasPrefix(first.ChannelID, "@") {
+		auditCommand(sub, words, first.Username)
+	}
+
+	// The messages are HTML already.
+	var lines = []string{}
+	for _, edit := range edits {
+		var previous = edit.Previous
+		if previous == "" {
+			previous = "<em>(not kept)</em>"
+		}
+		lines = append(lines, fmt.Sprintf(
+			"<li>%s: %s &rarr; %s</li>",
+			edit.EditedAt.Format("2006-01-02 15:04:05"), previous, edit.Message,
+		))
+	}
+	sub.ChatServer("Edits of message %d by <strong>%s</strong> in %s:<ol>%s</ol>",
+		msgID, html.EscapeString(first.Username), html.EscapeString(first.ChannelID), strings.Join(lines, ""),
+	)
+}
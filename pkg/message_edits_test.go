@@ -0,0 +1,79 @@
+package barertc
+
+import (
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestMessageEdits(t *testing.T) {
+	setupTestDatabase(t)
+	defer ClearEchoMessages("lobby")
+	config.Current.DirectMessageHistory.Enabled = true
+	config.Current.ChannelHistory.Enabled = true
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+	)
+
+	// Find the edit that bob received.
+	var received = func() (messages.Message, bool) {
+		for _, msg := range drainMessages(t, bob) {
+			if msg.Action == messages.ActionEdit {
+				return msg, true
+			}
+		}
+		return messages.Message{}, false
+	}
+
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "helo world"})
+	var mid = RecentChannelMessages("lobby")[0].MessageID
+	drainMessages(t, bob)
+
+	// Only alice may edit her message.
+	s.OnEdit(bob, messages.Message{Action: messages.ActionEdit, MessageID: mid, Message: "pwned"})
+	if _, ok := received(); ok {
+		t.Errorf("bob edited alice's message")
+	}
+
+	s.OnEdit(alice, messages.Message{Action: messages.ActionEdit, MessageID: mid, Message: "hello **world**"})
+	if msg, ok := received(); !ok || !msg.Edited || msg.Channel != "lobby" || msg.Message != "<p>hello <strong>world</strong></p>" {
+		t.Errorf("bob did not get the edit: %+v", msg)
+	}
+
+	// The echo buffer and the channel history have the new version.
+	if msg := RecentChannelMessages("lobby")[0]; !msg.Edited || msg.Message != "<p>hello <strong>world</strong></p>" {
+		t.Errorf("the echo buffer was not edited: %+v", msg)
+	}
+	if page, _, _ := models.PaginateChannelMessages("lobby", 0, 10); len(page) != 1 || !page[0].Edited || page[0].Message != "<p>hello <strong>world</strong></p>" {
+		t.Errorf("the channel history was not edited: %+v", page)
+	}
+
+	// Edits of a DM from a previous chat session, by its history.
+	var dm = messages.Message{MessageID: messages.NextMessageID(), Message: "<p>see you tmrw</p>"}
+	if err := (models.DirectMessage{}).LogMessage("alice", "bob", dm); err != nil {
+		t.Fatalf("LogMessage: %s", err)
+	}
+	s.OnEdit(alice, messages.Message{Action: messages.ActionEdit, MessageID: dm.MessageID, Message: "see you tomorrow"})
+	if msg, ok := received(); !ok || msg.Channel != "@alice" || msg.Message != "<p>see you tomorrow</p>" {
+		t.Errorf("bob did not get the DM edit: %+v", msg)
+	}
+	if page, _, _ := models.PaginateDirectMessages("alice", "bob", 0); len(page) != 1 || !page[0].Edited || page[0].Message != "<p>see you tomorrow</p>" {
+		t.Errorf("the DM history was not edited: %+v", page)
+	}
+
+	// Operators may review the prior versions.
+	for msgID, previous := range map[int64]string{
+		mid:          "<p>helo world</p>",
+		dm.MessageID: "<p>see you tmrw</p>",
+	} {
+		if edits, err := models.GetMessageEdits(msgID); err != nil || len(edits) != 1 || edits[0].Previous != previous {
+			t.Errorf("unexpected edits of message %d (err=%v): %+v", msgID, err, edits)
+		}
+	}
+}
@@ -9,11 +9,16 @@ import (
 	"time"
 
 	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
 	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
 )
 
 // Functionality for handling server-side message filtering and reporting.
 
+// MessageFilterBanReason is the reason given on bans issued by the message filters.
+const MessageFilterBanReason = "Server side message filter"
+
 // filterMessage will check an incoming user message against the configured
 // server-side filters and react accordingly. This function also is
 // responsible for collecting the recent contexts (10 messages per channel).
@@ -24,8 +29,10 @@ import (
 //
 // Returns the matching message filter (or nil) and a boolean (matched).
 func (s *Server) filterMessage(sub *Subscriber, rawMsg messages.Message, msg *messages.Message) (*config.MessageFilter, bool) {
+	var isDM = strings.HasPrefix(msg.Channel, "@")
+
 	// Collect the recent channel context first.
-	if strings.HasPrefix(msg.Channel, "@") {
+	if isDM {
 		// DM
 		pushDirectMessageContext(sub, sub.Username, msg.Channel[1:], rawMsg)
 
@@ -40,13 +47,34 @@ func (s *Server) filterMessage(sub *Subscriber, rawMsg messages.Message, msg *me
 		pushMessageContext(sub, msg.Channel, rawMsg)
 	}
 
-	// Check it against the configured filters.
-	var matched bool
+	// Check it against the configured filters. The ones which remove the user go first:
+	// the first match wins, and a message also censored by another filter must still get
+	// its sender kicked.
+	var (
+		filters = make([]*config.MessageFilter, 0, len(config.Current.MessageFilters))
+		matched bool
+	)
+	for _, filter := range config.Current.MessageFilters {
+		if filter.RemovesUser() {
+			filters = append(filters, filter)
+		}
+	}
 	for _, filter := range config.Current.MessageFilters {
+		if !filter.RemovesUser() {
+			filters = append(filters, filter)
+		}
+	}
+
+	for _, filter := range filters {
 		if !filter.Enabled {
 			continue
 		}
 
+		// Does the filter apply to this channel?
+		if (isDM && !filter.PrivateChannels) || (!isDM && !filter.PublicChannels) {
+			continue
+		}
+
 		for _, phrase := range filter.IterPhrases() {
 			m := phrase.FindAllStringSubmatch(msg.Message, -1)
 			for _, match := range m {
@@ -68,6 +96,117 @@ func (s *Server) filterMessage(sub *Subscriber, rawMsg messages.Message, msg *me
 	return nil, false
 }
 
+// runMessageFilters checks a user's message against the message filters and acts on
+// a match: it may censor the message, reply from ChatServer, report the message or remove
+// the user from the chat room.
+//
+// Returns true if the message is to be sent out. Otherwise, the (possibly censored)
+// message was echoed back to the sender only.
+func (s *Server) runMessageFilters(sub *Subscriber, rawMsg messages.Message, msg *messages.Message) bool {
+	filter, ok := s.filterMessage(sub, rawMsg, msg)
+	if !ok {
+		return true
+	}
+
+	// If we will not send this message out, do echo it back to
+	// the sender (possibly with censors applied).
+	if !filter.ForwardMessage {
+		s.SendTo(sub.Username, *msg)
+	}
+
+	// Is ChatServer to say something?
+	if filter.ChatServerResponse != "" {
+		sub.ChatServer(filter.ChatServerResponse)
+	}
+
+	// Are we to report the message to the site admin?
+	if filter.ReportMessage {
+		// If the user is OP, just tell them we would.
+		if sub.IsAdmin() {
+			sub.ChatServer("Your recent chat context would have been reported to your main website.")
+		} else if err := s.reportFilteredMessage(sub, rawMsg); err != nil {
+			// Send the report to the main website.
+			log.Error("Reporting filtered message: %s", err)
+		}
+	}
+
+	// Are we to remove the user from the chat room?
+	if s.punishFilteredMessage(sub, filter) {
+		return false
+	}
+
+	return filter.ForwardMessage
+}
+
+// punishFilteredMessage kicks or bans the sender of a filtered message, if the filter
+// is configured to. Returns true if the user was removed from the chat room.
+func (s *Server) punishFilteredMessage(sub *Subscriber, filter *config.MessageFilter) bool {
+	if !filter.RemovesUser() {
+		return false
+	}
+
+	// If the user is OP, just tell them we would.
+	if sub.IsAdmin() {
+		sub.ChatServer("You would have been removed from the chat room by a server side message filter.")
+		return false
+	}
+
+	// How long do the bans last?
+	var duration = 24 * time.Hour
+	if filter.BanDuration != "" {
+		if dur, err := ParseBanDuration(filter.BanDuration); err != nil {
+			log.Error("MessageFilter: invalid BanDuration %q, using 24 hours: %s", filter.BanDuration, err)
+		} else {
+			duration = dur
+		}
+	}
+
+	var (
+		username = sub.Username
+		presence = messages.PresenceKicked
+		action   = "kick"
+		bans     = []string{}
+	)
+
+	if filter.BanUser {
+		if _, err := BanUser(username, duration, MessageFilterBanReason, "ChatServer"); err != nil {
+			log.Error("MessageFilter: couldn't ban %s: %s", username, err)
+		} else {
+			presence = messages.PresenceBanned
+			action = "ban"
+			bans = append(bans, "username")
+		}
+	}
+
+	if filter.BanIP && sub.IP != "" {
+		var ban = models.Ban{
+			Kind:     banKindForAddress(sub.IP),
+			Value:    sub.IP,
+			Reason:   MessageFilterBanReason,
+			Operator: "ChatServer",
+		}
+		if duration > 0 {
+			ban.ExpiresAt = time.Now().Add(duration)
+		}
+		if _, err := AddBan(ban); err != nil {
+			log.Error("MessageFilter: couldn't ban the IP %s of %s: %s", sub.IP, username, err)
+		} else {
+			presence = messages.PresenceBanned
+			action = "ban"
+			bans = append(bans, "ip="+sub.IP)
+		}
+	}
+
+	log.Info("MessageFilter: %s is removed from the chat room (%s)", username, action)
+	var arguments string
+	if len(bans) > 0 {
+		arguments = fmt.Sprintf("%s %s", strings.Join(bans, " "), FormatBanDuration(duration))
+	}
+	Audit(models.AuditSourceFilter, "ChatServer", action, username, arguments)
+	s.Disconnect(sub, presence)
+	return true
+}
+
 // Report the filtered message along with recent context.
 func (s *Server) reportFilteredMessage(sub *Subscriber, msg messages.Message) error {
 	if !WebhookEnabled(WebhookReport) {
@@ -0,0 +1,83 @@
+package barertc
+
+import (
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+func TestMessageFilters(t *testing.T) {
+	var saved = config.Current.MessageFilters
+	defer func() {
+		config.Current.MessageFilters = saved
+	}()
+	config.Current.MessageFilters = []*config.MessageFilter{
+		{
+			// Censors swearing everywhere.
+			Enabled:         true,
+			PublicChannels:  true,
+			PrivateChannels: true,
+			KeywordPhrases:  []string{`\bdarn\b`},
+			CensorMessage:   true,
+			ForwardMessage:  true,
+		},
+		{
+			// Kicks for advertising, in the public channels only.
+			Enabled:        true,
+			PublicChannels: true,
+			KeywordPhrases: []string{`othersite`},
+			KickUser:       true,
+		},
+		{
+			// Censors phone numbers in DMs only.
+			Enabled:         true,
+			PrivateChannels: true,
+			KeywordPhrases:  []string{`\d{3}-\d{4}`},
+			CensorMessage:   true,
+			ForwardMessage:  true,
+		},
+	}
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+	)
+	drainMessages(t, bob)
+
+	// The text of the chat messages that bob received.
+	var received = func() []string {
+		var result []string
+		for _, msg := range drainMessages(t, bob) {
+			if msg.Action == messages.ActionMessage {
+				result = append(result, msg.Message)
+			}
+		}
+		return result
+	}
+
+	// The DM filter is not applied in public, and the public filter is not applied to DMs.
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "call 555-1234"})
+	if got := received(); len(got) != 1 || !strings.Contains(got[0], "555-1234") {
+		t.Errorf("the public message was filtered: %v", got)
+	}
+	s.OnMessage(alice, messages.Message{Channel: "@bob", Message: "call 555-1234 on othersite"})
+	if got := received(); len(got) != 1 || strings.Contains(got[0], "555-1234") || !strings.Contains(got[0], "othersite") {
+		t.Errorf("expected the DM to be censored only: %v", got)
+	}
+	if !alice.authenticated {
+		t.Fatalf("alice was kicked for a DM")
+	}
+
+	// A message both censored and forbidden gets her kicked.
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "darn, come to othersite"})
+	if got := received(); len(got) != 0 {
+		t.Errorf("bob got the forbidden message: %v", got)
+	}
+	if alice.authenticated {
+		t.Errorf("alice was not kicked")
+	}
+}
@@ -0,0 +1,231 @@
+package barertc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+// MessageSearch (/api/message/search) searches the caller's own DM history.
+//
+// It needs the DirectMessageHistory setting and a server built with SQLite FTS5
+// support. The caller must be logged into the chat room.
+//
+// It is a POST request with a json body containing the following schema:
+//
+//	{
+//		"JWTToken": "the caller's jwt token",
+//		"Query": "search terms",
+//		"Username": "only the DMs with this user (optional)",
+//		"Since": "2024-01-01T00:00:00Z",
+//		"Until": "2024-02-01T00:00:00Z",
+//		"Page": 1
+//	}
+//
+// Every word of the query must match. A word ending with "*" matches as a prefix, and
+// the Since and Until timestamps are optional.
+//
+// The response JSON will look like the following:
+//
+//	{
+//		"OK": true,
+//		"Error": "only on error responses",
+//		"Total": 42,
+//		"Page": 1,
+//		"Pages": 3,
+//		"Results": [
+//			{
+//				"MessageID": 1234,
+//				"ChannelID": "@alice:@bob",
+//				"Username": "alice",
+//				"Snippet": "…are we still on for <mark>lunch</mark> tomorrow?",
+//				"Timestamp": "2024-01-31T12:00:00Z"
+//			}
+//		]
+//	}
+//
+// The Snippet is HTML: the message text is escaped and its matched terms are in <mark> tags.
+func (s *Server) MessageSearch() http.HandlerFunc {
+	return s.messageSearch(false)
+}
+
+// OperatorMessageSearch (/api/message/search/all) searches every stored DM and public
+// channel message, for operators investigating a report.
+//
+// The caller must be logged into the chat room as an operator, and each search is
+// recorded in the audit log. The request and response are as for /api/message/search,
+// with these optional filters in place of "Username":
+//
+//	{
+//		"Username": "only messages sent by this user",
+//		"Participant": "only the DMs this user is a party to",
+//		"Channel": "only this channel, e.g. lobby or @alice:@bob"
+//	}
+func (s *Server) OperatorMessageSearch() http.HandlerFunc {
+	return s.messageSearch(true)
+}
+
+// messageSearch implements the user and operator search endpoints.
+func (s *Server) messageSearch(operator bool) http.HandlerFunc {
+	type request struct {
+		JWTToken    string
+		Query       string
+		Username    string
+		Participant string
+		Channel     string
+		Since       time.Time
+		Until       time.Time
+		Page        int
+	}
+
+	type result struct {
+		OK      bool
+		Error   string `json:",omitempty"`
+		Total   int
+		Page    int
+		Pages   int
+		Results []models.SearchResult
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// JSON writer for the response.
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		// Parse the request.
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only POST methods allowed",
+			})
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Only application/json content-types allowed",
+			})
+			return
+		}
+
+		defer r.Body.Close()
+
+		// Parse the request payload.
+		var (
+			params request
+			dec    = json.NewDecoder(r.Body)
+		)
+		if err := dec.Decode(&params); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Is the search available on the server?
+		if !models.SearchAvailable() || (!operator && !models.DirectMessageHistoryEnabled()) {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "Message search is not available on this server.",
+			})
+			return
+		}
+
+		// Are JWT tokens enabled on the server?
+		if !config.Current.JWT.Enabled || params.JWTToken == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "JWT authentication is not available.",
+			})
+			return
+		}
+
+		// Validate the user's JWT token.
+		claims, _, err := jwt.ParseAndValidate(params.JWTToken)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		// Get the user from the chat roster.
+		sub, err := s.GetSubscriber(claims.Subject)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(result{
+				Error: "You are not logged into the chat room.",
+			})
+			return
+		}
+
+		// Narrow down the search to what the caller may see.
+		var filter = models.MessageSearchFilter{
+			Query: params.Query,
+			Since: params.Since,
+			Until: params.Until,
+		}
+		if operator {
+			if !sub.IsAdmin() {
+				w.WriteHeader(http.StatusForbidden)
+				enc.Encode(result{
+					Error: "Only operators may search all messages.",
+				})
+				return
+			}
+
+			filter.Username = params.Username
+			filter.Participant = params.Participant
+			filter.ChannelID = params.Channel
+		} else {
+			filter.Participant = sub.Username
+			if params.Username != "" {
+				filter.ChannelID = models.CreateChannelID(sub.Username, params.Username)
+			}
+		}
+
+		if params.Page < 1 {
+			params.Page = 1
+		}
+
+		results, total, err := models.SearchMessages(filter, params.Page, models.SearchResultsPerPage)
+		if err != nil {
+			var status = http.StatusInternalServerError
+			if err == models.ErrEmptySearchQuery {
+				status = http.StatusBadRequest
+			}
+			w.WriteHeader(status)
+			enc.Encode(result{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		if operator {
+			var args = []string{fmt.Sprintf("%q", params.Query)}
+			if params.Participant != "" {
+				args = append(args, "participant="+params.Participant)
+			}
+			if params.Channel != "" {
+				args = append(args, "channel="+params.Channel)
+			}
+			Audit(models.AuditSourceAPI, sub.Username, "search", params.Username, strings.Join(args, " "))
+		}
+
+		enc.Encode(result{
+			OK:      true,
+			Total:   total,
+			Page:    params.Page,
+			Pages:   (total + models.SearchResultsPerPage - 1) / models.SearchResultsPerPage,
+			Results: results,
+		})
+	})
+}
@@ -0,0 +1,149 @@
+package barertc
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestMessageSearch(t *testing.T) {
+	setupTestDatabase(t)
+	defer ClearEchoMessages("lobby")
+	if !models.SearchAvailable() {
+		t.Skip("SQLite FTS5 is not available: run the tests with -tags sqlite_fts5")
+	}
+	config.Current.DirectMessageHistory.Enabled = true
+	config.Current.ChannelHistory.Enabled = true
+	config.Current.JWT.Enabled = true
+	config.Current.JWT.SecretKey = "test"
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob", "carol")
+		alice = users[0]
+		bob   = users[1]
+		carol = users[2]
+	)
+	carol.JWTClaims = &jwt.Claims{IsAdmin: true}
+
+	// Log a few messages.
+	var dm = func(from *Subscriber, to, message string) int64 {
+		var msg = messages.Message{MessageID: messages.NextMessageID(), Username: from.Username, Message: message}
+		if err := (models.DirectMessage{}).LogMessage(from.Username, to, msg); err != nil {
+			t.Fatalf("LogMessage: %s", err)
+		}
+		return msg.MessageID
+	}
+	dm(alice, "bob", "<p>Lunch <em>tomorrow</em> &amp; coffee?</p>")
+	var oops = dm(bob, "alice", "<p>Lunch sounds great</p>")
+	dm(carol, "bob", "<p>Is lunch on the agenda?</p>")
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "anyone for lunch?"})
+
+	var search = func(endpoint string, sub *Subscriber, body string) (int, []models.SearchResult) {
+		token, err := IssueLoginToken(sub.Username)
+		if err != nil {
+			t.Fatalf("IssueLoginToken: %s", err)
+		}
+		var (
+			rec = httptest.NewRecorder()
+			req = httptest.NewRequest("POST", endpoint, strings.NewReader(
+				`{"JWTToken": "`+token+`", `+body+`}`,
+			))
+			result struct {
+				Results []models.SearchResult
+			}
+		)
+		req.Header.Set("Content-Type", "application/json")
+		if strings.HasSuffix(endpoint, "/all") {
+			s.OperatorMessageSearch().ServeHTTP(rec, req)
+		} else {
+			s.MessageSearch().ServeHTTP(rec, req)
+		}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec.Code, result.Results
+	}
+
+	// Alice finds only her own DMs, with the matches highlighted.
+	code, results := search("/api/message/search", alice, `"Query": "lunch"`)
+	if code != 200 || len(results) != 2 {
+		t.Fatalf("unexpected search results for alice (status %d): %+v", code, results)
+	}
+	if results[1].Snippet != "<mark>Lunch</mark> tomorrow &amp; coffee?" {
+		t.Errorf("unexpected snippet: %q", results[1].Snippet)
+	}
+
+	// Bob narrows down his search to his DMs with carol.
+	if _, results := search("/api/message/search", bob, `"Query": "lun*", "Username": "carol"`); len(results) != 1 || results[0].Username != "carol" {
+		t.Errorf("unexpected search results for bob with carol: %+v", results)
+	}
+
+	// Taken back messages are removed from the index.
+	if _, err := (models.DirectMessage{}).TakebackMessage("bob", oops, false); err != nil {
+		t.Fatalf("TakebackMessage: %s", err)
+	}
+	if _, results := search("/api/message/search", alice, `"Query": "great"`); len(results) != 0 {
+		t.Errorf("found a taken back message: %+v", results)
+	}
+
+	// Only operators search everything, including the channel logs.
+	if code, _ := search("/api/message/search/all", alice, `"Query": "lunch"`); code != 403 {
+		t.Errorf("expected a 403 error for alice's operator search, got %d", code)
+	}
+	if _, results := search("/api/message/search/all", carol, `"Query": "lunch", "Username": "alice"`); len(results) != 2 || results[0].ChannelID != "lobby" {
+		t.Errorf("unexpected operator search results: %+v", results)
+	}
+
+	// Clearing the DM history removes it from the index, but not bob's channel messages.
+	if _, err := (models.DirectMessage{}).ClearMessages("bob"); err != nil {
+		t.Fatalf("ClearMessages: %s", err)
+	}
+	if _, results := search("/api/message/search/all", carol, `"Query": "lunch"`); len(results) != 1 || results[0].ChannelID != "lobby" {
+		t.Errorf("unexpected operator search results after clearing bob's DMs: %+v", results)
+	}
+}
+
+func TestDirectMessageParticipants(t *testing.T) {
+	setupTestDatabase(t)
+	config.Current.DirectMessageHistory.Enabled = true
+
+	// Users from before usernames were checked could have LIKE wildcards in them.
+	for _, from := range []string{"%", "a_c", "abc"} {
+		var msg = messages.Message{MessageID: messages.NextMessageID(), Username: from, Message: "lunch?"}
+		if err := (models.DirectMessage{}).LogMessage(from, "bob", msg); err != nil {
+			t.Fatalf("LogMessage: %s", err)
+		}
+	}
+
+	for username, expect := range map[string]string{
+		"%":   "@%:@bob",
+		"a_c": "@a_c:@bob",
+		"abc": "@abc:@bob",
+	} {
+		if got, err := models.GetDistinctChannelIDs(username); err != nil {
+			t.Errorf("GetDistinctChannelIDs(%q): %s", username, err)
+		} else if len(got) != 1 || got[0] != expect {
+			t.Errorf("GetDistinctChannelIDs(%q): expected [%s], got %v", username, expect, got)
+		}
+	}
+	if models.SearchAvailable() {
+		if results, _, err := models.SearchMessages(models.MessageSearchFilter{Query: "lunch", Participant: "%"}, 1, 10); err != nil {
+			t.Errorf("SearchMessages: %s", err)
+		} else if len(results) != 1 || results[0].ChannelID != "@%:@bob" {
+			t.Errorf("the participant search found other users' DMs: %+v", results)
+		}
+	}
+
+	// Clearing one user's DMs leaves the others alone.
+	if count, err := (models.DirectMessage{}).ClearMessages("a_c"); err != nil || count != 1 {
+		t.Errorf("ClearMessages: expected to clear 1 message, got %d (%v)", count, err)
+	}
+	if got, _ := models.GetDistinctChannelIDs("bob"); len(got) != 2 {
+		t.Errorf("expected bob to have 2 threads left, got %v", got)
+	}
+}
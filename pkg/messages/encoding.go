@@ -0,0 +1,107 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Encoding of the messages on a WebSocket connection, negotiated by subprotocol when the
+// connection is accepted. JSON is the default, for clients that ask for no subprotocol.
+type Encoding int
+
+const (
+	EncodingJSON Encoding = iota // text frames of JSON
+	EncodingCBOR                 // binary frames of CBOR
+)
+
+// WebSocket subprotocols for the encodings.
+const (
+	SubprotocolJSON = "barertc.json"
+	SubprotocolCBOR = "barertc.cbor"
+)
+
+/*
+The CBOR encoding (https://cbor.io) of the messages is the same as the JSON: structs are
+maps keyed by their json tag names, with omitempty leaving out the empty Go values. The
+[]byte of a `file` message is carried as a byte string instead of a base64 string.
+
+The decoder rejects messages over its default limits on nesting (32 levels of arrays and
+maps) and on the elements of an array or map.
+*/
+var (
+	cborEncMode cbor.EncMode
+	cborDecMode cbor.DecMode
+)
+
+func init() {
+	var err error
+	if cborEncMode, err = (cbor.EncOptions{OmitEmpty: cbor.OmitEmptyGoValue}).EncMode(); err != nil {
+		panic(err)
+	}
+	if cborDecMode, err = (cbor.DecOptions{}).DecMode(); err != nil {
+		panic(err)
+	}
+}
+
+// Subprotocols lists the WebSocket subprotocols that the server supports, in the order it
+// prefers them when a client offers several.
+var Subprotocols = []string{SubprotocolCBOR, SubprotocolJSON}
+
+// EncodingForSubprotocol returns the encoding of a negotiated WebSocket subprotocol.
+func EncodingForSubprotocol(subprotocol string) Encoding {
+	if subprotocol == SubprotocolCBOR {
+		return EncodingCBOR
+	}
+	return EncodingJSON
+}
+
+// ParseEncoding parses the name of an encoding, e.g. from a settings file: "json" or "cbor".
+func ParseEncoding(name string) (Encoding, error) {
+	switch name {
+	case "", "json":
+		return EncodingJSON, nil
+	case "cbor":
+		return EncodingCBOR, nil
+	default:
+		return EncodingJSON, fmt.Errorf("unsupported message encoding: %s", name)
+	}
+}
+
+// String returns the name of the encoding.
+func (e Encoding) String() string {
+	if e == EncodingCBOR {
+		return "cbor"
+	}
+	return "json"
+}
+
+// Subprotocol returns the WebSocket subprotocol to ask for the encoding.
+func (e Encoding) Subprotocol() string {
+	if e == EncodingCBOR {
+		return SubprotocolCBOR
+	}
+	return SubprotocolJSON
+}
+
+// Binary returns whether the encoding is sent in binary (rather than text) WebSocket frames.
+func (e Encoding) Binary() bool {
+	return e == EncodingCBOR
+}
+
+// Marshal encodes a message.
+func (e Encoding) Marshal(v interface{}) ([]byte, error) {
+	if e == EncodingCBOR {
+		return cborEncMode.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes a message.
+func (e Encoding) Unmarshal(data []byte, v interface{}) error {
+	if e == EncodingCBOR {
+		return cborDecMode.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
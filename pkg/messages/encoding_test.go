@@ -0,0 +1,139 @@
+package messages_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+func TestCBOREncoding(t *testing.T) {
+	var enc = messages.EncodingForSubprotocol(messages.SubprotocolCBOR)
+	if enc != messages.EncodingCBOR || !enc.Binary() {
+		t.Fatalf("expected the CBOR encoding, got %s", enc)
+	}
+
+	// Known encodings from the CBOR spec.
+	data, err := enc.Marshal(messages.Message{Action: messages.ActionPing})
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if expect := append([]byte{0xa1, 0x66}, "action\x64ping"...); !bytes.Equal(data, expect) {
+		t.Errorf("unexpected encoding of a ping: % x", data)
+	}
+
+	// Every kind of field survives the round trip.
+	var msg = messages.Message{
+		Action:    messages.ActionEcho,
+		Channel:   "lobby",
+		Username:  "soandso",
+		Message:   strings.Repeat("a long message ", 30),
+		Seq:       70000,
+		MessageID: -1234567890123,
+		Private:   true,
+		Bytes:     bytes.Repeat([]byte{0, 1, 2, 255}, 100),
+		Quote:     &messages.Quote{MessageID: 42, Username: "alice"},
+		Reactions: messages.Reactions{"❤️": {"alice", "bob"}},
+		WhoList: []messages.WhoList{
+			{Username: "alice", Status: "online", Video: messages.VideoFlagActive | messages.VideoFlagNSFW, LoginAt: 1700000000},
+			{Username: "bob", Operator: true},
+		},
+		Messages: []messages.Message{
+			{Action: messages.ActionMessage, Message: "hi"},
+		},
+	}
+	data, err = enc.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+
+	var result messages.Message
+	if err := enc.Unmarshal(data, &result); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if !reflect.DeepEqual(msg, result) {
+		t.Errorf("the message changed in the round trip:\n%+v\n%+v", msg, result)
+	}
+
+	// It is more compact than JSON.
+	if jsonData, _ := messages.EncodingJSON.Marshal(msg); len(data) >= len(jsonData) {
+		t.Errorf("CBOR (%d bytes) is not smaller than JSON (%d bytes)", len(data), len(jsonData))
+	}
+
+	// Broken data is an error.
+	if err := enc.Unmarshal(data[:len(data)-1], &result); err == nil {
+		t.Errorf("expected an error for truncated data")
+	}
+}
+
+func TestCBORLimits(t *testing.T) {
+	var nested = func(depth int, prefix, open []byte) []byte {
+		var data = append([]byte{}, prefix...)
+		for i := 0; i < depth; i++ {
+			data = append(data, open...)
+		}
+		return append(data, 0xf6) // null
+	}
+	var (
+		unknownField = append([]byte{0xa1, 0x61}, 'x')           // {"x": ...}
+		messagesList = append([]byte{0xa1, 0x68}, "messages"...) // {"messages": ...}
+	)
+
+	// Not too deep.
+	var msg messages.Message
+	if err := messages.EncodingCBOR.Unmarshal(nested(20, unknownField, []byte{0x81}), &msg); err != nil {
+		t.Errorf("Unmarshal 20 arrays deep: %s", err)
+	}
+
+	// Far too deep or too long, in all the ways a message can nest.
+	for name, data := range map[string][]byte{
+		"arrays in an unknown field": nested(100000, unknownField, []byte{0x81}),
+		"maps in an unknown field":   nested(100000, unknownField, []byte{0xa1, 0x61, 'x'}),
+		"messages in messages":       nested(100000, nil, append(append([]byte{}, messagesList...), 0x81)),
+		"huge array header":          append(append([]byte{}, messagesList...), 0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff),
+		"long array header":          append(append([]byte{}, messagesList...), 0x9a, 0x0f, 0xff, 0xff, 0xff),
+	} {
+		if err := messages.EncodingCBOR.Unmarshal(data, &msg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	var value interface{}
+	if err := messages.EncodingCBOR.Unmarshal(nested(100000, messagesList, []byte{0x81}), &value); err == nil {
+		t.Errorf("expected an error decoding deep arrays into an interface")
+	}
+}
+
+func FuzzUnmarshalCBOR(f *testing.F) {
+	for _, msg := range []messages.Message{
+		{Action: messages.ActionPing},
+		{Action: messages.ActionMessage, Channel: "lobby", Message: "hello", MessageID: 42, Bytes: []byte{1, 2, 3}},
+		{Action: messages.ActionEcho, Messages: []messages.Message{{Action: messages.ActionMessage, Quote: &messages.Quote{MessageID: 1}}}},
+		{Action: messages.ActionWhoList, WhoList: []messages.WhoList{{Username: "alice", Video: 3}}, Reactions: messages.Reactions{"👍": {"bob"}}},
+	} {
+		data, err := messages.EncodingCBOR.Marshal(msg)
+		if err != nil {
+			f.Fatalf("Marshal: %s", err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{0xa1, 0x61, 'x', 0x81, 0x81, 0x81, 0xf6})
+	f.Add([]byte{0x9a, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg messages.Message
+		if err := messages.EncodingCBOR.Unmarshal(data, &msg); err != nil {
+			return
+		}
+
+		// What was decoded encodes and decodes again.
+		again, err := messages.EncodingCBOR.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		if err := messages.EncodingCBOR.Unmarshal(again, &msg); err != nil {
+			t.Fatalf("Unmarshal of % x: %s", again, err)
+		}
+	})
+}
@@ -20,6 +20,16 @@ func NextMessageID() int64 {
 	return mid
 }
 
+// SetMinimumMessageID makes sure that the next MessageIDs are higher than id, e.g. the
+// newest message ID stored in the database from before a reboot.
+func SetMinimumMessageID(id int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	if messageID < id {
+		messageID = id
+	}
+}
+
 /*
 Message is the basic carrier of WebSocket chat protocol actions.
 
@@ -36,24 +46,50 @@ type Message struct {
 	// JWT token for `login` actions.
 	JWTToken string `json:"jwt,omitempty"`
 
+	// Sent on `login` actions: the protocol version of the client (see ProtocolWhoDeltas).
+	Protocol int `json:"protocol,omitempty"`
+
+	// Sequence number of the messages from the server on a WebSocket connection, and the
+	// token to resume the connection with (sent on `me` and `resume` actions).
+	Seq         int64  `json:"seq,omitempty"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+
 	// WhoList for `who` actions
 	WhoList []WhoList `json:"whoList,omitempty"`
 
 	// Sent on `me` actions along with Username
-	VideoStatus int    `json:"video,omitempty"`  // user video flags
-	ChatStatus  string `json:"status,omitempty"` // online vs. away
-	DND         bool   `json:"dnd,omitempty"`    // Do Not Disturb, e.g. DMs are closed
+	VideoStatus int    `json:"video,omitempty"`      // user video flags
+	ChatStatus  string `json:"status,omitempty"`     // online vs. away
+	DND         bool   `json:"dnd,omitempty"`        // Do Not Disturb, e.g. DMs are closed
+	NoReceipts  bool   `json:"noReceipts,omitempty"` // do not send read receipts for DMs
 
 	// Message ID to support takebacks/local deletions
 	MessageID int64 `json:"msgID,omitempty"`
 
+	// Sent on `edit` actions, and on echoed or past messages that were edited.
+	Edited bool `json:"edited,omitempty"`
+
+	// Sent on `message` actions that reply to another message: the client gives the
+	// ReplyTo message ID, and the server attaches the Quote of it.
+	ReplyTo int64  `json:"replyTo,omitempty"`
+	Quote   *Quote `json:"quote,omitempty"`
+
+	// Sent on `react` and `unreact` actions, and on echoed or past messages: all the
+	// emoji reactions to the message so far.
+	Reactions Reactions `json:"reactions,omitempty"`
+
+	// Sent on past DMs from the history: whether the recipient has received and read them.
+	Delivered bool `json:"delivered,omitempty"`
+	Read      bool `json:"read,omitempty"`
+
 	// Sent on `open` actions along with the (other) Username.
 	OpenSecret string `json:"openSecret,omitempty"`
 
 	// Send on `file` actions, passing e.g. image data.
 	Bytes []byte `json:"bytes,omitempty"`
 
-	// Send on `blocklist` actions, for doing a `mute` on a list of users
+	// Send on `blocklist` actions, for doing a `mute` on a list of users,
+	// and on `who` actions for a Channel to list its members.
 	Usernames []string `json:"usernames,omitempty"`
 
 	// Sent on `report` actions.
@@ -61,6 +97,17 @@ type Message struct {
 	Reason    string `json:"reason,omitempty"`
 	Comment   string `json:"comment,omitempty"`
 
+	// Sent on `create` and `join` actions for created channels.
+	Password   string `json:"password,omitempty"`
+	Private    bool   `json:"private,omitempty"`
+	InviteOnly bool   `json:"inviteOnly,omitempty"`
+
+	// Sent on `channels` actions.
+	Channels []ChannelInfo `json:"channels,omitempty"`
+
+	// Sent on `pins` actions: the pinned messages of the Channel.
+	Pins []PinnedMessage `json:"pins,omitempty"`
+
 	// Sent on `echo` actions to condense multiple messages into one packet.
 	Messages []Message `json:"messages,omitempty"`
 
@@ -81,6 +128,12 @@ const (
 	ActionBlocklist   = "blocklist"    // mute in bulk for usernames
 	ActionReport      = "report"       // user reports a message
 	ActionVideoInvite = "video-invite" // user invites another to watch their webcam
+	ActionCreate      = "create"       // create a chat channel
+	ActionJoin        = "join"         // join a channel (the server echoes it back)
+	ActionPart        = "part"         // leave a channel (the server echoes it back)
+	ActionInvite      = "invite"       // invite a user to a created channel
+	ActionPin         = "pin"          // pin a message to the top of its channel
+	ActionUnpin       = "unpin"        // unpin a message
 
 	// Actions sent by server or client
 	ActionMessage  = "message"  // post a message to the room
@@ -92,8 +145,16 @@ const (
 	ActionUnwatch  = "unwatch"  // user has closed your video
 	ActionFile     = "file"     // image sharing in chat
 	ActionTakeback = "takeback" // user takes back (deletes) their message for everybody
+	ActionEdit     = "edit"     // user corrects their message for everybody
 	ActionReact    = "react"    // emoji reaction to a chat message
+	ActionUnreact  = "unreact"  // take back an emoji reaction
 	ActionTyping   = "typing"   // typing indicator for DM threads
+	ActionTopic    = "topic"    // set (or announce) the topic of a channel
+	ActionMOTD     = "motd"     // set (or announce) the message of the day
+
+	// Receipts for DMs, sent by the recipient and forwarded to the sender
+	ActionDeliver = "delivered" // acknowledge that a DM was received
+	ActionRead    = "read"      // acknowledge that DMs were read
 
 	// Actions sent by server only
 	ActionPing     = "ping"
@@ -102,12 +163,31 @@ const (
 	ActionCut      = "cut"        // tell the client to turn off their webcam
 	ActionError    = "error"      // ChatServer errors
 	ActionKick     = "disconnect" // client should disconnect (e.g. have been kicked).
+	ActionChannels = "channels"   // server pushes the created channels the user can see
+	ActionPins     = "pins"       // server pushes the pinned messages of a channel
 
 	// WebRTC signaling messages.
 	ActionCandidate = "candidate"
 	ActionSDP       = "sdp"
 )
 
+// Resuming a dropped WebSocket connection.
+const (
+	ActionResume = "resume" // server replies whether the connection has resumed
+)
+
+// Who List deltas, sent by the server instead of full `who` lists to clients that support them.
+const (
+	ActionWhoAdd    = "who-add"    // users who appeared on the Who List
+	ActionWhoUpdate = "who-update" // users whose Who List entry changed
+	ActionWhoRemove = "who-remove" // users who are no longer on the Who List
+)
+
+// Protocol versions that a client may send on login, to opt in to the newer messages.
+const (
+	ProtocolWhoDeltas = 2 // Who List deltas instead of full lists
+)
+
 // WhoList is a member entry in the chat room.
 type WhoList struct {
 	Username string `json:"username"`
@@ -126,6 +206,42 @@ type WhoList struct {
 	Gender     string `json:"gender,omitempty"`
 }
 
+// ChannelInfo describes a created channel to a user who may see it.
+type ChannelInfo struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Topic        string `json:"topic,omitempty"`
+	Owner        string `json:"owner"`
+	Private      bool   `json:"private,omitempty"`
+	InviteOnly   bool   `json:"inviteOnly,omitempty"`
+	Password     bool   `json:"password,omitempty"` // is password-protected
+	PermitPhotos bool   `json:"permitPhotos,omitempty"`
+
+	// The user's own standing in the channel.
+	Joined   bool `json:"joined,omitempty"`
+	Invited  bool `json:"invited,omitempty"`
+	Operator bool `json:"op,omitempty"`
+}
+
+// PinnedMessage is a message pinned to the top of a channel.
+type PinnedMessage struct {
+	MessageID int64  `json:"msgID"`
+	Username  string `json:"username"`
+	Message   string `json:"message"`
+	PinnedBy  string `json:"pinnedBy"`
+	Timestamp string `json:"timestamp"` // when it was pinned
+}
+
+// Reactions are the emoji reactions to a chat message: the usernames who reacted with each emoji.
+type Reactions map[string][]string
+
+// Quote is an excerpt of the message that a reply was to.
+type Quote struct {
+	MessageID int64  `json:"msgID"`
+	Username  string `json:"username"`
+	Excerpt   string `json:"excerpt,omitempty"` // plain text; blank if the server did not keep the message
+}
+
 // VideoFlags to convey the state and setting of users' cameras concisely.
 // Also see the VideoFlag object in BareRTC.js for front-end sync.
 const (
@@ -146,4 +262,8 @@ const (
 	PresenceKicked   = "has been kicked from the room!"
 	PresenceBanned   = "has been banned!"
 	PresenceTimedOut = "has timed out!"
+
+	// Sent with a Channel when a user joins or leaves one channel.
+	PresenceJoinedChannel = "has joined the channel."
+	PresenceLeftChannel   = "has left the channel."
 )
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// AuditLog is an entry in the append-only log of operator actions, e.g. kicks and
+// bans or the admin API calls made by your website.
+type AuditLog struct {
+	ID        int64
+	Actor     string // username of the operator, or "AdminAPIKey"
+	Action    string // e.g. "kick" or "ban"
+	Target    string // username, IP address or blank
+	Arguments string // other parameters of the action, e.g. a ban's duration and reason
+	Source    string // e.g. AuditSourceCommand or AuditSourceAPI
+	CreatedAt time.Time
+}
+
+// Audit log sources.
+const (
+	AuditSourceCommand = "command" // operator chat commands
+	AuditSourceAPI     = "api"     // the REST API, e.g. called by your website
+	AuditSourceBot     = "bot"     // chat commands of a chatbot
+	AuditSourceConsole = "console" // the admin console and moderation panel
+	AuditSourceFilter  = "filter"  // automatic kicks and bans by the message filters
+	AuditSourceFlood   = "flood"   // automatic kicks by the flood control
+)
+
+// AuditLogFilter narrows down a search of the audit log. Blank fields match everything.
+type AuditLogFilter struct {
+	Actor    string
+	Target   string
+	Username string // matches either the actor or the target
+	Action   string
+	Source   string
+	Since    time.Time
+	Until    time.Time
+}
+
+func (a AuditLog) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT,
+			arguments TEXT,
+			source TEXT NOT NULL,
+			created_at INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_audit_logs_actor ON audit_logs(actor COLLATE NOCASE);
+		CREATE INDEX IF NOT EXISTS idx_audit_logs_target ON audit_logs(target COLLATE NOCASE);
+		CREATE INDEX IF NOT EXISTS idx_audit_logs_created_at ON audit_logs(created_at);
+	`)
+	return err
+}
+
+// CreateAuditLog appends an entry to the audit log.
+func CreateAuditLog(entry AuditLog) (AuditLog, error) {
+	if DB == nil {
+		return entry, ErrNotInitialized
+	}
+
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+
+	res, err := DB.Exec(`
+		INSERT INTO audit_logs (actor, action, target, arguments, source, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, entry.Actor, entry.Action, entry.Target, entry.Arguments, entry.Source, entry.CreatedAt.Unix())
+	if err != nil {
+		return entry, err
+	}
+
+	entry.ID, err = res.LastInsertId()
+	return entry, err
+}
+
+// SearchAuditLogs returns a page of the audit log (newest first) along with the total
+// count of entries that match the filter. Pages start at 1.
+func SearchAuditLogs(filter AuditLogFilter, page, perPage int) ([]AuditLog, int, error) {
+	if DB == nil {
+		return nil, 0, ErrNotInitialized
+	}
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 1
+	}
+
+	// Build the WHERE clause.
+	var (
+		where  = []string{"1=1"}
+		params = []interface{}{}
+	)
+	if filter.Actor != "" {
+		where = append(where, "actor = ? COLLATE NOCASE")
+		params = append(params, filter.Actor)
+	}
+	if filter.Target != "" {
+		where = append(where, "target = ? COLLATE NOCASE")
+		params = append(params, filter.Target)
+	}
+	if filter.Username != "" {
+		where = append(where, "(actor = ? COLLATE NOCASE OR target = ? COLLATE NOCASE)")
+		params = append(params, filter.Username, filter.Username)
+	}
+	if filter.Action != "" {
+		where = append(where, "action = ?")
+		params = append(params, filter.Action)
+	}
+	if filter.Source != "" {
+		where = append(where, "source = ?")
+		params = append(params, filter.Source)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		params = append(params, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		params = append(params, filter.Until.Unix())
+	}
+	var whereClause = strings.Join(where, " AND ")
+
+	// Count the total.
+	var total int
+	if err := DB.QueryRow(
+		"SELECT COUNT(id) FROM audit_logs WHERE "+whereClause,
+		params...,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, actor, action, target, arguments, source, created_at
+		FROM audit_logs
+		WHERE `+whereClause+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, append(params, perPage, (page-1)*perPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var result = []AuditLog{}
+	for rows.Next() {
+		var (
+			entry             AuditLog
+			target, arguments *string
+			createdAt         int64
+		)
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.Actor,
+			&entry.Action,
+			&target,
+			&arguments,
+			&entry.Source,
+			&createdAt,
+		); err != nil {
+			return nil, 0, err
+		}
+
+		if target != nil {
+			entry.Target = *target
+		}
+		if arguments != nil {
+			entry.Arguments = *arguments
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+
+		result = append(result, entry)
+	}
+
+	return result, total, rows.Err()
+}
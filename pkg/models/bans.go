@@ -0,0 +1,218 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Ban is an entry on the chat server's ban list.
+//
+// A ban targets one Kind of value: an exact IP address, a CIDR range, a chat
+// username, or the JWT subject of a logged-in account.
+type Ban struct {
+	ID        int64
+	Kind      string
+	Value     string
+	Reason    string
+	Operator  string // username of the operator who issued the ban
+	CreatedAt time.Time
+	ExpiresAt time.Time // zero value = permanent ban
+}
+
+// Ban kinds.
+const (
+	BanKindIP       = "ip"
+	BanKindCIDR     = "cidr"
+	BanKindUsername = "username"
+	BanKindSubject  = "subject"
+)
+
+func (b Ban) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS bans (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			value TEXT NOT NULL,
+			reason TEXT,
+			operator TEXT,
+			created_at INTEGER,
+			expires_at INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_bans_kind_value ON bans(kind, value);
+		CREATE INDEX IF NOT EXISTS idx_bans_expires_at ON bans(expires_at);
+	`)
+	return err
+}
+
+// IsPermanent returns whether the ban never expires.
+func (b Ban) IsPermanent() bool {
+	return b.ExpiresAt.IsZero()
+}
+
+// IsExpired returns whether the ban has run out.
+func (b Ban) IsExpired() bool {
+	return !b.IsPermanent() && time.Now().After(b.ExpiresAt)
+}
+
+// CreateBan adds a ban to the database and returns it with its ID assigned.
+func CreateBan(ban Ban) (Ban, error) {
+	if DB == nil {
+		return ban, ErrNotInitialized
+	}
+
+	if ban.Kind == "" || ban.Value == "" {
+		return ban, errors.New("ban kind and value are required")
+	}
+
+	if ban.CreatedAt.IsZero() {
+		ban.CreatedAt = time.Now()
+	}
+
+	res, err := DB.Exec(`
+		INSERT INTO bans (kind, value, reason, operator, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ban.Kind, ban.Value, ban.Reason, ban.Operator, ban.CreatedAt.Unix(), unixOrZero(ban.ExpiresAt))
+	if err != nil {
+		return ban, err
+	}
+
+	ban.ID, err = res.LastInsertId()
+	return ban, err
+}
+
+// DeleteBan removes a ban by its ID.
+func DeleteBan(id int64) (bool, error) {
+	if DB == nil {
+		return false, ErrNotInitialized
+	}
+
+	res, err := DB.Exec("DELETE FROM bans WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteBansByValue removes every ban of a kind on the given value, returning the count removed.
+func DeleteBansByValue(kind, value string) (int, error) {
+	if DB == nil {
+		return 0, ErrNotInitialized
+	}
+
+	res, err := DB.Exec("DELETE FROM bans WHERE kind = ? AND value = ?", kind, value)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	return int(affected), err
+}
+
+// DeleteExpiredBans removes all bans that have run out, returning the count removed.
+func DeleteExpiredBans() (int, error) {
+	if DB == nil {
+		return 0, ErrNotInitialized
+	}
+
+	res, err := DB.Exec(
+		"DELETE FROM bans WHERE expires_at > 0 AND expires_at < ?",
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	return int(affected), err
+}
+
+// GetActiveBans returns all bans which have not yet expired, oldest first.
+func GetActiveBans() ([]Ban, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, kind, value, reason, operator, created_at, expires_at
+		FROM bans
+		WHERE expires_at = 0 OR expires_at >= ?
+		ORDER BY id ASC
+	`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []Ban{}
+	for rows.Next() {
+		var (
+			ban                  Ban
+			reason, operator     *string
+			createdAt, expiresAt int64
+		)
+		if err := rows.Scan(
+			&ban.ID,
+			&ban.Kind,
+			&ban.Value,
+			&reason,
+			&operator,
+			&createdAt,
+			&expiresAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if reason != nil {
+			ban.Reason = *reason
+		}
+		if operator != nil {
+			ban.Operator = *operator
+		}
+		ban.CreatedAt = time.Unix(createdAt, 0)
+		if expiresAt > 0 {
+			ban.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+
+		result = append(result, ban)
+	}
+
+	return result, rows.Err()
+}
+
+// BanExists checks whether an active ban already exists with this kind and value.
+func BanExists(kind, value string) (bool, error) {
+	if DB == nil {
+		return false, ErrNotInitialized
+	}
+
+	var (
+		count int
+		row   = DB.QueryRow(`
+			SELECT COUNT(id)
+			FROM bans
+			WHERE kind = ? AND value = ?
+			AND (expires_at = 0 OR expires_at >= ?)
+		`, kind, strings.TrimSpace(value), time.Now().Unix())
+	)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// unixOrZero returns the unix timestamp, or zero for the zero time value.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,278 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+// ChannelMessage is a chat message in the history of a public channel.
+type ChannelMessage struct {
+	MessageID int64
+	ChannelID string
+	Username  string
+	Message   string
+	Timestamp int64
+}
+
+const ChannelMessagePerPage = 50
+
+// ChannelHistoryEnabled returns whether public channel history is turned on and the database is ready.
+func ChannelHistoryEnabled() bool {
+	return DB != nil && config.Current.ChannelHistory.Enabled
+}
+
+func (cm ChannelMessage) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS channel_messages (
+			message_id INTEGER PRIMARY KEY,
+			channel_id TEXT,
+			username TEXT,
+			message TEXT,
+			timestamp INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_channel_messages_channel_id ON channel_messages(channel_id);
+		CREATE INDEX IF NOT EXISTS idx_channel_messages_username ON channel_messages(username);
+		CREATE INDEX IF NOT EXISTS idx_channel_messages_timestamp ON channel_messages(timestamp);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Delete old messages past the retention period.
+	if days := config.Current.ChannelHistory.RetentionDays; days > 0 {
+		cutoff := time.Now().Add(time.Duration(-days) * 24 * time.Hour)
+		log.Info("Deleting old channel history past %d days (cutoff: %s)", days, cutoff.Format(time.RFC3339))
+		_, err := DB.Exec(
+			"DELETE FROM channel_messages WHERE timestamp < ?",
+			cutoff.Unix(),
+		)
+		if err != nil {
+			log.Error("Error removing old channel messages: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// LogMessage adds a message to the history of a public channel.
+func (cm ChannelMessage) LogMessage(channelID string, msg messages.Message) error {
+	if !ChannelHistoryEnabled() {
+		return ErrNotInitialized
+	}
+
+	if msg.MessageID == 0 {
+		return errors.New("message did not have a MessageID")
+	}
+
+	var timestamp = time.Now().Unix()
+	_, err := DB.Exec(`
+		INSERT INTO channel_messages (message_id, channel_id, username, message, timestamp)
+		VALUES (?, ?, ?, ?, ?)
+	`, msg.MessageID, channelID, msg.Username, msg.Message, timestamp)
+	if err != nil {
+		return err
+	}
+
+	if err := logMessageReply(msg); err != nil {
+		log.Error("Error logging the quote of channel message %d: %s", msg.MessageID, err)
+	}
+
+	if err := indexMessage(msg.MessageID, channelID, msg.Username, msg.Message, timestamp); err != nil {
+		log.Error("Error indexing channel message %d for search: %s", msg.MessageID, err)
+	}
+
+	return nil
+}
+
+// TakebackMessage removes a message by its MID from the channel history.
+//
+// Like the DirectMessage TakebackMessage, it returns true if the message was found as sent
+// by this username (or isAdmin), to satisfy the permission check of the OnTakeback handler
+// for messages from a previous chat session.
+func (cm ChannelMessage) TakebackMessage(username string, messageID int64, isAdmin bool) (bool, error) {
+	if !ChannelHistoryEnabled() {
+		return false, ErrNotInitialized
+	}
+
+	var (
+		query  = "DELETE FROM channel_messages WHERE message_id = ? AND username = ?"
+		params = []interface{}{messageID, username}
+	)
+	if isAdmin {
+		query = "DELETE FROM channel_messages WHERE message_id = ?"
+		params = params[:1]
+	}
+
+	res, err := DB.Exec(query, params...)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil || count == 0 {
+		return false, err
+	}
+
+	if err := deleteMessageReply(messageID); err != nil {
+		return true, err
+	}
+
+	return true, unindexMessage(messageID)
+}
+
+// GetChannelMessage looks up a message in the channel history by its MID.
+func GetChannelMessage(messageID int64) (ChannelMessage, error) {
+	var cm ChannelMessage
+	if !ChannelHistoryEnabled() {
+		return cm, ErrNotInitialized
+	}
+
+	row := DB.QueryRow(`
+		SELECT message_id, channel_id, username, message, timestamp
+		FROM channel_messages
+		WHERE message_id = ?
+	`, messageID)
+	err := row.Scan(&cm.MessageID, &cm.ChannelID, &cm.Username, &cm.Message, &cm.Timestamp)
+	return cm, err
+}
+
+// EditMessage replaces the text of a message in the channel history.
+func (cm ChannelMessage) EditMessage(messageID int64, message string) error {
+	if !ChannelHistoryEnabled() {
+		return ErrNotInitialized
+	}
+
+	if _, err := DB.Exec(
+		"UPDATE channel_messages SET message = ? WHERE message_id = ?",
+		message, messageID,
+	); err != nil {
+		return err
+	}
+
+	return reindexMessage(messageID, message)
+}
+
+// PaginateChannelMessages returns a page of a channel's messages before the beforeID (newest
+// first), the count of remaining older messages, and an error.
+func PaginateChannelMessages(channelID string, beforeID int64, perPage int) ([]messages.Message, int, error) {
+	if !ChannelHistoryEnabled() {
+		return nil, 0, ErrNotInitialized
+	}
+
+	var (
+		result = []messages.Message{}
+
+		// Compute the remaining messages after finding the final messageID this page.
+		lastMessageID int64
+		remaining     int
+	)
+
+	if beforeID == 0 {
+		beforeID = math.MaxInt64
+	}
+
+	rows, err := DB.Query(`
+		SELECT channel_messages.message_id, channel_messages.username, message, timestamp,
+			EXISTS (SELECT 1 FROM message_edits WHERE message_edits.message_id = channel_messages.message_id),
+			message_replies.reply_to, message_replies.username, message_replies.excerpt
+		FROM channel_messages
+		LEFT JOIN message_replies ON (message_replies.message_id = channel_messages.message_id)
+		WHERE channel_id = ?
+		AND channel_messages.message_id < ?
+		ORDER BY channel_messages.message_id DESC
+		LIMIT ?
+	`, channelID, beforeID, perPage)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			row                    ChannelMessage
+			edited                 bool
+			replyTo                *int64
+			replyUsername, excerpt *string
+		)
+		if err := rows.Scan(
+			&row.MessageID,
+			&row.Username,
+			&row.Message,
+			&row.Timestamp,
+			&edited,
+			&replyTo,
+			&replyUsername,
+			&excerpt,
+		); err != nil {
+			return nil, 0, err
+		}
+
+		msg := messages.Message{
+			Action:    messages.ActionMessage,
+			Channel:   channelID,
+			MessageID: row.MessageID,
+			Username:  row.Username,
+			Message:   row.Message,
+			Timestamp: time.Unix(row.Timestamp, 0).Format(time.RFC3339),
+			Edited:    edited,
+			Quote:     scanQuote(replyTo, replyUsername, excerpt),
+		}
+		result = append(result, msg)
+		lastMessageID = msg.MessageID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Get a count of the remaining messages.
+	if len(result) > 0 {
+		row := DB.QueryRow(`
+			SELECT COUNT(message_id)
+			FROM channel_messages
+			WHERE channel_id = ?
+			AND message_id < ?
+		`, channelID, lastMessageID)
+		if err := row.Scan(&remaining); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// And their emoji reactions.
+	if err := attachReactions(channelID, result); err != nil {
+		return nil, 0, err
+	}
+
+	return result, remaining, nil
+}
+
+// MaxMessageID returns the newest MessageID stored in the DM and channel histories.
+func MaxMessageID() (int64, error) {
+	if DB == nil {
+		return 0, ErrNotInitialized
+	}
+
+	var (
+		maxID *int64
+		row   = DB.QueryRow(`
+			SELECT MAX(message_id) FROM (
+				SELECT MAX(message_id) AS message_id FROM direct_messages
+				UNION ALL
+				SELECT MAX(message_id) AS message_id FROM channel_messages
+			)
+		`)
+	)
+	if err := row.Scan(&maxID); err != nil || maxID == nil {
+		return 0, err
+	}
+	return *maxID, nil
+}
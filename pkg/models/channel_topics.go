@@ -0,0 +1,182 @@
+package models
+
+import (
+	"time"
+)
+
+// ChannelTopic is the topic of a public channel (from settings.toml). Created
+// channels keep their topic on the Channel itself.
+//
+// The message of the day is stored as the topic of the blank channel ID, MOTDChannel.
+type ChannelTopic struct {
+	ChannelID string
+	Topic     string
+	Username  string // who set it
+	UpdatedAt time.Time
+}
+
+// MOTDChannel is the ChannelID of the message of the day.
+const MOTDChannel = ""
+
+// PinnedMessage is a chat message that an operator pinned to the top of a channel.
+//
+// A copy of the message is kept, as chat messages are not otherwise stored.
+type PinnedMessage struct {
+	ChannelID string
+	MessageID int64
+	Username  string // author of the message
+	Message   string // its HTML
+	PinnedBy  string
+	CreatedAt time.Time
+}
+
+func (t ChannelTopic) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS channel_topics (
+			channel_id TEXT PRIMARY KEY COLLATE NOCASE,
+			topic TEXT NOT NULL,
+			username TEXT,
+			updated_at INTEGER
+		);
+
+		CREATE TABLE IF NOT EXISTS pinned_messages (
+			channel_id TEXT NOT NULL COLLATE NOCASE,
+			message_id INTEGER NOT NULL,
+			username TEXT NOT NULL,
+			message TEXT NOT NULL,
+			pinned_by TEXT NOT NULL,
+			created_at INTEGER,
+			PRIMARY KEY (channel_id, message_id)
+		);
+	`)
+	return err
+}
+
+// GetChannelTopics returns the topics of the public channels, and the message of the day.
+func GetChannelTopics() ([]ChannelTopic, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT channel_id, topic, username, updated_at
+		FROM channel_topics
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []ChannelTopic{}
+	for rows.Next() {
+		var (
+			topic     ChannelTopic
+			username  *string
+			updatedAt int64
+		)
+		if err := rows.Scan(&topic.ChannelID, &topic.Topic, &username, &updatedAt); err != nil {
+			return nil, err
+		}
+		if username != nil {
+			topic.Username = *username
+		}
+		topic.UpdatedAt = time.Unix(updatedAt, 0)
+		result = append(result, topic)
+	}
+
+	return result, rows.Err()
+}
+
+// SetChannelTopic creates or updates the topic of a channel. A blank topic removes it.
+func SetChannelTopic(topic ChannelTopic) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	if topic.Topic == "" {
+		_, err := DB.Exec(`DELETE FROM channel_topics WHERE channel_id = ?`, topic.ChannelID)
+		return err
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO channel_topics (channel_id, topic, username, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (channel_id) DO UPDATE SET
+			topic = excluded.topic,
+			username = excluded.username,
+			updated_at = excluded.updated_at
+	`, topic.ChannelID, topic.Topic, topic.Username, topic.UpdatedAt.Unix())
+	return err
+}
+
+// GetPinnedMessages returns the pinned messages of every channel, oldest first.
+func GetPinnedMessages() ([]PinnedMessage, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT channel_id, message_id, username, message, pinned_by, created_at
+		FROM pinned_messages
+		ORDER BY created_at, message_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []PinnedMessage{}
+	for rows.Next() {
+		var (
+			pin       PinnedMessage
+			createdAt int64
+		)
+		if err := rows.Scan(&pin.ChannelID, &pin.MessageID, &pin.Username, &pin.Message, &pin.PinnedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		pin.CreatedAt = time.Unix(createdAt, 0)
+		result = append(result, pin)
+	}
+
+	return result, rows.Err()
+}
+
+// PinMessage stores a pinned message.
+func PinMessage(pin PinnedMessage) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		INSERT OR REPLACE INTO pinned_messages (channel_id, message_id, username, message, pinned_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, pin.ChannelID, pin.MessageID, pin.Username, pin.Message, pin.PinnedBy, pin.CreatedAt.Unix())
+	return err
+}
+
+// UnpinMessage removes a pinned message from a channel.
+func UnpinMessage(channelID string, messageID int64) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		DELETE FROM pinned_messages
+		WHERE channel_id = ? AND message_id = ?
+	`, channelID, messageID)
+	return err
+}
+
+// DeleteChannelPins removes all of the pinned messages of a channel, e.g. when it is closed.
+func DeleteChannelPins(channelID string) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`DELETE FROM pinned_messages WHERE channel_id = ?`, channelID)
+	return err
+}
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Channel is a chat room created at runtime by a user (the /create command), as
+// opposed to the PublicChannels configured in settings.toml.
+type Channel struct {
+	ID           string // like "movie-night"
+	Name         string // like "Movie Night"
+	Owner        string // username of the creator
+	Topic        string
+	Private      bool // hidden from everybody but its members
+	InviteOnly   bool // users need an invite to join
+	PasswordHash string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// ChannelMember is a user's role in a created channel.
+type ChannelMember struct {
+	ChannelID string
+	Username  string
+	Role      string // e.g. ChannelRoleMember
+	CreatedAt time.Time
+}
+
+// Roles of users in a created channel.
+const (
+	ChannelRoleInvited  = "invited"  // may join, but has not yet
+	ChannelRoleMember   = "member"   // has joined the channel
+	ChannelRoleOperator = "operator" // has joined, and may set the topic and invite others
+)
+
+// Errors about created channels.
+var (
+	ErrChannelExists   = errors.New("that channel already exists")
+	ErrChannelNotFound = errors.New("channel not found")
+)
+
+func (c Channel) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS channels (
+			id TEXT PRIMARY KEY COLLATE NOCASE,
+			name TEXT NOT NULL,
+			owner TEXT NOT NULL,
+			topic TEXT,
+			private INTEGER NOT NULL DEFAULT 0,
+			invite_only INTEGER NOT NULL DEFAULT 0,
+			password_hash TEXT,
+			created_at INTEGER,
+			updated_at INTEGER
+		);
+
+		CREATE TABLE IF NOT EXISTS channel_members (
+			channel_id TEXT NOT NULL COLLATE NOCASE,
+			username TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at INTEGER,
+			PRIMARY KEY (channel_id, username)
+		);
+	`)
+	return err
+}
+
+// SetPassword hashes and sets the channel's password, or removes it if blank. It does not save the channel.
+func (c *Channel) SetPassword(password string) error {
+	if password == "" {
+		c.PasswordHash = ""
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	c.PasswordHash = string(hash)
+	return nil
+}
+
+// HasPassword tells whether the channel is password-protected.
+func (c Channel) HasPassword() bool {
+	return c.PasswordHash != ""
+}
+
+// CheckPassword verifies the channel's password.
+func (c Channel) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(c.PasswordHash), []byte(password)) == nil
+}
+
+// CreateChannel adds a new channel to the database.
+//
+// Returns ErrChannelExists if the channel ID is taken.
+func CreateChannel(ch Channel) (Channel, error) {
+	if DB == nil {
+		return ch, ErrNotInitialized
+	}
+
+	var now = time.Now()
+	ch.CreatedAt = now
+	ch.UpdatedAt = now
+
+	_, err := DB.Exec(`
+		INSERT INTO channels (id, name, owner, topic, private, invite_only, password_hash, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		ch.ID, ch.Name, ch.Owner, ch.Topic, ch.Private, ch.InviteOnly, ch.PasswordHash,
+		ch.CreatedAt.Unix(), ch.UpdatedAt.Unix(),
+	)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ch, ErrChannelExists
+	}
+	return ch, err
+}
+
+// SaveChannel updates the settings of an existing channel.
+func SaveChannel(ch Channel) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		UPDATE channels
+		SET name = ?, owner = ?, topic = ?, private = ?, invite_only = ?, password_hash = ?, updated_at = ?
+		WHERE id = ?
+	`,
+		ch.Name, ch.Owner, ch.Topic, ch.Private, ch.InviteOnly, ch.PasswordHash, time.Now().Unix(),
+		ch.ID,
+	)
+	return err
+}
+
+// DeleteChannel removes a channel and its members.
+func DeleteChannel(id string) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	if _, err := DB.Exec(`DELETE FROM channel_members WHERE channel_id = ?`, id); err != nil {
+		return err
+	}
+	_, err := DB.Exec(`DELETE FROM channels WHERE id = ?`, id)
+	return err
+}
+
+// GetChannels returns all of the created channels.
+func GetChannels() ([]Channel, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, name, owner, topic, private, invite_only, password_hash, created_at, updated_at
+		FROM channels
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []Channel{}
+	for rows.Next() {
+		var (
+			ch                   Channel
+			topic, passwordHash  *string
+			createdAt, updatedAt int64
+		)
+		if err := rows.Scan(
+			&ch.ID,
+			&ch.Name,
+			&ch.Owner,
+			&topic,
+			&ch.Private,
+			&ch.InviteOnly,
+			&passwordHash,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if topic != nil {
+			ch.Topic = *topic
+		}
+		if passwordHash != nil {
+			ch.PasswordHash = *passwordHash
+		}
+		ch.CreatedAt = time.Unix(createdAt, 0)
+		ch.UpdatedAt = time.Unix(updatedAt, 0)
+
+		result = append(result, ch)
+	}
+
+	return result, rows.Err()
+}
+
+// GetChannelMembers returns the members (and invitees) of every created channel.
+func GetChannelMembers() ([]ChannelMember, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT channel_id, username, role, created_at
+		FROM channel_members
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []ChannelMember{}
+	for rows.Next() {
+		var (
+			member    ChannelMember
+			createdAt int64
+		)
+		if err := rows.Scan(&member.ChannelID, &member.Username, &member.Role, &createdAt); err != nil {
+			return nil, err
+		}
+		member.CreatedAt = time.Unix(createdAt, 0)
+		result = append(result, member)
+	}
+
+	return result, rows.Err()
+}
+
+// SetChannelMember creates or updates the role of a user in a channel. A blank
+// role removes the user from the channel.
+func SetChannelMember(channelID, username, role string) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	if role == "" {
+		_, err := DB.Exec(`
+			DELETE FROM channel_members
+			WHERE channel_id = ? AND username = ?
+		`, channelID, username)
+		return err
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO channel_members (channel_id, username, role, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (channel_id, username) DO UPDATE SET
+			role = excluded.role
+	`, channelID, username, role, time.Now().Unix())
+	return err
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -21,9 +22,57 @@ func Initialize(connString string) error {
 	DB = db
 
 	// Run table migrations
-	if err := (DirectMessage{}).CreateTable(); err != nil {
-		return err
+	for _, table := range []interface{ CreateTable() error }{
+		DirectMessage{},
+		ChannelMessage{},
+		Ban{},
+		UserIP{},
+		UserRole{},
+		User{},
+		LoginLockout{},
+		AuditLog{},
+		Channel{},
+		ChannelTopic{},
+		MessageReply{},
+		MessageEdit{},
+		MessageReaction{},
+		MessageSearch{},
+		Mailbox{},
+		PendingMessage{},
+	} {
+		if err := table.CreateTable(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// addColumn adds a new column to a table that was created by an older version of the
+// chat server, if it does not have it yet. Returns whether the column was added.
+func addColumn(table, column, definition string) (bool, error) {
+	rows, err := DB.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	if _, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
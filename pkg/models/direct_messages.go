@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"git.kirsle.net/apps/barertc/pkg/config"
 	"git.kirsle.net/apps/barertc/pkg/log"
@@ -23,6 +24,14 @@ type DirectMessage struct {
 
 const DirectMessagePerPage = 20
 
+// DirectMessageHistoryEnabled returns whether DM history is turned on and the database is ready.
+//
+// The database is always opened to hold the ban list, so the DM functions below additionally
+// check the DirectMessageHistory setting before they store or return anything.
+func DirectMessageHistoryEnabled() bool {
+	return DB != nil && config.Current.DirectMessageHistory.Enabled
+}
+
 func (dm DirectMessage) CreateTable() error {
 	if DB == nil {
 		return ErrNotInitialized
@@ -34,7 +43,10 @@ func (dm DirectMessage) CreateTable() error {
 			channel_id TEXT,
 			username TEXT,
 			message TEXT,
-			timestamp INTEGER
+			timestamp INTEGER,
+			delivered_at INTEGER,
+			read_at INTEGER,
+			read_private INTEGER NOT NULL DEFAULT 0
 		);
 
 		CREATE INDEX IF NOT EXISTS idx_direct_messages_channel_id ON direct_messages(channel_id);
@@ -45,6 +57,24 @@ func (dm DirectMessage) CreateTable() error {
 		return err
 	}
 
+	// The delivery and read receipts of the DMs. The messages from before they were kept
+	// count as delivered and read, or the whole history would show up as unread.
+	for _, column := range [][3]string{
+		{"delivered_at", "INTEGER", "UPDATE direct_messages SET delivered_at = timestamp"},
+		{"read_at", "INTEGER", "UPDATE direct_messages SET read_at = timestamp"},
+		{"read_private", "INTEGER NOT NULL DEFAULT 0", ""},
+	} {
+		added, err := addColumn("direct_messages", column[0], column[1])
+		if err != nil {
+			return err
+		}
+		if added && column[2] != "" {
+			if _, err := DB.Exec(column[2]); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Delete old messages past the retention period.
 	if days := config.Current.DirectMessageHistory.RetentionDays; days > 0 {
 		cutoff := time.Now().Add(time.Duration(-days) * 24 * time.Hour)
@@ -63,7 +93,7 @@ func (dm DirectMessage) CreateTable() error {
 
 // LogMessage adds a message to the DM history between two users.
 func (dm DirectMessage) LogMessage(fromUsername, toUsername string, msg messages.Message) error {
-	if DB == nil {
+	if !DirectMessageHistoryEnabled() {
 		return ErrNotInitialized
 	}
 
@@ -80,21 +110,29 @@ func (dm DirectMessage) LogMessage(fromUsername, toUsername string, msg messages
 		INSERT INTO direct_messages (message_id, channel_id, username, message, timestamp)
 		VALUES (?, ?, ?, ?, ?)
 	`, msg.MessageID, channelID, fromUsername, msg.Message, timestamp)
+	if err != nil {
+		return err
+	}
+
+	if err := logMessageReply(msg); err != nil {
+		log.Error("Error logging the quote of DM %d: %s", msg.MessageID, err)
+	}
 
-	return err
+	if err := indexMessage(msg.MessageID, channelID, fromUsername, msg.Message, timestamp); err != nil {
+		log.Error("Error indexing DM %d for search: %s", msg.MessageID, err)
+	}
+
+	return nil
 }
 
 // ClearMessages clears all stored DMs that the username as a participant in.
 func (dm DirectMessage) ClearMessages(username string) (int, error) {
-	if DB == nil {
+	if !DirectMessageHistoryEnabled() {
 		return 0, ErrNotInitialized
 	}
 
-	var placeholders = []interface{}{
-		fmt.Sprintf("@%s:%%", username), // `@alice:%`
-		fmt.Sprintf("%%:@%s", username), // `%:@alice`
-		username,
-	}
+	participant, placeholders := participantClause(username)
+	placeholders = append(placeholders, username)
 
 	// Count all the messages we'll delete.
 	var (
@@ -102,7 +140,7 @@ func (dm DirectMessage) ClearMessages(username string) (int, error) {
 		row   = DB.QueryRow(`
 			SELECT COUNT(message_id)
 			FROM direct_messages
-			WHERE (channel_id LIKE ? OR channel_id LIKE ?)
+			WHERE `+participant+`
 			OR username = ?
 		`, placeholders...)
 	)
@@ -113,11 +151,26 @@ func (dm DirectMessage) ClearMessages(username string) (int, error) {
 	// Delete them all.
 	_, err := DB.Exec(`
 		DELETE FROM direct_messages
-		WHERE (channel_id LIKE ? OR channel_id LIKE ?)
+		WHERE `+participant+`
 		OR username = ?
 	`, placeholders...)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := deleteDirectMessageEdits(username); err != nil {
+		return 0, err
+	}
+
+	if err := deleteDirectMessageReactions(username); err != nil {
+		return 0, err
+	}
 
-	return count, err
+	if err := pruneMessageReplies(); err != nil {
+		return 0, err
+	}
+
+	return count, unindexDirectMessages(username)
 }
 
 // TakebackMessage removes a message by its MID from the DM history.
@@ -128,7 +181,7 @@ func (dm DirectMessage) ClearMessages(username string) (int, error) {
 // boolean true that the username/messageID matched which will satisfy the permission check
 // in the OnTakeback handler.
 func (dm DirectMessage) TakebackMessage(username string, messageID int64, isAdmin bool) (bool, error) {
-	if DB == nil {
+	if !DirectMessageHistoryEnabled() {
 		return false, ErrNotInitialized
 	}
 
@@ -152,14 +205,101 @@ func (dm DirectMessage) TakebackMessage(username string, messageID int64, isAdmi
 		"DELETE FROM direct_messages WHERE message_id = ?",
 		messageID,
 	)
+	if err == nil {
+		err = deleteMessageReply(messageID)
+	}
+	if err == nil {
+		err = unindexMessage(messageID)
+	}
 
 	// Return that it was successfully validated and deleted.
 	return err == nil, err
 }
 
+// GetDirectMessage looks up a message in the DM history by its MID.
+func GetDirectMessage(messageID int64) (DirectMessage, error) {
+	var dm DirectMessage
+	if !DirectMessageHistoryEnabled() {
+		return dm, ErrNotInitialized
+	}
+
+	row := DB.QueryRow(`
+		SELECT message_id, channel_id, username, message, timestamp
+		FROM direct_messages
+		WHERE message_id = ?
+	`, messageID)
+	err := row.Scan(&dm.MessageID, &dm.ChannelID, &dm.Username, &dm.Message, &dm.Timestamp)
+	return dm, err
+}
+
+// EditMessage replaces the text of a message in the DM history.
+func (dm DirectMessage) EditMessage(messageID int64, message string) error {
+	if !DirectMessageHistoryEnabled() {
+		return ErrNotInitialized
+	}
+
+	if _, err := DB.Exec(
+		"UPDATE direct_messages SET message = ? WHERE message_id = ?",
+		message, messageID,
+	); err != nil {
+		return err
+	}
+
+	return reindexMessage(messageID, message)
+}
+
+// MarkDelivered records that a DM from the sender was received by the recipient's chat
+// client, and returns whether it was not marked before.
+func (dm DirectMessage) MarkDelivered(fromUsername, toUsername string, messageID int64) (bool, error) {
+	if !DirectMessageHistoryEnabled() {
+		return false, ErrNotInitialized
+	}
+
+	res, err := DB.Exec(`
+		UPDATE direct_messages
+		SET delivered_at = ?
+		WHERE message_id = ?
+		AND channel_id = ?
+		AND username = ?
+		AND delivered_at IS NULL
+	`, time.Now().Unix(), messageID, CreateChannelID(fromUsername, toUsername), fromUsername)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// MarkRead records that the recipient has read the DMs from the sender, up to and including
+// the messageID, and returns how many were not marked before.
+//
+// With private, the messages only count as read for the recipient's unread counts, and the
+// sender does not see the read receipt.
+func (dm DirectMessage) MarkRead(fromUsername, toUsername string, messageID int64, private bool) (int64, error) {
+	if !DirectMessageHistoryEnabled() {
+		return 0, ErrNotInitialized
+	}
+
+	var now = time.Now().Unix()
+	res, err := DB.Exec(`
+		UPDATE direct_messages
+		SET read_at = ?, read_private = ?, delivered_at = COALESCE(delivered_at, ?)
+		WHERE channel_id = ?
+		AND username = ?
+		AND message_id <= ?
+		AND read_at IS NULL
+	`, now, private, now, CreateChannelID(fromUsername, toUsername), fromUsername, messageID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 // PaginateDirectMessages returns a page of messages, the count of remaining, and an error.
 func PaginateDirectMessages(fromUsername, toUsername string, beforeID int64) ([]messages.Message, int, error) {
-	if DB == nil {
+	if !DirectMessageHistoryEnabled() {
 		return nil, 0, ErrNotInitialized
 	}
 
@@ -177,11 +317,15 @@ func PaginateDirectMessages(fromUsername, toUsername string, beforeID int64) ([]
 	}
 
 	rows, err := DB.Query(`
-		SELECT message_id, username, message, timestamp
+		SELECT direct_messages.message_id, direct_messages.username, message, timestamp,
+			delivered_at IS NOT NULL, read_at IS NOT NULL AND read_private = 0,
+			EXISTS (SELECT 1 FROM message_edits WHERE message_edits.message_id = direct_messages.message_id),
+			message_replies.reply_to, message_replies.username, message_replies.excerpt
 		FROM direct_messages
+		LEFT JOIN message_replies ON (message_replies.message_id = direct_messages.message_id)
 		WHERE channel_id = ?
-		AND message_id < ?
-		ORDER BY message_id DESC
+		AND direct_messages.message_id < ?
+		ORDER BY direct_messages.message_id DESC
 		LIMIT ?
 	`, channelID, beforeID, DirectMessagePerPage)
 	if err != nil {
@@ -189,12 +333,24 @@ func PaginateDirectMessages(fromUsername, toUsername string, beforeID int64) ([]
 	}
 
 	for rows.Next() {
-		var row DirectMessage
+		var (
+			row                    DirectMessage
+			delivered, read        bool
+			edited                 bool
+			replyTo                *int64
+			replyUsername, excerpt *string
+		)
 		if err := rows.Scan(
 			&row.MessageID,
 			&row.Username,
 			&row.Message,
 			&row.Timestamp,
+			&delivered,
+			&read,
+			&edited,
+			&replyTo,
+			&replyUsername,
+			&excerpt,
 		); err != nil {
 			return nil, 0, err
 		}
@@ -204,6 +360,10 @@ func PaginateDirectMessages(fromUsername, toUsername string, beforeID int64) ([]
 			Username:  row.Username,
 			Message:   row.Message,
 			Timestamp: time.Unix(row.Timestamp, 0).Format(time.RFC3339),
+			Edited:    edited,
+			Quote:     scanQuote(replyTo, replyUsername, excerpt),
+			Delivered: delivered,
+			Read:      read,
 		}
 		result = append(result, msg)
 		lastMessageID = msg.MessageID
@@ -220,15 +380,21 @@ func PaginateDirectMessages(fromUsername, toUsername string, beforeID int64) ([]
 		return nil, 0, err
 	}
 
+	// And their emoji reactions.
+	if err := attachReactions(channelID, result); err != nil {
+		return nil, 0, err
+	}
+
 	return result, remaining, nil
 }
 
 // PaginateUsernames returns a page of usernames that the current user has conversations with.
 //
-// Returns the usernames, total count, pages, and error.
-func PaginateUsernames(fromUsername, sort string, page, perPage int) ([]string, int, int, error) {
-	if DB == nil {
-		return nil, 0, 0, ErrNotInitialized
+// Returns the usernames, the count of unread messages from each of them (only those
+// with unread messages are in the map), total count, pages, and error.
+func PaginateUsernames(fromUsername, sort string, page, perPage int) ([]string, map[string]int, int, int, error) {
+	if !DirectMessageHistoryEnabled() {
+		return nil, nil, 0, 0, ErrNotInitialized
 	}
 
 	var (
@@ -266,12 +432,12 @@ func PaginateUsernames(fromUsername, sort string, page, perPage int) ([]string,
 	// causes a full table scan index which is very inefficient!
 	channelIDs, err := GetDistinctChannelIDs(fromUsername)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, nil, 0, 0, err
 	}
 
 	// No channel IDs = no response to fetch.
 	if len(channelIDs) == 0 {
-		return nil, 0, 0, errors.New("you have no direct messages stored on this chat server")
+		return nil, nil, 0, 0, errors.New("you have no direct messages stored on this chat server")
 	}
 
 	var (
@@ -305,7 +471,7 @@ func PaginateUsernames(fromUsername, sort string, page, perPage int) ([]string,
 		params...,
 	)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, nil, 0, 0, err
 	}
 
 	for rows.Next() {
@@ -313,7 +479,7 @@ func PaginateUsernames(fromUsername, sort string, page, perPage int) ([]string,
 		if err := rows.Scan(
 			&username,
 		); err != nil {
-			return nil, 0, 0, err
+			return nil, nil, 0, 0, err
 		}
 
 		result = append(result, username)
@@ -327,27 +493,72 @@ func PaginateUsernames(fromUsername, sort string, page, perPage int) ([]string,
 		pages = 1
 	}
 
-	return result, count, pages, nil
+	// Count the unread messages from them.
+	counts, err := countUnread(fromUsername, channelIDs)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	var unread = map[string]int{}
+	for _, username := range result {
+		if count, ok := counts[username]; ok {
+			unread[username] = count
+		}
+	}
+
+	return result, unread, count, pages, nil
+}
+
+// countUnread counts the unread messages from the other party of each DM thread.
+func countUnread(username string, channelIDs []string) (map[string]int, error) {
+	var (
+		result = map[string]int{}
+		params = []interface{}{}
+	)
+	for _, cid := range channelIDs {
+		params = append(params, cid)
+	}
+	params = append(params, username)
+
+	rows, err := DB.Query(fmt.Sprintf(`
+		SELECT username, COUNT(message_id)
+		FROM direct_messages
+		WHERE channel_id IN (%s)
+		AND username <> ?
+		AND read_at IS NULL
+		GROUP BY username`,
+		"?"+strings.Repeat(",?", len(channelIDs)-1),
+	), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			username string
+			count    int
+		)
+		if err := rows.Scan(&username, &count); err != nil {
+			return nil, err
+		}
+		result[username] = count
+	}
+
+	return result, rows.Err()
 }
 
 // GetDistinctChannelIDs collects all of the conversation thread IDs the current user is a party to.
 func GetDistinctChannelIDs(username string) ([]string, error) {
 	var (
-		result     = []string{}
-		channelIDs = []string{
-			fmt.Sprintf(`@%s:%%`, username),
-			fmt.Sprintf(`%%:@%s`, username),
-		}
+		result              = []string{}
+		participant, params = participantClause(username)
 	)
 
 	rows, err := DB.Query(`
 		SELECT distinct(channel_id)
 		FROM direct_messages
-		WHERE (
-			channel_id LIKE ?
-			OR channel_id LIKE ?
-		)
-	`, channelIDs[0], channelIDs[1])
+		WHERE `+participant, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -363,6 +574,22 @@ func GetDistinctChannelIDs(username string) ([]string, error) {
 	return result, nil
 }
 
+// participantClause returns an SQL condition (and its parameters) matching the DM channel IDs
+// that the username is a party to: `@alice:@bob` for alice or bob.
+//
+// The start or end of the channel ID is compared exactly: a LIKE pattern would treat any
+// `%` or `_` in the username as a wildcard and match other users' conversations.
+func participantClause(username string) (string, []interface{}) {
+	var (
+		prefix = "@" + username + ":"
+		suffix = ":@" + username
+	)
+	return "(substr(channel_id, 1, ?) = ? OR substr(channel_id, -?) = ?)", []interface{}{
+		utf8.RuneCountInString(prefix), prefix,
+		utf8.RuneCountInString(suffix), suffix,
+	}
+}
+
 // CreateChannelID returns a deterministic channel ID for a direct message conversation.
 //
 // The usernames (passed in any order) are sorted alphabetically and composed into the channel ID.
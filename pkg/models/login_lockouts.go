@@ -0,0 +1,138 @@
+package models
+
+import (
+	"time"
+)
+
+// LoginLockout records a temporary lockout after too many failed attempts on an
+// authentication endpoint, e.g. guessing passwords on the login page.
+//
+// The table is a durable log of lockout events: operators can review it, and the
+// chat server counts recent lockouts to decide when to escalate to an IP ban.
+type LoginLockout struct {
+	ID          int64
+	Kind        string // LockoutKindIP or LockoutKindUsername
+	Value       string
+	Endpoint    string // e.g. "/api/login"
+	Failures    int    // failed attempts counted in the window
+	LockedUntil time.Time
+	CreatedAt   time.Time
+}
+
+// Lockout kinds.
+const (
+	LockoutKindIP       = "ip"
+	LockoutKindUsername = "username"
+)
+
+func (l LoginLockout) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS login_lockouts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			value TEXT NOT NULL,
+			endpoint TEXT,
+			failures INTEGER,
+			locked_until INTEGER,
+			created_at INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_login_lockouts_kind_value ON login_lockouts(kind, value, created_at);
+	`)
+	return err
+}
+
+// CreateLoginLockout logs a lockout event.
+func CreateLoginLockout(lockout LoginLockout) (LoginLockout, error) {
+	if DB == nil {
+		return lockout, ErrNotInitialized
+	}
+
+	if lockout.CreatedAt.IsZero() {
+		lockout.CreatedAt = time.Now()
+	}
+
+	res, err := DB.Exec(`
+		INSERT INTO login_lockouts (kind, value, endpoint, failures, locked_until, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`,
+		lockout.Kind, lockout.Value, lockout.Endpoint, lockout.Failures,
+		lockout.LockedUntil.Unix(), lockout.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return lockout, err
+	}
+
+	lockout.ID, err = res.LastInsertId()
+	return lockout, err
+}
+
+// CountLoginLockouts returns how many lockouts a value has had since the given time.
+func CountLoginLockouts(kind, value string, since time.Time) (int, error) {
+	if DB == nil {
+		return 0, ErrNotInitialized
+	}
+
+	var (
+		count int
+		row   = DB.QueryRow(`
+			SELECT COUNT(id)
+			FROM login_lockouts
+			WHERE kind = ? AND value = ? AND created_at >= ?
+		`, kind, value, since.Unix())
+	)
+	err := row.Scan(&count)
+	return count, err
+}
+
+// GetRecentLoginLockouts returns the most recent lockout events, newest first.
+func GetRecentLoginLockouts(limit int) ([]LoginLockout, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, kind, value, endpoint, failures, locked_until, created_at
+		FROM login_lockouts
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []LoginLockout{}
+	for rows.Next() {
+		var (
+			lockout                LoginLockout
+			endpoint               *string
+			lockedUntil, createdAt int64
+		)
+		if err := rows.Scan(
+			&lockout.ID,
+			&lockout.Kind,
+			&lockout.Value,
+			&endpoint,
+			&lockout.Failures,
+			&lockedUntil,
+			&createdAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if endpoint != nil {
+			lockout.Endpoint = *endpoint
+		}
+		lockout.LockedUntil = time.Unix(lockedUntil, 0)
+		lockout.CreatedAt = time.Unix(createdAt, 0)
+
+		result = append(result, lockout)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,242 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+// Mailbox holds the settings of a user from their last chat session, which apply to
+// the DMs that are sent to them while they are offline.
+type Mailbox struct {
+	Username  string
+	IsAdmin   bool
+	DND       bool
+	Muted     []string
+	Blocked   []string
+	UpdatedAt time.Time
+}
+
+// PendingMessage is a DM, kept in the direct_messages table, that has not yet been
+// delivered to its offline recipient.
+type PendingMessage struct {
+	MessageID int64
+	Sender    string
+	Recipient string
+	CreatedAt time.Time
+}
+
+func (m Mailbox) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS mailboxes (
+			username TEXT PRIMARY KEY,
+			is_admin BOOLEAN NOT NULL DEFAULT 0,
+			dnd BOOLEAN NOT NULL DEFAULT 0,
+			muted TEXT,
+			blocked TEXT,
+			updated_at DATETIME NOT NULL
+		);
+	`)
+	return err
+}
+
+func (pm PendingMessage) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS pending_messages (
+			message_id INTEGER PRIMARY KEY,
+			sender TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_pending_messages_recipient ON pending_messages(recipient);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Forget the messages that were erased by the DM retention period.
+	if _, err := DB.Exec(`
+		DELETE FROM pending_messages
+		WHERE message_id NOT IN (SELECT message_id FROM direct_messages)
+	`); err != nil {
+		log.Error("Error removing old pending messages: %s", err)
+	}
+
+	return nil
+}
+
+// SaveMailbox stores the settings of a user as they leave the chat room.
+func SaveMailbox(m Mailbox) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		INSERT OR REPLACE INTO mailboxes (username, is_admin, dnd, muted, blocked, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, m.Username, m.IsAdmin, m.DND, strings.Join(m.Muted, ","), strings.Join(m.Blocked, ","), time.Now())
+	return err
+}
+
+// GetMailbox looks up the settings of a user from their last chat session.
+func GetMailbox(username string) (Mailbox, error) {
+	if DB == nil {
+		return Mailbox{}, ErrNotInitialized
+	}
+
+	var (
+		m              = Mailbox{Username: username}
+		muted, blocked *string
+	)
+	err := DB.QueryRow(`
+		SELECT is_admin, dnd, muted, blocked, updated_at
+		FROM mailboxes
+		WHERE username = ?
+	`, username).Scan(&m.IsAdmin, &m.DND, &muted, &blocked, &m.UpdatedAt)
+	if err != nil {
+		return m, err
+	}
+
+	if muted != nil && *muted != "" {
+		m.Muted = strings.Split(*muted, ",")
+	}
+	if blocked != nil && *blocked != "" {
+		m.Blocked = strings.Split(*blocked, ",")
+	}
+	return m, nil
+}
+
+// QueuePendingMessage records that a DM, which is already in the DM history, awaits
+// delivery to its recipient.
+func QueuePendingMessage(msgID int64, sender, recipient string) error {
+	if !DirectMessageHistoryEnabled() {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO pending_messages (message_id, sender, recipient, created_at)
+		VALUES (?, ?, ?, ?)
+	`, msgID, sender, recipient, time.Now())
+	return err
+}
+
+// CountPendingMessages returns the number of DMs awaiting delivery to the recipient, in
+// total and from the sender.
+func CountPendingMessages(recipient, sender string) (total, fromSender int, err error) {
+	if !DirectMessageHistoryEnabled() {
+		return 0, 0, ErrNotInitialized
+	}
+
+	err = DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(sender = ?), 0)
+		FROM pending_messages
+		JOIN direct_messages ON (direct_messages.message_id = pending_messages.message_id)
+		WHERE recipient = ?
+	`, sender, recipient).Scan(&total, &fromSender)
+	return
+}
+
+// TakePendingMessages returns the DMs awaiting delivery to the recipient, oldest first,
+// and removes them from the queue.
+//
+// The Channel of each message is the sender (with the @ prefix).
+func TakePendingMessages(recipient string) ([]messages.Message, error) {
+	if !DirectMessageHistoryEnabled() {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT direct_messages.message_id, direct_messages.username, message, timestamp,
+			EXISTS (SELECT 1 FROM message_edits WHERE message_edits.message_id = direct_messages.message_id),
+			message_replies.reply_to, message_replies.username, message_replies.excerpt
+		FROM pending_messages
+		JOIN direct_messages ON (direct_messages.message_id = pending_messages.message_id)
+		LEFT JOIN message_replies ON (message_replies.message_id = direct_messages.message_id)
+		WHERE recipient = ?
+		ORDER BY direct_messages.message_id ASC
+	`, recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []messages.Message{}
+	for rows.Next() {
+		var (
+			row                    DirectMessage
+			edited                 bool
+			replyTo                *int64
+			replyUsername, excerpt *string
+		)
+		if err := rows.Scan(
+			&row.MessageID,
+			&row.Username,
+			&row.Message,
+			&row.Timestamp,
+			&edited,
+			&replyTo,
+			&replyUsername,
+			&excerpt,
+		); err != nil {
+			return nil, err
+		}
+
+		result = append(result, messages.Message{
+			Action:    messages.ActionMessage,
+			Channel:   "@" + row.Username,
+			Username:  row.Username,
+			Message:   row.Message,
+			MessageID: row.MessageID,
+			Timestamp: time.Unix(row.Timestamp, 0).Format(time.RFC3339),
+			Edited:    edited,
+			Quote:     scanQuote(replyTo, replyUsername, excerpt),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Messages queued since (e.g. a DM sent while they were logging in) are left for next time.
+	if len(result) > 0 {
+		if _, err := DB.Exec(`
+			DELETE FROM pending_messages
+			WHERE recipient = ? AND message_id <= ?
+		`, recipient, result[len(result)-1].MessageID); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// HasConversation returns whether two users have a DM history with each other.
+func HasConversation(username, other string) (bool, error) {
+	if !DirectMessageHistoryEnabled() {
+		return false, ErrNotInitialized
+	}
+
+	var id int64
+	err := DB.QueryRow(`
+		SELECT message_id FROM direct_messages
+		WHERE channel_id = ?
+		LIMIT 1
+	`, CreateChannelID(username, other)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+)
+
+// MessageEdit records a user's edit of their chat message, so that operators may
+// review its prior versions.
+//
+// Edits of public channel messages are always kept. Edits of DMs are only kept with
+// the DirectMessageHistory setting, and are erased along with the DM history.
+type MessageEdit struct {
+	ID        int64
+	MessageID int64
+	ChannelID string // channel ID, or the DM channel ID from CreateChannelID
+	Username  string
+	Previous  string // HTML of the message before the edit; blank if it was not kept
+	Message   string // HTML of the message after the edit
+	EditedAt  time.Time
+}
+
+func (me MessageEdit) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS message_edits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER NOT NULL,
+			channel_id TEXT NOT NULL,
+			username TEXT NOT NULL,
+			previous TEXT,
+			message TEXT NOT NULL,
+			edited_at INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits(message_id);
+		CREATE INDEX IF NOT EXISTS idx_message_edits_edited_at ON message_edits(edited_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Delete old edits past the retention periods of the DM and channel histories.
+	for _, retention := range []struct {
+		days  int
+		where string
+	}{
+		{config.Current.DirectMessageHistory.RetentionDays, "channel_id LIKE '@%'"},
+		{config.Current.ChannelHistory.RetentionDays, "channel_id NOT LIKE '@%'"},
+	} {
+		if retention.days <= 0 {
+			continue
+		}
+
+		cutoff := time.Now().Add(time.Duration(-retention.days) * 24 * time.Hour)
+		if _, err := DB.Exec(
+			"DELETE FROM message_edits WHERE edited_at < ? AND "+retention.where,
+			cutoff.Unix(),
+		); err != nil {
+			log.Error("Error removing old message edits: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// CreateMessageEdit records an edit of a message.
+func CreateMessageEdit(edit MessageEdit) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	if edit.EditedAt.IsZero() {
+		edit.EditedAt = time.Now()
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO message_edits (message_id, channel_id, username, previous, message, edited_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, edit.MessageID, edit.ChannelID, edit.Username, edit.Previous, edit.Message, edit.EditedAt.Unix())
+	return err
+}
+
+// GetMessageEdits returns the recorded edits of a message, oldest first.
+func GetMessageEdits(messageID int64) ([]MessageEdit, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, message_id, channel_id, username, previous, message, edited_at
+		FROM message_edits
+		WHERE message_id = ?
+		ORDER BY id
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []MessageEdit{}
+	for rows.Next() {
+		var (
+			edit     MessageEdit
+			previous *string
+			editedAt int64
+		)
+		if err := rows.Scan(
+			&edit.ID,
+			&edit.MessageID,
+			&edit.ChannelID,
+			&edit.Username,
+			&previous,
+			&edit.Message,
+			&editedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if previous != nil {
+			edit.Previous = *previous
+		}
+		edit.EditedAt = time.Unix(editedAt, 0)
+
+		result = append(result, edit)
+	}
+
+	return result, rows.Err()
+}
+
+// deleteDirectMessageEdits erases the edits of the DMs that the username is a party to,
+// for DirectMessage.ClearMessages.
+func deleteDirectMessageEdits(username string) error {
+	participant, params := participantClause(username)
+	_, err := DB.Exec(`
+		DELETE FROM message_edits
+		WHERE channel_id LIKE '@%'
+		AND (
+			`+participant+`
+			OR username = ?
+		)
+	`, append(params, username)...)
+	return err
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+// MessageReaction is an emoji reaction by a user to a chat message.
+//
+// The ChannelID is the public channel of the message, or the channel ID of the DM
+// thread (like "@alice:@bob"), so that the reactions are only shown along with it.
+type MessageReaction struct {
+	MessageID int64
+	ChannelID string
+	Username  string
+	Emoji     string
+	CreatedAt time.Time
+}
+
+func (mr MessageReaction) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS message_reactions (
+			message_id INTEGER NOT NULL,
+			channel_id TEXT NOT NULL,
+			username TEXT NOT NULL,
+			emoji TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (message_id, username, emoji)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_message_reactions_channel_id ON message_reactions(channel_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// The messages that were not stored in the DM or channel history are gone after a
+	// reboot, and so are the ones erased by the retention periods.
+	if _, err := DB.Exec(`
+		DELETE FROM message_reactions
+		WHERE message_id NOT IN (
+			SELECT message_id FROM direct_messages
+			UNION ALL
+			SELECT message_id FROM channel_messages
+		)
+	`); err != nil {
+		log.Error("Error removing old message reactions: %s", err)
+	}
+
+	return nil
+}
+
+// AddReaction stores a user's emoji reaction to a message, and returns whether it is
+// new (false if they had already reacted with this emoji).
+func AddReaction(msgID int64, channelID, username, emoji string) (bool, error) {
+	if DB == nil {
+		return false, ErrNotInitialized
+	}
+
+	res, err := DB.Exec(`
+		INSERT OR IGNORE INTO message_reactions (message_id, channel_id, username, emoji, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, msgID, channelID, username, emoji, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RemoveReaction takes back a user's emoji reaction to a message, and returns whether
+// they had reacted with it.
+func RemoveReaction(msgID int64, channelID, username, emoji string) (bool, error) {
+	if DB == nil {
+		return false, ErrNotInitialized
+	}
+
+	res, err := DB.Exec(`
+		DELETE FROM message_reactions
+		WHERE message_id = ? AND channel_id = ? AND username = ? AND emoji = ?
+	`, msgID, channelID, username, emoji)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CountUserReactions returns the number of distinct emojis a user has reacted with to a message.
+func CountUserReactions(msgID int64, username string) (int, error) {
+	if DB == nil {
+		return 0, ErrNotInitialized
+	}
+
+	var count int
+	err := DB.QueryRow(`
+		SELECT COUNT(*) FROM message_reactions
+		WHERE message_id = ? AND username = ?
+	`, msgID, username).Scan(&count)
+	return count, err
+}
+
+// GetReactions returns the aggregated reactions to the messages of a channel, by message ID.
+//
+// The users are listed in the order that they reacted.
+func GetReactions(channelID string, msgIDs ...int64) (map[int64]messages.Reactions, error) {
+	var result = map[int64]messages.Reactions{}
+	if DB == nil {
+		return result, ErrNotInitialized
+	} else if len(msgIDs) == 0 {
+		return result, nil
+	}
+
+	var (
+		placeholders = make([]string, 0, len(msgIDs))
+		args         = []interface{}{channelID}
+	)
+	for _, id := range msgIDs {
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+
+	rows, err := DB.Query(fmt.Sprintf(`
+		SELECT message_id, username, emoji
+		FROM message_reactions
+		WHERE channel_id = ? AND message_id IN (%s)
+		ORDER BY created_at ASC, rowid ASC
+	`, strings.Join(placeholders, ", ")), args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			msgID           int64
+			username, emoji string
+		)
+		if err := rows.Scan(&msgID, &username, &emoji); err != nil {
+			return result, err
+		}
+
+		if _, ok := result[msgID]; !ok {
+			result[msgID] = messages.Reactions{}
+		}
+		result[msgID][emoji] = append(result[msgID][emoji], username)
+	}
+
+	return result, rows.Err()
+}
+
+// attachReactions fills in the reactions to a page of the DM or channel history.
+func attachReactions(channelID string, page []messages.Message) error {
+	var ids = make([]int64, 0, len(page))
+	for _, msg := range page {
+		ids = append(ids, msg.MessageID)
+	}
+
+	reactions, err := GetReactions(channelID, ids...)
+	if err != nil {
+		return err
+	}
+
+	for i := range page {
+		page[i].Reactions = reactions[page[i].MessageID]
+	}
+	return nil
+}
+
+// DeleteMessageReactions forgets the reactions to a message that was taken back.
+func DeleteMessageReactions(msgID int64) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec("DELETE FROM message_reactions WHERE message_id = ?", msgID)
+	return err
+}
+
+// deleteDirectMessageReactions forgets the reactions in all of a user's DM threads, for
+// when they clear their DM history.
+func deleteDirectMessageReactions(username string) error {
+	participant, params := participantClause(username)
+	_, err := DB.Exec(`
+		DELETE FROM message_reactions
+		WHERE channel_id LIKE '@%'
+		AND `+participant, params...)
+	return err
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+// MessageReply records which message a reply in the DM or channel history was to, along
+// with the quoted excerpt, so that replies render the same after a scrollback.
+type MessageReply struct {
+	MessageID int64 // the reply
+	ReplyTo   int64 // the message it replied to
+	Username  string
+	Excerpt   string
+}
+
+func (mr MessageReply) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS message_replies (
+			message_id INTEGER PRIMARY KEY,
+			reply_to INTEGER NOT NULL,
+			username TEXT NOT NULL,
+			excerpt TEXT
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Forget the replies that were erased by the retention periods.
+	if err := pruneMessageReplies(); err != nil {
+		log.Error("Error removing old message replies: %s", err)
+	}
+
+	return nil
+}
+
+// logMessageReply stores the quote of a reply, for the LogMessage functions.
+func logMessageReply(msg messages.Message) error {
+	if msg.Quote == nil {
+		return nil
+	}
+
+	_, err := DB.Exec(`
+		INSERT OR REPLACE INTO message_replies (message_id, reply_to, username, excerpt)
+		VALUES (?, ?, ?, ?)
+	`, msg.MessageID, msg.Quote.MessageID, msg.Quote.Username, msg.Quote.Excerpt)
+	return err
+}
+
+// deleteMessageReply forgets the quote of a reply that was taken back.
+func deleteMessageReply(messageID int64) error {
+	_, err := DB.Exec("DELETE FROM message_replies WHERE message_id = ?", messageID)
+	return err
+}
+
+// pruneMessageReplies forgets the quotes of the replies that are no longer stored.
+func pruneMessageReplies() error {
+	_, err := DB.Exec(`
+		DELETE FROM message_replies
+		WHERE message_id NOT IN (
+			SELECT message_id FROM direct_messages
+			UNION ALL
+			SELECT message_id FROM channel_messages
+		)
+	`)
+	return err
+}
+
+// scanQuote builds the Quote of a history message from the columns of a LEFT JOIN on
+// the message_replies table.
+func scanQuote(replyTo *int64, username, excerpt *string) *messages.Quote {
+	if replyTo == nil {
+		return nil
+	}
+
+	var quote = &messages.Quote{
+		MessageID: *replyTo,
+	}
+	if username != nil {
+		quote.Username = *username
+	}
+	if excerpt != nil {
+		quote.Excerpt = *excerpt
+	}
+	return quote
+}
@@ -0,0 +1,352 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// MessageSearch is the SQLite FTS5 full-text index over the DM history and the channel logs.
+//
+// The index is keyed by the MessageID (its rowid) and holds the plain text of each message,
+// kept in sync by the LogMessage, EditMessage, TakebackMessage and ClearMessages functions of the
+// DirectMessage and ChannelMessage tables.
+//
+// FTS5 needs the go-sqlite3 driver built with the `sqlite_fts5` tag: when it is missing,
+// a warning is logged at startup and searches return ErrSearchNotAvailable.
+type MessageSearch struct{}
+
+// MessageSearchFilter narrows down a full-text search. Blank fields match everything.
+type MessageSearchFilter struct {
+	Query       string
+	Participant string // only the DMs that this user is a party to
+	Username    string // only messages sent by this user
+	ChannelID   string // only this channel, e.g. "lobby" or a DM channel ID from CreateChannelID
+	Since       time.Time
+	Until       time.Time
+}
+
+// SearchResult is a message matched by a full-text search.
+type SearchResult struct {
+	MessageID int64
+	ChannelID string
+	Username  string
+	Snippet   string // HTML: an excerpt of the message with the matched terms in <mark> tags
+	Timestamp time.Time
+}
+
+const SearchResultsPerPage = 20
+
+var (
+	ErrSearchNotAvailable = errors.New("message search is not available on this server")
+	ErrEmptySearchQuery   = errors.New("the search query is empty")
+
+	// Set when the FTS5 index was created at startup.
+	searchAvailable bool
+
+	// Strips the HTML of chat messages down to the text to be indexed.
+	searchTextPolicy = bluemonday.StrictPolicy()
+)
+
+// Markers around the matched terms of a snippet, swapped for <mark> tags after escaping.
+const (
+	snippetOpen  = "\x02"
+	snippetClose = "\x03"
+)
+
+// SearchAvailable returns whether the full-text search index is ready.
+func SearchAvailable() bool {
+	return DB != nil && searchAvailable
+}
+
+// CreateTable creates the full-text index and catches it up with the stored messages, e.g.
+// for messages logged before the index existed or removed by the retention periods.
+func (ms MessageSearch) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS message_search USING fts5(
+			message,
+			channel_id UNINDEXED,
+			username UNINDEXED,
+			timestamp UNINDEXED,
+			tokenize = 'unicode61 remove_diacritics 2'
+		);
+	`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			log.Warn("Message search is not available: the server was not built with SQLite FTS5 support (go build -tags sqlite_fts5)")
+			searchAvailable = false
+			return nil
+		}
+		return err
+	}
+	searchAvailable = true
+
+	// Forget the messages that are no longer stored.
+	if _, err := DB.Exec(`
+		DELETE FROM message_search
+		WHERE rowid NOT IN (
+			SELECT message_id FROM direct_messages
+			UNION ALL
+			SELECT message_id FROM channel_messages
+		)
+	`); err != nil {
+		log.Error("Error pruning the message search index: %s", err)
+	}
+
+	// Index the stored messages that are missing from it.
+	var count int
+	for _, table := range []string{"direct_messages", "channel_messages"} {
+		n, err := backfillSearchIndex(table)
+		if err != nil {
+			log.Error("Error indexing %s for message search: %s", table, err)
+		}
+		count += n
+	}
+	if count > 0 {
+		log.Info("Indexed %d stored messages for message search", count)
+	}
+
+	return nil
+}
+
+// backfillSearchIndex indexes the messages of a history table that are not in the index.
+func backfillSearchIndex(table string) (int, error) {
+	rows, err := DB.Query(fmt.Sprintf(`
+		SELECT message_id, channel_id, username, message, timestamp
+		FROM %s
+		WHERE message_id NOT IN (SELECT rowid FROM message_search)
+	`, table))
+	if err != nil {
+		return 0, err
+	}
+
+	// Read them all before writing, as SQLite may not write while the rows are open.
+	var pending []DirectMessage
+	for rows.Next() {
+		var row DirectMessage
+		if err := rows.Scan(&row.MessageID, &row.ChannelID, &row.Username, &row.Message, &row.Timestamp); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, row := range pending {
+		if err := indexMessage(row.MessageID, row.ChannelID, row.Username, row.Message, row.Timestamp); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// searchText returns the plain text of a chat message's HTML.
+func searchText(message string) string {
+	return strings.TrimSpace(html.UnescapeString(searchTextPolicy.Sanitize(message)))
+}
+
+// indexMessage adds a logged message to the full-text index.
+func indexMessage(messageID int64, channelID, username, message string, timestamp int64) error {
+	if !SearchAvailable() {
+		return nil
+	}
+
+	// Messages without text (e.g. only an image) are not searchable.
+	text := searchText(message)
+	if text == "" {
+		return nil
+	}
+
+	_, err := DB.Exec(`
+		INSERT OR REPLACE INTO message_search (rowid, message, channel_id, username, timestamp)
+		VALUES (?, ?, ?, ?, ?)
+	`, messageID, text, channelID, username, timestamp)
+	return err
+}
+
+// unindexMessage removes a message from the full-text index.
+func unindexMessage(messageID int64) error {
+	if !SearchAvailable() {
+		return nil
+	}
+
+	_, err := DB.Exec(`DELETE FROM message_search WHERE rowid = ?`, messageID)
+	return err
+}
+
+// reindexMessage replaces the text of an edited message in the full-text index.
+func reindexMessage(messageID int64, message string) error {
+	if !SearchAvailable() {
+		return nil
+	}
+
+	var (
+		row = DB.QueryRow(`
+			SELECT channel_id, username, timestamp FROM direct_messages WHERE message_id = ?
+			UNION ALL
+			SELECT channel_id, username, timestamp FROM channel_messages WHERE message_id = ?
+		`, messageID, messageID)
+		channelID, username string
+		timestamp           int64
+	)
+	if err := row.Scan(&channelID, &username, &timestamp); err != nil {
+		return err
+	}
+
+	if err := unindexMessage(messageID); err != nil {
+		return err
+	}
+	return indexMessage(messageID, channelID, username, message, timestamp)
+}
+
+// unindexDirectMessages removes all of the DMs that the username is a party to from the
+// full-text index, for DirectMessage.ClearMessages.
+func unindexDirectMessages(username string) error {
+	if !SearchAvailable() {
+		return nil
+	}
+
+	participant, params := participantClause(username)
+	_, err := DB.Exec(`
+		DELETE FROM message_search
+		WHERE channel_id LIKE '@%'
+		AND (
+			`+participant+`
+			OR username = ?
+		)
+	`, append(params, username)...)
+	return err
+}
+
+// matchQuery turns a user's search terms into an FTS5 query: each word is quoted so that
+// the FTS5 syntax (e.g. AND, NEAR, column filters) is not interpreted, and a trailing "*"
+// is kept as a prefix search.
+func matchQuery(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		var prefix bool
+		if strings.HasSuffix(word, "*") {
+			prefix = true
+			word = strings.TrimRight(word, "*")
+		}
+		if word == "" {
+			continue
+		}
+
+		term := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchMessages returns a page of the messages that match a full-text search (newest
+// first) along with the total count of matches. Pages start at 1.
+//
+// The caller is responsible to narrow down the filter to what the user may see, e.g. the
+// Participant for a user searching their own DMs.
+func SearchMessages(filter MessageSearchFilter, page, perPage int) ([]SearchResult, int, error) {
+	if !SearchAvailable() {
+		return nil, 0, ErrSearchNotAvailable
+	}
+
+	var match = matchQuery(filter.Query)
+	if match == "" {
+		return nil, 0, ErrEmptySearchQuery
+	}
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 1
+	}
+
+	// Build the WHERE clause.
+	var (
+		where  = []string{"message_search MATCH ?"}
+		params = []interface{}{match}
+	)
+	if filter.Participant != "" {
+		participant, participantParams := participantClause(filter.Participant)
+		where = append(where, participant)
+		params = append(params, participantParams...)
+	}
+	if filter.Username != "" {
+		where = append(where, "username = ?")
+		params = append(params, filter.Username)
+	}
+	if filter.ChannelID != "" {
+		where = append(where, "channel_id = ?")
+		params = append(params, filter.ChannelID)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "timestamp >= ?")
+		params = append(params, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "timestamp < ?")
+		params = append(params, filter.Until.Unix())
+	}
+	var whereClause = strings.Join(where, " AND ")
+
+	// Count the total.
+	var total int
+	if err := DB.QueryRow(
+		"SELECT COUNT(rowid) FROM message_search WHERE "+whereClause,
+		params...,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(`
+		SELECT rowid, channel_id, username, timestamp,
+			snippet(message_search, 0, char(2), char(3), '…', 16)
+		FROM message_search
+		WHERE `+whereClause+`
+		ORDER BY rowid DESC
+		LIMIT ? OFFSET ?
+	`, append(params, perPage, (page-1)*perPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var result = []SearchResult{}
+	for rows.Next() {
+		var (
+			row       SearchResult
+			timestamp int64
+		)
+		if err := rows.Scan(&row.MessageID, &row.ChannelID, &row.Username, &timestamp, &row.Snippet); err != nil {
+			return nil, 0, err
+		}
+
+		// Escape the snippet text and highlight its matches.
+		row.Snippet = strings.NewReplacer(
+			snippetOpen, "<mark>",
+			snippetClose, "</mark>",
+		).Replace(html.EscapeString(row.Snippet))
+		row.Timestamp = time.Unix(timestamp, 0)
+
+		result = append(result, row)
+	}
+
+	return result, total, rows.Err()
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// UserIP records which IP addresses a chat username has connected from.
+//
+// Operators use it to look up the IP addresses behind a nickname (or the
+// nicknames behind an IP address) when issuing bans.
+type UserIP struct {
+	Username  string
+	IP        string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// UserIPsPerPage is the maximum number of results returned from a search.
+const UserIPsPerPage = 200
+
+func (u UserIP) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_ips (
+			username TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			first_seen INTEGER,
+			last_seen INTEGER,
+			PRIMARY KEY (username, ip)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_user_ips_ip ON user_ips(ip);
+	`)
+	return err
+}
+
+// LogUserIP records that the username was seen connecting from an IP address.
+func LogUserIP(username, ip string) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	var now = time.Now().Unix()
+	_, err := DB.Exec(`
+		INSERT INTO user_ips (username, ip, first_seen, last_seen)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (username, ip) DO UPDATE SET last_seen = excluded.last_seen
+	`, username, ip, now, now)
+	return err
+}
+
+// GetUserIPs returns the IP addresses that a username has connected from, most recent first.
+func GetUserIPs(username string) ([]UserIP, error) {
+	return queryUserIPs(`
+		SELECT username, ip, first_seen, last_seen
+		FROM user_ips
+		WHERE username = ?
+		ORDER BY last_seen DESC
+		LIMIT ?
+	`, username, UserIPsPerPage)
+}
+
+// SearchUserIPs returns UserIP records where the username or IP address contains the query string.
+func SearchUserIPs(query string) ([]UserIP, error) {
+	var like = "%" + strings.ToLower(query) + "%"
+	return queryUserIPs(`
+		SELECT username, ip, first_seen, last_seen
+		FROM user_ips
+		WHERE lower(username) LIKE ? OR ip LIKE ?
+		ORDER BY last_seen DESC
+		LIMIT ?
+	`, like, like, UserIPsPerPage)
+}
+
+// RecentUserIPs returns the most recently seen UserIP records.
+func RecentUserIPs() ([]UserIP, error) {
+	return queryUserIPs(`
+		SELECT username, ip, first_seen, last_seen
+		FROM user_ips
+		ORDER BY last_seen DESC
+		LIMIT ?
+	`, UserIPsPerPage)
+}
+
+func queryUserIPs(query string, params ...interface{}) ([]UserIP, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = []UserIP{}
+	for rows.Next() {
+		var (
+			row                 UserIP
+			firstSeen, lastSeen int64
+		)
+		if err := rows.Scan(&row.Username, &row.IP, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		row.FirstSeen = time.Unix(firstSeen, 0)
+		row.LastSeen = time.Unix(lastSeen, 0)
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
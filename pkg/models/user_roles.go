@@ -0,0 +1,103 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// UserRole stores the chat roles of a username which were granted at runtime,
+// e.g. by an operator using the /op or /deop commands.
+//
+// Roles configured in settings.toml are not stored here: see the Roles section
+// of the config.
+type UserRole struct {
+	Username  string
+	Operator  bool
+	VIP       bool
+	Rules     []string // moderation rules, e.g. "redcam" or "noimage"
+	UpdatedBy string   // username of the operator who last changed the role
+	UpdatedAt time.Time
+}
+
+func (r UserRole) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_roles (
+			username TEXT PRIMARY KEY,
+			operator INTEGER NOT NULL DEFAULT 0,
+			vip INTEGER NOT NULL DEFAULT 0,
+			rules TEXT,
+			updated_by TEXT,
+			updated_at INTEGER
+		);
+	`)
+	return err
+}
+
+// GetUserRole looks up the stored role of a username.
+//
+// The boolean is false (with no error) if the username has no stored role.
+func GetUserRole(username string) (UserRole, bool, error) {
+	var role = UserRole{
+		Username: username,
+	}
+	if DB == nil {
+		return role, false, ErrNotInitialized
+	}
+
+	var (
+		rules, updatedBy *string
+		updatedAt        int64
+		row              = DB.QueryRow(`
+			SELECT operator, vip, rules, updated_by, updated_at
+			FROM user_roles
+			WHERE username = ?
+		`, username)
+	)
+	if err := row.Scan(&role.Operator, &role.VIP, &rules, &updatedBy, &updatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return role, false, nil
+		}
+		return role, false, err
+	}
+
+	if rules != nil && *rules != "" {
+		role.Rules = strings.Split(*rules, ",")
+	}
+	if updatedBy != nil {
+		role.UpdatedBy = *updatedBy
+	}
+	role.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return role, true, nil
+}
+
+// SaveUserRole creates or updates the stored role of a username.
+func SaveUserRole(role UserRole) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	if role.UpdatedAt.IsZero() {
+		role.UpdatedAt = time.Now()
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO user_roles (username, operator, vip, rules, updated_by, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET
+			operator = excluded.operator,
+			vip = excluded.vip,
+			rules = excluded.rules,
+			updated_by = excluded.updated_by,
+			updated_at = excluded.updated_at
+	`,
+		role.Username, role.Operator, role.VIP, strings.Join(role.Rules, ","),
+		role.UpdatedBy, role.UpdatedAt.Unix(),
+	)
+	return err
+}
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is a local chat account, for users who sign in with a password on the chat
+// server itself rather than being sent over by your website's JWT token.
+//
+// Usernames are unique without regard to case.
+type User struct {
+	ID           int64
+	Username     string
+	Email        string
+	PasswordHash string
+	Operator     bool
+	VIP          bool
+	Disabled     bool
+	CreatedAt    time.Time
+	LastLoginAt  time.Time // zero value = never logged in
+}
+
+// Errors returned by the user account functions.
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("that username is already taken")
+)
+
+func (u User) CreateTable() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			email TEXT,
+			password_hash TEXT NOT NULL,
+			operator INTEGER NOT NULL DEFAULT 0,
+			vip INTEGER NOT NULL DEFAULT 0,
+			disabled INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER,
+			last_login_at INTEGER
+		);
+	`)
+	return err
+}
+
+// SetPassword hashes and sets the user's password. It does not save the user.
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// CheckPassword verifies the user's password.
+func (u User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// CreateUser adds a new account to the database and returns it with its ID assigned.
+//
+// Returns ErrUserExists if the username is taken.
+func CreateUser(user User) (User, error) {
+	if DB == nil {
+		return user, ErrNotInitialized
+	}
+
+	user.Username = strings.TrimSpace(user.Username)
+	if user.Username == "" || user.PasswordHash == "" {
+		return user, errors.New("username and password are required")
+	}
+
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+
+	res, err := DB.Exec(`
+		INSERT INTO users (username, email, password_hash, operator, vip, disabled, created_at, last_login_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		user.Username, user.Email, user.PasswordHash, user.Operator, user.VIP, user.Disabled,
+		user.CreatedAt.Unix(), unixOrZero(user.LastLoginAt),
+	)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return user, ErrUserExists
+		}
+		return user, err
+	}
+
+	user.ID, err = res.LastInsertId()
+	return user, err
+}
+
+// GetUser looks up an account by username (case insensitive).
+//
+// Returns ErrUserNotFound if there is no such account.
+func GetUser(username string) (User, error) {
+	if DB == nil {
+		return User{}, ErrNotInitialized
+	}
+
+	var (
+		user                   User
+		email                  *string
+		createdAt, lastLoginAt int64
+		row                    = DB.QueryRow(`
+			SELECT id, username, email, password_hash, operator, vip, disabled, created_at, last_login_at
+			FROM users
+			WHERE username = ?
+		`, strings.TrimSpace(username))
+	)
+	if err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&email,
+		&user.PasswordHash,
+		&user.Operator,
+		&user.VIP,
+		&user.Disabled,
+		&createdAt,
+		&lastLoginAt,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return user, ErrUserNotFound
+		}
+		return user, err
+	}
+
+	if email != nil {
+		user.Email = *email
+	}
+	user.CreatedAt = time.Unix(createdAt, 0)
+	if lastLoginAt > 0 {
+		user.LastLoginAt = time.Unix(lastLoginAt, 0)
+	}
+
+	return user, nil
+}
+
+// UserExists checks whether an account exists with this username (case insensitive).
+func UserExists(username string) (bool, error) {
+	if _, err := GetUser(username); err != nil {
+		if err == ErrUserNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Save updates the user's email, password, roles and disabled flag in the database.
+func (u User) Save() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	_, err := DB.Exec(`
+		UPDATE users
+		SET email = ?, password_hash = ?, operator = ?, vip = ?, disabled = ?
+		WHERE id = ?
+	`, u.Email, u.PasswordHash, u.Operator, u.VIP, u.Disabled, u.ID)
+	return err
+}
+
+// TouchLastLogin sets the user's last login time to now.
+func (u *User) TouchLastLogin() error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	u.LastLoginAt = time.Now()
+	_, err := DB.Exec(
+		"UPDATE users SET last_login_at = ? WHERE id = ?",
+		u.LastLoginAt.Unix(), u.ID,
+	)
+	return err
+}
@@ -0,0 +1,155 @@
+package barertc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	ourjwt "git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/*
+Moderation actions shared by the operator chat commands and the admin console.
+
+Each takes the username of the operator who performed it. The errors they return
+are user friendly, for the caller to show to the operator.
+*/
+
+// KickUser removes a user from the chat room.
+func (s *Server) KickUser(operator, username string) error {
+	other, err := s.GetSubscriber(username)
+	if err != nil {
+		return fmt.Errorf("username not found: %s", username)
+	} else if other.Username == operator {
+		return errors.New("did you really mean to kick yourself?")
+	}
+
+	log.Info("Operator %s kicks %s", operator, username)
+	other.ChatServer("You have been kicked from the chat room by %s", operator)
+	s.Disconnect(other, messages.PresenceKicked)
+	return nil
+}
+
+// BanAndDisconnect adds a user to the ban list, and removes them from the chat room if
+// they are online. A zero duration is a permanent ban.
+func (s *Server) BanAndDisconnect(operator, username string, duration time.Duration, reason string) (models.Ban, error) {
+	log.Info("Operator %s bans %s %s", operator, username, FormatBanDuration(duration))
+
+	// Add them to the ban list.
+	ban, err := BanUser(username, duration, reason, operator)
+	if err != nil {
+		return ban, fmt.Errorf("could not save the ban on %s: %s", username, err)
+	}
+
+	// If the target user is currently online, disconnect them and broadcast the ban to everybody.
+	if other, err := s.GetSubscriber(username); err == nil {
+		other.ChatServer("You have been banned from the chat room by %s %s.", operator, FormatBanDuration(duration))
+		if ban.Reason != "" {
+			other.ChatServer("Reason: %s", ban.Reason)
+		}
+		s.Disconnect(other, messages.PresenceBanned)
+	}
+
+	return ban, nil
+}
+
+// MarkCameraNSFW forces a user's camera to be marked as Explicit.
+func (s *Server) MarkCameraNSFW(operator, username string) error {
+	other, err := s.GetSubscriber(username)
+	if err != nil {
+		return fmt.Errorf("username not found: %s", username)
+	}
+
+	// Sanity check that the target user is presently on a blue camera.
+	if !(other.VideoStatus&messages.VideoFlagActive == messages.VideoFlagActive) {
+		return fmt.Errorf("%s's camera was not currently enabled.", username)
+	} else if other.VideoStatus&messages.VideoFlagNSFW == messages.VideoFlagNSFW {
+		return fmt.Errorf("%s's camera was already marked as explicit.", username)
+	}
+
+	// The message to deliver to the target.
+	var message = "Just a friendly reminder to mark your camera as 'Explicit' by using the button at the top " +
+		"of the page if you are going to be sexual on webcam.<br><br>"
+
+	// If the admin who marked it was previously booted
+	if other.Boots(operator) {
+		message += "Your camera was detected to depict 'Explicit' activity and has been marked for you."
+	} else {
+		message += fmt.Sprintf("Your camera has been marked as Explicit for you by @%s", operator)
+	}
+
+	other.ChatServer(message)
+	other.VideoStatus |= messages.VideoFlagNSFW
+	other.SendMe()
+	s.SendWhoListChanges(other.Username)
+
+	// Send an admin report to your main website.
+	if err := PostWebhookReport(WebhookRequestReport{
+		FromUsername:  operator,
+		AboutUsername: username,
+		Channel:       "n/a",
+		Timestamp:     time.Now().Format(time.RFC3339),
+		Reason:        "NSFW Command Issued",
+		Message:       fmt.Sprintf("The admin @%s marks the webcam red for user @%s", operator, username),
+		Comment:       "An admin marked their webcam as explicit.",
+	}); err != nil {
+		log.Error("Error delivering a report to your website about the /nsfw command by %s: %s", operator, err)
+	}
+
+	return nil
+}
+
+// CutCamera tells a user's page to turn off their camera.
+func (s *Server) CutCamera(operator, username string) error {
+	other, err := s.GetSubscriber(username)
+	if err != nil {
+		return fmt.Errorf("username not found: %s", username)
+	}
+
+	// Sanity check that the target user is presently on a blue camera.
+	if !(other.VideoStatus&messages.VideoFlagActive == messages.VideoFlagActive) {
+		return fmt.Errorf("%s's camera was not currently enabled.", username)
+	}
+
+	log.Info("Operator %s cuts the camera of %s", operator, username)
+	other.SendCut()
+	return nil
+}
+
+// SetOperatorRights grants or removes the operator rights of a user. The role is saved to
+// the database, and applied right away if the user is online (the boolean is true).
+func (s *Server) SetOperatorRights(operator, username string, grant bool) (bool, error) {
+	// Operators from the settings.toml can't be removed from chat.
+	if !grant && config.Current.Roles.IsOperator(username) {
+		return false, fmt.Errorf("%s is listed as an operator in the server's settings.toml and must be removed from there.", username)
+	}
+
+	log.Info("Operator %s sets operator rights of %s to %t", operator, username, grant)
+	if err := SetOperator(username, grant, operator); err != nil {
+		log.Error("SetOperatorRights(%s): %s", username, err)
+		return false, fmt.Errorf("couldn't save the operator role for %s: %s", username, err)
+	}
+
+	other, err := s.GetSubscriber(username)
+	if err != nil {
+		return false, nil
+	}
+
+	if other.JWTClaims == nil {
+		other.JWTClaims = &ourjwt.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject: username,
+			},
+		}
+	}
+	other.JWTClaims.IsAdmin = grant
+
+	// Send everyone the Who List.
+	s.SendWhoListChanges(other.Username)
+	return true, nil
+}
@@ -0,0 +1,190 @@
+package barertc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+// OfflineDeliveryEnabled returns whether DMs to offline users are kept for them.
+func OfflineDeliveryEnabled() bool {
+	return config.Current.DirectMessageHistory.OfflineDelivery && models.DirectMessageHistoryEnabled()
+}
+
+// sendOfflineMessage keeps a DM to an offline user, to be delivered on their next login.
+//
+// The recipient's settings from their last chat session (DND, mutes and blocks) apply
+// as if they were online, and the size of their mailbox is limited. The message has
+// already been echoed back to the sender.
+func (s *Server) sendOfflineMessage(sub *Subscriber, username string, msg, message messages.Message) {
+	mailbox, err := models.GetMailbox(username)
+	if err != nil {
+		// Somebody who was never on chat: the message won't be sent.
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Error("Error reading the mailbox of %s: %s", username, err)
+		}
+		sub.ChatServer("Could not deliver your message: @%s appears not to be online.", username)
+		return
+	}
+	var rcpt = offlineSubscriber(mailbox)
+
+	// They were not accepting new DMs.
+	if rcpt.DND {
+		if ok, err := models.HasConversation(sub.Username, username); err != nil || !ok {
+			sub.ChatServer("Could not deliver your message: %s is offline and not accepting new DMs.", username)
+			return
+		}
+	}
+
+	// The same rules as for online users.
+	if rcpt.Mutes(sub.Username) && !sub.IsAdmin() {
+		log.Debug("Do not keep message for %s: they have muted or booted %s", username, sub.Username)
+		return
+	}
+	if sub.Mutes(username) && !sub.IsAdmin() {
+		sub.ChatServer("You have muted %s and so your message has not been sent.", username)
+		return
+	}
+	if sub.Blocks(rcpt) {
+		return
+	}
+
+	// Is their mailbox full?
+	total, fromSender, err := models.CountPendingMessages(username, sub.Username)
+	if err != nil {
+		log.Error("Error counting the pending messages of %s: %s", username, err)
+		sub.ChatServer("Could not deliver your message: %s appears not to be online.", username)
+		return
+	}
+	var settings = config.Current.DirectMessageHistory
+	if settings.MailboxQuota > 0 && total >= settings.MailboxQuota {
+		sub.ChatServer("Could not deliver your message: %s is offline and has too many messages waiting for them.", username)
+		return
+	}
+	if settings.MailboxPerSender > 0 && fromSender >= settings.MailboxPerSender {
+		sub.ChatServer("Could not deliver your message: you have already sent %d messages to %s while they were away.", fromSender, username)
+		return
+	}
+
+	// Log this conversation?
+	if IsLoggingUsername(sub) {
+		LogMessage(sub, username, sub.Username, msg)
+	}
+
+	// Keep it in the DM history until they come back.
+	if err := (models.DirectMessage{}).LogMessage(sub.Username, username, message); err != nil {
+		log.Error("Logging DM history to SQLite: %s", err)
+		sub.ChatServer("Your message could not be delivered: %s", err)
+		return
+	}
+	if err := models.QueuePendingMessage(message.MessageID, sub.Username, username); err != nil {
+		log.Error("Error queueing DM %d for %s: %s", message.MessageID, username, err)
+		sub.ChatServer("Your message could not be delivered: %s", err)
+		return
+	}
+
+	if fromSender == 0 {
+		sub.ChatServer("%s is offline: your messages will be delivered when they next log in.", username)
+	}
+}
+
+// DeliverPendingMessages sends a user the DMs they received while they were offline, with
+// a summary of who wrote to them.
+func (s *Server) DeliverPendingMessages(sub *Subscriber) {
+	pending, err := models.TakePendingMessages(sub.Username)
+	if err != nil {
+		if err != models.ErrNotInitialized {
+			log.Error("Error reading the pending messages of %s: %s", sub.Username, err)
+		}
+		return
+	} else if len(pending) == 0 {
+		return
+	}
+
+	sub.SendJSON(messages.Message{
+		Action:   messages.ActionEcho,
+		Messages: pending,
+	})
+
+	// Summarize the conversations, in the order they were started.
+	var (
+		senders []string
+		counts  = map[string]int{}
+	)
+	for _, msg := range pending {
+		if _, ok := counts[msg.Username]; !ok {
+			senders = append(senders, msg.Username)
+		}
+		counts[msg.Username]++
+	}
+	for i, username := range senders {
+		senders[i] = fmt.Sprintf("<strong>%s</strong> (%d)", html.EscapeString(username), counts[username])
+	}
+
+	var plural = "s"
+	if len(pending) == 1 {
+		plural = ""
+	}
+	sub.ChatServer("While you were away, you received %d direct message%s from: %s", len(pending), plural, strings.Join(senders, ", "))
+}
+
+// saveMailbox stores the DND status, mutes and blocks of a user who is leaving the chat,
+// which apply to the DMs sent to them while they are offline.
+func (sub *Subscriber) saveMailbox() {
+	if sub.Username == "" || !sub.authenticated || !OfflineDeliveryEnabled() {
+		return
+	}
+
+	var mailbox = models.Mailbox{
+		Username: sub.Username,
+		IsAdmin:  sub.IsAdmin(),
+		DND:      sub.DND,
+	}
+
+	sub.muteMu.RLock()
+	for username := range sub.muted {
+		mailbox.Muted = append(mailbox.Muted, username)
+	}
+	for username := range sub.blocked {
+		mailbox.Blocked = append(mailbox.Blocked, username)
+	}
+	sub.muteMu.RUnlock()
+
+	if err := models.SaveMailbox(mailbox); err != nil {
+		log.Error("Error saving the mailbox of %s: %s", sub.Username, err)
+	}
+}
+
+// offlineSubscriber stands in for an offline user, with their settings from their last
+// chat session, so that the Mutes and Blocks checks apply to them.
+func offlineSubscriber(mailbox models.Mailbox) *Subscriber {
+	var sub = &Subscriber{
+		Username:  mailbox.Username,
+		DND:       mailbox.DND,
+		JWTClaims: &jwt.Claims{IsAdmin: mailbox.IsAdmin},
+		booted:    map[string]struct{}{},
+		muted:     map[string]struct{}{},
+		blocked:   map[string]struct{}{},
+	}
+	for _, username := range mailbox.Muted {
+		sub.muted[username] = struct{}{}
+	}
+	for _, username := range mailbox.Blocked {
+		sub.blocked[username] = struct{}{}
+	}
+
+	// And the blocklist from your website.
+	for _, username := range GetCachedBlocklist(mailbox.Username) {
+		sub.blocked[username] = struct{}{}
+	}
+
+	return sub
+}
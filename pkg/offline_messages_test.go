@@ -0,0 +1,94 @@
+package barertc
+
+import (
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestOfflineMessages(t *testing.T) {
+	setupTestDatabase(t)
+	config.Current.DirectMessageHistory.Enabled = true
+	config.Current.DirectMessageHistory.OfflineDelivery = true
+	config.Current.DirectMessageHistory.MailboxPerSender = 2
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, false, "alice", "bob", "carol", "<i>dan</i>")
+		alice = users[0]
+		bob   = users[1]
+		carol = users[2]
+		dan   = users[3]
+	)
+
+	// The ChatServer messages that a user received.
+	var notices = func(sub *Subscriber) []string {
+		var result []string
+		for _, msg := range drainMessages(t, sub) {
+			if msg.Action == messages.ActionError {
+				result = append(result, msg.Message)
+			}
+		}
+		return result
+	}
+
+	// Bob, who has muted carol, times out.
+	bob.muted["carol"] = struct{}{}
+	s.Disconnect(bob, messages.PresenceTimedOut)
+
+	// Nobody can write to users who have never been on chat.
+	s.OnMessage(alice, messages.Message{Channel: "@dave", Message: "hi"})
+	if got := notices(alice); len(got) != 1 || !strings.Contains(got[0], "appears not to be online") {
+		t.Errorf("expected the DM to dave to fail: %v", got)
+	}
+
+	// Alice's messages are kept for bob, up to the limit.
+	for _, text := range []string{"hi", "call me", "hello??"} {
+		s.OnMessage(alice, messages.Message{Channel: "@bob", Message: text})
+	}
+	if got := notices(alice); len(got) != 2 || !strings.Contains(got[0], "when they next log in") || !strings.Contains(got[1], "already sent 2 messages") {
+		t.Errorf("unexpected notices for alice: %v", got)
+	}
+
+	// Carol's are dropped, as bob has muted her.
+	s.OnMessage(carol, messages.Message{Channel: "@bob", Message: "hey"})
+	if total, _, err := models.CountPendingMessages("bob", "alice"); err != nil || total != 2 {
+		t.Errorf("expected 2 pending messages for bob (err=%v), got %d", err, total)
+	}
+	s.OnMessage(dan, messages.Message{Channel: "@bob", Message: "yo"})
+
+	// Bob comes back and gets them.
+	bob = s.NewPollingSubscriber(nil, func() {})
+	s.AddSubscriber(bob)
+	s.OnLogin(bob, messages.Message{Username: "bob"})
+
+	var (
+		delivered []string
+		summary   string
+	)
+	for _, msg := range drainMessages(t, bob) {
+		if msg.Action == messages.ActionEcho {
+			for _, echo := range msg.Messages {
+				if echo.Channel == "@alice" {
+					delivered = append(delivered, echo.Message)
+				}
+			}
+		} else if msg.Action == messages.ActionError && strings.HasPrefix(msg.Message, "While you were away") {
+			summary = msg.Message
+		}
+	}
+	if len(delivered) != 2 || !strings.Contains(delivered[0], "hi") || !strings.Contains(delivered[1], "call me") {
+		t.Errorf("bob did not get alice's messages: %v", delivered)
+	}
+	if !strings.Contains(summary, "alice</strong> (2)") || strings.Contains(summary, "carol") || !strings.Contains(summary, "&lt;i&gt;dan&lt;/i&gt;</strong> (1)") {
+		t.Errorf("unexpected summary: %q", summary)
+	}
+
+	// They are only delivered once.
+	if total, _, _ := models.CountPendingMessages("bob", "alice"); total != 0 {
+		t.Errorf("expected the pending messages to be gone, got %d", total)
+	}
+}
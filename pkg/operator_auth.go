@@ -0,0 +1,386 @@
+package barertc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/util"
+	jwtv4 "github.com/golang-jwt/jwt/v4"
+)
+
+/*
+Operator authentication for the moderation web panel (the /admin console, the /psi
+pages and the ban management APIs).
+
+An operator signs in with one of:
+
+  - A JWT token with operator rights, by visiting the page with ?jwt= in the URL.
+  - The username and password of a local chat account with operator rights.
+  - The AdminAPIKey from settings.toml.
+
+They are given a signed session cookie, and every form post from the panel must
+carry a CSRF token which is derived from that cookie. Scripts may instead send the
+AdminAPIKey in an X-API-Key header on every request, with no cookie or CSRF token.
+*/
+
+// Operator session settings.
+const (
+	OperatorSessionCookie = "barertc_operator"
+	OperatorSessionExpiry = 12 * time.Hour
+	CSRFHeader            = "X-CSRF-Token"
+	CSRFFormField         = "csrf_token"
+
+	// The operator name given to sessions that signed in with the AdminAPIKey.
+	AdminAPIKeyOperator = "AdminAPIKey"
+)
+
+type operatorContextKey struct{}
+
+// operatorSessionSecret signs the session cookies and CSRF tokens. It is made up anew
+// each time the chat server starts, which signs everybody out of the panel.
+var operatorSessionSecret = func() []byte {
+	var secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// operatorSession is the signed-in operator for a request.
+type operatorSession struct {
+	Username  string
+	CSRFToken string // blank for X-API-Key requests
+}
+
+// OperatorAuth is a middleware that only lets operators through to the handler.
+//
+// Requests that are not GET or HEAD must also pass the CSRF check.
+func OperatorAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Scripts may send the AdminAPIKey in a header, which browsers won't do by themselves.
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			if remaining, locked := LoginLockedOut(util.IPAddress(r), ""); locked {
+				setRetryAfter(w, remaining)
+				http.Error(w, "Too many failed attempts, please try again later.", http.StatusTooManyRequests)
+				return
+			}
+			if !checkAdminAPIKey(key) {
+				RecordLoginFailure(r.URL.Path, util.IPAddress(r), "")
+				http.Error(w, "Authentication denied.", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, withOperatorSession(r, operatorSession{Username: AdminAPIKeyOperator}))
+			return
+		}
+
+		// Signing in by a JWT token on the query string.
+		if token := r.URL.Query().Get("jwt"); token != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			claims, ok, err := jwt.ParseAndValidate(token)
+			if err != nil || !ok {
+				http.Error(w, "Invalid JWT", http.StatusUnauthorized)
+				return
+			}
+			ApplyRoles(claims)
+			if !claims.IsAdmin {
+				http.Error(w, "Acceso restringido a operadores.", http.StatusForbidden)
+				return
+			}
+
+			log.Info("OperatorAuth: %s signed in to the moderation panel with a JWT token", claims.Subject)
+			setOperatorSession(w, claims.Subject, claims.Issuer)
+
+			// Redirect to drop the token from the URL.
+			var query = r.URL.Query()
+			query.Del("jwt")
+			r.URL.RawQuery = query.Encode()
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			return
+		}
+
+		session, ok := getOperatorSession(r)
+		if !ok {
+			if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") {
+				renderOperatorLogin(w, r, "")
+				return
+			}
+			http.Error(w, "Acceso restringido a operadores.", http.StatusUnauthorized)
+			return
+		}
+
+		// CSRF protection for anything that changes state.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			var token = r.Header.Get(CSRFHeader)
+			if token == "" {
+				token = r.PostFormValue(CSRFFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+				log.Warn("OperatorAuth: CSRF check failed for %s on %s", session.Username, r.URL.Path)
+				http.Error(w, "Token CSRF inválido. Recarga la página e inténtalo de nuevo.", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, withOperatorSession(r, session))
+	})
+}
+
+// OperatorName returns the username of the operator signed in to the request.
+func OperatorName(r *http.Request) string {
+	if session, ok := r.Context().Value(operatorContextKey{}).(operatorSession); ok {
+		return session.Username
+	}
+	return ""
+}
+
+// OperatorCSRFToken returns the CSRF token of the operator signed in to the request,
+// for pages to include in their form posts.
+func OperatorCSRFToken(r *http.Request) string {
+	if session, ok := r.Context().Value(operatorContextKey{}).(operatorSession); ok {
+		return session.CSRFToken
+	}
+	return ""
+}
+
+// OperatorLogin (/operator/login) signs an operator in to the moderation panel with a
+// local account password or the AdminAPIKey.
+func OperatorLogin() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			renderOperatorLogin(w, r, "")
+			return
+		}
+
+		var (
+			username = strings.TrimSpace(r.PostFormValue("username"))
+			password = r.PostFormValue("password")
+			apiKey   = r.PostFormValue("apikey")
+			next     = r.PostFormValue("next")
+			ip       = util.IPAddress(r)
+			issuer   string // of the operator's identity, as in their JWT claims
+		)
+
+		if !checkLoginThrottle(w, r, username) {
+			return
+		}
+
+		if apiKey != "" {
+			if !checkAdminAPIKey(apiKey) {
+				RecordLoginFailure("/operator/login", ip, "")
+				renderOperatorLogin(w, r, "Acceso denegado.")
+				return
+			}
+			username = AdminAPIKeyOperator
+		} else {
+			user, ok := authenticateUser(username, password)
+			if !ok {
+				RecordLoginFailure("/operator/login", ip, username)
+				renderOperatorLogin(w, r, ErrLoginFailed)
+				return
+			}
+			ResetLoginFailures(username)
+
+			if !isOperator(user.Username, LoginTokenIssuer) || user.Disabled {
+				renderOperatorLogin(w, r, "Acceso restringido a operadores.")
+				return
+			}
+			username = user.Username
+			issuer = LoginTokenIssuer
+		}
+
+		log.Info("OperatorLogin: %s signed in to the moderation panel from %s", username, ip)
+		setOperatorSession(w, username, issuer)
+
+		http.Redirect(w, r, localRedirect(next), http.StatusSeeOther)
+	})
+}
+
+// localRedirect returns the next page to go to after signing in, if it is a local path on
+// this server, or else the admin console.
+func localRedirect(next string) string {
+	// Browsers read a backslash as a slash, e.g. "/\evil.com" as "//evil.com".
+	if !strings.HasPrefix(next, "/") || strings.ContainsAny(next, "\\\r\n\t") {
+		return "/admin"
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "//") {
+		return "/admin"
+	}
+	return next
+}
+
+// OperatorLogout (/operator/logout) clears the operator session cookie.
+func OperatorLogout() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     OperatorSessionCookie,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/operator/login", http.StatusSeeOther)
+	})
+}
+
+// renderOperatorLogin shows the sign in form of the moderation panel.
+func renderOperatorLogin(w http.ResponseWriter, r *http.Request, message string) {
+	tmpl, err := template.New("index").ParseFiles("web/templates/operator_login.html")
+	if err != nil {
+		http.Error(w, "Error cargando operator_login.html: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var next = r.URL.RequestURI()
+	if r.URL.Path == "/operator/login" {
+		next = r.FormValue("next")
+	}
+
+	if message != "" || r.URL.Path != "/operator/login" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	tmpl.ExecuteTemplate(w, "index", map[string]interface{}{
+		"Config":  config.Current,
+		"Message": message,
+		"Next":    next,
+	})
+}
+
+// isOperator checks whether a username currently has operator rights. The issuer is
+// that of their JWT claims, e.g. LoginTokenIssuer for a local chat account.
+func isOperator(username, issuer string) bool {
+	var claims = jwt.Claims{
+		RegisteredClaims: jwtv4.RegisteredClaims{
+			Subject: username,
+			Issuer:  issuer,
+		},
+	}
+	ApplyRoles(&claims)
+	return claims.IsAdmin
+}
+
+// checkAdminAPIKey compares the AdminAPIKey in constant time.
+func checkAdminAPIKey(key string) bool {
+	return config.Current.AdminAPIKey != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(config.Current.AdminAPIKey)) == 1
+}
+
+// withOperatorSession attaches the operator session to the request context.
+func withOperatorSession(r *http.Request, session operatorSession) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), operatorContextKey{}, session))
+}
+
+// setOperatorSession gives the operator a signed session cookie. The issuer of their
+// JWT claims is remembered, so that their roles are checked the same way later.
+func setOperatorSession(w http.ResponseWriter, username, issuer string) {
+	if isAdminAPIKeySession(username, issuer) && config.Current.AdminAPIKey == "" {
+		log.Error("setOperatorSession: refusing an AdminAPIKey session when there is no AdminAPIKey")
+		return
+	}
+
+	var (
+		expires = time.Now().Add(OperatorSessionExpiry)
+		payload = base64.RawURLEncoding.EncodeToString([]byte(username)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(issuer)) + "." +
+			strconv.FormatInt(expires.Unix(), 10)
+	)
+	http.SetCookie(w, &http.Cookie{
+		Name:     OperatorSessionCookie,
+		Value:    payload + "." + signOperatorValue("session", payload),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// getOperatorSession verifies the session cookie, and that its operator still has
+// their operator rights.
+func getOperatorSession(r *http.Request) (operatorSession, bool) {
+	cookie, err := r.Cookie(OperatorSessionCookie)
+	if err != nil {
+		return operatorSession{}, false
+	}
+
+	username, issuer, err := parseOperatorSession(cookie.Value)
+	if err != nil {
+		log.Debug("getOperatorSession: %s", err)
+		return operatorSession{}, false
+	}
+
+	if isAdminAPIKeySession(username, issuer) {
+		if config.Current.AdminAPIKey == "" {
+			return operatorSession{}, false
+		}
+	} else if !isOperator(username, issuer) {
+		return operatorSession{}, false
+	}
+
+	return operatorSession{
+		Username:  username,
+		CSRFToken: signOperatorValue("csrf", cookie.Value),
+	}, true
+}
+
+// isAdminAPIKeySession checks whether a session was signed in with the AdminAPIKey.
+func isAdminAPIKeySession(username, issuer string) bool {
+	return username == AdminAPIKeyOperator && issuer == ""
+}
+
+// parseOperatorSession checks the signature and expiration of a session cookie and
+// returns its username and issuer.
+func parseOperatorSession(value string) (username, issuer string, err error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 {
+		return "", "", errors.New("malformed session")
+	}
+
+	var payload = strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(signOperatorValue("session", payload))) {
+		return "", "", errors.New("bad session signature")
+	}
+
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", errors.New("session expired")
+	}
+
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("malformed session username: %s", err)
+	}
+	iss, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("malformed session issuer: %s", err)
+	}
+
+	return string(name), string(iss), nil
+}
+
+// signOperatorValue computes the HMAC of a value for a purpose ("session" or "csrf").
+//
+// The key is derived from the secret of this process and the AdminAPIKey, so changing
+// the AdminAPIKey signs everyone out as well.
+func signOperatorValue(purpose, value string) string {
+	var key = sha256.Sum256([]byte("barertc operator " + purpose + ":" + string(operatorSessionSecret) + ":" + config.Current.AdminAPIKey))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,122 @@
+package barertc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+)
+
+func TestOperatorAuth(t *testing.T) {
+	var saved = config.Current.AdminAPIKey
+	defer func() {
+		config.Current.AdminAPIKey = saved
+	}()
+	config.Current.AdminAPIKey = "test-api-key"
+
+	var handler = OperatorAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok " + OperatorName(r)))
+	}))
+
+	// Get a session cookie for the AdminAPIKey operator.
+	rec := httptest.NewRecorder()
+	setOperatorSession(rec, AdminAPIKeyOperator, "")
+	cookie := rec.Result().Cookies()[0]
+	csrf := signOperatorValue("csrf", cookie.Value)
+
+	var tests = []struct {
+		Name   string
+		Method string
+		Header map[string]string
+		Cookie bool
+		Body   string
+		Expect int
+	}{
+		{"no auth", http.MethodGet, nil, false, "", http.StatusUnauthorized},
+		{"bad api key", http.MethodPost, map[string]string{"X-API-Key": "wrong"}, false, "", http.StatusUnauthorized},
+		{"api key", http.MethodPost, map[string]string{"X-API-Key": "test-api-key"}, false, "", http.StatusOK},
+		{"session get", http.MethodGet, nil, true, "", http.StatusOK},
+		{"session post without csrf", http.MethodPost, nil, true, "ip=1.2.3.4", http.StatusForbidden},
+		{"session post with bad csrf", http.MethodPost, map[string]string{CSRFHeader: "nope"}, true, "", http.StatusForbidden},
+		{"session post with csrf header", http.MethodPost, map[string]string{CSRFHeader: csrf}, true, "", http.StatusOK},
+		{"session post with csrf field", http.MethodPost, nil, true, CSRFFormField + "=" + csrf, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.Method, "/api/bans", strings.NewReader(test.Body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		if test.Body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for k, v := range test.Header {
+			req.Header.Set(k, v)
+		}
+		if test.Cookie {
+			req.AddCookie(cookie)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.Expect {
+			t.Errorf("%s: expected status %d, got %d: %s", test.Name, test.Expect, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Tampered and expired sessions are rejected.
+	for _, value := range []string{
+		cookie.Value + "0",
+		"QWRtaW5BUElLZXk..1." + signOperatorValue("session", "QWRtaW5BUElLZXk..1"),
+	} {
+		if _, _, err := parseOperatorSession(value); err == nil {
+			t.Errorf("expected session %q to be rejected", value)
+		}
+	}
+}
+
+func TestOperatorSessionWithoutAdminAPIKey(t *testing.T) {
+	var saved = config.Current.AdminAPIKey
+	defer func() {
+		config.Current.AdminAPIKey = saved
+	}()
+	config.Current.AdminAPIKey = "test-api-key"
+
+	rec := httptest.NewRecorder()
+	setOperatorSession(rec, AdminAPIKeyOperator, "")
+	cookie := rec.Result().Cookies()[0]
+
+	// With the AdminAPIKey removed, its sessions are no longer valid and no new ones are given.
+	config.Current.AdminAPIKey = ""
+	req := httptest.NewRequest(http.MethodGet, "/api/bans", nil)
+	req.AddCookie(cookie)
+	if _, ok := getOperatorSession(req); ok {
+		t.Errorf("expected the AdminAPIKey session to be rejected")
+	}
+
+	rec = httptest.NewRecorder()
+	setOperatorSession(rec, AdminAPIKeyOperator, "")
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		t.Errorf("expected no AdminAPIKey session to be given, got %s", cookies[0].Value)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	for next, expect := range map[string]string{
+		"/admin?tab=bans":     "/admin?tab=bans",
+		"/psi":                "/psi",
+		"":                    "/admin",
+		"admin":               "/admin",
+		"https://evil.com/":   "/admin",
+		"//evil.com":          "/admin",
+		"/\\evil.com":         "/admin",
+		"/\\/evil.com":        "/admin",
+		"/\tevil.com":         "/admin",
+		"javascript:alert(1)": "/admin",
+		"/%2F/evil.com":       "/admin",
+	} {
+		if got := localRedirect(next); got != expect {
+			t.Errorf("localRedirect(%q): expected %q, got %q", next, expect, got)
+		}
+	}
+}
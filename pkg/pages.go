@@ -1,17 +1,15 @@
-
 package barertc
 
 import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
 	"git.kirsle.net/apps/barertc/pkg/config"
 	"git.kirsle.net/apps/barertc/pkg/jwt"
 	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/models"
 	"git.kirsle.net/apps/barertc/pkg/util"
 )
 
@@ -19,7 +17,7 @@ import (
 func IndexPage() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := util.IPAddress(r)
-		if isIPBanned(ip) {
+		if _, banned := FindIPBan(ip); banned {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("Acceso denegado. Tu IP ha sido baneada."))
 			return
@@ -134,7 +132,7 @@ func PsiPage() http.HandlerFunc {
 			http.Error(w, "Error cargando psi.html: "+err.Error(), 500)
 			return
 		}
-		tmpl.ExecuteTemplate(w, "psi", nil)
+		tmpl.ExecuteTemplate(w, "psi", psiValues(r))
 	})
 }
 
@@ -147,99 +145,144 @@ func PsiPage2() http.HandlerFunc {
 			http.Error(w, "Error cargando psi2.html: "+err.Error(), 500)
 			return
 		}
-		tmpl.ExecuteTemplate(w, "psi2", nil)
+		tmpl.ExecuteTemplate(w, "psi2", psiValues(r))
 	})
 }
 
-// GetBansAPI devuelve el contenido de datos.txt
+// psiValues son las variables de plantilla de las páginas psi.
+func psiValues(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"Operator":  OperatorName(r),
+		"CSRFToken": OperatorCSRFToken(r),
+	}
+}
+
+// GetBansAPI devuelve el historial de nicks e IPs conectados (antes datos.txt)
 func GetBansAPI() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		data, err := os.ReadFile("datos.txt")
+		records, err := models.RecentUserIPs()
 		if err != nil {
-			http.Error(w, "Error leyendo datos.txt: "+err.Error(), 500)
+			http.Error(w, "Error leyendo el historial de IPs: "+err.Error(), 500)
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write(data)
+		w.Write([]byte(formatUserIPs(records)))
 	}
 }
 
-// GetBansAPI2 devuelve el contenido de datos2.txt
+// GetBansAPI2 devuelve la lista de IPs y rangos baneados (antes datos2.txt)
 func GetBansAPI2() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		data, err := os.ReadFile("datos2.txt")
-		if err != nil {
-			http.Error(w, "Error leyendo datos2.txt: "+err.Error(), 500)
-			return
+		var lines = []string{}
+		for _, ban := range ActiveBans() {
+			if ban.Kind == models.BanKindIP || ban.Kind == models.BanKindCIDR {
+				lines = append(lines, ban.Value)
+			}
 		}
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write(data)
+		w.Write([]byte(strings.Join(lines, "\n")))
 	}
 }
 
-// AddBanAPI agrega IP y nick al archivo datos.txt
+// AddBanAPI banea una IP, o todas las IPs conocidas de un nick
 func AddBanAPI() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST methods allowed", http.StatusMethodNotAllowed)
+			return
+		}
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Error al procesar formulario", 400)
 			return
 		}
-		ip := util.IPAddress(r)
-		nick := r.FormValue("nick")
-		if ip == "" || nick == "" {
+		var (
+			ip     = strings.TrimSpace(r.FormValue("ip"))
+			nick   = strings.TrimSpace(r.FormValue("nick"))
+			reason = strings.TrimSpace(r.FormValue("reason"))
+			ips    = []string{}
+		)
+		if ip == "" && nick == "" {
 			http.Error(w, "IP o nick vacío", 400)
 			return
 		}
-		linea := fmt.Sprintf("Nick: %s | IP: %s\n", nick, ip)
-		exePath, err := os.Executable()
-		if err != nil {
-			http.Error(w, "Error al obtener ruta ejecutable", 500)
-			return
+
+		if ip != "" {
+			ips = append(ips, ip)
+		} else {
+			records, err := models.GetUserIPs(nick)
+			if err != nil {
+				http.Error(w, "Error buscando las IPs del nick: "+err.Error(), 500)
+				return
+			}
+			for _, record := range records {
+				ips = append(ips, record.IP)
+			}
+			if len(ips) == 0 {
+				http.Error(w, fmt.Sprintf("No se conocen IPs para el nick %s", nick), 404)
+				return
+			}
 		}
-		rutaArchivo := filepath.Join(filepath.Dir(exePath), "datos.txt")
-		f, err := os.OpenFile(rutaArchivo, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			http.Error(w, "Error al abrir datos.txt: "+err.Error(), 500)
-			return
+
+		for _, addr := range ips {
+			if _, err := AddBan(models.Ban{
+				Kind:     banKindForAddress(addr),
+				Value:    addr,
+				Reason:   reason,
+				Operator: OperatorName(r),
+			}); err != nil {
+				http.Error(w, fmt.Sprintf("Error al banear %s: %s", addr, err), 400)
+				return
+			}
 		}
-		defer f.Close()
-		if _, err := f.WriteString(linea); err != nil {
-			http.Error(w, "Error al escribir: "+err.Error(), 500)
-			return
+
+		Audit(operatorSource(r), OperatorName(r), "banip", strings.Join(ips, ", "), fmt.Sprintf("nick=%q reason=%q", nick, reason))
+
+		if nick != "" {
+			fmt.Fprintf(w, "Nick %s con IP %s baneado con éxito.", nick, strings.Join(ips, ", "))
+		} else {
+			fmt.Fprintf(w, "IP %s baneada con éxito.", ip)
 		}
-		fmt.Fprintf(w, "Nick %s con IP %s baneado con éxito.", nick, ip)
 	}
 }
 
-// AddBanAPI2 agrega IP al archivo datos2.txt
+// AddBanAPI2 agrega una IP o rango CIDR a la lista de baneos
 func AddBanAPI2() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST methods allowed", http.StatusMethodNotAllowed)
+			return
+		}
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Error al procesar formulario", 400)
 			return
 		}
-		ip := r.FormValue("ip")
+		ip := strings.TrimSpace(r.FormValue("ip"))
 		if ip == "" {
 			http.Error(w, "IP vacía", 400)
 			return
 		}
-		f, err := os.OpenFile("datos2.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			http.Error(w, "Error al abrir datos2.txt: "+err.Error(), 500)
-			return
-		}
-		defer f.Close()
-		if _, err := f.WriteString(ip + "\n"); err != nil {
-			http.Error(w, "Error al escribir: "+err.Error(), 500)
+		var reason = strings.TrimSpace(r.FormValue("reason"))
+		if _, err := AddBan(models.Ban{
+			Kind:     banKindForAddress(ip),
+			Value:    ip,
+			Reason:   reason,
+			Operator: OperatorName(r),
+		}); err != nil {
+			http.Error(w, "Error al banear: "+err.Error(), 400)
 			return
 		}
+		Audit(operatorSource(r), OperatorName(r), "banip", ip, reason)
 		fmt.Fprintf(w, "IP %s baneada con éxito.", ip)
 	}
 }
 
-// UnbanAPI elimina una IP del archivo datos2.txt
+// UnbanAPI elimina una IP o rango CIDR de la lista de baneos
 func UnbanAPI() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST methods allowed", http.StatusMethodNotAllowed)
+			return
+		}
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Error al procesar formulario", 400)
 			return
@@ -250,87 +293,63 @@ func UnbanAPI() http.HandlerFunc {
 			return
 		}
 
-		ruta := "datos2.txt"
-		data, err := os.ReadFile(ruta)
+		count, err := LiftBans(banKindForAddress(ip), ip)
 		if err != nil {
-			http.Error(w, "Error leyendo datos2.txt: "+err.Error(), 500)
+			http.Error(w, "Error eliminando el baneo: "+err.Error(), 500)
 			return
-		}
-
-		lines := strings.Split(string(data), "\n")
-		var nuevasLineas []string
-		for _, line := range lines {
-			if strings.TrimSpace(line) != ip {
-				nuevasLineas = append(nuevasLineas, line)
-			}
-		}
-
-		err = os.WriteFile(ruta, []byte(strings.Join(nuevasLineas, "\n")), 0644)
-		if err != nil {
-			http.Error(w, "Error escribiendo datos2.txt: "+err.Error(), 500)
+		} else if count == 0 {
+			http.Error(w, fmt.Sprintf("La IP %s no estaba baneada.", ip), 404)
 			return
 		}
 
+		Audit(operatorSource(r), OperatorName(r), "unbanip", ip, "")
 		fmt.Fprintf(w, "IP %s eliminada de la lista de baneos.", ip)
 	}
 }
 
-// isIPBanned revisa si la IP está en ambos archivos: datos.txt y datos2.txt
-func isIPBanned(ip string) bool {
-	foundInDatos := false
-	foundInDatos2 := false
-
-	if data, err := os.ReadFile("datos.txt"); err == nil {
-		for _, line := range strings.Split(string(data), "\n") {
-			if strings.Contains(line, "IP: "+ip) {
-				foundInDatos = true
-				break
-			}
-		}
-	}
-
-	if data, err := os.ReadFile("datos2.txt"); err == nil {
-		for _, line := range strings.Split(string(data), "\n") {
-			if strings.TrimSpace(line) == ip {
-				foundInDatos2 = true
-				break
-			}
-		}
-	}
-
-	return foundInDatos && foundInDatos2
-}
-
-// BuscarUsuarioAPI permite buscar coincidencias de texto en datos.txt
+// BuscarUsuarioAPI permite buscar coincidencias de nick o IP en el historial de conexiones
 func BuscarUsuarioAPI() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("query")
+		query := strings.TrimSpace(r.URL.Query().Get("query"))
 		if query == "" {
 			http.Error(w, "Parámetro 'query' requerido", http.StatusBadRequest)
 			return
 		}
 
-		data, err := os.ReadFile("datos.txt")
+		records, err := models.SearchUserIPs(query)
 		if err != nil {
-			http.Error(w, "Error leyendo datos.txt: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Error buscando en el historial de IPs: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		lines := strings.Split(string(data), "\n")
-		var resultados []string
-		for _, line := range lines {
-			if strings.Contains(strings.ToLower(line), strings.ToLower(query)) {
-				resultados = append(resultados, line)
-			}
-		}
-
-		if len(resultados) == 0 {
+		if len(records) == 0 {
 			w.Write([]byte("No se encontraron coincidencias."))
 			return
 		}
 
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(strings.Join(resultados, "\n")))
+		w.Write([]byte(formatUserIPs(records)))
 	}
 }
 
+// formatUserIPs formatea el historial de IPs como las líneas del antiguo datos.txt,
+// marcando las IPs que se encuentran baneadas.
+func formatUserIPs(records []models.UserIP) string {
+	var lines = []string{}
+	for _, record := range records {
+		line := fmt.Sprintf("Nick: %s | IP: %s", record.Username, record.IP)
+		if _, banned := FindIPBan(record.IP); banned {
+			line += " (baneada)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// banKindForAddress returns the ban kind for an IP address or a CIDR range.
+func banKindForAddress(addr string) string {
+	if strings.Contains(addr, "/") {
+		return models.BanKindCIDR
+	}
+	return models.BanKindIP
+}
@@ -15,6 +15,10 @@ import (
 // Polling user timeout before disconnecting them.
 const PollingUserTimeout = time.Minute
 
+// LongPollTimeout is the longest time that a long-poll request is held open, waiting
+// for new messages for the client.
+const LongPollTimeout = 25 * time.Second
+
 // JSON payload structure for polling API.
 type PollMessage struct {
 	// Send the username after authenticated.
@@ -25,6 +29,9 @@ type PollMessage struct {
 
 	// BareRTC protocol message.
 	Message messages.Message `json:"msg"`
+
+	// Long-poll: the number of seconds to wait for new messages, if there are none yet.
+	Wait int `json:"wait,omitempty"`
 }
 
 type PollResponse struct {
@@ -56,10 +63,10 @@ func (s *Server) KickIdlePollUsers() {
 	for {
 		time.Sleep(10 * time.Second)
 		for _, sub := range s.IterSubscribers() {
-			if sub.usePolling && time.Since(sub.lastPollAt) > PollingUserTimeout {
+			if sub.usePolling && time.Since(sub.lastPolled()) > PollingUserTimeout {
 				// Send an exit message.
 				if sub.authenticated && sub.ChatStatus != "hidden" {
-					log.Error("KickIdlePollUsers: %s last seen %s ago", sub.Username, sub.lastPollAt)
+					log.Error("KickIdlePollUsers: %s last seen %s ago", sub.Username, sub.lastPolled())
 
 					sub.authenticated = false
 					s.Broadcast(messages.Message{
@@ -67,7 +74,7 @@ func (s *Server) KickIdlePollUsers() {
 						Username: sub.Username,
 						Message:  messages.PresenceTimedOut,
 					})
-					s.SendWhoList()
+					s.SendWhoListChanges(sub.Username)
 				}
 
 				s.DeleteSubscriber(sub)
@@ -78,11 +85,13 @@ func (s *Server) KickIdlePollUsers() {
 
 // FlushPollResponse returns a response for the polling API that will flush
 // all pending messages sent to the client.
+//
+// If the client has a Server-Sent Events stream open, the messages are sent there instead.
 func (sub *Subscriber) FlushPollResponse() PollResponse {
 	var msgs = []messages.Message{}
 
 	// Drain the messages from the outbox channel.
-	for len(sub.messages) > 0 {
+	for len(sub.messages) > 0 && !sub.isStreaming() {
 		message := <-sub.messages
 		var msg messages.Message
 		json.Unmarshal(message, &msg)
@@ -96,6 +105,52 @@ func (sub *Subscriber) FlushPollResponse() PollResponse {
 	}
 }
 
+// WaitPollResponse is the FlushPollResponse of a long-poll request: if there are no
+// messages for the client yet, it waits for them up to the timeout.
+func (sub *Subscriber) WaitPollResponse(ctx context.Context, timeout time.Duration) PollResponse {
+	if len(sub.messages) == 0 && !sub.isStreaming() {
+		var timer = time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case message := <-sub.messages:
+			// Put it back in front of any others that arrive meanwhile.
+			var response = sub.FlushPollResponse()
+			var msg messages.Message
+			json.Unmarshal(message, &msg)
+			response.Messages = append([]messages.Message{msg}, response.Messages...)
+			return response
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return sub.FlushPollResponse()
+}
+
+// refreshPollJWT gives polling users a ping back with an updated JWT once in a while,
+// if they use JWT authentication. Equivalent to the WebSockets pinger channel.
+func (sub *Subscriber) refreshPollJWT() {
+	sub.streamMu.Lock()
+	if time.Since(sub.lastPollJWT) <= PingInterval {
+		sub.streamMu.Unlock()
+		return
+	}
+	sub.lastPollJWT = time.Now()
+	sub.streamMu.Unlock()
+
+	if sub.JWTClaims != nil {
+		if jwt, err := sub.JWTClaims.ReSign(); err != nil {
+			log.Error("ReSign JWT token for %s#%d: %s", sub.Username, sub.ID, err)
+		} else {
+			sub.SendJSON(messages.Message{
+				Action:   messages.ActionPing,
+				JWTToken: jwt,
+			})
+		}
+	}
+}
+
 // Functions for the Polling API as an alternative to WebSockets.
 func (s *Server) PollingAPI() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -133,6 +188,25 @@ func (s *Server) PollingAPI() http.HandlerFunc {
 		// Debug logging.
 		log.Debug("Polling connection from %s - %s", ip, r.Header.Get("User-Agent"))
 
+		// Is their IP address banned?
+		if ban, banned := FindIPBan(ip); banned {
+			log.Warn("Polling API: connection from banned IP %s (ban #%d)", ip, ban.ID)
+			w.WriteHeader(http.StatusForbidden)
+			enc.Encode(PollResponse{
+				Messages: []messages.Message{
+					{
+						Action:   messages.ActionError,
+						Username: "ChatServer",
+						Message:  "Your IP address has been banned from the chat room.",
+					},
+					{
+						Action: messages.ActionKick,
+					},
+				},
+			})
+			return
+		}
+
 		// Are they resuming an authenticated session?
 		var sub *Subscriber
 		if params.Username != "" || params.SessionID != "" {
@@ -177,28 +251,25 @@ func (s *Server) PollingAPI() http.HandlerFunc {
 			}
 
 			// Ping their last seen time.
-			sub.lastPollAt = time.Now()
+			sub.touchPoll()
 		}
 
 		// If they are authenticated, handle this message.
 		if sub != nil && sub.authenticated {
 			s.OnClientMessage(sub, params.Message)
+			sub.refreshPollJWT()
 
-			// If they use JWT authentication, give them a ping back with an updated
-			// JWT once in a while. Equivalent to the WebSockets pinger channel.
-			if time.Since(sub.lastPollJWT) > PingInterval {
-				sub.lastPollJWT = time.Now()
-
-				if sub.JWTClaims != nil {
-					if jwt, err := sub.JWTClaims.ReSign(); err != nil {
-						log.Error("ReSign JWT token for %s#%d: %s", sub.Username, sub.ID, err)
-					} else {
-						sub.SendJSON(messages.Message{
-							Action:   messages.ActionPing,
-							JWTToken: jwt,
-						})
-					}
+			// Long-poll: hold the request until there are messages for them.
+			if params.Wait > 0 {
+				var timeout = time.Duration(params.Wait) * time.Second
+				if timeout > LongPollTimeout {
+					timeout = LongPollTimeout
 				}
+				sub.setLongPolling()
+				response := sub.WaitPollResponse(r.Context(), timeout)
+				sub.touchPoll()
+				enc.Encode(response)
+				return
 			}
 
 			enc.Encode(sub.FlushPollResponse())
@@ -216,6 +287,7 @@ func (s *Server) PollingAPI() http.HandlerFunc {
 		// roster unless their login succeeds.
 		ctx, cancel := context.WithCancel(r.Context())
 		sub = s.NewPollingSubscriber(ctx, cancel)
+		sub.IP = ip
 
 		// Tentatively add them to the server. If they don't pass authentication,
 		// remove their subscriber immediately. Note: they need added here so they
@@ -238,5 +310,3 @@ func (s *Server) PollingAPI() http.HandlerFunc {
 		enc.Encode(sub.FlushPollResponse())
 	})
 }
-
-
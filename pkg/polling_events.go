@@ -0,0 +1,159 @@
+package barertc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/util"
+)
+
+// EventStreamKeepAlive is how often a comment line is sent down an idle Server-Sent
+// Events stream, so that proxies keep it open and the user is not timed out.
+const EventStreamKeepAlive = 15 * time.Second
+
+// PollingEvents (/poll/events) is a Server-Sent Events stream of the messages for a user
+// of the polling API, for near-WebSocket latency where WebSockets are not available.
+//
+// The user logs in and sends their messages with the /poll endpoint as usual, and opens
+// an EventSource with their session as query parameters:
+//
+//	/poll/events?username=soandso&session_id=...
+//
+// Each message for them is sent as an event with its JSON as the data. While the stream
+// is open, the responses from /poll do not carry any messages.
+func (s *Server) PollingEvents() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := util.IPAddress(r)
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET methods allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// Is their IP address banned?
+		if ban, banned := FindIPBan(ip); banned {
+			log.Warn("Polling events: connection from banned IP %s (ban #%d)", ip, ban.ID)
+			http.Error(w, "Your IP address has been banned from the chat room.", http.StatusForbidden)
+			return
+		}
+
+		// Look up their session.
+		var (
+			username  = r.FormValue("username")
+			sessionID = r.FormValue("session_id")
+		)
+		sub, err := s.GetSubscriber(username)
+		if err != nil || !sub.usePolling || !sub.authenticated || sessionID == "" || sub.sessionID != sessionID {
+			http.Error(w, "Your authentication has expired, please log back into the chat again.", http.StatusUnauthorized)
+			return
+		}
+
+		log.Debug("Polling events: %s#%d opened a stream from %s", sub.Username, sub.ID, ip)
+
+		ctx, stream := sub.openStream(r.Context())
+		defer sub.closeStream(stream)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // nginx
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(EventStreamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case data := <-sub.messages:
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-keepAlive.C:
+				// Kicked out, or timed out?
+				if !s.hasSubscriber(sub) {
+					return
+				}
+
+				sub.touchPoll()
+				sub.refreshPollJWT()
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// openStream marks the polling subscriber as having a Server-Sent Events stream open, and
+// closes any previous one. Returns the context and number of the new stream.
+func (sub *Subscriber) openStream(parent context.Context) (context.Context, int) {
+	ctx, cancel := context.WithCancel(parent)
+
+	sub.streamMu.Lock()
+	defer sub.streamMu.Unlock()
+	if sub.streamCancel != nil {
+		sub.streamCancel()
+	}
+	sub.streamID++
+	sub.streamCancel = cancel
+
+	return ctx, sub.streamID
+}
+
+// closeStream marks the stream as closed, unless a newer one has replaced it.
+func (sub *Subscriber) closeStream(stream int) {
+	sub.streamMu.Lock()
+	defer sub.streamMu.Unlock()
+	if sub.streamID == stream && sub.streamCancel != nil {
+		sub.streamCancel()
+		sub.streamCancel = nil
+	}
+	sub.lastPollAt = time.Now()
+}
+
+// isStreaming checks whether the polling subscriber has a Server-Sent Events stream open.
+func (sub *Subscriber) isStreaming() bool {
+	sub.streamMu.Lock()
+	defer sub.streamMu.Unlock()
+	return sub.streamCancel != nil
+}
+
+// touchPoll records that the polling subscriber was just seen, for KickIdlePollUsers.
+func (sub *Subscriber) touchPoll() {
+	sub.streamMu.Lock()
+	defer sub.streamMu.Unlock()
+	sub.lastPollAt = time.Now()
+}
+
+// lastPolled returns when the polling subscriber was last seen.
+func (sub *Subscriber) lastPolled() time.Time {
+	sub.streamMu.Lock()
+	defer sub.streamMu.Unlock()
+	return sub.lastPollAt
+}
+
+// setLongPolling marks the polling subscriber as waiting for new messages on their polls.
+func (sub *Subscriber) setLongPolling() {
+	sub.streamMu.Lock()
+	defer sub.streamMu.Unlock()
+	sub.longPolling = true
+}
+
+// isLongPolling checks whether the polling subscriber waits for new messages on their polls.
+func (sub *Subscriber) isLongPolling() bool {
+	sub.streamMu.Lock()
+	defer sub.streamMu.Unlock()
+	return sub.longPolling
+}
@@ -0,0 +1,211 @@
+package barertc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+func TestLongPollAndEvents(t *testing.T) {
+	var (
+		s   = NewServer()
+		mux = http.NewServeMux()
+		bob = s.NewPollingSubscriber(nil, func() {})
+	)
+	mux.Handle("/poll", s.PollingAPI())
+	mux.Handle("/poll/events", s.PollingEvents())
+	var ts = httptest.NewServer(mux)
+	defer ts.Close()
+
+	bob.Username = "bob"
+	bob.authenticated = true
+	s.AddSubscriber(bob)
+	s.JoinChannelsOnLogin(bob)
+
+	var poll = func(params PollMessage) PollResponse {
+		body, _ := json.Marshal(params)
+		resp, err := http.Post(ts.URL+"/poll", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST /poll: %s", err)
+		}
+		defer resp.Body.Close()
+
+		var result PollResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("POST /poll: %s", err)
+		}
+		return result
+	}
+
+	// Alice logs in.
+	var session = poll(PollMessage{Message: messages.Message{Action: messages.ActionLogin, Username: "alice"}})
+	if session.SessionID == "" {
+		t.Fatalf("alice did not log in: %+v", session)
+	}
+
+	// Bob says hello while alice waits for it.
+	time.AfterFunc(100*time.Millisecond, func() {
+		s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "hello alice"})
+	})
+	var (
+		start  = time.Now()
+		result = poll(PollMessage{
+			Username:  session.Username,
+			SessionID: session.SessionID,
+			Message:   messages.Message{Action: messages.ActionPing},
+			Wait:      5,
+		})
+	)
+	if len(result.Messages) == 0 || !strings.Contains(result.Messages[0].Message, "hello alice") {
+		t.Errorf("the long-poll did not get bob's message: %+v", result.Messages)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the long-poll waited too long: %s", elapsed)
+	}
+
+	// Alice opens a stream.
+	var query = url.Values{
+		"username":   {session.Username},
+		"session_id": {session.SessionID},
+	}
+	if resp, err := http.Get(ts.URL + "/poll/events?username=alice&session_id=wrong"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401 for a bad session: %v %v", resp, err)
+	}
+	resp, err := http.Get(ts.URL + "/poll/events?" + query.Encode())
+	if err != nil {
+		t.Fatalf("GET /poll/events: %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected Content-Type: %s", ct)
+	}
+
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "streaming now"})
+
+	var (
+		scanner = bufio.NewScanner(resp.Body)
+		found   = make(chan bool)
+	)
+	go func() {
+		for scanner.Scan() {
+			var line = scanner.Text()
+			if strings.HasPrefix(line, "data: ") && strings.Contains(line, "streaming now") {
+				found <- true
+				return
+			}
+		}
+		found <- false
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Errorf("the stream ended without bob's message")
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("timed out waiting for bob's message on the stream")
+	}
+
+	// The messages do not come with the /poll responses while the stream is open.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "one more"})
+	result = poll(PollMessage{
+		Username:  session.Username,
+		SessionID: session.SessionID,
+		Message:   messages.Message{Action: messages.ActionPing},
+	})
+	if len(result.Messages) != 0 {
+		t.Errorf("the /poll response had messages: %+v", result.Messages)
+	}
+}
+
+// A user's polls, streams and the idle check all touch their polling state at once: run
+// with -race.
+func TestConcurrentPolling(t *testing.T) {
+	var (
+		s   = NewServer()
+		mux = http.NewServeMux()
+	)
+	mux.Handle("/poll", s.PollingAPI())
+	mux.Handle("/poll/events", s.PollingEvents())
+	var ts = httptest.NewServer(mux)
+	defer ts.Close()
+
+	var poll = func(params PollMessage) (PollResponse, error) {
+		body, _ := json.Marshal(params)
+		resp, err := http.Post(ts.URL+"/poll", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return PollResponse{}, err
+		}
+		defer resp.Body.Close()
+
+		var result PollResponse
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		return result, err
+	}
+
+	session, err := poll(PollMessage{Message: messages.Message{Action: messages.ActionLogin, Username: "alice"}})
+	if err != nil || session.SessionID == "" {
+		t.Fatalf("alice did not log in: %+v %v", session, err)
+	}
+	alice, err := s.GetSubscriber("alice")
+	if err != nil {
+		t.Fatalf("GetSubscriber: %s", err)
+	}
+	var query = url.Values{
+		"username":   {session.Username},
+		"session_id": {session.SessionID},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(3)
+
+		// She opens and drops a stream...
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/poll/events?"+query.Encode(), nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+
+		// ...while she long-polls...
+		go func() {
+			defer wg.Done()
+			if _, err := poll(PollMessage{
+				Username:  session.Username,
+				SessionID: session.SessionID,
+				Message:   messages.Message{Action: messages.ActionPing},
+				Wait:      1,
+			}); err != nil {
+				t.Errorf("POST /poll: %s", err)
+			}
+		}()
+
+		// ...and the server checks on her.
+		go func() {
+			defer wg.Done()
+			alice.lastPolled()
+			alice.isLongPolling()
+			alice.isStreaming()
+		}()
+	}
+	wg.Wait()
+
+	if !alice.isLongPolling() || time.Since(alice.lastPolled()) > time.Minute {
+		t.Errorf("alice's polling state was not kept: long-poll %v, last seen %s", alice.isLongPolling(), alice.lastPolled())
+	}
+}
@@ -0,0 +1,202 @@
+package barertc
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+const (
+	// MaxReactionLength is the length (in characters) of the longest emoji reaction.
+	MaxReactionLength = 16
+
+	// MaxReactionsPerUser is the number of different emojis that each user may react with to one message.
+	MaxReactionsPerUser = 10
+)
+
+// OnReact handles emoji reactions to chat messages, and taking them back.
+//
+// The reactions are kept along with the message, and everybody who can see it gets the
+// new set of reactions: the members of its channel, or both parties of a DM.
+func (s *Server) OnReact(sub *Subscriber, msg messages.Message) {
+	if sub.Username == "" || !sub.authenticated {
+		sub.ChatServer("You must log in first.")
+		return
+	}
+
+	// Special reactions to no message (e.g. nudges to mark a camera as explicit) are
+	// only forwarded to everybody.
+	if msg.MessageID < 0 {
+		if msg.Action == messages.ActionReact {
+			s.Broadcast(messages.Message{
+				Action:    messages.ActionReact,
+				Username:  sub.Username,
+				Message:   msg.Message,
+				MessageID: msg.MessageID,
+			})
+		}
+		return
+	}
+
+	var emoji = strings.TrimSpace(msg.Message)
+	if emoji == "" || utf8.RuneCountInString(emoji) > MaxReactionLength {
+		sub.ChatServer("That is not a valid emoji reaction.")
+		return
+	}
+
+	// Which channel is the message in? Older clients only send its ID.
+	var channel = msg.Channel
+	if channel == "" {
+		var ok bool
+		if channel, ok = s.findMessageChannel(sub, msg.MessageID); !ok {
+			sub.ChatServer("The message you reacted to was not found (it may have been taken back).")
+			return
+		}
+	}
+
+	// Created channels are only for their members.
+	if !s.checkChannelAccess(sub, channel) {
+		return
+	}
+
+	// If we know the message, it must be visible to them. Others (e.g. pictures, which
+	// the server does not keep) may still be reacted to in their channel.
+	if author, _, ok := s.findMessage(sub, channel, msg.MessageID); ok {
+		if err := s.checkVisible(sub, author); err != nil {
+			sub.ChatServer("Your reaction was not sent: %s.", err)
+			return
+		}
+	}
+
+	// The reactions in DMs are stored with the channel ID of the thread.
+	var (
+		isDM      = strings.HasPrefix(channel, "@")
+		channelID = channel
+		changed   bool
+		err       error
+	)
+	if isDM {
+		channelID = models.CreateChannelID(sub.Username, strings.TrimPrefix(channel, "@"))
+	}
+
+	if msg.Action == messages.ActionUnreact {
+		changed, err = models.RemoveReaction(msg.MessageID, channelID, sub.Username, emoji)
+	} else {
+		if count, err := models.CountUserReactions(msg.MessageID, sub.Username); err == nil && count >= MaxReactionsPerUser {
+			sub.ChatServer("You have already reacted to that message with %d emojis.", count)
+			return
+		}
+		changed, err = models.AddReaction(msg.MessageID, channelID, sub.Username, emoji)
+	}
+
+	var message = messages.Message{
+		Action:    msg.Action,
+		Channel:   channel,
+		Username:  sub.Username,
+		Message:   emoji,
+		MessageID: msg.MessageID,
+	}
+
+	// Without the database, the reactions are only forwarded along.
+	if err == nil {
+		if !changed {
+			return
+		}
+
+		if reactions, err := models.GetReactions(channelID, msg.MessageID); err != nil {
+			log.Error("Error reading the reactions to message %d: %s", msg.MessageID, err)
+		} else {
+			message.Reactions = reactions[msg.MessageID]
+		}
+	} else if err != models.ErrNotInitialized {
+		log.Error("Error storing the reaction of %s to message %d: %s", sub.Username, msg.MessageID, err)
+		sub.ChatServer("Your reaction could not be saved.")
+		return
+	}
+
+	// Is this a DM?
+	if isDM {
+		// Send the reaction only to both parties.
+		s.SendTo(sub.Username, message)
+		message.Channel = "@" + sub.Username
+
+		// Not if the receiver has muted us, or there is blocking between them.
+		rcpt, err := s.GetSubscriber(strings.TrimPrefix(channel, "@"))
+		if err != nil || (rcpt.Mutes(sub.Username) && !sub.IsAdmin()) || sub.Blocks(rcpt) {
+			return
+		}
+		s.SendTo(rcpt.Username, message)
+		return
+	}
+
+	// Send it to the members of the channel.
+	s.Broadcast(message)
+}
+
+// findMessageChannel finds the channel of a message by its ID alone, among the channels
+// and DM threads of the user: for clients that do not send the channel of a reaction.
+//
+// For DMs, the channel is the other party's username (with the @ prefix).
+func (s *Server) findMessageChannel(sub *Subscriber, msgID int64) (string, bool) {
+	echoLock.RLock()
+	for channel, msgs := range echoMessages {
+		for _, msg := range msgs {
+			if msg.MessageID == msgID {
+				echoLock.RUnlock()
+				return channel, true
+			}
+		}
+	}
+	echoLock.RUnlock()
+
+	if cm, err := models.GetChannelMessage(msgID); err == nil {
+		return cm.ChannelID, true
+	}
+
+	// A DM that the user is a party of?
+	if dm, err := models.GetDirectMessage(msgID); err == nil {
+		var parties = strings.Split(dm.ChannelID, ":")
+		for i, party := range parties {
+			if party == "@"+sub.Username && len(parties) == 2 {
+				return parties[1-i], true
+			}
+		}
+		return "", false
+	}
+
+	// Their own message in this chat session.
+	if channel, ok := sub.sentMessage(msgID); ok && channel != "" {
+		return channel, true
+	}
+
+	return "", false
+}
+
+// attachEchoReactions fills in the current reactions to the echoed messages.
+func attachEchoReactions(echoes []messages.Message) {
+	var byChannel = map[string][]int64{}
+	for _, msg := range echoes {
+		byChannel[msg.Channel] = append(byChannel[msg.Channel], msg.MessageID)
+	}
+
+	var found = map[int64]messages.Reactions{}
+	for channel, ids := range byChannel {
+		reactions, err := models.GetReactions(channel, ids...)
+		if err != nil {
+			if err != models.ErrNotInitialized {
+				log.Error("Error reading the reactions to the echoed messages of %s: %s", channel, err)
+			}
+			return
+		}
+		for id, r := range reactions {
+			found[id] = r
+		}
+	}
+
+	for i := range echoes {
+		echoes[i].Reactions = found[echoes[i].MessageID]
+	}
+}
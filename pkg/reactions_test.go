@@ -0,0 +1,93 @@
+package barertc
+
+import (
+	"reflect"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestReactions(t *testing.T) {
+	setupTestDatabase(t)
+	defer ClearEchoMessages("lobby")
+	config.Current.DirectMessageHistory.Enabled = true
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob", "carol")
+		alice = users[0]
+		bob   = users[1]
+		carol = users[2]
+	)
+
+	// Find the last reaction that a user received.
+	var received = func(sub *Subscriber) (messages.Message, bool) {
+		var (
+			result messages.Message
+			found  bool
+		)
+		for _, msg := range drainMessages(t, sub) {
+			if msg.Action == messages.ActionReact || msg.Action == messages.ActionUnreact {
+				result, found = msg, true
+			}
+		}
+		return result, found
+	}
+
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "hello"})
+	var mid = RecentChannelMessages("lobby")[0].MessageID
+
+	s.OnReact(bob, messages.Message{Action: messages.ActionReact, Channel: "lobby", MessageID: mid, Message: "❤️"})
+	s.OnReact(carol, messages.Message{Action: messages.ActionReact, MessageID: mid, Message: "❤️"}) // no channel
+	s.OnReact(carol, messages.Message{Action: messages.ActionReact, Channel: "lobby", MessageID: mid, Message: "👍"})
+	var expect = messages.Reactions{"❤️": {"bob", "carol"}, "👍": {"carol"}}
+	if msg, ok := received(alice); !ok || msg.Channel != "lobby" || !reflect.DeepEqual(msg.Reactions, expect) {
+		t.Errorf("alice did not get the reactions: %+v", msg)
+	}
+
+	// Reacting twice does nothing; unreacting takes it back.
+	s.OnReact(bob, messages.Message{Action: messages.ActionReact, Channel: "lobby", MessageID: mid, Message: "❤️"})
+	if msg, ok := received(alice); ok {
+		t.Errorf("a duplicate reaction was sent: %+v", msg)
+	}
+	s.OnReact(carol, messages.Message{Action: messages.ActionUnreact, Channel: "lobby", MessageID: mid, Message: "👍"})
+	expect = messages.Reactions{"❤️": {"bob", "carol"}}
+	if msg, ok := received(alice); !ok || msg.Action != messages.ActionUnreact || !reflect.DeepEqual(msg.Reactions, expect) {
+		t.Errorf("alice did not get the unreact: %+v", msg)
+	}
+
+	// Late joiners see them on the echoed messages.
+	bob.SendEchoedMessages()
+	var echoed bool
+	for _, msg := range drainMessages(t, bob) {
+		for _, echo := range msg.Messages {
+			if echo.MessageID == mid {
+				echoed = reflect.DeepEqual(echo.Reactions, expect)
+			}
+		}
+	}
+	if !echoed {
+		t.Errorf("the echoed message did not have the reactions")
+	}
+
+	// Reactions to DMs go only to both parties, and are in the DM history.
+	s.OnMessage(alice, messages.Message{Channel: "@bob", Message: "psst"})
+	page, _, _ := models.PaginateDirectMessages("alice", "bob", 0)
+	if len(page) != 1 {
+		t.Fatalf("expected one DM in the history, got %+v", page)
+	}
+	drainMessages(t, carol)
+	s.OnReact(bob, messages.Message{Action: messages.ActionReact, Channel: "@alice", MessageID: page[0].MessageID, Message: "👀"})
+	if msg, ok := received(alice); !ok || msg.Channel != "@bob" {
+		t.Errorf("alice did not get the DM reaction: %+v", msg)
+	}
+	if msg, ok := received(carol); ok {
+		t.Errorf("carol got a reaction to a DM between others: %+v", msg)
+	}
+	page, _, _ = models.PaginateDirectMessages("bob", "alice", 0)
+	if len(page) != 1 || !reflect.DeepEqual(page[0].Reactions, messages.Reactions{"👀": {"bob"}}) {
+		t.Errorf("the DM history did not have the reactions: %+v", page)
+	}
+}
@@ -0,0 +1,71 @@
+package barertc
+
+import (
+	"strings"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+// OnReceipt handles the delivery and read receipts of DMs, sent by their recipient.
+//
+// A `delivered` receipt is for one message, and a `read` receipt covers all the messages
+// from the sender up to its MessageID. The receipts are stored in the DM history (when
+// enabled) and forwarded to the sender, except for the read receipts of users who
+// have turned them off.
+func (s *Server) OnReceipt(sub *Subscriber, msg messages.Message) {
+	if sub.Username == "" || !sub.authenticated {
+		return
+	}
+
+	// Only for DMs: the channel is the sender of the messages.
+	if !strings.HasPrefix(msg.Channel, "@") || msg.MessageID <= 0 {
+		return
+	}
+	var sender = strings.TrimPrefix(msg.Channel, "@")
+
+	var (
+		marked bool
+		err    error
+	)
+	switch msg.Action {
+	case messages.ActionDeliver:
+		marked, err = (models.DirectMessage{}).MarkDelivered(sender, sub.Username, msg.MessageID)
+	case messages.ActionRead:
+		var n int64
+		n, err = (models.DirectMessage{}).MarkRead(sender, sub.Username, msg.MessageID, sub.NoReceipts)
+		marked = n > 0
+	default:
+		return
+	}
+
+	// Without the DM history, the receipts are only for the messages of the current chat session.
+	if err == models.ErrNotInitialized {
+		if rcpt, err := s.GetSubscriber(sender); err == nil {
+			sentTo, ok := rcpt.sentMessage(msg.MessageID)
+			marked = ok && sentTo == "@"+sub.Username
+		}
+	} else if err != nil {
+		log.Error("Error storing the %s receipt of %s for DM %d: %s", msg.Action, sub.Username, msg.MessageID, err)
+		return
+	}
+
+	// Nothing new for the sender?
+	if !marked || (msg.Action == messages.ActionRead && sub.NoReceipts) {
+		return
+	}
+
+	// Not if the sender muted them, or there is blocking between them.
+	rcpt, err := s.GetSubscriber(sender)
+	if err != nil || rcpt.Mutes(sub.Username) || sub.Blocks(rcpt) {
+		return
+	}
+
+	s.SendTo(rcpt.Username, messages.Message{
+		Action:    msg.Action,
+		Channel:   "@" + sub.Username,
+		Username:  sub.Username,
+		MessageID: msg.MessageID,
+	})
+}
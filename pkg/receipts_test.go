@@ -0,0 +1,109 @@
+package barertc
+
+import (
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestReceipts(t *testing.T) {
+	setupTestDatabase(t)
+	config.Current.DirectMessageHistory.Enabled = true
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, false, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+	)
+
+	// Find the receipts that alice received.
+	var receipts = func() []messages.Message {
+		var result []messages.Message
+		for _, msg := range drainMessages(t, alice) {
+			if msg.Action == messages.ActionDeliver || msg.Action == messages.ActionRead {
+				result = append(result, msg)
+			}
+		}
+		return result
+	}
+
+	// Alice sends bob three DMs.
+	for _, text := range []string{"hi", "are you there?", "hello??"} {
+		s.OnMessage(alice, messages.Message{Channel: "@bob", Message: text})
+	}
+	usernames, unread, _, _, err := models.PaginateUsernames("bob", "newest", 1, 9)
+	if err != nil || len(usernames) != 1 || unread["alice"] != 3 {
+		t.Fatalf("expected 3 unread DMs from alice (err=%v): %v %v", err, usernames, unread)
+	}
+	page, _, _ := models.PaginateDirectMessages("alice", "bob", 0) // newest first
+	drainMessages(t, alice)
+
+	// Bob's client received the first one; the receipt is only sent once.
+	for i := 0; i < 2; i++ {
+		s.OnReceipt(bob, messages.Message{Action: messages.ActionDeliver, Channel: "@alice", MessageID: page[2].MessageID})
+	}
+	if got := receipts(); len(got) != 1 || got[0].Channel != "@bob" || got[0].MessageID != page[2].MessageID {
+		t.Errorf("unexpected delivery receipts: %+v", got)
+	}
+
+	// Not for messages of somebody else.
+	s.OnReceipt(alice, messages.Message{Action: messages.ActionRead, Channel: "@bob", MessageID: page[0].MessageID})
+	if _, unread, _, _, _ := models.PaginateUsernames("bob", "newest", 1, 9); unread["alice"] != 3 {
+		t.Errorf("alice marked her own DMs read: %v", unread)
+	}
+
+	// Bob reads the first two.
+	s.OnReceipt(bob, messages.Message{Action: messages.ActionRead, Channel: "@alice", MessageID: page[1].MessageID})
+	if got := receipts(); len(got) != 1 || got[0].Action != messages.ActionRead || got[0].MessageID != page[1].MessageID {
+		t.Errorf("unexpected read receipts: %+v", got)
+	}
+	if _, unread, _, _, _ := models.PaginateUsernames("bob", "newest", 1, 9); unread["alice"] != 1 {
+		t.Errorf("expected 1 unread DM: %v", unread)
+	}
+	page, _, _ = models.PaginateDirectMessages("alice", "bob", 0)
+	for i, expect := range []bool{false, true, true} {
+		if page[i].Read != expect || page[i].Delivered != expect {
+			t.Errorf("DM %d: expected read and delivered=%v: %+v", i, expect, page[i])
+		}
+	}
+
+	// With read receipts turned off, the last one is read but alice is not told.
+	bob.NoReceipts = true
+	s.OnReceipt(bob, messages.Message{Action: messages.ActionRead, Channel: "@alice", MessageID: page[0].MessageID})
+	if got := receipts(); len(got) != 0 {
+		t.Errorf("alice got a private read receipt: %+v", got)
+	}
+	if _, unread, _, _, _ := models.PaginateUsernames("bob", "newest", 1, 9); len(unread) != 0 {
+		t.Errorf("expected no unread DMs: %v", unread)
+	}
+	if page, _, _ = models.PaginateDirectMessages("alice", "bob", 0); page[0].Read {
+		t.Errorf("the private read receipt is in the DM history: %+v", page[0])
+	}
+}
+
+func TestReceiptsMigration(t *testing.T) {
+	setupTestDatabase(t)
+	config.Current.DirectMessageHistory.Enabled = true
+
+	// A DM history from before the receipts were kept.
+	var msg = messages.Message{MessageID: messages.NextMessageID(), Username: "alice", Message: "hi"}
+	if err := (models.DirectMessage{}).LogMessage("alice", "bob", msg); err != nil {
+		t.Fatalf("LogMessage: %s", err)
+	}
+	for _, column := range []string{"delivered_at", "read_at", "read_private"} {
+		if _, err := models.DB.Exec("ALTER TABLE direct_messages DROP COLUMN " + column); err != nil {
+			t.Fatalf("DROP COLUMN %s: %s", column, err)
+		}
+	}
+
+	// The old messages are not unread after the upgrade.
+	if err := (models.DirectMessage{}).CreateTable(); err != nil {
+		t.Fatalf("CreateTable: %s", err)
+	}
+	if _, unread, _, _, err := models.PaginateUsernames("bob", "newest", 1, 9); err != nil || unread["alice"] != 0 {
+		t.Errorf("expected no unread DMs from alice (err=%v): %v", err, unread)
+	}
+}
@@ -0,0 +1,97 @@
+package barertc
+
+import (
+	"errors"
+	"strings"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+// ReplyExcerptLength is the length (in characters) of the quoted excerpt attached to replies.
+const ReplyExcerptLength = 120
+
+// quoteReply looks up the message that a user is replying to, and returns its Quote.
+//
+// The message must be in the same channel (or DM thread) and visible to the user: see
+// findMessage and checkVisible.
+func (s *Server) quoteReply(sub *Subscriber, channel string, msgID int64) (*messages.Quote, error) {
+	author, text, ok := s.findMessage(sub, channel, msgID)
+	if !ok {
+		return nil, errors.New("the message you replied to was not found (it may have been taken back)")
+	}
+
+	// Is it visible to them?
+	if err := s.checkVisible(sub, author); err != nil {
+		return nil, err
+	}
+
+	// Quote a short excerpt of its text.
+	var quote = &messages.Quote{
+		MessageID: msgID,
+		Username:  author,
+		Excerpt:   PlainText(text),
+	}
+	if runes := []rune(quote.Excerpt); len(runes) > ReplyExcerptLength {
+		quote.Excerpt = strings.TrimSpace(string(runes[:ReplyExcerptLength])) + "…"
+	}
+
+	return quote, nil
+}
+
+// findMessage looks up a message in a channel (or DM thread, as seen by the user), and
+// returns its author and its text.
+//
+// Messages are found in the echo buffer and the DM and channel histories. DMs are also
+// found among the messages that either party sent in their current chat session, but the
+// server does not keep their text without the DM history, so it is blank.
+func (s *Server) findMessage(sub *Subscriber, channel string, msgID int64) (string, string, bool) {
+	if strings.HasPrefix(channel, "@") {
+		var other = strings.TrimPrefix(channel, "@")
+		if dm, err := models.GetDirectMessage(msgID); err == nil && dm.ChannelID == models.CreateChannelID(sub.Username, other) {
+			return dm.Username, dm.Message, true
+		} else if sentTo, ok := sub.sentMessage(msgID); ok && sentTo == channel {
+			return sub.Username, "", true
+		} else if rcpt, err := s.GetSubscriber(other); err == nil {
+			if sentTo, ok := rcpt.sentMessage(msgID); ok && sentTo == "@"+sub.Username {
+				return rcpt.Username, "", true
+			}
+		}
+		return "", "", false
+	}
+
+	for _, msg := range RecentChannelMessages(channel) {
+		if msg.MessageID == msgID {
+			return msg.Username, msg.Message, true
+		}
+	}
+
+	if _, ok := config.Current.GetChannel(channel); ok {
+		if cm, err := models.GetChannelMessage(msgID); err == nil && cm.ChannelID == channel {
+			return cm.Username, cm.Message, true
+		}
+	}
+
+	return "", "", false
+}
+
+// checkVisible checks that the messages of an author are visible to the user: they are
+// not from somebody they have blocked or muted, or who blocks them.
+func (s *Server) checkVisible(sub *Subscriber, author string) error {
+	if _, ok := sub.blockedOrMuted()[author]; ok {
+		return errors.New("you have blocked or muted the author of that message")
+	} else if other, err := s.GetSubscriber(author); err == nil && sub.Blocks(other) {
+		return errors.New("that message is not visible to you")
+	}
+	return nil
+}
+
+// sentMessage returns the channel that the subscriber sent a message to in their current
+// chat session (blank for pictures), by its MID.
+func (sub *Subscriber) sentMessage(msgID int64) (string, bool) {
+	sub.midMu.Lock()
+	defer sub.midMu.Unlock()
+	channel, ok := sub.messageIDs[msgID]
+	return channel, ok
+}
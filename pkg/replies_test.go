@@ -0,0 +1,83 @@
+package barertc
+
+import (
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+func TestReplies(t *testing.T) {
+	setupTestDatabase(t)
+	defer ClearEchoMessages("lobby")
+	config.Current.ChannelHistory.Enabled = true
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob", "carol")
+		alice = users[0]
+		bob   = users[1]
+		carol = users[2]
+	)
+
+	// Find the last chat message that alice received.
+	var received = func() (messages.Message, bool) {
+		var (
+			result messages.Message
+			found  bool
+		)
+		for _, msg := range drainMessages(t, alice) {
+			if msg.Action == messages.ActionMessage {
+				result, found = msg, true
+			}
+		}
+		return result, found
+	}
+
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "anyone like **jazz**?"})
+	var mid = RecentChannelMessages("lobby")[0].MessageID
+	drainMessages(t, alice)
+
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "I do!", ReplyTo: mid})
+	msg, ok := received()
+	if !ok || msg.ReplyTo != mid || msg.Quote == nil {
+		t.Fatalf("alice did not get the reply: %+v", msg)
+	}
+	if q := msg.Quote; q.MessageID != mid || q.Username != "alice" || q.Excerpt != "anyone like jazz?" {
+		t.Errorf("unexpected quote: %+v", q)
+	}
+
+	// Replies to messages that are not there, or in another channel.
+	for _, channel := range []string{"lobby", "offtopic"} {
+		s.OnMessage(bob, messages.Message{Channel: channel, Message: "huh?", ReplyTo: mid + 1000})
+		if _, ok := received(); ok {
+			t.Errorf("a reply to a missing message was sent to %s", channel)
+		}
+	}
+	s.OnMessage(bob, messages.Message{Channel: "offtopic", Message: "me too", ReplyTo: mid})
+	if _, ok := received(); ok {
+		t.Errorf("a reply to a message in another channel was sent")
+	}
+
+	// Not to somebody that they muted.
+	carol.muteMu.Lock()
+	carol.muted["alice"] = struct{}{}
+	carol.muteMu.Unlock()
+	s.OnMessage(carol, messages.Message{Channel: "lobby", Message: "no way", ReplyTo: mid})
+	if _, ok := received(); ok {
+		t.Errorf("carol replied to a message from somebody she muted")
+	}
+
+	// The quote is kept in the channel history.
+	page, _, err := models.PaginateChannelMessages("lobby", 0, 10)
+	if err != nil || len(page) != 2 {
+		t.Fatalf("unexpected channel history (err=%v): %+v", err, page)
+	}
+	if q := page[0].Quote; q == nil || q.MessageID != mid || q.Username != "alice" || q.Excerpt != "anyone like jazz?" {
+		t.Errorf("the reply lost its quote in the history: %+v", q)
+	}
+	if page[1].Quote != nil {
+		t.Errorf("the original message has a quote: %+v", page[1].Quote)
+	}
+}
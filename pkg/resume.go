@@ -0,0 +1,244 @@
+package barertc
+
+import (
+	"context"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"github.com/google/uuid"
+	"nhooyr.io/websocket"
+)
+
+/*
+Resuming dropped WebSocket connections.
+
+Each message that the server sends on a WebSocket is numbered with a sequence number,
+and the most recent ones are kept. When the connection drops without being closed (e.g.
+a phone switching networks), the user keeps their place in the chat for the
+ResumeGracePeriod: they stay on the Who List and the messages sent to them are kept.
+
+If they reconnect in time with their resume token and the last sequence number they
+received, they get back their chat session (mutes, boots, blocks, channels, video
+status and so on) and the messages they missed are replayed. Otherwise they have left
+the chat room.
+*/
+
+const (
+	// ResumeBufferSize is the number of recent messages kept to replay for each user.
+	ResumeBufferSize = 500
+
+	// ResumeBufferBytes is the size of the recent messages kept for each user, which
+	// may be less than ResumeBufferSize when they are sent a lot of pictures.
+	ResumeBufferBytes = 4 * 1024 * 1024
+)
+
+// outboxMessage is a message sent to a WebSocket subscriber, kept to replay.
+type outboxMessage struct {
+	seq  int64
+	data []byte
+}
+
+// ResumeEnabled returns whether dropped WebSocket connections may be resumed.
+func ResumeEnabled() bool {
+	return config.Current.ResumeGracePeriod > 0
+}
+
+// marshalOutbound encodes a message for the client. The messages on WebSocket connections
+// are numbered and kept to replay. Call with the resumeMu held.
+func (sub *Subscriber) marshalOutbound(v interface{}) ([]byte, error) {
+	msg, ok := v.(messages.Message)
+	if !ok || sub.usePolling || msg.Action == messages.ActionPing {
+		return sub.encoding.Marshal(v)
+	}
+
+	sub.seq++
+	msg.Seq = sub.seq
+	data, err := sub.encoding.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if ResumeEnabled() {
+		sub.outbox = append(sub.outbox, outboxMessage{
+			seq:  msg.Seq,
+			data: data,
+		})
+		sub.outboxBytes += len(data)
+		for len(sub.outbox) > ResumeBufferSize || (sub.outboxBytes > ResumeBufferBytes && len(sub.outbox) > 1) {
+			sub.outboxBytes -= len(sub.outbox[0].data)
+			sub.outbox = sub.outbox[1:]
+		}
+	}
+
+	return data, nil
+}
+
+// newResumeToken gives the subscriber a new token to resume their WebSocket connection
+// with, on login.
+func (sub *Subscriber) newResumeToken() {
+	if sub.usePolling || !ResumeEnabled() {
+		return
+	}
+
+	sub.resumeMu.Lock()
+	sub.resumeToken = uuid.New().String()
+	sub.resumeMu.Unlock()
+}
+
+// getResumeToken safely returns the subscriber's resume token.
+func (sub *Subscriber) getResumeToken() string {
+	sub.resumeMu.Lock()
+	defer sub.resumeMu.Unlock()
+	return sub.resumeToken
+}
+
+// hasSubscriber checks whether the subscriber is (still) in the chat room.
+func (s *Server) hasSubscriber(sub *Subscriber) bool {
+	s.subscribersMu.RLock()
+	defer s.subscribersMu.RUnlock()
+	_, ok := s.subscribers[sub]
+	return ok
+}
+
+// ConnectionLost handles a WebSocket connection that has closed or failed.
+//
+// If the user closed it (e.g. they left the page) or may not resume it, they have left
+// the chat room. Otherwise they keep their place for the ResumeGracePeriod.
+func (s *Server) ConnectionLost(sub *Subscriber, conn *websocket.Conn, err error) {
+	// Already removed, e.g. they were kicked.
+	if !s.hasSubscriber(sub) {
+		return
+	}
+
+	switch websocket.CloseStatus(err) {
+	case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+	default:
+		if s.detach(sub, conn) {
+			return
+		}
+	}
+
+	s.DeleteSubscriber(sub)
+	s.announceExit(sub)
+}
+
+// detach keeps the subscriber in the chat room after their connection dropped, until they
+// resume it or the ResumeGracePeriod is over. Returns false if they may not resume.
+func (s *Server) detach(sub *Subscriber, conn *websocket.Conn) bool {
+	sub.resumeMu.Lock()
+	defer sub.resumeMu.Unlock()
+
+	// They have already moved on to a new connection, or this one was already lost.
+	if sub.conn != conn || sub.detached {
+		return true
+	}
+
+	if !ResumeEnabled() || sub.usePolling || !sub.authenticated || sub.resumeToken == "" {
+		return false
+	}
+
+	log.Info("Connection of %s#%d dropped: they have %ds to resume it", sub.Username, sub.ID, config.Current.ResumeGracePeriod)
+	sub.detached = true
+	if sub.cancel != nil {
+		sub.cancel()
+	}
+
+	sub.detachTimer = time.AfterFunc(time.Duration(config.Current.ResumeGracePeriod)*time.Second, func() {
+		s.resumeExpired(sub)
+	})
+	return true
+}
+
+// resumeExpired removes a subscriber who did not resume their connection in time.
+func (s *Server) resumeExpired(sub *Subscriber) {
+	sub.resumeMu.Lock()
+	if !sub.detached {
+		sub.resumeMu.Unlock()
+		return
+	}
+	sub.resumeToken = ""
+	sub.resumeMu.Unlock()
+
+	if !s.hasSubscriber(sub) {
+		return
+	}
+
+	log.Info("%s#%d did not resume their connection in time", sub.Username, sub.ID)
+	s.DeleteSubscriber(sub)
+	s.announceExit(sub)
+}
+
+// announceExit tells everybody that the user has left the chat room, unless they were hidden.
+func (s *Server) announceExit(sub *Subscriber) {
+	if sub.authenticated && sub.ChatStatus != "hidden" {
+		s.Broadcast(messages.Message{
+			Action:   messages.ActionPresence,
+			Username: sub.Username,
+			Message:  messages.PresenceExited,
+		})
+		s.SendWhoListChanges(sub.Username)
+	}
+}
+
+// ResumeSubscriber finds the chat session of a dropped connection by its resume token, and
+// moves it to the new connection.
+//
+// The seq is the last message that the client received. Returns the messages they missed,
+// to be written to the new connection before any others, and false if the session can not
+// be resumed (it is gone, some of the messages they missed are no longer kept, or the new
+// connection asked for a different encoding than the kept messages are in).
+func (s *Server) ResumeSubscriber(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, enc messages.Encoding, token string, seq int64) (*Subscriber, [][]byte, bool) {
+	if token == "" || !ResumeEnabled() {
+		return nil, nil, false
+	}
+
+	for _, sub := range s.IterSubscribers() {
+		sub.resumeMu.Lock()
+		if sub.resumeToken != token || !sub.detached {
+			sub.resumeMu.Unlock()
+			continue
+		}
+
+		// Can we replay everything they missed?
+		if enc != sub.encoding || seq > sub.seq || (seq < sub.seq && (len(sub.outbox) == 0 || sub.outbox[0].seq > seq+1)) {
+			sub.resumeMu.Unlock()
+			return nil, nil, false
+		}
+
+		var replay [][]byte
+		for _, msg := range sub.outbox {
+			if msg.seq > seq {
+				replay = append(replay, msg.data)
+			}
+		}
+
+		// Discard what was waiting for the old connection: it is in the replay.
+	drain:
+		for {
+			select {
+			case <-sub.messages:
+			default:
+				break drain
+			}
+		}
+
+		if sub.detachTimer != nil {
+			sub.detachTimer.Stop()
+		}
+		sub.detached = false
+		sub.conn = conn
+		sub.ctx = ctx
+		sub.cancel = cancel
+		sub.closeSlow = func() {
+			conn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
+		}
+		sub.resumeMu.Unlock()
+
+		log.Info("%s#%d resumed their connection: replaying %d messages", sub.Username, sub.ID, len(replay))
+		return sub, replay, true
+	}
+
+	return nil, nil, false
+}
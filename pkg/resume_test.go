@@ -0,0 +1,99 @@
+package barertc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+func TestResume(t *testing.T) {
+	var (
+		s     = NewServer()
+		alice = s.NewSubscriber(context.Background(), func() {})
+		bob   = s.NewPollingSubscriber(nil, func() {})
+		lost  = errors.New("connection reset by peer")
+	)
+	logIn(s, alice, "alice", true)
+	logIn(s, bob, "bob", true)
+	alice.newResumeToken()
+	alice.SendMe()
+
+	// The last message that alice's client received.
+	var lastSeq int64
+	for _, msg := range drainMessages(t, alice) {
+		if msg.Seq <= lastSeq {
+			t.Errorf("the messages to alice are not numbered in order: %+v", msg)
+		}
+		lastSeq = msg.Seq
+	}
+	drainMessages(t, bob)
+
+	// Her connection drops: she is still in the chat room, without a word to the others.
+	s.ConnectionLost(alice, nil, lost)
+	if !s.hasSubscriber(alice) {
+		t.Fatalf("alice was removed from the chat room")
+	}
+	for _, msg := range drainMessages(t, bob) {
+		if msg.Action == messages.ActionPresence {
+			t.Errorf("bob got a presence message: %+v", msg)
+		}
+	}
+
+	// The messages sent in the meantime are kept for her.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "are you there?"})
+	if n := len(alice.messages); n != 0 {
+		t.Errorf("expected no messages queued for the dropped connection, got %d", n)
+	}
+
+	if _, _, ok := s.ResumeSubscriber(context.Background(), func() {}, nil, messages.EncodingJSON, "wrong", lastSeq); ok {
+		t.Errorf("resumed with the wrong token")
+	}
+	sub, replay, ok := s.ResumeSubscriber(context.Background(), func() {}, nil, messages.EncodingJSON, alice.getResumeToken(), lastSeq)
+	if !ok || sub != alice {
+		t.Fatalf("alice could not resume her connection")
+	}
+	var found bool
+	for i, data := range replay {
+		var msg messages.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("replay: %s", err)
+		}
+		if msg.Seq != lastSeq+int64(i)+1 {
+			t.Errorf("replayed message %d has seq %d, expected %d", i, msg.Seq, lastSeq+int64(i)+1)
+		}
+		if msg.Action == messages.ActionMessage && strings.Contains(msg.Message, "are you there?") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("bob's message was not replayed to alice")
+	}
+
+	// The new connection gets the new messages again.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "welcome back"})
+	if n := len(alice.messages); n != 1 {
+		t.Errorf("expected 1 message queued for the new connection, got %d", n)
+	}
+
+	// If she does not come back in time, she has left.
+	drainMessages(t, bob)
+	s.ConnectionLost(alice, nil, lost)
+	s.resumeExpired(alice)
+	if s.hasSubscriber(alice) {
+		t.Errorf("alice is still in the chat room")
+	}
+	var exited bool
+	for _, msg := range drainMessages(t, bob) {
+		exited = exited || (msg.Action == messages.ActionPresence && msg.Username == "alice")
+	}
+	if !exited {
+		t.Errorf("bob was not told that alice left")
+	}
+	if _, _, ok := s.ResumeSubscriber(context.Background(), func() {}, nil, messages.EncodingJSON, alice.getResumeToken(), lastSeq); ok {
+		t.Errorf("resumed after the grace period")
+	}
+}
@@ -0,0 +1,132 @@
+package barertc
+
+import (
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	ourjwt "git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/models"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/* Operator and VIP roles for logged-in chat accounts. */
+
+// JWT tokens issued by the chat server's own login page.
+const (
+	LoginTokenIssuer = "BareRTC"
+	LoginTokenExpiry = 6 * time.Hour // how long they are valid for
+)
+
+// ChatbotTokenIssuer is the issuer of JWT tokens signed by the /api/authenticate
+// endpoint for chatbots.
+const ChatbotTokenIssuer = "BareRTC-API"
+
+/*
+ApplyRoles updates the JWT claims of a logged-in user with their roles from the
+settings.toml and the database.
+
+A role stored in the database (by the /op and /deop commands, or on the user's local
+chat account for tokens issued by our login page) overrides whatever the JWT token had
+claimed, and the Operators and VIPs from settings.toml always have their role on top
+of that.
+*/
+func ApplyRoles(claims *ourjwt.Claims) {
+	if claims == nil || claims.Subject == "" {
+		return
+	}
+	var username = claims.Subject
+
+	if role, ok, err := models.GetUserRole(username); err != nil {
+		if err != models.ErrNotInitialized {
+			log.Error("ApplyRoles(%s): %s", username, err)
+		}
+	} else if ok {
+		claims.IsAdmin = role.Operator
+		claims.VIP = role.VIP
+		for _, rule := range role.Rules {
+			claims.Rules = addRule(claims.Rules, ourjwt.Rule(rule))
+		}
+	}
+
+	// Roles of a local chat account, only for tokens from our own login page: a JWT user
+	// from your website is a different person, even if a local account has their name.
+	if claims.Issuer == LoginTokenIssuer {
+		if user, err := models.GetUser(username); err == nil {
+			claims.IsAdmin = user.Operator
+			claims.VIP = user.VIP
+		} else if err != models.ErrUserNotFound && err != models.ErrNotInitialized {
+			log.Error("ApplyRoles(%s): %s", username, err)
+		}
+	}
+
+	if config.Current.Roles.IsOperator(username) {
+		claims.IsAdmin = true
+	}
+	if config.Current.Roles.IsVIP(username) {
+		claims.VIP = true
+	}
+
+	// Server side moderation rules, so the front-end will know about them too.
+	if rule := config.Current.GetModerationRule(username); rule != nil {
+		for enabled, value := range map[ourjwt.Rule]bool{
+			ourjwt.RedCamRule:      rule.CameraAlwaysNSFW,
+			ourjwt.NoBroadcastRule: rule.NoBroadcast,
+			ourjwt.NoVideoRule:     rule.NoVideo,
+			ourjwt.NoImageRule:     rule.NoImage,
+			ourjwt.NoDarkVideoRule: rule.NoDarkVideo,
+		} {
+			if value {
+				claims.Rules = addRule(claims.Rules, enabled)
+			}
+		}
+	}
+}
+
+// IssueLoginToken signs a JWT token for a user who logged in with their chat account password.
+func IssueLoginToken(username string) (string, error) {
+	var claims = ourjwt.Claims{
+		Nick: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject: username,
+			Issuer:  LoginTokenIssuer,
+		},
+	}
+	ApplyRoles(&claims)
+	return claims.Sign(LoginTokenExpiry)
+}
+
+// SetOperator grants or removes the operator role of a username in the database.
+//
+// The role is saved in the user_roles table, which applies to JWT users from your website,
+// and also on the local chat account if there is one by that name.
+func SetOperator(username string, operator bool, updatedBy string) error {
+	if user, err := models.GetUser(username); err == nil {
+		user.Operator = operator
+		if err := user.Save(); err != nil {
+			return err
+		}
+	} else if err != models.ErrUserNotFound {
+		return err
+	}
+
+	role, _, err := models.GetUserRole(username)
+	if err != nil {
+		return err
+	}
+
+	role.Operator = operator
+	role.UpdatedBy = updatedBy
+	role.UpdatedAt = time.Now()
+	return models.SaveUserRole(role)
+}
+
+// addRule appends a rule to the list if it is not already there.
+func addRule(rules ourjwt.Rules, rule ourjwt.Rule) ourjwt.Rules {
+	for _, existing := range rules {
+		if existing == rule {
+			return rules
+		}
+	}
+	return append(rules, rule)
+}
@@ -0,0 +1,51 @@
+package barertc
+
+import (
+	"testing"
+
+	ourjwt "git.kirsle.net/apps/barertc/pkg/jwt"
+	"git.kirsle.net/apps/barertc/pkg/models"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestApplyRolesByIssuer(t *testing.T) {
+	setupTestDatabase(t)
+
+	// A website moderator, and a local account somebody registered with their name.
+	if err := models.SaveUserRole(models.UserRole{Username: "Alice", Operator: true}); err != nil {
+		t.Fatalf("SaveUserRole: %s", err)
+	}
+	// A local operator, and a website user by the same name.
+	for _, user := range []models.User{
+		{Username: "alice", PasswordHash: "x"},
+		{Username: "bob", PasswordHash: "x", Operator: true, VIP: true},
+	} {
+		if _, err := models.CreateUser(user); err != nil {
+			t.Fatalf("CreateUser(%s): %s", user.Username, err)
+		}
+	}
+
+	for _, test := range []struct {
+		Username string
+		Issuer   string
+		Admin    bool
+		VIP      bool
+	}{
+		{"Alice", "example.com", true, false},
+		{"alice", LoginTokenIssuer, false, false},
+		{"bob", LoginTokenIssuer, true, true},
+		{"bob", "example.com", false, false},
+	} {
+		var claims = ourjwt.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject: test.Username,
+				Issuer:  test.Issuer,
+			},
+		}
+		ApplyRoles(&claims)
+		if claims.IsAdmin != test.Admin || claims.VIP != test.VIP {
+			t.Errorf("%s from %s: expected admin=%v vip=%v, got admin=%v vip=%v",
+				test.Username, test.Issuer, test.Admin, test.VIP, claims.IsAdmin, claims.VIP)
+		}
+	}
+}
@@ -1,20 +1,16 @@
 package barertc
 
 import (
-	"bufio"
-	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 
 	"git.kirsle.net/apps/barertc/pkg/config"
 	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
 	"git.kirsle.net/apps/barertc/pkg/models"
 )
 
@@ -35,9 +31,25 @@ func NewServer() *Server {
 }
 
 func (s *Server) Setup() error {
-	if config.Current.DirectMessageHistory.Enabled {
-		if err := models.Initialize(config.Current.DirectMessageHistory.SQLiteDatabase); err != nil {
-			log.Error("Error initializing SQLite database: %s", err)
+	// The SQLite database holds the ban list and chat accounts, and the DM history when that feature is enabled.
+	if err := models.Initialize(config.Current.DirectMessageHistory.SQLiteDatabase); err != nil {
+		log.Error("Error initializing SQLite database: %s", err)
+	} else {
+		ImportLegacyBans() // also loads the ban list
+		ImportLegacyUsers()
+		if err := ReloadUserChannels(); err != nil {
+			log.Error("Error loading the created channels: %s", err)
+		}
+		if err := ReloadChannelTopics(); err != nil {
+			log.Error("Error loading the channel topics: %s", err)
+		}
+		if maxID, err := models.MaxMessageID(); err != nil {
+			log.Error("Error reading the newest message ID: %s", err)
+		} else {
+			messages.SetMinimumMessageID(maxID)
+		}
+		if err := RehydrateEchoMessages(); err != nil {
+			log.Error("Error loading the channel history: %s", err)
 		}
 	}
 
@@ -45,19 +57,29 @@ func (s *Server) Setup() error {
 
 	// Rutas existentes
 	mux.Handle("/", s.JWTMiddleware(IndexPage()))
-	mux.Handle("/psi", PsiPage())
-	mux.Handle("/api/bans", GetBansAPI())
-	mux.Handle("/psi2", PsiPage2())
-	mux.Handle("/api/bans2", GetBansAPI2())
-	mux.HandleFunc("/api/ban", AddBanAPI())
-	mux.HandleFunc("/api/buscar", BuscarUsuarioAPI())
-	mux.HandleFunc("/api/ban2", AddBanAPI2())
-	mux.HandleFunc("/api/unban2", UnbanAPI())
+
+	// Panel de moderación: solo para operadores.
+	mux.Handle("/operator/login", OperatorLogin())
+	mux.Handle("/operator/logout", OperatorLogout())
+	mux.Handle("/admin", OperatorAuth(s.AdminPage()))
+	mux.Handle("/admin/action", OperatorAuth(s.AdminAction()))
+	mux.Handle("/psi", OperatorAuth(PsiPage()))
+	mux.Handle("/api/bans", OperatorAuth(GetBansAPI()))
+	mux.Handle("/psi2", OperatorAuth(PsiPage2()))
+	mux.Handle("/api/bans2", OperatorAuth(GetBansAPI2()))
+	mux.Handle("/api/ban", OperatorAuth(AddBanAPI()))
+	mux.Handle("/api/buscar", OperatorAuth(BuscarUsuarioAPI()))
+	mux.Handle("/api/ban2", OperatorAuth(AddBanAPI2()))
+	mux.Handle("/api/unban2", OperatorAuth(UnbanAPI()))
+	mux.Handle("/api/audit", OperatorAuth(s.AuditAPI()))
+
 	mux.Handle("/about", AboutPage())
 	mux.Handle("/logout", LogoutPage())
 	mux.Handle("/ws", s.WebSocket())
 	mux.Handle("/poll", s.PollingAPI())
+	mux.Handle("/poll/events", s.PollingEvents())
 	mux.Handle("/api/statistics", s.Statistics())
+	mux.Handle("/api/authenticate", s.Authenticate())
 	mux.Handle("/api/blocklist", s.BlockList())
 	mux.Handle("/api/block/now", s.BlockNow())
 	mux.Handle("/api/disconnect/now", s.DisconnectNow())
@@ -66,12 +88,18 @@ func (s *Server) Setup() error {
 	mux.Handle("/api/message/history", s.MessageHistory())
 	mux.Handle("/api/message/usernames", s.MessageUsernameHistory())
 	mux.Handle("/api/message/clear", s.ClearMessages())
+	mux.Handle("/api/message/search", s.MessageSearch())
+	mux.Handle("/api/message/search/all", s.OperatorMessageSearch())
+	mux.Handle("/api/channel/history", s.ChannelHistory())
 	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("dist/assets"))))
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("dist/static"))))
 
 	// Nuevas rutas de autenticación
 	mux.HandleFunc("/api/register", s.HandleRegister)
 	mux.HandleFunc("/api/login", s.HandleLogin)
+	mux.Handle("/api/account/password", s.ChangePassword())
+	mux.Handle("/api/account/reset-password", s.ResetPassword())
+	mux.Handle("/api/account/update", s.UpdateAccount())
 
 	s.mux = mux
 	return nil
@@ -80,6 +108,8 @@ func (s *Server) Setup() error {
 func (s *Server) ListenAndServe(address string) error {
 	s.upSince = time.Now()
 	go s.KickIdlePollUsers()
+	go s.SweepExpiredBans()
+	go s.ResyncWhoLists()
 	go s.sendWhoListAfterReady()
 	return http.ListenAndServe(address, s.mux)
 }
@@ -88,6 +118,7 @@ func (s *Server) sendWhoListAfterReady() {
 	time.Sleep(16 * time.Second)
 	log.Info("Up 15 seconds, sending WhoList to any online chatters")
 	s.SendWhoList()
+	s.SendAllChannelWhoLists()
 }
 
 // Middleware JWT
@@ -125,147 +156,11 @@ func (s *Server) JWTMiddleware(next http.Handler) http.Handler {
 
 		if op, found := claims["op"].(bool); found && op {
 			// Set header to use later (you can customize this)
-			r.Header.Set("X-User", claims["username"].(string))
+			username, _ := claims["sub"].(string)
+			r.Header.Set("X-User", username)
 			r.Header.Set("X-Op", "true")
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
-
-// Registro de usuarios
-func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-
-	if username == "" || password == "" {
-		http.Error(w, "Faltan campos", http.StatusBadRequest)
-		return
-	}
-
-	if userExists(username) {
-		http.Error(w, "El usuario ya existe", http.StatusConflict)
-		return
-	}
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, "Error interno", http.StatusInternalServerError)
-		return
-	}
-
-	f, err := os.OpenFile(".users.txt", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
-	if err != nil {
-		http.Error(w, "No se puede guardar", http.StatusInternalServerError)
-		return
-	}
-	defer f.Close()
-
-	_, err = fmt.Fprintf(f, "%s:%s\n", username, string(hashedPassword))
-	if err != nil {
-		http.Error(w, "Error al escribir", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-}
-
-// Inicio de sesión
-func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-
-	if username == "" || password == "" {
-		http.Error(w, "Faltan campos", http.StatusBadRequest)
-		return
-	}
-
-	file, err := os.Open(".users.txt")
-	if err != nil {
-		http.Error(w, "No autorizado", http.StatusUnauthorized)
-		return
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
-		}
-
-		user := parts[0]
-		hashed := parts[1]
-
-		if user == username {
-			err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
-			if err == nil {
-				// Verificar si es moderador
-				moderators := map[string]bool{
-					"Killer":   true,
-					"Cris":     true,
-					"Ricotera": true,
-					"Denisse":  true,
-				}
-
-				if moderators[username] {
-					// Crear token JWT
-					token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-						"username":  username,
-						"moderator": true,
-						"op":        true,
-						"exp":       time.Now().Add(6 * time.Hour).Unix(),
-					})
-					tokenString, err := token.SignedString([]byte(config.Current.JWT.SecretKey))
-					if err != nil {
-						http.Error(w, "Error al generar token", http.StatusInternalServerError)
-						return
-					}
-
-					redirectURL := fmt.Sprintf("/?jwt=%s", tokenString)
-					http.Redirect(w, r, redirectURL, http.StatusSeeOther)
-					return
-				}
-
-				// Usuario común
-				w.WriteHeader(http.StatusOK)
-				return
-			} else {
-				http.Error(w, "Contraseña incorrecta", http.StatusUnauthorized)
-				return
-			}
-		}
-	}
-
-	http.Error(w, "Usuario no encontrado", http.StatusUnauthorized)
-}
-
-func userExists(username string) bool {
-	file, err := os.Open(".users.txt")
-	if err != nil {
-		return false
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 && parts[0] == username {
-			return true
-		}
-	}
-	return false
-}
-
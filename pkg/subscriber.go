@@ -2,7 +2,6 @@ package barertc
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -29,23 +28,31 @@ type Subscriber struct {
 	ChatStatus    string
 	VideoStatus   int
 	DND           bool // Do Not Disturb status (DMs are closed)
+	NoReceipts    bool // do not send read receipts for DMs
 	JWTClaims     *jwt.Claims
 	authenticated bool // has passed the login step
 	loginAt       time.Time
-	IsOp     bool 
-	Op bool
+	IsOp          bool
+	Op            bool
 	// Connection details (WebSocket).
 	conn      *websocket.Conn // WebSocket user
 	ctx       context.Context
 	cancel    context.CancelFunc
 	messages  chan []byte
+	encoding  messages.Encoding // negotiated by WebSocket subprotocol
 	closeSlow func()
-	IP string 
+	IP        string
 	// Polling API users.
-	usePolling  bool
-	sessionID   string
-	lastPollAt  time.Time
-	lastPollJWT time.Time // give a new JWT once in a while
+	usePolling bool
+	sessionID  string
+
+	// Their polls and Server-Sent Events stream, which come in on concurrent requests.
+	streamMu     sync.Mutex
+	lastPollAt   time.Time
+	lastPollJWT  time.Time // give a new JWT once in a while
+	longPolling  bool      // they wait for new messages on each poll
+	streamID     int       // their Server-Sent Events stream, if they have one open
+	streamCancel context.CancelFunc
 
 	muteMu  sync.RWMutex
 	booted  map[string]struct{} // usernames booted off your camera
@@ -59,9 +66,33 @@ type Subscriber struct {
 	// as normal and it can see user messages in chat.
 	unblockable bool
 
-	// Record which message IDs belong to this user.
+	// Record which message IDs belong to this user, and the channel each text message
+	// was sent to (for edits). Pictures have a blank channel, as they can not be edited.
 	midMu      sync.Mutex
-	messageIDs map[int64]struct{}
+	messageIDs map[int64]string
+
+	// Chat channels the user is in.
+	channelsMu sync.RWMutex
+	channels   map[string]struct{}
+
+	// Flood control rate limits.
+	flood floodState
+
+	// Resuming a dropped WebSocket connection: the sequence number of the last message
+	// sent, and the recent messages to replay.
+	resumeMu    sync.Mutex
+	resumeToken string
+	seq         int64
+	outbox      []outboxMessage
+	outboxBytes int
+	detached    bool // the connection dropped, and may still resume
+	detachTimer *time.Timer
+
+	// Who List deltas: the protocol version of their client, and the Who List entries
+	// last sent to them (nil until they are sent a full Who List).
+	whoMu    sync.Mutex
+	protocol int
+	whoSent  map[string]messages.WhoList
 
 	// Logging.
 	log   bool
@@ -78,7 +109,8 @@ func (s *Server) NewSubscriber(ctx context.Context, cancelFunc func()) *Subscrib
 		muted:      make(map[string]struct{}),
 		blocked:    make(map[string]struct{}),
 		invited:    make(map[string]struct{}),
-		messageIDs: make(map[int64]struct{}),
+		messageIDs: make(map[int64]string),
+		channels:   make(map[string]struct{}),
 		ChatStatus: "online",
 	}
 }
@@ -87,6 +119,7 @@ func (s *Server) NewSubscriber(ctx context.Context, cancelFunc func()) *Subscrib
 func (s *Server) NewWebSocketSubscriber(ctx context.Context, conn *websocket.Conn, cancelFunc func()) *Subscriber {
 	sub := s.NewSubscriber(ctx, cancelFunc)
 	sub.conn = conn
+	sub.encoding = messages.EncodingForSubprotocol(conn.Subprotocol())
 	sub.closeSlow = func() {
 		conn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
 	}
@@ -111,7 +144,7 @@ func (s *Server) NewPollingSubscriber(ctx context.Context, cancelFunc func()) *S
 				Username: sub.Username,
 				Message:  messages.PresenceExited,
 			})
-			s.SendWhoList()
+			s.SendWhoListChanges(sub.Username)
 		}
 
 		s.DeleteSubscriber(sub)
@@ -121,6 +154,11 @@ func (s *Server) NewPollingSubscriber(ctx context.Context, cancelFunc func()) *S
 
 // OnClientMessage handles a chat protocol message from the user's WebSocket or polling API.
 func (s *Server) OnClientMessage(sub *Subscriber, msg messages.Message) {
+	// Are they going too fast?
+	if !s.checkFloodControl(sub, msg) {
+		return
+	}
+
 	// What action are they performing?
 	switch msg.Action {
 	case messages.ActionLogin:
@@ -153,12 +191,22 @@ func (s *Server) OnClientMessage(sub *Subscriber, msg messages.Message) {
 		s.OnUnwatch(sub, msg)
 	case messages.ActionTakeback:
 		s.OnTakeback(sub, msg)
-	case messages.ActionReact:
+	case messages.ActionEdit:
+		s.OnEdit(sub, msg)
+	case messages.ActionReact, messages.ActionUnreact:
 		s.OnReact(sub, msg)
+	case messages.ActionDeliver, messages.ActionRead:
+		s.OnReceipt(sub, msg)
 	case messages.ActionReport:
 		s.OnReport(sub, msg)
 	case messages.ActionVideoInvite:
 		s.OnVideoInvite(sub, msg)
+	case messages.ActionCreate, messages.ActionJoin, messages.ActionPart, messages.ActionInvite, messages.ActionTopic:
+		s.OnChannelAction(sub, msg)
+	case messages.ActionPin, messages.ActionUnpin:
+		s.OnPin(sub, msg)
+	case messages.ActionMOTD:
+		s.OnMOTD(sub, msg)
 	case messages.ActionPing:
 	default:
 		sub.ChatServer("Unsupported message type: %s", msg.Action)
@@ -167,39 +215,38 @@ func (s *Server) OnClientMessage(sub *Subscriber, msg messages.Message) {
 
 // ReadLoop spawns a goroutine that reads from the websocket connection.
 func (sub *Subscriber) ReadLoop(s *Server) {
+	// The subscriber may move on to a new connection if this one drops and resumes.
+	sub.resumeMu.Lock()
+	var conn, ctx = sub.conn, sub.ctx
+	sub.resumeMu.Unlock()
+
 	go func() {
 		for {
-			msgType, data, err := sub.conn.Read(sub.ctx)
+			msgType, data, err := conn.Read(ctx)
 			if err != nil {
 				log.Error("ReadLoop error(%d=%s): %+v", sub.ID, sub.Username, err)
-				s.DeleteSubscriber(sub)
-
-				// Notify if this user was auth'd and not hidden
-				if sub.authenticated && sub.ChatStatus != "hidden" {
-					s.Broadcast(messages.Message{
-						Action:   messages.ActionPresence,
-						Username: sub.Username,
-						Message:  messages.PresenceExited,
-					})
-					s.SendWhoList()
-				}
+				s.ConnectionLost(sub, conn, err)
 				return
 			}
 
-			if msgType != websocket.MessageText {
+			if msgType != messageType(sub.encoding) {
 				log.Error("Unexpected MessageType")
 				continue
 			}
 
 			// Read the user's posted message.
 			var msg messages.Message
-			if err := json.Unmarshal(data, &msg); err != nil {
+			if err := sub.encoding.Unmarshal(data, &msg); err != nil {
 				log.Error("Read(%d=%s) Message error: %s", sub.ID, sub.Username, err)
 				continue
 			}
 
 			if msg.Action != messages.ActionFile {
-				log.Debug("Read(%d=%s): %s", sub.ID, sub.Username, data)
+				if sub.encoding.Binary() {
+					log.Debug("Read(%d=%s): %+v", sub.ID, sub.Username, msg)
+				} else {
+					log.Debug("Read(%d=%s): %s", sub.ID, sub.Username, data)
+				}
 			}
 
 			// Handle their message.
@@ -220,11 +267,23 @@ func (sub *Subscriber) IsVIP() bool {
 
 // SendJSON sends a JSON message to the websocket client.
 func (sub *Subscriber) SendJSON(v interface{}) error {
-	data, err := json.Marshal(v)
+	sub.resumeMu.Lock()
+	defer sub.resumeMu.Unlock()
+
+	data, err := sub.marshalOutbound(v)
 	if err != nil {
 		return err
 	}
-	log.Debug("SendJSON(%d=%s): %s", sub.ID, sub.Username, data)
+	if sub.encoding.Binary() {
+		log.Debug("SendJSON(%d=%s): %d bytes of %s", sub.ID, sub.Username, len(data), sub.encoding)
+	} else {
+		log.Debug("SendJSON(%d=%s): %s", sub.ID, sub.Username, data)
+	}
+
+	// Their connection dropped: the message is kept in case they resume it.
+	if sub.detached {
+		return nil
+	}
 
 	// Add the message to the recipient's queue. If the queue is too full,
 	// disconnect the client as they can't keep up.
@@ -243,6 +302,7 @@ func (sub *Subscriber) SendMe() {
 		Action:      messages.ActionMe,
 		Username:    sub.Username,
 		VideoStatus: sub.VideoStatus,
+		ResumeToken: sub.getResumeToken(),
 	})
 }
 
@@ -297,17 +357,67 @@ func (s *Server) DeleteSubscriber(sub *Subscriber) {
 	log.Error("DeleteSubscriber: %s", sub.Username)
 
 	// Cancel its context to clean up the for-loop goroutine.
-	if sub.cancel != nil {
+	sub.resumeMu.Lock()
+	var cancel = sub.cancel
+	sub.resumeMu.Unlock()
+	if cancel != nil {
 		log.Info("Calling sub.cancel() on subscriber: %s#%d", sub.Username, sub.ID)
-		sub.cancel()
+		cancel()
 	}
 
 	// Clean up any log files.
 	sub.teardownLogs()
 
+	// Remember their settings for the DMs sent to them while they are away.
+	sub.saveMailbox()
+
 	s.subscribersMu.Lock()
 	delete(s.subscribers, sub)
 	s.subscribersMu.Unlock()
+
+	s.LeaveAllChannels(sub)
+}
+
+// How long Disconnect waits for the kick message to be delivered before it removes
+// the subscriber. The front-end polls every 5 seconds on the polling API.
+const (
+	DisconnectGracePeriod        = 2 * time.Second
+	PollingDisconnectGracePeriod = 10 * time.Second
+)
+
+// Disconnect removes a subscriber from the chat room and closes their connection,
+// whether they are on a WebSocket or the polling API.
+//
+// The presence is broadcast to everyone (e.g. messages.PresenceKicked), and the
+// subscriber is sent a kick message before they are removed a moment later.
+func (s *Server) Disconnect(sub *Subscriber, presence string) {
+	if sub.authenticated && sub.Username != "" {
+		s.Broadcast(messages.Message{
+			Action:   messages.ActionPresence,
+			Username: sub.Username,
+			Message:  presence,
+		})
+	}
+
+	sub.SendJSON(messages.Message{
+		Action: messages.ActionKick,
+	})
+
+	// Their mailbox is saved now, while we still know who they were.
+	sub.saveMailbox()
+	var username = sub.Username
+	sub.authenticated = false
+	sub.Username = ""
+	s.SendWhoListChanges(username)
+	s.LeaveAllChannels(sub)
+
+	var grace = DisconnectGracePeriod
+	if sub.usePolling {
+		grace = PollingDisconnectGracePeriod
+	}
+	time.AfterFunc(grace, func() {
+		s.DeleteSubscriber(sub)
+	})
 }
 
 // IterSubscribers loops over the subscriber list with a read lock.
@@ -375,6 +485,9 @@ func (s *Server) Broadcast(msg messages.Message) {
 		sender = nil
 	}
 
+	// Channel messages only go to the channel's members.
+	var inChannelOnly = msg.Channel != "" && !strings.HasPrefix(msg.Channel, "@")
+
 	// Get the list of users who are online NOW, so we don't hold the mutex lock too long.
 	// Example: sending a fat GIF to a large audience could hang up the server for a long
 	// time until every copy of the GIF has been sent.
@@ -402,6 +515,10 @@ func (s *Server) Broadcast(msg messages.Message) {
 			continue
 		}
 
+		if inChannelOnly && !sub.InChannel(msg.Channel) {
+			continue
+		}
+
 		sub.SendJSON(msg)
 	}
 }
@@ -422,6 +539,10 @@ func (s *Server) SendTo(username string, msg messages.Message) error {
 				Username:  msg.Username,
 				Message:   msg.Message,
 				MessageID: msg.MessageID,
+				Edited:    msg.Edited,
+				ReplyTo:   msg.ReplyTo,
+				Quote:     msg.Quote,
+				Reactions: msg.Reactions,
 			})
 		}
 	}
@@ -432,8 +553,35 @@ func (s *Server) SendTo(username string, msg messages.Message) error {
 	return nil
 }
 
-// SendWhoList broadcasts the connected members to everybody in the room.
+// SendWhoList broadcasts the connected members to everybody in the room, building every
+// subscriber's list in full. It is for the periodic resync: on a change made by a user,
+// SendWhoListChanges is much cheaper.
+//
+// Clients that support Who List deltas are only sent the changes to their list, see sendWhoList.
 func (s *Server) SendWhoList() {
+	s.sendWhoLists(nil)
+}
+
+// SendWhoListChanges updates everybody's Who List after the entries of some users may have
+// changed: they logged in or out, changed their status, or muted, booted or blocked somebody.
+//
+// Each subscriber has only those entries rebuilt, rather than their whole list. The users
+// named are sent their whole list, since how they see everybody else may have changed too.
+func (s *Server) SendWhoListChanges(usernames ...string) {
+	var changed = map[string]struct{}{}
+	for _, username := range usernames {
+		if username != "" {
+			changed[username] = struct{}{}
+		}
+	}
+	if len(changed) > 0 {
+		s.sendWhoLists(changed)
+	}
+}
+
+// sendWhoLists sends the Who Lists, in full when changed is nil or else only the entries of
+// the changed usernames.
+func (s *Server) sendWhoLists(changed map[string]struct{}) {
 
 	// Don't send WhoList messages in the first 15 seconds of the server launch. This is to minimize
 	// messages sent during a server reboot if a lot of chatters were online: Presence messages are
@@ -468,79 +616,98 @@ func (s *Server) SendWhoList() {
 			continue
 		}
 
-		var users = []messages.WhoList{}
-		for _, un := range usernames {
-			user := userSub[un]
-			if user.ChatStatus == "hidden" {
-				continue
+		if _, ok := changed[sub.Username]; changed != nil && !ok {
+			var entries = map[string]*messages.WhoList{}
+			for username := range changed {
+				entries[username] = whoEntryFor(sub, userSub[username])
 			}
-
-			// Blocking: hide the presence of both people from the Who List.
-			if user.Blocks(sub) {
-				log.Debug("WhoList: hide %s from %s (blocking)", user.Username, sub.Username)
+			if sub.patchWhoList(entries) {
 				continue
 			}
+		}
 
-			who := messages.WhoList{
-				Username: user.Username,
-				Status:   user.ChatStatus,
-				Video:    user.VideoStatus,
-				DND:      user.DND,
-				LoginAt:  user.loginAt.Unix(),
-			}
+		sub.sendWhoList(whoListFor(sub, usernames, userSub))
+	}
+}
 
-			// Hide video flags of other users (never for the current user).
-			if user.Username != sub.Username {
-
-				// If this person had booted us, force their camera to "off"
-				if user.Boots(sub.Username) || user.Mutes(sub.Username) {
-					if sub.IsAdmin() {
-						// They kicked the admin off, but admin can reopen the cam if they want.
-						// But, unset the user's "auto-open your camera" flag, so if the admin
-						// reopens it, the admin's cam won't open on the recipient's screen.
-						who.Video ^= messages.VideoFlagMutualOpen
-					} else {
-						// Force their video to "off"
-						who.Video = 0
-					}
-				} else if user.InvitesVideo(sub.Username) {
-					// This user invited us to see their webcam, set the relevant flag.
-					who.Video |= messages.VideoFlagInvited
-				}
+// whoListFor builds the Who List as seen by one subscriber: without the users hidden from
+// them, and with the video flags that they may see.
+func whoListFor(sub *Subscriber, usernames []string, userSub map[string]*Subscriber) []messages.WhoList {
+	var users = []messages.WhoList{}
+	for _, un := range usernames {
+		if who := whoEntryFor(sub, userSub[un]); who != nil {
+			users = append(users, *who)
+		}
+	}
+	return users
+}
 
-				// If this person's VideoFlag is set to VIP Only, force their camera to "off"
-				// except when the person looking has the VIP status.
-				if (user.VideoStatus&messages.VideoFlagOnlyVIP == messages.VideoFlagOnlyVIP) && !sub.IsVIP() {
-					who.Video = 0
-				}
-			}
+// whoEntryFor builds the Who List entry of a user as seen by one subscriber, or nil if the
+// user is not on their list (or not online).
+func whoEntryFor(sub *Subscriber, user *Subscriber) *messages.WhoList {
+	if user == nil || user.ChatStatus == "hidden" {
+		return nil
+	}
 
-			if user.JWTClaims != nil {
-				who.Operator = user.JWTClaims.IsAdmin
-				who.Avatar = user.JWTClaims.Avatar
-				who.ProfileURL = user.JWTClaims.ProfileURL
-				who.Nickname = user.JWTClaims.Nick
-				who.Emoji = user.JWTClaims.Emoji
-				who.Gender = user.JWTClaims.Gender
-
-				// VIP flags: if we are in MutuallySecret mode, only VIPs can see
-				// other VIP flags on the Who List.
-				if config.Current.VIP.MutuallySecret {
-					if sub.IsVIP() {
-						who.VIP = user.JWTClaims.VIP
-					}
-				} else {
-					who.VIP = user.JWTClaims.VIP
-				}
+	// Blocking: hide the presence of both people from the Who List.
+	if user.Blocks(sub) {
+		log.Debug("WhoList: hide %s from %s (blocking)", user.Username, sub.Username)
+		return nil
+	}
+
+	who := messages.WhoList{
+		Username: user.Username,
+		Status:   user.ChatStatus,
+		Video:    user.VideoStatus,
+		DND:      user.DND,
+		LoginAt:  user.loginAt.Unix(),
+	}
+
+	// Hide video flags of other users (never for the current user).
+	if user.Username != sub.Username {
+
+		// If this person had booted us, force their camera to "off"
+		if user.Boots(sub.Username) || user.Mutes(sub.Username) {
+			if sub.IsAdmin() {
+				// They kicked the admin off, but admin can reopen the cam if they want.
+				// But, unset the user's "auto-open your camera" flag, so if the admin
+				// reopens it, the admin's cam won't open on the recipient's screen.
+				who.Video ^= messages.VideoFlagMutualOpen
+			} else {
+				// Force their video to "off"
+				who.Video = 0
 			}
-			users = append(users, who)
+		} else if user.InvitesVideo(sub.Username) {
+			// This user invited us to see their webcam, set the relevant flag.
+			who.Video |= messages.VideoFlagInvited
 		}
 
-		sub.SendJSON(messages.Message{
-			Action:  messages.ActionWhoList,
-			WhoList: users,
-		})
+		// If this person's VideoFlag is set to VIP Only, force their camera to "off"
+		// except when the person looking has the VIP status.
+		if (user.VideoStatus&messages.VideoFlagOnlyVIP == messages.VideoFlagOnlyVIP) && !sub.IsVIP() {
+			who.Video = 0
+		}
+	}
+
+	if user.JWTClaims != nil {
+		who.Operator = user.JWTClaims.IsAdmin
+		who.Avatar = user.JWTClaims.Avatar
+		who.ProfileURL = user.JWTClaims.ProfileURL
+		who.Nickname = user.JWTClaims.Nick
+		who.Emoji = user.JWTClaims.Emoji
+		who.Gender = user.JWTClaims.Gender
+
+		// VIP flags: if we are in MutuallySecret mode, only VIPs can see
+		// other VIP flags on the Who List.
+		if config.Current.VIP.MutuallySecret {
+			if sub.IsVIP() {
+				who.VIP = user.JWTClaims.VIP
+			}
+		} else {
+			who.VIP = user.JWTClaims.VIP
+		}
 	}
+	return &who
 }
 
 // InvitesVideo checks whether the subscriber has invited the username to see their webcam.
@@ -0,0 +1,229 @@
+package barertc
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"git.kirsle.net/apps/barertc/pkg/models"
+)
+
+/* Chat channels created by users at runtime, backed by the SQLite database. */
+
+// UserChannel is a created channel along with the roles of its members.
+type UserChannel struct {
+	models.Channel
+	Members map[string]string // username -> role, e.g. models.ChannelRoleMember
+}
+
+// Role returns the user's role in the channel, or blank if they have none.
+func (ch UserChannel) Role(username string) string {
+	return ch.Members[username]
+}
+
+// IsMember tells whether the user has joined the channel.
+func (ch UserChannel) IsMember(username string) bool {
+	var role = ch.Members[username]
+	return role == models.ChannelRoleMember || role == models.ChannelRoleOperator
+}
+
+// IsOperator tells whether the user may manage the channel: its owner and channel operators.
+func (ch UserChannel) IsOperator(username string) bool {
+	return username == ch.Owner || ch.Members[username] == models.ChannelRoleOperator
+}
+
+// IsOpen tells whether anybody may join the channel without an invite or password.
+func (ch UserChannel) IsOpen() bool {
+	return !ch.Private && !ch.InviteOnly && !ch.HasPassword()
+}
+
+// VisibleTo tells whether the user may know that the channel exists. Private channels
+// are only seen by their owner, members and invitees.
+func (ch UserChannel) VisibleTo(username string) bool {
+	return !ch.Private || username == ch.Owner || ch.Members[username] != ""
+}
+
+// Info describes the channel to a user.
+func (ch UserChannel) Info(username string) messages.ChannelInfo {
+	return messages.ChannelInfo{
+		ID:           ch.ID,
+		Name:         ch.Name,
+		Topic:        ch.Topic,
+		Owner:        ch.Owner,
+		Private:      ch.Private,
+		InviteOnly:   ch.InviteOnly,
+		Password:     ch.HasPassword(),
+		PermitPhotos: config.Current.UserChannels.PermitPhotos,
+		Joined:       ch.IsMember(username),
+		Invited:      ch.Role(username) == models.ChannelRoleInvited,
+		Operator:     ch.IsOperator(username),
+	}
+}
+
+// Channel IDs of created channels: lowercase letters, numbers, dashes and underscores.
+var userChannelIDRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,31}$`)
+
+// In-memory copy of the created channels, which are checked on every broadcast.
+//
+// The Members maps are never modified in place (a changed channel gets a new map), so
+// that a UserChannel returned by LookupUserChannel is safe to read without the lock.
+var (
+	userChannels   = map[string]UserChannel{}
+	userChannelsMu sync.RWMutex
+)
+
+// ReloadUserChannels refreshes the in-memory channels from the database.
+func ReloadUserChannels() error {
+	channels, err := models.GetChannels()
+	if err != nil {
+		return err
+	}
+
+	members, err := models.GetChannelMembers()
+	if err != nil {
+		return err
+	}
+
+	var cache = map[string]UserChannel{}
+	for _, ch := range channels {
+		cache[ch.ID] = UserChannel{
+			Channel: ch,
+			Members: map[string]string{},
+		}
+	}
+	for _, member := range members {
+		if ch, ok := cache[member.ChannelID]; ok {
+			ch.Members[member.Username] = member.Role
+		}
+	}
+
+	userChannelsMu.Lock()
+	userChannels = cache
+	userChannelsMu.Unlock()
+
+	log.Info("ReloadUserChannels: %d created channels loaded", len(cache))
+	return nil
+}
+
+// LookupUserChannel finds a created channel by its ID.
+func LookupUserChannel(id string) (UserChannel, bool) {
+	userChannelsMu.RLock()
+	defer userChannelsMu.RUnlock()
+	ch, ok := userChannels[id]
+	return ch, ok
+}
+
+// ListUserChannels returns all of the created channels, sorted by ID.
+func ListUserChannels() []UserChannel {
+	userChannelsMu.RLock()
+	var result = make([]UserChannel, 0, len(userChannels))
+	for _, ch := range userChannels {
+		result = append(result, ch)
+	}
+	userChannelsMu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// CreateUserChannel stores a new channel, with its owner as its first member.
+//
+// Returns models.ErrChannelExists if the channel ID is taken.
+func CreateUserChannel(ch models.Channel) (UserChannel, error) {
+	userChannelsMu.Lock()
+	defer userChannelsMu.Unlock()
+
+	if _, ok := userChannels[ch.ID]; ok {
+		return UserChannel{}, models.ErrChannelExists
+	}
+
+	ch, err := models.CreateChannel(ch)
+	if err != nil && err != models.ErrNotInitialized {
+		return UserChannel{}, err
+	}
+	if err := models.SetChannelMember(ch.ID, ch.Owner, models.ChannelRoleOperator); err != nil && err != models.ErrNotInitialized {
+		return UserChannel{}, err
+	}
+
+	var uc = UserChannel{
+		Channel: ch,
+		Members: map[string]string{
+			ch.Owner: models.ChannelRoleOperator,
+		},
+	}
+	userChannels[ch.ID] = uc
+	return uc, nil
+}
+
+// SaveUserChannel updates the settings of a created channel, e.g. its topic.
+func SaveUserChannel(ch models.Channel) error {
+	userChannelsMu.Lock()
+	defer userChannelsMu.Unlock()
+
+	uc, ok := userChannels[ch.ID]
+	if !ok {
+		return models.ErrChannelNotFound
+	}
+
+	if err := models.SaveChannel(ch); err != nil && err != models.ErrNotInitialized {
+		return err
+	}
+
+	uc.Channel = ch
+	userChannels[ch.ID] = uc
+	return nil
+}
+
+// SetUserChannelRole sets a user's role in a created channel. A blank role removes
+// the user from the channel.
+func SetUserChannelRole(id, username, role string) error {
+	userChannelsMu.Lock()
+	defer userChannelsMu.Unlock()
+
+	uc, ok := userChannels[id]
+	if !ok {
+		return models.ErrChannelNotFound
+	}
+
+	if err := models.SetChannelMember(id, username, role); err != nil && err != models.ErrNotInitialized {
+		return err
+	}
+
+	var members = map[string]string{}
+	for name, r := range uc.Members {
+		members[name] = r
+	}
+	if role == "" {
+		delete(members, username)
+	} else {
+		members[username] = role
+	}
+
+	uc.Members = members
+	userChannels[id] = uc
+	return nil
+}
+
+// DeleteUserChannel removes a created channel and its members.
+func DeleteUserChannel(id string) error {
+	userChannelsMu.Lock()
+	defer userChannelsMu.Unlock()
+
+	if err := models.DeleteChannel(id); err != nil && err != models.ErrNotInitialized {
+		return err
+	}
+
+	delete(userChannels, id)
+	return nil
+}
+
+// normalizeChannelID cleans up a channel name typed by a user, e.g. "#Movie-Night".
+func normalizeChannelID(channel string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(channel), "#"))
+}
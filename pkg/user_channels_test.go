@@ -0,0 +1,156 @@
+package barertc
+
+import (
+	"strings"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+func TestPrivateUserChannels(t *testing.T) {
+	var saved = config.Current.UserChannels
+	defer func() {
+		config.Current.UserChannels = saved
+		DeleteUserChannel("secret")
+	}()
+	config.Current.UserChannels = config.UserChannels{
+		Enabled: true,
+	}
+
+	var (
+		s     = NewServer()
+		users = loginUsers(s, false, "alice", "bob", "carol")
+		alice = users[0]
+		bob   = users[1]
+		carol = users[2]
+	)
+
+	// Alice creates a private channel.
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: `/create secret "Secret Club" private`})
+	if ch, ok := LookupUserChannel("secret"); !ok || !ch.Private || !ch.IsOperator("alice") || !ch.IsMember("alice") {
+		t.Fatalf("the secret channel was not created as expected: %+v", ch)
+	}
+
+	// Bob can neither see it, join it nor post to it.
+	bob.SendChannels()
+	for _, msg := range drainMessages(t, bob) {
+		if msg.Action == messages.ActionChannels && len(msg.Channels) > 0 {
+			t.Errorf("bob should not see any channels, got: %+v", msg.Channels)
+		}
+	}
+	s.OnJoinChannel(bob, messages.Message{Channel: "secret"})
+	s.OnMessage(bob, messages.Message{Channel: "secret", Message: "let me in"})
+	for _, msg := range drainMessages(t, bob) {
+		if msg.Action == messages.ActionError && msg.Message != "Channel not found: secret" {
+			t.Errorf("bob got an error that leaks the channel: %s", msg.Message)
+		}
+	}
+
+	// Nor learn of it by trying to create it himself.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "/create secret"})
+	for _, msg := range drainMessages(t, bob) {
+		if strings.Contains(msg.Message, "exists") {
+			t.Errorf("bob's /create leaks the channel: %s", msg.Message)
+		}
+	}
+	if ch, _ := LookupUserChannel("secret"); ch.IsMember("bob") {
+		t.Errorf("bob should not have joined the channel")
+	}
+
+	// Alice invites bob, who joins.
+	s.OnMessage(alice, messages.Message{Channel: "secret", Message: "/invite bob"})
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "/join #secret"})
+	if ch, _ := LookupUserChannel("secret"); !ch.IsMember("bob") {
+		t.Fatalf("bob should have joined the channel")
+	}
+
+	// Messages in the channel only go to its members.
+	drainMessages(t, alice)
+	drainMessages(t, bob)
+	drainMessages(t, carol)
+	s.OnMessage(alice, messages.Message{Action: messages.ActionMessage, Channel: "secret", Message: "hello club"})
+	for _, sub := range users {
+		var got bool
+		for _, msg := range drainMessages(t, sub) {
+			if msg.Channel == "secret" {
+				got = true
+			}
+		}
+		if got != (sub != carol) {
+			t.Errorf("%s received the channel message: %v", sub.Username, got)
+		}
+	}
+
+	// Bob leaves, and may not come back without another invite.
+	s.OnMessage(bob, messages.Message{Channel: "secret", Message: "/part"})
+	s.OnJoinChannel(bob, messages.Message{Channel: "secret"})
+	if ch, _ := LookupUserChannel("secret"); ch.IsMember("bob") {
+		t.Errorf("bob should not have been able to rejoin")
+	}
+}
+
+func TestChannelMembership(t *testing.T) {
+	var (
+		s     = NewServer()
+		users = loginUsers(s, true, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+	)
+
+	// They are in the public channels, but not the VIP one.
+	if !alice.InChannel("lobby") || !bob.InChannel("offtopic") || bob.InChannel("vip") {
+		t.Fatalf("wrong channels on login: alice %v, bob %v", alice.JoinedChannels(), bob.JoinedChannels())
+	}
+
+	// The channel Who List.
+	var whoList = func(sub *Subscriber, channel string) []string {
+		var result []string
+		for _, msg := range drainMessages(t, sub) {
+			if msg.Action == messages.ActionWhoList && msg.Channel == channel {
+				result = msg.Usernames
+			}
+		}
+		return result
+	}
+	if who := whoList(alice, "lobby"); len(who) != 2 {
+		t.Errorf("expected both users in the lobby Who List, got %v", who)
+	}
+
+	// Bob leaves the lobby, and no longer gets its messages.
+	s.OnMessage(bob, messages.Message{Channel: "lobby", Message: "/part"})
+	if who := whoList(alice, "lobby"); len(who) != 1 || who[0] != "alice" {
+		t.Errorf("expected only alice in the lobby Who List, got %v", who)
+	}
+	drainMessages(t, bob)
+
+	s.OnMessage(alice, messages.Message{Channel: "lobby", Message: "anybody here?"})
+	for _, msg := range drainMessages(t, bob) {
+		if msg.Channel == "lobby" {
+			t.Errorf("bob got a lobby message after leaving it: %+v", msg)
+		}
+	}
+
+	// Nor may he post there, or to the VIP channel.
+	for channel, expect := range map[string]string{
+		"lobby": "You are not in #lobby",
+		"vip":   "Channel not found: vip",
+	} {
+		s.OnMessage(bob, messages.Message{Channel: channel, Message: "hello"})
+		var got string
+		for _, msg := range drainMessages(t, bob) {
+			if msg.Action == messages.ActionError {
+				got = msg.Message
+			}
+		}
+		if !strings.Contains(got, expect) {
+			t.Errorf("posting to %s: expected %q, got %q", channel, expect, got)
+		}
+	}
+
+	// Alice leaving the chat room updates the Who Lists.
+	s.DeleteSubscriber(alice)
+	if who := whoList(bob, "offtopic"); len(who) != 1 || who[0] != "bob" {
+		t.Errorf("expected only bob in the offtopic Who List, got %v", who)
+	}
+}
@@ -4,20 +4,89 @@ import (
 	"net"
 	"net/http"
 	"strings"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
 )
 
 /*
 IPAddress returns the best guess at the user's IP address, as a string for logging.
-It prioritizes common proxy headers regardless of configuration.
+
+Proxy headers (X-Real-IP and X-Forwarded-For) are only honored when UseXForwardedFor
+is enabled in the settings, and the request came in from one of the TrustedProxies (or
+any address, if no TrustedProxies are configured). Otherwise a user could dodge an IP
+ban simply by sending a fake header.
 */
 func IPAddress(r *http.Request) string {
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+	remote := remoteHost(r)
+	if !config.Current.UseXForwardedFor || !IsTrustedProxy(remote) {
+		return remote
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" && net.ParseIP(realIP) != nil {
 		return realIP
 	}
+
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return strings.SplitN(xff, ",", 2)[0]
+		// Walk the hops from right to left: the first address that isn't one of
+		// our own trusted proxies is the client.
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				continue
+			}
+			if i == 0 || !IsTrustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+
+	return remote
+}
+
+// IsTrustedProxy checks whether an IP address is one of the TrustedProxies from the settings.
+//
+// If no TrustedProxies are configured, every address is trusted.
+func IsTrustedProxy(addr string) bool {
+	if len(config.Current.TrustedProxies) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range config.Current.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if other := net.ParseIP(proxy); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IPv6Network returns the network of an IPv6 address at the given prefix length, e.g. its /64.
+//
+// Returns nil if the address is IPv4, or the prefix length is out of range.
+func IPv6Network(ip net.IP, prefixLength int) *net.IPNet {
+	if ip == nil || ip.To4() != nil || prefixLength <= 0 || prefixLength > 128 {
+		return nil
 	}
 
+	mask := net.CIDRMask(prefixLength, 128)
+	return &net.IPNet{
+		IP:   ip.Mask(mask),
+		Mask: mask,
+	}
+}
+
+// remoteHost returns the IP address of the request's remote address, without its port.
+func remoteHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return r.RemoteAddr // fallback with port
@@ -0,0 +1,75 @@
+package util_test
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/config"
+	"git.kirsle.net/apps/barertc/pkg/util"
+)
+
+func TestIPAddress(t *testing.T) {
+	var tests = []struct {
+		UseXForwardedFor bool
+		TrustedProxies   []string
+		RemoteAddr       string
+		XRealIP          string
+		XForwardedFor    string
+		Expect           string
+	}{
+		// Headers are ignored unless UseXForwardedFor is enabled.
+		{false, nil, "203.0.113.1:5000", "1.2.3.4", "", "203.0.113.1"},
+		{true, nil, "203.0.113.1:5000", "1.2.3.4", "", "1.2.3.4"},
+		{true, nil, "203.0.113.1:5000", "", "1.2.3.4, 10.0.0.2", "1.2.3.4"},
+
+		// Headers are only trusted from the TrustedProxies.
+		{true, []string{"10.0.0.0/8"}, "203.0.113.1:5000", "1.2.3.4", "", "203.0.113.1"},
+		{true, []string{"10.0.0.0/8"}, "10.0.0.1:5000", "1.2.3.4", "", "1.2.3.4"},
+		{true, []string{"10.0.0.1"}, "10.0.0.1:5000", "", "1.2.3.4", "1.2.3.4"},
+
+		// A client can't spoof their address by prepending hops to X-Forwarded-For.
+		{true, []string{"10.0.0.0/8"}, "10.0.0.1:5000", "", "6.6.6.6, 1.2.3.4, 10.0.0.2", "1.2.3.4"},
+
+		// Garbage headers fall back to the remote address.
+		{true, nil, "[2001:db8::1]:5000", "not an ip", "", "2001:db8::1"},
+	}
+
+	for i, test := range tests {
+		config.Current.UseXForwardedFor = test.UseXForwardedFor
+		config.Current.TrustedProxies = test.TrustedProxies
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.RemoteAddr
+		if test.XRealIP != "" {
+			r.Header.Set("X-Real-IP", test.XRealIP)
+		}
+		if test.XForwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.XForwardedFor)
+		}
+
+		if actual := util.IPAddress(r); actual != test.Expect {
+			t.Errorf("Test #%d: expected %s but got %s", i, test.Expect, actual)
+		}
+	}
+}
+
+func TestIPv6Network(t *testing.T) {
+	var tests = []struct {
+		IP     string
+		Prefix int
+		Expect string
+	}{
+		{"2001:db8:1:2:3:4:5:6", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3:4:5:6", 48, "2001:db8:1::/48"},
+		{"2001:db8:1:2:3:4:5:6", 128, "2001:db8:1:2:3:4:5:6/128"},
+		{"192.168.1.1", 64, "<nil>"},
+		{"2001:db8::1", 0, "<nil>"},
+	}
+
+	for _, test := range tests {
+		if actual := util.IPv6Network(net.ParseIP(test.IP), test.Prefix).String(); actual != test.Expect {
+			t.Errorf("IPv6Network(%s, %d): expected %s but got %s", test.IP, test.Prefix, test.Expect, actual)
+		}
+	}
+}
@@ -2,46 +2,25 @@ package barertc
 
 import (
     "context"
-    "encoding/json"
     "fmt"
     "net/http"
-    "os"
-    "path/filepath"
+    "strconv"
     "strings"
     "time"
 
     "git.kirsle.net/apps/barertc/pkg/config"
     "git.kirsle.net/apps/barertc/pkg/log"
     "git.kirsle.net/apps/barertc/pkg/messages"
+    "git.kirsle.net/apps/barertc/pkg/models"
     "git.kirsle.net/apps/barertc/pkg/util"
     "git.kirsle.net/apps/barertc/pkg/jwt"
     "nhooyr.io/websocket"
 )
 
+// GuardaNick records the nickname and IP address of a connecting user in the database.
 func GuardaNick(nick, ip string) {
-    log.Debug("Guardando cualquier nick (invitados incluidos)")
-
-    linea := fmt.Sprintf("Nick: %s | IP: %s\n", nick, ip)
-    log.Debug("Escribiendo en datos.txt: %s", linea)
-
-    exePath, err := os.Executable()
-    if err != nil {
-        log.Error("No se pudo obtener ruta del ejecutable: %s", err)
-        return
-    }
-    rutaArchivo := filepath.Join(filepath.Dir(exePath), "datos.txt")
-
-    f, err := os.OpenFile(rutaArchivo, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-    if err != nil {
-        log.Error("No se pudo abrir datos.txt: %s", err)
-        return
-    }
-    defer f.Close()
-
-    if _, err := f.WriteString(linea); err != nil {
-        log.Error("No se pudo escribir en datos.txt: %s", err)
-    } else {
-        log.Info("Se escribió correctamente el nick en datos.txt")
+    if err := models.LogUserIP(nick, ip); err != nil && err != models.ErrNotInitialized {
+        log.Error("No se pudo guardar el nick %s (%s): %s", nick, ip, err)
     }
 }
 
@@ -50,15 +29,22 @@ func (s *Server) WebSocket() http.HandlerFunc {
         ip := util.IPAddress(r)
 
         // Verificar si la IP está baneada
-        if EstaBaneado(ip) {
-            log.Warn("Intento de conexión de IP baneada: %s", ip)
+        if ban, banned := FindIPBan(ip); banned {
+            log.Warn("Intento de conexión de IP baneada: %s (ban #%d)", ip, ban.ID)
             http.Error(w, "Tu IP ha sido baneada", http.StatusForbidden)
             return
         }
         log.Info("WebSocket connection from %s - %s", ip, r.Header.Get("User-Agent"))
 
+        // The client may ask for compression, and for a binary encoding by subprotocol.
+        var compression = websocket.CompressionDisabled
+        if config.Current.WebSocketCompression {
+            compression = websocket.CompressionNoContextTakeover
+        }
+
         c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-            CompressionMode: websocket.CompressionDisabled,
+            Subprotocols:    messages.Subprotocols,
+            CompressionMode: compression,
         })
         if err != nil {
             w.WriteHeader(http.StatusInternalServerError)
@@ -68,6 +54,28 @@ func (s *Server) WebSocket() http.HandlerFunc {
         defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
         c.SetReadLimit(config.Current.WebSocketReadLimit)
+        enc := messages.EncodingForSubprotocol(c.Subprotocol())
+
+        // Resuming a dropped connection?
+        if token := r.URL.Query().Get("resume"); token != "" {
+            seq, _ := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+            ctx, cancel := context.WithCancel(r.Context())
+            if sub, replay, ok := s.ResumeSubscriber(ctx, cancel, c, enc, token, seq); ok {
+                sub.IP = ip
+                GuardaNick(sub.Username, ip)
+                s.resumeWebSocket(ctx, c, sub, replay)
+                return
+            }
+            cancel()
+
+            // They will need to log in again.
+            ack, _ := enc.Marshal(messages.Message{
+                Action: messages.ActionResume,
+            })
+            if err := writeTimeout(r.Context(), time.Second*time.Duration(config.Current.WebSocketSendTimeout), c, enc, ack); err != nil {
+                return
+            }
+        }
 
         jwtToken := r.URL.Query().Get("jwt")
         var claims *jwt.Claims
@@ -108,11 +116,6 @@ func (s *Server) WebSocket() http.HandlerFunc {
             sub.Op = true
         }
 
-        // Guardar nick real
-        if !strings.HasPrefix(sub.Username, "Invitado_") {
-            GuardaNick(sub.Username, ip)
-        }
-
         // Intentamos leer primer mensaje si el nick es automático
         if strings.HasPrefix(sub.Username, "Invitado_") {
             log.Debug("Nick automático, intentando recibir login...")
@@ -122,8 +125,9 @@ func (s *Server) WebSocket() http.HandlerFunc {
                 log.Error("Error leyendo primer mensaje WebSocket: %s", err)
             } else {
                 var loginMsg messages.Message
-                if err := json.Unmarshal(msg, &loginMsg); err == nil && loginMsg.Action == messages.ActionLogin && loginMsg.Username != "" {
+                if err := enc.Unmarshal(msg, &loginMsg); err == nil && loginMsg.Action == messages.ActionLogin && loginMsg.Username != "" {
                     sub.Username = loginMsg.Username
+                    sub.setProtocol(loginMsg.Protocol)
                     log.Debug("Nick recibido del login: %s", sub.Username)
                 } else {
                     log.Warn("No se pudo extraer el nick del primer mensaje, se mantiene el automático")
@@ -144,58 +148,75 @@ func (s *Server) WebSocket() http.HandlerFunc {
             Username: sub.Username,
             Message:  "entered",
         })
-        s.SendWhoList()
-        defer s.DeleteSubscriber(sub)
-
-        go sub.ReadLoop(s)
-
-        pinger := time.NewTicker(PingInterval)
-        for {
-            select {
-            case msg := <-sub.messages:
-                err = writeTimeout(ctx, time.Second*time.Duration(config.Current.WebSocketSendTimeout), c, msg)
-                if err != nil {
-                    return
-                }
-            case <-pinger.C:
-                sub.SendJSON(messages.Message{
-                    Action: messages.ActionPing,
-                })
-            case <-ctx.Done():
-                pinger.Stop()
-                return
-            }
-        }
-    })
-}
+        s.SendWhoListChanges(sub.Username)
 
-func writeTimeout(ctx context.Context, timeout time.Duration, c *websocket.Conn, msg []byte) error {
-    ctx, cancel := context.WithTimeout(ctx, timeout)
-    defer cancel()
-    return c.Write(ctx, websocket.MessageText, msg)
+        s.serveWebSocket(ctx, c, sub)
+    })
 }
 
+// resumeWebSocket continues the chat session of a dropped connection on a new one: the
+// client is told that it has resumed and is sent the messages it missed.
+func (s *Server) resumeWebSocket(ctx context.Context, c *websocket.Conn, sub *Subscriber, replay [][]byte) {
+    var timeout = time.Second * time.Duration(config.Current.WebSocketSendTimeout)
 
-// EstaBaneado verifica si la IP está en datos2.txt
-func EstaBaneado(ip string) bool {
-    exePath, err := os.Executable()
-    if err != nil {
-        log.Error("No se pudo obtener ruta del ejecutable: %s", err)
-        return false
+    ack, _ := sub.encoding.Marshal(messages.Message{
+        Action:      messages.ActionResume,
+        ResumeToken: sub.getResumeToken(),
+    })
+    if err := writeTimeout(ctx, timeout, c, sub.encoding, ack); err != nil {
+        s.ConnectionLost(sub, c, err)
+        return
     }
-    rutaArchivo := filepath.Join(filepath.Dir(exePath), "datos2.txt")
 
-    data, err := os.ReadFile(rutaArchivo)
-    if err != nil {
-        log.Error("No se pudo leer datos2.txt: %s", err)
-        return false
+    for _, msg := range replay {
+        if err := writeTimeout(ctx, timeout, c, sub.encoding, msg); err != nil {
+            s.ConnectionLost(sub, c, err)
+            return
+        }
     }
 
-    lineas := strings.Split(string(data), "")
-    for _, linea := range lineas {
-        if strings.TrimSpace(linea) == ip {
-            return true
+    s.serveWebSocket(ctx, c, sub)
+}
+
+// serveWebSocket runs the read loop of a WebSocket subscriber and writes their messages,
+// until the connection closes.
+func (s *Server) serveWebSocket(ctx context.Context, c *websocket.Conn, sub *Subscriber) {
+    var err error
+    defer func() {
+        s.ConnectionLost(sub, c, err)
+    }()
+
+    go sub.ReadLoop(s)
+
+    pinger := time.NewTicker(PingInterval)
+    defer pinger.Stop()
+    for {
+        select {
+        case msg := <-sub.messages:
+            err = writeTimeout(ctx, time.Second*time.Duration(config.Current.WebSocketSendTimeout), c, sub.encoding, msg)
+            if err != nil {
+                return
+            }
+        case <-pinger.C:
+            sub.SendJSON(messages.Message{
+                Action: messages.ActionPing,
+            })
+        case <-ctx.Done():
+            return
         }
     }
-    return false
+}
+
+func writeTimeout(ctx context.Context, timeout time.Duration, c *websocket.Conn, enc messages.Encoding, msg []byte) error {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    return c.Write(ctx, messageType(enc), msg)
+}
+
+// messageType returns the type of WebSocket frames that carry the messages in an encoding.
+func messageType(enc messages.Encoding) websocket.MessageType {
+    if enc.Binary() {
+        return websocket.MessageBinary
+    }
+    return websocket.MessageText
 }
\ No newline at end of file
@@ -0,0 +1,70 @@
+package barertc
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/messages"
+	"nhooyr.io/websocket"
+)
+
+func TestWebSocketEncoding(t *testing.T) {
+	var (
+		s  = NewServer()
+		ts = httptest.NewServer(s.WebSocket())
+	)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Ask for compression and CBOR.
+	c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), &websocket.DialOptions{
+		Subprotocols:    []string{messages.SubprotocolCBOR},
+		CompressionMode: websocket.CompressionNoContextTakeover,
+	})
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	if c.Subprotocol() != messages.SubprotocolCBOR {
+		t.Errorf("the server did not agree to CBOR: %q", c.Subprotocol())
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("the server did not agree to compression: %q", ext)
+	}
+
+	// Log in, and get the Who List back.
+	login, _ := messages.EncodingCBOR.Marshal(messages.Message{
+		Action:   messages.ActionLogin,
+		Username: "alice",
+	})
+	if err := c.Write(ctx, websocket.MessageBinary, login); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	for {
+		typ, data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatalf("did not get the Who List: %s", err)
+		}
+		if typ != websocket.MessageBinary {
+			t.Fatalf("expected binary messages, got %s", typ)
+		}
+
+		var msg messages.Message
+		if err := messages.EncodingCBOR.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Unmarshal: %s", err)
+		}
+		if msg.Action == messages.ActionWhoList {
+			if len(msg.WhoList) != 1 || msg.WhoList[0].Username != "alice" {
+				t.Errorf("unexpected Who List: %+v", msg.WhoList)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package barertc
+
+import (
+	"sort"
+	"time"
+
+	"git.kirsle.net/apps/barertc/pkg/log"
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+/*
+Who List deltas.
+
+The Who List is personalized for each user (blocking, booted cameras, VIP flags...). The
+server remembers the list it last sent to each subscriber, and on a change made by a user
+(see SendWhoListChanges) it rebuilds only that user's entry on everybody's list. Clients
+that log in with the ProtocolWhoDeltas version are sent only what changed on their list:
+
+- `who-add` with the WhoList entries of the users who appeared,
+- `who-update` with the entries that changed, and
+- `who-remove` with the Usernames who are no longer on the list.
+
+They get a full `who` list first, and again every WhoListResyncInterval (when every list is
+rebuilt in full) in case they ever fall out of step. Older clients get the full list each
+time that theirs changed.
+*/
+
+// WhoListResyncInterval is how often the clients of Who List deltas are sent a full list.
+const WhoListResyncInterval = 10 * time.Minute
+
+// sendWhoList sends the subscriber their whole Who List: in full, or the changes since the last one.
+func (sub *Subscriber) sendWhoList(users []messages.WhoList) {
+	sub.whoMu.Lock()
+	defer sub.whoMu.Unlock()
+
+	var next = map[string]messages.WhoList{}
+	for _, who := range users {
+		next[who.Username] = who
+	}
+
+	// Older clients always get the full list, as do the others for their first list (or a resync).
+	if sub.protocol < messages.ProtocolWhoDeltas || sub.whoSent == nil {
+		sub.whoSent = next
+		sub.SendJSON(messages.Message{
+			Action:  messages.ActionWhoList,
+			WhoList: users,
+		})
+		return
+	}
+
+	var (
+		added   = []messages.WhoList{}
+		updated = []messages.WhoList{}
+		removed = []string{}
+	)
+	for _, who := range users {
+		if prev, ok := sub.whoSent[who.Username]; !ok {
+			added = append(added, who)
+		} else if prev != who {
+			updated = append(updated, who)
+		}
+	}
+	for username := range sub.whoSent {
+		if _, ok := next[username]; !ok {
+			removed = append(removed, username)
+		}
+	}
+	sort.Strings(removed)
+	sub.whoSent = next
+
+	sub.sendWhoDeltas(added, updated, removed)
+}
+
+/*
+patchWhoList updates some entries of the subscriber's Who List, by username: nil for a user
+who is not on their list. It sends the changes, or for older clients the full list if it
+changed.
+
+It returns false if the subscriber has not been sent a Who List to update, e.g. on a resync:
+then they need their whole list from sendWhoList instead.
+*/
+func (sub *Subscriber) patchWhoList(entries map[string]*messages.WhoList) bool {
+	sub.whoMu.Lock()
+	defer sub.whoMu.Unlock()
+
+	if sub.whoSent == nil {
+		return false
+	}
+
+	var (
+		usernames = make([]string, 0, len(entries))
+		added     = []messages.WhoList{}
+		updated   = []messages.WhoList{}
+		removed   = []string{}
+	)
+	for username := range entries {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		var (
+			who       = entries[username]
+			prev, had = sub.whoSent[username]
+		)
+		switch {
+		case who == nil && had:
+			removed = append(removed, username)
+			delete(sub.whoSent, username)
+		case who != nil && !had:
+			added = append(added, *who)
+			sub.whoSent[username] = *who
+		case who != nil && prev != *who:
+			updated = append(updated, *who)
+			sub.whoSent[username] = *who
+		}
+	}
+
+	if len(added)+len(updated)+len(removed) == 0 {
+		return true
+	}
+
+	// Older clients get the full list, from what we last sent them.
+	if sub.protocol < messages.ProtocolWhoDeltas {
+		var users = make([]messages.WhoList, 0, len(sub.whoSent))
+		for _, who := range sub.whoSent {
+			users = append(users, who)
+		}
+		sort.Slice(users, func(i, j int) bool {
+			return users[i].Username < users[j].Username
+		})
+		sub.SendJSON(messages.Message{
+			Action:  messages.ActionWhoList,
+			WhoList: users,
+		})
+		return true
+	}
+
+	sub.sendWhoDeltas(added, updated, removed)
+	return true
+}
+
+// sendWhoDeltas sends the changes to a Who List. The caller holds whoMu.
+func (sub *Subscriber) sendWhoDeltas(added, updated []messages.WhoList, removed []string) {
+	if len(removed) > 0 {
+		sub.SendJSON(messages.Message{
+			Action:    messages.ActionWhoRemove,
+			Usernames: removed,
+		})
+	}
+	if len(added) > 0 {
+		sub.SendJSON(messages.Message{
+			Action:  messages.ActionWhoAdd,
+			WhoList: added,
+		})
+	}
+	if len(updated) > 0 {
+		sub.SendJSON(messages.Message{
+			Action:  messages.ActionWhoUpdate,
+			WhoList: updated,
+		})
+	}
+}
+
+// setProtocol sets the protocol version of the subscriber's client, on login. Their next
+// Who List is sent in full.
+func (sub *Subscriber) setProtocol(version int) {
+	sub.whoMu.Lock()
+	defer sub.whoMu.Unlock()
+	sub.protocol = version
+	sub.whoSent = nil
+}
+
+// resyncWhoList makes the subscriber's next Who List be sent in full.
+func (sub *Subscriber) resyncWhoList() {
+	sub.whoMu.Lock()
+	defer sub.whoMu.Unlock()
+	sub.whoSent = nil
+}
+
+// ResyncWhoLists sends the clients of Who List deltas a full list every WhoListResyncInterval.
+func (s *Server) ResyncWhoLists() {
+	log.Debug("ResyncWhoLists goroutine engaged")
+	for {
+		time.Sleep(WhoListResyncInterval)
+		for _, sub := range s.IterSubscribers() {
+			sub.resyncWhoList()
+		}
+		s.SendWhoList()
+	}
+}
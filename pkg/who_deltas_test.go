@@ -0,0 +1,134 @@
+package barertc
+
+import (
+	"reflect"
+	"testing"
+
+	"git.kirsle.net/apps/barertc/pkg/messages"
+)
+
+// whoMessages returns the Who List messages that a user received: the action, and the usernames in it.
+func whoMessages(t *testing.T, sub *Subscriber) map[string][]string {
+	var result = map[string][]string{}
+	for _, msg := range drainMessages(t, sub) {
+		switch msg.Action {
+		case messages.ActionWhoList, messages.ActionWhoAdd, messages.ActionWhoUpdate:
+			for _, who := range msg.WhoList {
+				result[msg.Action] = append(result[msg.Action], who.Username)
+			}
+		case messages.ActionWhoRemove:
+			result[msg.Action] = msg.Usernames
+		}
+	}
+	return result
+}
+
+func expectWhoMessages(t *testing.T, sub *Subscriber, expect map[string][]string) {
+	t.Helper()
+	if got := whoMessages(t, sub); !reflect.DeepEqual(got, expect) {
+		t.Errorf("%s expected %v, got %v", sub.Username, expect, got)
+	}
+}
+
+func TestWhoListDeltas(t *testing.T) {
+	var (
+		s     = NewServer()
+		users = loginUsers(s, false, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+		carol = s.NewPollingSubscriber(nil, func() {})
+	)
+	alice.setProtocol(messages.ProtocolWhoDeltas)
+
+	var expect = func(sub *Subscriber, expect map[string][]string) {
+		t.Helper()
+		expectWhoMessages(t, sub, expect)
+	}
+
+	// Both get the full list first.
+	s.SendWhoList()
+	expect(alice, map[string][]string{"who": {"alice", "bob"}})
+	expect(bob, map[string][]string{"who": {"alice", "bob"}})
+
+	// Carol joins.
+	logIn(s, carol, "carol", false)
+	s.SendWhoList()
+	expect(alice, map[string][]string{"who-add": {"carol"}})
+	expect(bob, map[string][]string{"who": {"alice", "bob", "carol"}})
+
+	// She goes away.
+	carol.ChatStatus = "away"
+	s.SendWhoList()
+	expect(alice, map[string][]string{"who-update": {"carol"}})
+	expect(bob, map[string][]string{"who": {"alice", "bob", "carol"}})
+
+	// Nothing changed.
+	s.SendWhoList()
+	expect(alice, map[string][]string{})
+	expect(bob, map[string][]string{"who": {"alice", "bob", "carol"}})
+
+	// She blocks alice: she is gone from alice's list, not from bob's.
+	carol.blocked["alice"] = struct{}{}
+	s.SendWhoList()
+	expect(alice, map[string][]string{"who-remove": {"carol"}})
+	expect(bob, map[string][]string{"who": {"alice", "bob", "carol"}})
+
+	// The periodic resync sends the full list again.
+	alice.resyncWhoList()
+	s.SendWhoList()
+	expect(alice, map[string][]string{"who": {"alice", "bob"}})
+}
+
+func TestWhoListChanges(t *testing.T) {
+	var (
+		s     = NewServer()
+		users = loginUsers(s, false, "alice", "bob")
+		alice = users[0]
+		bob   = users[1]
+		carol = s.NewPollingSubscriber(nil, func() {})
+	)
+	alice.setProtocol(messages.ProtocolWhoDeltas)
+	var expect = func(sub *Subscriber, expect map[string][]string) {
+		t.Helper()
+		expectWhoMessages(t, sub, expect)
+	}
+
+	s.SendWhoList()
+	expect(alice, map[string][]string{"who": {"alice", "bob"}})
+	expect(bob, map[string][]string{"who": {"alice", "bob"}})
+
+	// Carol logs in: she gets her whole list.
+	logIn(s, carol, "carol", false)
+	s.SendWhoListChanges("carol")
+	expect(alice, map[string][]string{"who-add": {"carol"}})
+	expect(bob, map[string][]string{"who": {"alice", "bob", "carol"}})
+	expect(carol, map[string][]string{"who": {"alice", "bob", "carol"}})
+
+	// She goes away.
+	carol.ChatStatus = "away"
+	s.SendWhoListChanges("carol")
+	expect(alice, map[string][]string{"who-update": {"carol"}})
+	expect(bob, map[string][]string{"who": {"alice", "bob", "carol"}})
+	expect(carol, map[string][]string{"who": {"alice", "bob", "carol"}})
+
+	// Nothing changed on the others' lists: older clients aren't sent it again either.
+	s.SendWhoListChanges("carol")
+	expect(alice, map[string][]string{})
+	expect(bob, map[string][]string{})
+	expect(carol, map[string][]string{"who": {"alice", "bob", "carol"}})
+
+	// She blocks alice: they are both gone from the other's list, not from bob's.
+	s.OnBlock(carol, messages.Message{Username: "alice"})
+	expect(alice, map[string][]string{"who-remove": {"carol"}})
+	expect(bob, map[string][]string{})
+	expect(carol, map[string][]string{"who": {"bob", "carol"}})
+
+	// She leaves.
+	s.Disconnect(carol, messages.PresenceExited)
+	expect(alice, map[string][]string{})
+	expect(bob, map[string][]string{"who": {"alice", "bob"}})
+
+	// Bob leaves.
+	s.Disconnect(bob, messages.PresenceExited)
+	expect(alice, map[string][]string{"who-remove": {"bob"}})
+}
@@ -4,11 +4,15 @@ class ChatClient {
      * Constructor for the client.
      *
      * @param usePolling: instead of WebSocket use the ajax polling API.
+     * @param pollingMode: how to receive messages with the polling API: "sse" for
+     *                     Server-Sent Events, "long" for long-polling, or "short" to
+     *                     check every 5 seconds.
      * @param onClientError: function to receive 'ChatClient' messages to
      *                       add to the chat room (this.ChatClient())
      */
     constructor({
         usePolling=false,
+        pollingMode="sse",
         onClientError,
 
         username,
@@ -20,7 +24,9 @@ class ChatClient {
         onMe,
         onMessage,
         onTakeback,
+        onEdit,
         onReact,
+        onReceipt,
         onPresence,
         onRing,
         onOpen,
@@ -30,6 +36,12 @@ class ChatClient {
         onUnwatch,
         onBlock,
         onCut,
+        onChannels,
+        onTopic,
+        onJoin,
+        onPart,
+        onPins,
+        onMOTD,
 
         // Misc function registrations for callback.
         onLoggedIn, // connection is fully established (first 'me' echo from server).
@@ -39,6 +51,7 @@ class ChatClient {
         pushHistory,
      }) {
         this.usePolling = usePolling;
+        this.pollingMode = pollingMode;
 
         // Pointer to the 'ChatClient(message)' command from the main app.
         this.ChatClient = onClientError;
@@ -52,7 +65,9 @@ class ChatClient {
         this.onMe = onMe;
         this.onMessage = onMessage;
         this.onTakeback = onTakeback;
+        this.onEdit = onEdit;
         this.onReact = onReact;
+        this.onReceipt = onReceipt;
         this.onPresence = onPresence;
         this.onRing = onRing;
         this.onOpen = onOpen;
@@ -62,6 +77,12 @@ class ChatClient {
         this.onUnwatch = onUnwatch;
         this.onBlock = onBlock;
         this.onCut = onCut;
+        this.onChannels = onChannels;
+        this.onTopic = onTopic;
+        this.onJoin = onJoin;
+        this.onPart = onPart;
+        this.onPins = onPins;
+        this.onMOTD = onMOTD;
 
         this.onLoggedIn = onLoggedIn;
         this.onNewJWT = onNewJWT;
@@ -72,6 +93,9 @@ class ChatClient {
         // Received the first 'me' echo from server (to call onLoggedIn once per connection)
         this.firstMe = false;
 
+        // The Who List, kept up to date with the changes sent by the server.
+        this.whoList = [];
+
         // WebSocket connection.
         this.ws = {
             conn: null,
@@ -81,6 +105,12 @@ class ChatClient {
             reconnect: true, // unless told to go away
             disconnectLimit: 2,
             disconnectCount: 0,
+
+            // Resume the chat session if the connection drops: the token from the
+            // server and the sequence number of the last message received.
+            resumeToken: "",
+            seq: 0,
+            resuming: false,
         };
 
         // Polling connection.
@@ -88,13 +118,15 @@ class ChatClient {
             username: "",
             sessionID: "",
             timeout: null, // setTimeout for next poll.
+            streaming: false, // receiving messages by Server-Sent Events or long-polling
+            eventSource: null,
         }
     }
 
     // Connected polls if the client is connected.
     connected() {
         if (this.usePolling) {
-            return this.polling.timeout != null && this.polling.sessionID != "";
+            return this.polling.sessionID != "";
         }
         return this.ws.connected;
     }
@@ -115,9 +147,13 @@ class ChatClient {
 
     // Common function to send a message to the server. The message
     // is a JSON object before stringify.
-    send(message) {
+    //
+    // With the polling API, wait is the number of seconds for the server to hold the
+    // request for new messages (long-polling), and it returns a Promise of whether the
+    // request succeeded.
+    send(message, wait=0) {
         if (this.usePolling) {
-            fetch("/poll", {
+            return fetch("/poll", {
                 method: "POST",
                 mode: "same-origin",
                 cache: "no-cache",
@@ -129,6 +165,7 @@ class ChatClient {
                     username: this.polling.username,
                     session_id: this.polling.sessionID,
                     msg: message,
+                    wait: wait || undefined,
                 })
             }).then(resp => resp.json()).then(resp => {
                 console.log(resp);
@@ -139,10 +176,16 @@ class ChatClient {
                 for (let msg of resp.messages) {
                     this.handle(msg);
                 }
+
+                // Logged in: start receiving our messages as they come.
+                if (this.pollingMode !== "short" && this.polling.sessionID && !this.polling.streaming) {
+                    this.startStreaming();
+                }
+                return true;
             }).catch(err => {
                 this.ChatClient("Error from polling API: " + err);
+                return false;
             });
-            return;
         }
 
         if (!this.ws.connected) {
@@ -158,11 +201,27 @@ class ChatClient {
 
     // Common function to handle a message from the server.
     handle(msg) {
+        // Keep track of the last message received, to resume from.
+        if (msg.seq) {
+            this.ws.seq = msg.seq;
+        }
+
         switch (msg.action) {
             case "who":
+                if (!msg.channel) {
+                    this.whoList = msg.whoList || [];
+                }
                 this.onWho(msg);
                 break;
+            case "who-add":
+            case "who-update":
+            case "who-remove":
+                this.applyWhoDelta(msg);
+                break;
             case "me":
+                if (msg.resumeToken) {
+                    this.ws.resumeToken = msg.resumeToken;
+                }
                 this.onMe(msg);
 
                 // The first me?
@@ -186,9 +245,17 @@ class ChatClient {
             case "takeback":
                 this.onTakeback(msg);
                 break;
+            case "edit":
+                this.onEdit(msg);
+                break;
             case "react":
+            case "unreact":
                 this.onReact(msg);
                 break;
+            case "delivered":
+            case "read":
+                this.onReceipt(msg);
+                break;
             case "presence":
                 this.onPresence(msg);
                 break;
@@ -216,6 +283,24 @@ class ChatClient {
             case "cut":
                 this.onCut(msg);
                 break;
+            case "channels":
+                this.onChannels(msg);
+                break;
+            case "topic":
+                this.onTopic(msg);
+                break;
+            case "join":
+                this.onJoin(msg);
+                break;
+            case "part":
+                this.onPart(msg);
+                break;
+            case "pins":
+                this.onPins(msg);
+                break;
+            case "motd":
+                this.onMOTD(msg);
+                break;
             case "error":
                 this.pushHistory({
                     channel: msg.channel,
@@ -224,9 +309,21 @@ class ChatClient {
                     isChatServer: true,
                 });
                 break;
+            case "resume":
+                this.ws.resuming = false;
+                if (msg.resumeToken) {
+                    this.ChatClient("Reconnected: your chat session has been resumed.");
+                } else {
+                    // Too late to resume: log in again.
+                    this.ws.resumeToken = "";
+                    this.onWho({ whoList: [] });
+                    this.login();
+                }
+                break;
             case "disconnect":
                 this.onWho({ whoList: [] });
                 this.ws.reconnect = false;
+                this.ws.resumeToken = "";
                 this.disconnect();
                 break;
             case "ping":
@@ -250,15 +347,12 @@ class ChatClient {
         // Polling API?
         if (this.usePolling) {
             this.ChatClient("Connecting to the server via polling API...");
-            this.startPolling();
+            if (this.pollingMode === "short") {
+                this.startPolling();
+            }
 
             // Log in now.
-            this.send({
-                action: "login",
-                username: this.username,
-                jwt: this.jwt.token,
-                dnd: this.prefs.closeDMs,
-            });
+            this.login();
             return;
         }
 
@@ -266,13 +360,26 @@ class ChatClient {
 
         const proto = location.protocol === 'https:' ? 'wss' : 'ws';
         const token = this.jwt?.token;
-const conn = token
-  ? new WebSocket(`${proto}://${location.host}/ws?jwt=${token}`)
-  : new WebSocket(`${proto}://${location.host}/ws`);
+        const params = new URLSearchParams();
+        if (token) {
+            params.set("jwt", token);
+        }
+
+        // Resuming our chat session after the connection dropped?
+        this.ws.resuming = this.ws.resumeToken !== "";
+        if (this.ws.resuming) {
+            params.set("resume", this.ws.resumeToken);
+            params.set("seq", this.ws.seq);
+        }
+
+        const query = params.toString();
+        const conn = new WebSocket(`${proto}://${location.host}/ws` + (query ? `?${query}` : ""));
 
         conn.addEventListener("close", ev => {
-            // Lost connection to server - scrub who list.
-            this.onWho({ whoList: [] });
+            // Lost connection to server - scrub who list, unless we may resume where we left off.
+            if (!this.ws.resumeToken) {
+                this.onWho({ whoList: [] });
+            }
 
             this.ws.connected = false;
             this.ChatClient(`WebSocket Disconnected code: ${ev.code}, reason: ${ev.reason}`);
@@ -301,18 +408,10 @@ const conn = token
             this.ws.connected = true;
             this.ChatClient("Websocket connected!");
 
-            // Upload our blocklist to the server before login. This resolves a bug where if a block
-            // was added recently (other user still online in chat), that user would briefly see your
-            // "has entered the room" message followed by you immediately not being online.
-            this.bulkMuteUsers();
-
-            // Tell the server our username.
-            this.send({
-                action: "login",
-                username: this.username,
-                jwt: this.jwt.token,
-                dnd: this.prefs.closeDMs,
-            });
+            // When resuming, the server tells us whether we need to log in again.
+            if (!this.ws.resuming) {
+                this.login();
+            }
 
             // Focus the message entry box.
             window.requestAnimationFrame(() => {
@@ -333,6 +432,52 @@ const conn = token
         this.ws.conn = conn;
     }
 
+    // Log in to the server.
+    login() {
+        // Upload our blocklist to the server before login. This resolves a bug where if a block
+        // was added recently (other user still online in chat), that user would briefly see your
+        // "has entered the room" message followed by you immediately not being online.
+        if (!this.usePolling) {
+            this.bulkMuteUsers();
+        }
+
+        // Tell the server our username.
+        this.send({
+            action: "login",
+            username: this.username,
+            jwt: this.jwt.token,
+            dnd: this.prefs.closeDMs,
+            noReceipts: !this.prefs.readReceipts,
+            protocol: 2, // we can handle Who List deltas
+        });
+    }
+
+    // Apply a change to the Who List from the server, and pass the whole list on to the app.
+    applyWhoDelta(msg) {
+        let users = {};
+        for (let row of this.whoList) {
+            users[row.username] = row;
+        }
+
+        if (msg.action === "who-remove") {
+            for (let username of msg.usernames || []) {
+                delete users[username];
+            }
+        } else {
+            for (let row of msg.whoList || []) {
+                users[row.username] = row;
+            }
+        }
+
+        this.whoList = Object.values(users).sort((a, b) => {
+            return a.username < b.username ? -1 : a.username > b.username ? 1 : 0;
+        });
+        this.onWho({
+            action: "who",
+            whoList: this.whoList,
+        });
+    }
+
     // Start the polling interval.
     startPolling() {
         if (!this.usePolling) return;
@@ -356,11 +501,70 @@ const conn = token
         this.startPolling();
     }
 
+    // Receive our messages as they come with the polling API: by Server-Sent Events, or
+    // long-polling if those are not available.
+    startStreaming() {
+        this.polling.streaming = true;
+
+        if (this.pollingMode === "sse" && window.EventSource) {
+            const params = new URLSearchParams({
+                username: this.polling.username,
+                session_id: this.polling.sessionID,
+            });
+            const es = new EventSource(`/poll/events?${params}`);
+
+            es.addEventListener("message", ev => {
+                this.handle(JSON.parse(ev.data));
+            });
+
+            es.addEventListener("error", () => {
+                // The browser reconnects by itself, unless the server turned us away.
+                if (es.readyState === EventSource.CLOSED && this.polling.eventSource === es) {
+                    this.polling.eventSource = null;
+                    this.pollingMode = "long";
+                    this.ChatClient("The event stream from the server was closed: switching to long-polling.");
+                    this.longPoll();
+                }
+            });
+
+            this.polling.eventSource = es;
+            return;
+        }
+
+        this.longPoll();
+    }
+
+    // Wait for our next messages with a long-poll request, and then again.
+    longPoll() {
+        if (!this.usePolling || !this.polling.streaming || this.polling.sessionID === "") {
+            return;
+        }
+
+        this.send({
+            action: "ping",
+        }, 25).then(ok => {
+            // On errors, wait a moment before trying again.
+            if (ok) {
+                this.longPoll();
+            } else {
+                this.polling.timeout = setTimeout(() => {
+                    this.longPoll();
+                }, 5000);
+            }
+        });
+    }
+
     // Stop polling.
     stopPolling() {
         if (this.polling.timeout != null) {
             clearTimeout(this.polling.timeout);
         }
+
+        this.polling.streaming = false;
+        if (this.polling.eventSource != null) {
+            this.polling.eventSource.close();
+            this.polling.eventSource = null;
+        }
     }
 }
 
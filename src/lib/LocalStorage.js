@@ -8,6 +8,7 @@ const keys = {
     'preferredDeviceNames': Object, // Webcam/mic device names (object, keys video,audio)
     'whoSort': String,              // user's preferred sort order for the Who List
     'theme': String,                // light, dark, or auto theme
+    'pollingMode': String,          // with usePolling: sse, long or short polling
 
     // Webcam settings (booleans)
     'videoMutual': Boolean,
@@ -27,6 +28,7 @@ const keys = {
     'watchNotif': Boolean,
     'muteSounds': Boolean,
     'closeDMs': Boolean,      // close unsolicited DMs
+    'readReceipts': Boolean,  // send read receipts for DMs
     'debug': Boolean,        // Debug views enabled (admin only)
 
     // Don't Show Again on NSFW modals.